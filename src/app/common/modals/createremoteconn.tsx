@@ -363,6 +363,7 @@ class CreateRemoteConnModal extends React.Component<{}, {}> {
                                 { value: "detect", label: "detect" },
                                 { value: "bash", label: "bash" },
                                 { value: "zsh", label: "zsh" },
+                                { value: "fish", label: "fish" },
                             ]}
                             value={this.tempShellPref.get()}
                             onChange={(val: string) => {
@@ -89,8 +89,12 @@ class InfoMsg extends React.Component<{}, {}> {
                                     { "has-space": this.hasSpace(istr) },
                                     { "metacmd-comp": istr.startsWith("^") }
                                 )}
+                                title={infoMsg.infocompdescs?.[idx]}
                             >
                                 {this.getAfterSlash(istr)}
+                                <If condition={infoMsg.infocompdescs?.[idx]}>
+                                    <span className="info-comp-desc">{infoMsg.infocompdescs[idx]}</span>
+                                </If>
                             </div>
                         </For>
                         <If condition={infoMsg.infocompsmore}>
@@ -99,6 +99,16 @@ declare global {
         color: string;
     };
 
+    type PortForwardStateType = {
+        forwardid: string;
+        forwardtype: "local" | "remote" | "dynamic";
+        bindaddr: string;
+        targetaddr?: string;
+        status: "active" | "inactive" | "error";
+        errorstr?: string;
+        numconns: number;
+    };
+
     type RemoteType = {
         remotetype: string;
         remoteid: string;
@@ -108,6 +118,9 @@ declare global {
         status: RemoteStatusTypeStrs;
         connecttimeout: number;
         countdownactive: boolean;
+        reconnecting?: boolean;
+        reconnectattempt?: number;
+        reconnecttimeout?: number;
         errorstr: string;
         installstatus: string;
         installerrorstr: string;
@@ -119,6 +132,7 @@ declare global {
         archived: boolean;
         uname: string;
         mshellversion: string;
+        mshellcapabilities?: string[];
         needsmshellupgrade: boolean;
         noinitpk: boolean;
         authtype: string;
@@ -128,6 +142,7 @@ declare global {
         remove?: boolean;
         shellpref: string;
         defaultshelltype: string;
+        portforwards?: PortForwardStateType[];
     };
 
     type RemoteStateType = {
@@ -254,12 +269,23 @@ declare global {
         donets: number;
         exitcode: number;
         durationms: number;
+        rusage?: CmdRUsageType;
         runout: any[];
         rtnstate: boolean;
         remove?: boolean;
         restarted?: boolean;
     };
 
+    type CmdRUsageType = {
+        utimems: number;
+        stimems: number;
+        maxrsskb: number;
+        inblock: number;
+        outblock: number;
+        nvcsw: number;
+        nivcsw: number;
+    };
+
     type LineUpdateType = {
         line: LineType;
         cmd: CmdDataType;
@@ -421,6 +447,7 @@ declare global {
         infoerror?: string;
         infolines?: string[];
         infocomps?: string[];
+        infocompdescs?: string[];
         infocompsmore?: boolean;
         timeoutms?: number;
     };
@@ -580,6 +607,11 @@ declare global {
         };
         globalshortcut: string;
         globalshortcutenabled: boolean;
+        retention?: {
+            maxdisksize?: number;
+            archivedmaxagems?: number;
+            maxscreenptysize?: number;
+        };
     };
 
     type ReleaseInfoType = {
@@ -795,6 +827,9 @@ declare global {
         isdir: boolean;
         perm: number;
         notfound: boolean;
+        mode?: number;
+        issymlink?: boolean;
+        symlinktarget?: string;
     };
 
     type ExtBlob = Blob & {
@@ -33,6 +33,7 @@ type File struct {
 	EndPos       int64
 	FileDataSize int64 // size of data (does not include header size)
 	FlockStatus  int
+	IndexFile    *os.File // optional timestamp index (see index.go), nil if the file has no index
 }
 
 type Stat struct {
@@ -41,6 +42,10 @@ type Stat struct {
 	MaxSize    int64
 	FileOffset int64
 	DataSize   int64
+	HasIndex   bool
+
+	Compressed     bool  // see compress.go
+	CompressedSize int64 // size on disk of the compressed file
 }
 
 func (f *File) flock(ctx context.Context, lockType int) error {
@@ -107,6 +112,10 @@ func OpenCirFile(fileName string) (*File, error) {
 		return nil, fmt.Errorf("invalid cirfile, file length[%d] less than HeaderLen[%d]", finfo.Size(), HeaderLen)
 	}
 	rtn := &File{OSFile: fd}
+	indexFd, err := os.OpenFile(IndexFileName(fileName), os.O_RDWR, 0777)
+	if err == nil {
+		rtn.IndexFile = indexFd
+	}
 	return rtn, nil
 }
 
@@ -126,6 +135,7 @@ func StatCirFile(ctx context.Context, fileName string) (*Stat, error) {
 		MaxSize:    file.MaxSize,
 		FileOffset: fileOffset,
 		DataSize:   dataSize,
+		HasIndex:   file.HasIndex(),
 	}, nil
 }
 
@@ -149,8 +159,16 @@ func CreateCirFile(fileName string, maxSize int64) (*File, error) {
 	if err != nil {
 		return nil, err
 	}
+	return initCirFile(fd, maxSize)
+}
+
+// writes the header for a new (empty) cirfile to fd
+func initCirFile(fd *os.File, maxSize int64) (*File, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("invalid maxsize[%d]", maxSize)
+	}
 	rtn := &File{OSFile: fd, Version: CurrentVersion, MaxSize: maxSize, StartPos: FilePosEmpty}
-	err = rtn.flock(nil, syscall.LOCK_EX) // pass nil context here for a fast fail if someone else is also creating the same file
+	err := rtn.flock(nil, syscall.LOCK_EX) // pass nil context here for a fast fail if someone else is also creating the same file
 	if err != nil {
 		return nil, fmt.Errorf("cannot lock file: %w", err)
 	}
@@ -163,6 +181,9 @@ func CreateCirFile(fileName string, maxSize int64) (*File, error) {
 }
 
 func (f *File) Close() error {
+	if f.IndexFile != nil {
+		f.IndexFile.Close()
+	}
 	return f.OSFile.Close()
 }
 
@@ -440,6 +461,10 @@ func (f *File) ensureFreeSpace(requiredSpace int64) error {
 
 // does not implement io.WriterAt (needs context)
 func (f *File) WriteAt(ctx context.Context, buf []byte, writePos int64) error {
+	return f.writeAtTs(ctx, buf, writePos, nowMs())
+}
+
+func (f *File) writeAtTs(ctx context.Context, buf []byte, writePos int64, ts int64) (rtnErr error) {
 	if writePos < 0 {
 		return fmt.Errorf("WriteAt got invalid writePos[%d]", writePos)
 	}
@@ -462,6 +487,14 @@ func (f *File) WriteAt(ctx context.Context, buf []byte, writePos int64) error {
 		buf = buf[negOffset:]
 		writePos = f.FileOffset
 	}
+	if len(buf) > 0 {
+		// the index entry is written last (only for successful writes)
+		defer func() {
+			if rtnErr == nil {
+				rtnErr = f.addIndexEntry(writePos, ts)
+			}
+		}()
+	}
 	if writePos > f.FileOffset+currentSize {
 		// fill gap with zero bytes
 		posOffset := writePos - (f.FileOffset + currentSize)
@@ -559,6 +592,10 @@ func (f *File) internalAppendData(buf []byte) error {
 }
 
 func (f *File) AppendData(ctx context.Context, buf []byte) error {
+	return f.appendDataTs(ctx, buf, nowMs())
+}
+
+func (f *File) appendDataTs(ctx context.Context, buf []byte, ts int64) error {
 	err := f.flock(ctx, syscall.LOCK_EX)
 	if err != nil {
 		return err
@@ -568,5 +605,10 @@ func (f *File) AppendData(ctx context.Context, buf []byte) error {
 	if err != nil {
 		return err
 	}
-	return f.internalAppendData(buf)
+	appendOffset := f.FileOffset + totalChunksSize(f.getFileChunks())
+	err = f.internalAppendData(buf)
+	if err != nil || len(buf) == 0 {
+		return err
+	}
+	return f.addIndexEntry(appendOffset, ts)
 }
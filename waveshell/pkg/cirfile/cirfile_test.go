@@ -5,10 +5,13 @@ package cirfile
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
@@ -301,3 +304,305 @@ func TestWriteAt(t *testing.T) {
 	}
 	dumpFile(fPath)
 }
+
+func TestIndex(t *testing.T) {
+	fPath := testFilePath(t, "index.cf")
+	f, err := CreateCirFileWithIndex(fPath, 100)
+	if err != nil {
+		t.Fatalf("cannot create cirfile: %v", err)
+	}
+	defer f.Close()
+	ctx := context.Background()
+	f.appendDataTs(ctx, []byte("aaaaaaaaaa"), 1000)
+	f.appendDataTs(ctx, []byte("bb"), 1005) // within IndexGranularityMs, shares the "a" record
+	f.appendDataTs(ctx, []byte("cccccccccc"), 2000)
+	f.writeAtTs(ctx, []byte("dddddddddd"), 22, 3000)
+	f.writeAtTs(ctx, []byte("CC"), 12, 4000) // overwrite, not indexed
+	entries, err := f.ReadIndex(ctx)
+	if err != nil {
+		t.Fatalf("cannot read index: %v", err)
+	}
+	expected := []IndexEntry{{0, 1000}, {12, 2000}, {22, 3000}}
+	if fmt.Sprint(entries) != fmt.Sprint(expected) {
+		t.Fatalf("bad index entries %v, expected %v", entries, expected)
+	}
+	offset, data, err := f.ReadTimeRange(ctx, 1500, 3000, 0)
+	if err != nil || offset != 12 || string(data) != "CCcccccccc" {
+		t.Fatalf("bad time range read: offset[%d] data[%s] err[%v]", offset, data, err)
+	}
+	offset, data, _ = f.ReadTimeRange(ctx, 2500, 0, 4)
+	if offset != 22 || string(data) != "dddd" {
+		t.Fatalf("bad time range read (no end): offset[%d] data[%s]", offset, data)
+	}
+	if offset, data, _ = f.ReadTimeRange(ctx, 5000, 0, 0); offset != 32 || len(data) != 0 {
+		t.Fatalf("expected no data after the last write: offset[%d] data[%s]", offset, data)
+	}
+	// wrap the ring, data before offset 7 is overwritten (the first record is clamped)
+	f.appendDataTs(ctx, []byte(makeData(75)), 5000)
+	entries, _ = f.ReadIndex(ctx)
+	expected = []IndexEntry{{7, 1000}, {12, 2000}, {22, 3000}, {32, 5000}}
+	if fmt.Sprint(entries) != fmt.Sprint(expected) {
+		t.Fatalf("bad index entries after wrap %v, expected %v", entries, expected)
+	}
+	f.appendDataTs(ctx, []byte(makeData(20)), 6000)
+	entries, _ = f.ReadIndex(ctx)
+	expected = []IndexEntry{{27, 3000}, {32, 5000}, {107, 6000}}
+	if fmt.Sprint(entries) != fmt.Sprint(expected) {
+		t.Fatalf("bad index entries after second wrap %v, expected %v", entries, expected)
+	}
+	f.Close()
+	f, err = OpenCirFile(fPath)
+	if err != nil || !f.HasIndex() {
+		t.Fatalf("index not opened: %v", err)
+	}
+	stat, _ := StatCirFile(ctx, fPath)
+	if stat == nil || !stat.HasIndex {
+		t.Fatalf("stat should report index")
+	}
+}
+
+func TestIndexCompact(t *testing.T) {
+	fPath := testFilePath(t, "compact.cf")
+	f, err := CreateCirFileWithIndex(fPath, 10000)
+	if err != nil {
+		t.Fatalf("cannot create cirfile: %v", err)
+	}
+	defer f.Close()
+	ctx := context.Background()
+	for i := 0; i < MaxIndexEntries+10; i++ {
+		f.appendDataTs(ctx, []byte("x"), int64(i*IndexGranularityMs))
+	}
+	finfo, _ := f.IndexFile.Stat()
+	numEntries := finfo.Size() / IndexEntrySize
+	if numEntries > MaxIndexEntries {
+		t.Fatalf("index not compacted, %d entries", numEntries)
+	}
+	entries, _ := f.ReadIndex(ctx)
+	if len(entries) == 0 || entries[0].Offset != 0 || entries[len(entries)-1].Ts > int64((MaxIndexEntries+9)*IndexGranularityMs) {
+		t.Fatalf("bad compacted entries: %v", entries[0:2])
+	}
+	_, data, _ := f.ReadTimeRange(ctx, 0, 0, 0)
+	if len(data) != MaxIndexEntries+10 {
+		t.Fatalf("compaction should not lose data, read %d bytes", len(data))
+	}
+	if err := RemoveCirFile(fPath); err != nil {
+		t.Fatalf("cannot remove cirfile: %v", err)
+	}
+	if _, err := os.Stat(IndexFileName(fPath)); !os.IsNotExist(err) {
+		t.Fatalf("index file not removed")
+	}
+}
+
+func TestCompress(t *testing.T) {
+	fPath := testFilePath(t, "compress.cf")
+	f, err := CreateCirFileWithIndex(fPath, 100)
+	if err != nil {
+		t.Fatalf("cannot create cirfile: %v", err)
+	}
+	ctx := context.Background()
+	f.appendDataTs(ctx, []byte(makeData(80)), 1000)
+	f.appendDataTs(ctx, []byte(makeData(40)), 2000) // wraps, fileoffset is 20
+	f.Close()
+	zStat, err := CompressCirFile(ctx, fPath)
+	if err != nil {
+		t.Fatalf("cannot compress: %v", err)
+	}
+	if !zStat.Compressed || zStat.FileOffset != 20 || zStat.DataSize != 100 || !zStat.HasIndex {
+		t.Fatalf("bad compressed stat: %#v", zStat)
+	}
+	if _, err := os.Stat(fPath); !os.IsNotExist(err) {
+		t.Fatalf("cirfile not removed after compression")
+	}
+	if _, err := os.Stat(IndexFileName(fPath)); !os.IsNotExist(err) {
+		t.Fatalf("index not removed after compression")
+	}
+	cf, err := ReadCompressedFile(fPath)
+	if err != nil {
+		t.Fatalf("cannot read compressed file: %v", err)
+	}
+	expectedData := makeData(80)[20:] + makeData(40)
+	if offset, data, _ := cf.ReadAll(ctx); offset != 20 || string(data) != expectedData {
+		t.Fatalf("bad compressed data: offset[%d] data[%q]", offset, data)
+	}
+	if offset, data, _ := cf.ReadAtWithMax(ctx, 90, 5); offset != 90 || string(data) != expectedData[70:75] {
+		t.Fatalf("bad compressed read: offset[%d] data[%q]", offset, data)
+	}
+	if offset, data, _ := cf.ReadTimeRange(ctx, 1500, 0, 0); offset != 80 || string(data) != makeData(40) {
+		t.Fatalf("bad compressed time range read: offset[%d] data[%q]", offset, data)
+	}
+	err = DecompressCirFile(fPath)
+	if err != nil {
+		t.Fatalf("cannot decompress: %v", err)
+	}
+	if _, err := os.Stat(CompressedFileName(fPath)); !os.IsNotExist(err) {
+		t.Fatalf("compressed file not removed after decompression")
+	}
+	f, err = OpenCirFile(fPath)
+	if err != nil {
+		t.Fatalf("cannot open decompressed file: %v", err)
+	}
+	defer f.Close()
+	if offset, data, _ := f.ReadAll(ctx); offset != 20 || string(data) != expectedData {
+		t.Fatalf("bad decompressed data: offset[%d] data[%q]", offset, data)
+	}
+	entries, _ := f.ReadIndex(ctx)
+	if fmt.Sprint(entries) != fmt.Sprint(cf.Index) || len(entries) != 2 {
+		t.Fatalf("bad decompressed index %v, expected %v", entries, cf.Index)
+	}
+	// the restored file is writable
+	err = f.appendDataTs(ctx, []byte("xyz"), 3000)
+	if err != nil {
+		t.Fatalf("cannot append to decompressed file: %v", err)
+	}
+	if offset, data, _ := f.ReadAtWithMax(ctx, 120, 10); offset != 120 || string(data) != "xyz" {
+		t.Fatalf("bad append after decompress: offset[%d] data[%q]", offset, data)
+	}
+}
+
+func TestCompressedCacheSize(t *testing.T) {
+	fPath := testFilePath(t, "cache.cf")
+	os.WriteFile(fPath, nil, 0600)
+	finfo, _ := os.Stat(fPath)
+	const entrySize = CompressedCacheMaxSize / 3
+	for idx := 0; idx < 4; idx++ {
+		putCachedCompressedFile(fmt.Sprintf("cache-%d", idx), finfo, &CompressedFile{Data: make([]byte, entrySize)})
+	}
+	defer func() {
+		for idx := 0; idx < 5; idx++ {
+			invalidateCompressedCache(fmt.Sprintf("cache-%d", idx))
+		}
+	}()
+	// only the 3 most recently used fit
+	if getCachedCompressedFile("cache-0", finfo) != nil || compressedCacheSize != 3*entrySize {
+		t.Fatalf("cache not bounded by size: %v size=%d", compressedCacheOrder, compressedCacheSize)
+	}
+	getCachedCompressedFile("cache-1", finfo)
+	putCachedCompressedFile("cache-4", finfo, &CompressedFile{Data: make([]byte, entrySize)})
+	if getCachedCompressedFile("cache-1", finfo) == nil || getCachedCompressedFile("cache-2", finfo) != nil {
+		t.Fatalf("least recently used file not evicted: %v", compressedCacheOrder)
+	}
+	// too large for the cache
+	putCachedCompressedFile("cache-big", finfo, &CompressedFile{Data: make([]byte, CompressedCacheMaxSize+1)})
+	if getCachedCompressedFile("cache-big", finfo) != nil || compressedCacheSize != 3*entrySize {
+		t.Fatalf("file larger than the cache was cached: size=%d", compressedCacheSize)
+	}
+}
+
+func TestConcurrentDecompress(t *testing.T) {
+	fPath := testFilePath(t, "concurrent.cf")
+	f, err := CreateCirFileWithIndex(fPath, 100)
+	if err != nil {
+		t.Fatalf("cannot create cirfile: %v", err)
+	}
+	ctx := context.Background()
+	f.appendDataTs(ctx, []byte(makeData(50)), 1000)
+	f.Close()
+	_, err = CompressCirFile(ctx, fPath)
+	if err != nil {
+		t.Fatalf("cannot compress: %v", err)
+	}
+	cf1, _ := ReadCompressedFile(fPath)
+	cf2, _ := ReadCompressedFile(fPath)
+	if cf1 == nil || cf1 != cf2 {
+		t.Fatalf("compressed file not cached")
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for idx := range errs {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			errs[idx] = DecompressCirFile(fPath)
+		}(idx)
+	}
+	wg.Wait()
+	for idx, err := range errs {
+		// callers that open the compressed file after it was removed get ErrNotExist (the cirfile exists)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("decompress %d error: %v", idx, err)
+		}
+	}
+	f, err = OpenCirFile(fPath)
+	if err != nil {
+		t.Fatalf("cannot open decompressed file: %v", err)
+	}
+	defer f.Close()
+	if offset, data, _ := f.ReadAll(ctx); offset != 0 || string(data) != makeData(50) {
+		t.Fatalf("bad decompressed data: offset[%d] data[%q]", offset, data)
+	}
+	dirEntries, _ := os.ReadDir(filepath.Dir(fPath))
+	for _, entry := range dirEntries {
+		if strings.HasSuffix(entry.Name(), ".tmp") || strings.HasSuffix(entry.Name(), CompressedSuffix) {
+			t.Errorf("leftover file %s", entry.Name())
+		}
+	}
+	if _, err := ReadCompressedFile(fPath); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("stale compressed file read after decompress: %v", err)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	ctx := context.Background()
+	for _, compress := range []bool{false, true} {
+		fPath := testFilePath(t, "truncate.cf")
+		f, err := CreateCirFileWithIndex(fPath, 100)
+		if err != nil {
+			t.Fatalf("cannot create cirfile: %v", err)
+		}
+		f.appendDataTs(ctx, []byte(makeData(80)), 1000)
+		f.appendDataTs(ctx, []byte(makeData(40)), 2000) // wraps, fileoffset is 20
+		f.appendDataTs(ctx, []byte(makeData(10)), 3000)
+		f.Close()
+		if compress {
+			_, err = CompressCirFile(ctx, fPath)
+			if err != nil {
+				t.Fatalf("cannot compress: %v", err)
+			}
+			// loads the cache, which must be invalidated by the truncation
+			ReadCompressedFile(fPath)
+		}
+		expectedData := (makeData(80) + makeData(40) + makeData(10))[100:]
+		stat, err := TruncateCirFile(ctx, fPath, 25)
+		if err != nil {
+			t.Fatalf("cannot truncate (compress=%v): %v", compress, err)
+		}
+		if stat.Compressed != compress || stat.FileOffset != 105 || stat.DataSize != 25 || !stat.HasIndex {
+			t.Fatalf("bad truncated stat (compress=%v): %#v", compress, stat)
+		}
+		var rdr interface {
+			ReadAll(ctx context.Context) (int64, []byte, error)
+			ReadIndex(ctx context.Context) ([]IndexEntry, error)
+		}
+		if compress {
+			rdr, err = ReadCompressedFile(fPath)
+		} else {
+			var tf *File
+			tf, err = OpenCirFile(fPath)
+			if err == nil {
+				defer tf.Close()
+			}
+			rdr = tf
+		}
+		if err != nil {
+			t.Fatalf("cannot open truncated file: %v", err)
+		}
+		if offset, data, _ := rdr.ReadAll(ctx); offset != 105 || string(data) != expectedData[5:] {
+			t.Fatalf("bad truncated data (compress=%v): offset[%d] data[%q]", compress, offset, data)
+		}
+		entries, _ := rdr.ReadIndex(ctx)
+		if fmt.Sprint(entries) != "[{105 2000} {120 3000}]" {
+			t.Fatalf("bad truncated index (compress=%v): %v", compress, entries)
+		}
+		// keeping more than the data size is a no-op
+		stat, err = TruncateCirFile(ctx, fPath, 1000)
+		if err != nil || stat.DataSize != 25 {
+			t.Fatalf("bad no-op truncate (compress=%v): %#v %v", compress, stat, err)
+		}
+		if !compress {
+			finfo, _ := os.Stat(fPath)
+			if finfo.Size() != HeaderLen+25 {
+				t.Errorf("truncated file not rewritten, size %d", finfo.Size())
+			}
+		}
+	}
+}
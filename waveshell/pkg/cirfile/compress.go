@@ -0,0 +1,476 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cirfile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// a compressed cirfile is a read-only snapshot of a cirfile (and its index) stored in fileName + CompressedSuffix:
+//
+//	[magic "CFZ" version byte] [maxsize int64] [fileoffset int64] [datasize int64] [numindex int64]
+//	[index entries (IndexEntrySize each)] [gzip stream of the data]
+//
+// all integers are big endian.  the header and index are uncompressed so the file can be stat'ed cheaply.
+// only one of the cirfile or compressed file should exist, CompressCirFile and DecompressCirFile switch between them.
+const CompressedSuffix = ".z"
+const CompressedMagic = "CFZ"
+const CompressedVersion = 1
+const CompressedHeaderLen = 36
+
+type CompressedFile struct {
+	Location       string
+	MaxSize        int64
+	FileOffset     int64
+	Data           []byte
+	Index          []IndexEntry // nil if the original cirfile had no index
+	CompressedSize int64
+}
+
+type compressedHeader struct {
+	MaxSize    int64
+	FileOffset int64
+	DataSize   int64
+	NumIndex   int64 // -1 for no index
+}
+
+func CompressedFileName(fileName string) string {
+	return fileName + CompressedSuffix
+}
+
+func encodeCompressedHeader(hdr compressedHeader) []byte {
+	barr := make([]byte, CompressedHeaderLen)
+	copy(barr[0:3], CompressedMagic)
+	barr[3] = CompressedVersion
+	binary.BigEndian.PutUint64(barr[4:12], uint64(hdr.MaxSize))
+	binary.BigEndian.PutUint64(barr[12:20], uint64(hdr.FileOffset))
+	binary.BigEndian.PutUint64(barr[20:28], uint64(hdr.DataSize))
+	binary.BigEndian.PutUint64(barr[28:36], uint64(hdr.NumIndex))
+	return barr
+}
+
+func readCompressedHeader(r io.Reader) (compressedHeader, error) {
+	var hdr compressedHeader
+	barr := make([]byte, CompressedHeaderLen)
+	_, err := io.ReadFull(r, barr)
+	if err != nil {
+		return hdr, fmt.Errorf("cannot read compressed header: %w", err)
+	}
+	if string(barr[0:3]) != CompressedMagic || barr[3] != CompressedVersion {
+		return hdr, fmt.Errorf("invalid compressed cirfile header")
+	}
+	hdr.MaxSize = int64(binary.BigEndian.Uint64(barr[4:12]))
+	hdr.FileOffset = int64(binary.BigEndian.Uint64(barr[12:20]))
+	hdr.DataSize = int64(binary.BigEndian.Uint64(barr[20:28]))
+	hdr.NumIndex = int64(binary.BigEndian.Uint64(barr[28:36]))
+	if hdr.MaxSize <= 0 || hdr.DataSize < 0 || hdr.DataSize > hdr.MaxSize || hdr.NumIndex > MaxIndexEntries {
+		return hdr, fmt.Errorf("invalid compressed cirfile header values")
+	}
+	return hdr, nil
+}
+
+// compresses fileName (and its index) into fileName + CompressedSuffix and removes the cirfile.
+// holds LOCK_EX on the cirfile until it is removed, readers that already have the file open can finish.
+// data written to the cirfile by a writer that opened it before the compression finished is lost, so only
+// compress files that are no longer being written.  returns the stat of the compressed file.
+func CompressCirFile(ctx context.Context, fileName string) (*Stat, error) {
+	f, err := OpenCirFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	err = f.flock(ctx, syscall.LOCK_EX)
+	if err != nil {
+		return nil, err
+	}
+	defer f.unflock()
+	err = f.readMeta()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, totalChunksSize(f.getFileChunks()))
+	_, nr, err := f.internalReadNext(buf, 0)
+	if err != nil {
+		return nil, err
+	}
+	hdr := compressedHeader{MaxSize: f.MaxSize, FileOffset: f.FileOffset, DataSize: int64(nr), NumIndex: -1}
+	var entries []IndexEntry
+	if f.IndexFile != nil {
+		entries, err = f.internalReadLiveIndex()
+		if err != nil {
+			return nil, err
+		}
+		hdr.NumIndex = int64(len(entries))
+	}
+	zFileName := CompressedFileName(fileName)
+	tmpFileName := zFileName + ".tmp"
+	fd, err := os.Create(tmpFileName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create compressed file: %w", err)
+	}
+	writeErr := writeCompressedFile(fd, hdr, entries, buf[0:nr])
+	closeErr := fd.Close()
+	if writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr != nil {
+		os.Remove(tmpFileName)
+		return nil, fmt.Errorf("cannot write compressed file: %w", writeErr)
+	}
+	err = os.Rename(tmpFileName, zFileName)
+	if err != nil {
+		os.Remove(tmpFileName)
+		return nil, fmt.Errorf("cannot rename compressed file: %w", err)
+	}
+	os.Remove(IndexFileName(fileName)) // ignore error
+	err = os.Remove(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot remove cirfile: %w", err)
+	}
+	return StatCompressedFile(fileName)
+}
+
+func writeCompressedFile(w io.Writer, hdr compressedHeader, entries []IndexEntry, data []byte) error {
+	_, err := w.Write(encodeCompressedHeader(hdr))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(encodeIndexEntries(entries))
+	if err != nil {
+		return err
+	}
+	gzw := gzip.NewWriter(w)
+	_, err = gzw.Write(data)
+	if err != nil {
+		return err
+	}
+	return gzw.Close()
+}
+
+// fileName is the name of the (original) cirfile
+func StatCompressedFile(fileName string) (*Stat, error) {
+	zFileName := CompressedFileName(fileName)
+	fd, err := os.Open(zFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	finfo, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+	hdr, err := readCompressedHeader(fd)
+	if err != nil {
+		return nil, err
+	}
+	return &Stat{
+		Location:       zFileName,
+		Version:        CurrentVersion,
+		MaxSize:        hdr.MaxSize,
+		FileOffset:     hdr.FileOffset,
+		DataSize:       hdr.DataSize,
+		HasIndex:       hdr.NumIndex >= 0,
+		Compressed:     true,
+		CompressedSize: finfo.Size(),
+	}, nil
+}
+
+// decompressed files are cached (validated by size and modtime), readers poll compressed files in small chunks.
+// the cache is bounded by the total decompressed size, files larger than the cache are not cached
+const CompressedCacheMaxSize = 32 * 1024 * 1024
+
+// upper bound for preallocating the decompressed data (the same as shexec.MaxMaxPtySize, which cannot be
+// imported here).  larger data is still read, the buffer just grows as it is decompressed
+const MaxDecompressPrealloc = 100 * 1024 * 1024
+
+type compressedCacheEntry struct {
+	Size    int64
+	ModTime time.Time
+	File    *CompressedFile
+}
+
+var compressedCacheLock = &sync.Mutex{}
+var compressedCache = make(map[string]*compressedCacheEntry) // key is the compressed file name
+var compressedCacheOrder []string                            // least recently used first
+var compressedCacheSize int64                                // sum of cachedSize() for the cached files
+
+// decompressed size in memory
+func (cf *CompressedFile) cachedSize() int64 {
+	return int64(len(cf.Data)) + int64(len(cf.Index))*IndexEntrySize
+}
+
+func getCachedCompressedFile(zFileName string, finfo os.FileInfo) *CompressedFile {
+	compressedCacheLock.Lock()
+	defer compressedCacheLock.Unlock()
+	entry := compressedCache[zFileName]
+	if entry == nil {
+		return nil
+	}
+	if entry.Size != finfo.Size() || !entry.ModTime.Equal(finfo.ModTime()) {
+		removeCacheEntryLocked(zFileName)
+		return nil
+	}
+	removeCacheOrderLocked(zFileName)
+	compressedCacheOrder = append(compressedCacheOrder, zFileName)
+	return entry.File
+}
+
+func putCachedCompressedFile(zFileName string, finfo os.FileInfo, cf *CompressedFile) {
+	compressedCacheLock.Lock()
+	defer compressedCacheLock.Unlock()
+	removeCacheEntryLocked(zFileName)
+	if cf.cachedSize() > CompressedCacheMaxSize {
+		return
+	}
+	compressedCache[zFileName] = &compressedCacheEntry{Size: finfo.Size(), ModTime: finfo.ModTime(), File: cf}
+	compressedCacheOrder = append(compressedCacheOrder, zFileName)
+	compressedCacheSize += cf.cachedSize()
+	for compressedCacheSize > CompressedCacheMaxSize {
+		removeCacheEntryLocked(compressedCacheOrder[0])
+	}
+}
+
+func removeCacheEntryLocked(zFileName string) {
+	entry := compressedCache[zFileName]
+	if entry == nil {
+		return
+	}
+	removeCacheOrderLocked(zFileName)
+	delete(compressedCache, zFileName)
+	compressedCacheSize -= entry.File.cachedSize()
+}
+
+func removeCacheOrderLocked(zFileName string) {
+	for idx, name := range compressedCacheOrder {
+		if name == zFileName {
+			compressedCacheOrder = append(compressedCacheOrder[0:idx:idx], compressedCacheOrder[idx+1:]...)
+			return
+		}
+	}
+}
+
+func invalidateCompressedCache(zFileName string) {
+	compressedCacheLock.Lock()
+	defer compressedCacheLock.Unlock()
+	removeCacheEntryLocked(zFileName)
+}
+
+// reads and decompresses the entire compressed file (fileName is the name of the original cirfile).
+// the result may be shared with other callers (from the cache) and must not be modified
+func ReadCompressedFile(fileName string) (*CompressedFile, error) {
+	zFileName := CompressedFileName(fileName)
+	fd, err := os.Open(zFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	finfo, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if cf := getCachedCompressedFile(zFileName, finfo); cf != nil {
+		return cf, nil
+	}
+	cf, err := readCompressedFd(fd, zFileName, finfo.Size())
+	if err != nil {
+		return nil, err
+	}
+	putCachedCompressedFile(zFileName, finfo, cf)
+	return cf, nil
+}
+
+func readCompressedFd(fd *os.File, zFileName string, compressedSize int64) (*CompressedFile, error) {
+	hdr, err := readCompressedHeader(fd)
+	if err != nil {
+		return nil, err
+	}
+	rtn := &CompressedFile{Location: zFileName, MaxSize: hdr.MaxSize, FileOffset: hdr.FileOffset, CompressedSize: compressedSize}
+	if hdr.NumIndex >= 0 {
+		indexBytes := make([]byte, hdr.NumIndex*IndexEntrySize)
+		_, err = io.ReadFull(fd, indexBytes)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read compressed index: %w", err)
+		}
+		rtn.Index = make([]IndexEntry, hdr.NumIndex)
+		for idx := range rtn.Index {
+			rec := indexBytes[idx*IndexEntrySize:]
+			rtn.Index[idx].Offset = int64(binary.BigEndian.Uint64(rec[0:8]))
+			rtn.Index[idx].Ts = int64(binary.BigEndian.Uint64(rec[8:16]))
+		}
+	}
+	gzr, err := gzip.NewReader(fd)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read compressed data: %w", err)
+	}
+	defer gzr.Close()
+	var buf bytes.Buffer
+	// the header is not trusted for the allocation size
+	if hdr.DataSize <= MaxDecompressPrealloc {
+		buf.Grow(int(hdr.DataSize))
+	} else {
+		buf.Grow(MaxDecompressPrealloc)
+	}
+	_, err = io.Copy(&buf, io.LimitReader(gzr, hdr.DataSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress data: %w", err)
+	}
+	if int64(buf.Len()) != hdr.DataSize {
+		return nil, fmt.Errorf("compressed data size mismatch (expected %d, got %d)", hdr.DataSize, buf.Len())
+	}
+	rtn.Data = buf.Bytes()
+	return rtn, nil
+}
+
+// restores a compressed file to a (writable) cirfile, and removes the compressed file.
+// concurrent calls for the same file are serialized with a flock on the compressed file (callers that
+// were waiting find the cirfile already restored).  the cirfile is created under a unique temp name and
+// renamed into place so readers never see a partial file
+func DecompressCirFile(fileName string) error {
+	zFileName := CompressedFileName(fileName)
+	zFd, err := os.Open(zFileName)
+	if err != nil {
+		return err
+	}
+	defer zFd.Close()
+	err = syscall.Flock(int(zFd.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return fmt.Errorf("cannot lock compressed file: %w", err)
+	}
+	defer syscall.Flock(int(zFd.Fd()), syscall.LOCK_UN)
+	if _, err := os.Stat(fileName); err == nil {
+		return nil
+	}
+	finfo, err := zFd.Stat()
+	if err != nil {
+		return err
+	}
+	cf, err := readCompressedFd(zFd, zFileName, finfo.Size())
+	if err != nil {
+		return err
+	}
+	err = writeCirFileFromCompressed(fileName, cf)
+	if err != nil {
+		return err
+	}
+	invalidateCompressedCache(zFileName)
+	return os.Remove(zFileName)
+}
+
+// writes the contents of cf to a new cirfile (under a unique temp name) and renames it (and its index) to fileName
+func writeCirFileFromCompressed(fileName string, cf *CompressedFile) error {
+	tmpFd, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("cannot create temp file: %w", err)
+	}
+	tmpFileName := tmpFd.Name()
+	f, err := initCirFile(tmpFd, cf.MaxSize)
+	if err != nil {
+		tmpFd.Close()
+		os.Remove(tmpFileName)
+		return err
+	}
+	if cf.Index != nil {
+		f.IndexFile, err = os.Create(IndexFileName(tmpFileName))
+		if err != nil {
+			f.Close()
+			os.Remove(tmpFileName)
+			return fmt.Errorf("cannot create index: %w", err)
+		}
+	}
+	err = f.restoreData(cf)
+	f.Close()
+	if err != nil {
+		RemoveCirFile(tmpFileName)
+		return err
+	}
+	if cf.Index != nil {
+		err = os.Rename(IndexFileName(tmpFileName), IndexFileName(fileName))
+		if err != nil {
+			RemoveCirFile(tmpFileName)
+			return fmt.Errorf("cannot rename index: %w", err)
+		}
+	}
+	err = os.Rename(tmpFileName, fileName)
+	if err != nil {
+		RemoveCirFile(tmpFileName)
+		return fmt.Errorf("cannot rename cirfile: %w", err)
+	}
+	return nil
+}
+
+func (f *File) restoreData(cf *CompressedFile) error {
+	err := f.flock(nil, syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer f.unflock()
+	f.FileOffset = cf.FileOffset
+	err = f.internalAppendData(cf.Data)
+	if err != nil {
+		return err
+	}
+	if f.IndexFile != nil {
+		_, err = f.IndexFile.WriteAt(encodeIndexEntries(cf.Index), 0)
+		if err != nil {
+			return fmt.Errorf("cannot write index: %w", err)
+		}
+	}
+	return nil
+}
+
+// the read functions match the *File read functions (the context is not used)
+
+func (cf *CompressedFile) Close() error {
+	return nil
+}
+
+func (cf *CompressedFile) ReadAll(ctx context.Context) (int64, []byte, error) {
+	return cf.FileOffset, cf.Data, nil
+}
+
+func (cf *CompressedFile) ReadAtWithMax(ctx context.Context, offset int64, maxSize int64) (int64, []byte, error) {
+	if offset < cf.FileOffset {
+		offset = cf.FileOffset
+	}
+	dataEnd := cf.FileOffset + int64(len(cf.Data))
+	if offset >= dataEnd {
+		return dataEnd, nil, nil
+	}
+	endOffset := dataEnd
+	if maxSize >= 0 && offset+maxSize < endOffset {
+		endOffset = offset + maxSize
+	}
+	return offset, cf.Data[offset-cf.FileOffset : endOffset-cf.FileOffset], nil
+}
+
+func (cf *CompressedFile) ReadIndex(ctx context.Context) ([]IndexEntry, error) {
+	if cf.Index == nil {
+		return nil, ErrNoIndex
+	}
+	return cf.Index, nil
+}
+
+func (cf *CompressedFile) ReadTimeRange(ctx context.Context, startTs int64, endTs int64, maxSize int64) (int64, []byte, error) {
+	if cf.Index == nil {
+		return 0, nil, ErrNoIndex
+	}
+	startOffset, endOffset := timeRangeOffsets(cf.Index, cf.FileOffset+int64(len(cf.Data)), startTs, endTs)
+	if startOffset >= endOffset {
+		return startOffset, nil, nil
+	}
+	if maxSize > 0 && endOffset-startOffset > maxSize {
+		endOffset = startOffset + maxSize
+	}
+	return startOffset, cf.Data[startOffset-cf.FileOffset : endOffset-cf.FileOffset], nil
+}
@@ -0,0 +1,261 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cirfile
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+	"time"
+)
+
+// the optional index is a sidecar file (fileName + IndexSuffix) of fixed size records:
+//
+//	[offset int64][ts int64] (big endian, 16 bytes)
+//
+// each record means the data starting at offset (absolute, like FileOffset) was written at ts (unix millis).
+// records are strictly increasing in offset (and non-decreasing in ts).  records for data that has been
+// overwritten by the ring are removed when the index is compacted (and ignored until then).
+// the index is protected by the cirfile's flock.
+const IndexSuffix = ".idx"
+const IndexEntrySize = 16
+const MaxIndexEntries = 4096
+const IndexGranularityMs = 10 // writes closer together than this share a record
+
+var ErrNoIndex = errors.New("cirfile has no index")
+
+type IndexEntry struct {
+	Offset int64 `json:"offset"`
+	Ts     int64 `json:"ts"`
+}
+
+func IndexFileName(fileName string) string {
+	return fileName + IndexSuffix
+}
+
+// creates a cirfile along with an (empty) index
+func CreateCirFileWithIndex(fileName string, maxSize int64) (*File, error) {
+	rtn, err := CreateCirFile(fileName, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	// truncates any stale index left from a removed file
+	rtn.IndexFile, err = os.Create(IndexFileName(fileName))
+	if err != nil {
+		rtn.Close()
+		return nil, fmt.Errorf("cannot create index: %w", err)
+	}
+	return rtn, nil
+}
+
+// removes the cirfile and its index (if any), and the compressed file (if any, see compress.go)
+func RemoveCirFile(fileName string) error {
+	os.Remove(IndexFileName(fileName)) // ignore error
+	invalidateCompressedCache(CompressedFileName(fileName))
+	zErr := os.Remove(CompressedFileName(fileName))
+	err := os.Remove(fileName)
+	if errors.Is(err, fs.ErrNotExist) && zErr == nil {
+		return nil
+	}
+	return err
+}
+
+func (f *File) HasIndex() bool {
+	return f.IndexFile != nil
+}
+
+func (f *File) readIndexEntries() ([]IndexEntry, error) {
+	barr, err := io.ReadAll(io.NewSectionReader(f.IndexFile, 0, 1<<62))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read index: %w", err)
+	}
+	numEntries := len(barr) / IndexEntrySize // ignore a partial trailing record
+	rtn := make([]IndexEntry, numEntries)
+	for idx := 0; idx < numEntries; idx++ {
+		rec := barr[idx*IndexEntrySize:]
+		rtn[idx].Offset = int64(binary.BigEndian.Uint64(rec[0:8]))
+		rtn[idx].Ts = int64(binary.BigEndian.Uint64(rec[8:16]))
+	}
+	return rtn, nil
+}
+
+func encodeIndexEntries(entries []IndexEntry) []byte {
+	barr := make([]byte, len(entries)*IndexEntrySize)
+	for idx, entry := range entries {
+		rec := barr[idx*IndexEntrySize:]
+		binary.BigEndian.PutUint64(rec[0:8], uint64(entry.Offset))
+		binary.BigEndian.PutUint64(rec[8:16], uint64(entry.Ts))
+	}
+	return barr
+}
+
+// returns (last entry, number of entries)
+func (f *File) readLastIndexEntry() (*IndexEntry, int64, error) {
+	finfo, err := f.IndexFile.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	numEntries := finfo.Size() / IndexEntrySize
+	if numEntries == 0 {
+		return nil, 0, nil
+	}
+	var rec [IndexEntrySize]byte
+	_, err = f.IndexFile.ReadAt(rec[:], (numEntries-1)*IndexEntrySize)
+	if err != nil {
+		return nil, 0, err
+	}
+	entry := &IndexEntry{Offset: int64(binary.BigEndian.Uint64(rec[0:8])), Ts: int64(binary.BigEndian.Uint64(rec[8:16]))}
+	return entry, numEntries, nil
+}
+
+// must hold LOCK_EX.  called after data is written at offset
+func (f *File) addIndexEntry(offset int64, ts int64) error {
+	if f.IndexFile == nil {
+		return nil
+	}
+	lastEntry, numEntries, err := f.readLastIndexEntry()
+	if err != nil {
+		return fmt.Errorf("cannot read index: %w", err)
+	}
+	if lastEntry != nil {
+		if offset <= lastEntry.Offset || ts-lastEntry.Ts < IndexGranularityMs {
+			// overwrite of already indexed data, or close enough to the last write
+			return nil
+		}
+	}
+	newEntry := encodeIndexEntries([]IndexEntry{{Offset: offset, Ts: ts}})
+	_, err = f.IndexFile.WriteAt(newEntry, numEntries*IndexEntrySize)
+	if err != nil {
+		return fmt.Errorf("cannot write index: %w", err)
+	}
+	if numEntries+1 > MaxIndexEntries {
+		return f.compactIndex()
+	}
+	return nil
+}
+
+// drops entries for data no longer in the ring, then (if still too large) every other entry.
+// not atomic, a crash while compacting can lose index entries (not data)
+func (f *File) compactIndex() error {
+	entries, err := f.readIndexEntries()
+	if err != nil {
+		return err
+	}
+	entries = liveIndexEntries(entries, f.FileOffset, f.FileOffset+totalChunksSize(f.getFileChunks()))
+	for len(entries) > MaxIndexEntries/2 {
+		var thinned []IndexEntry
+		for idx := 0; idx < len(entries); idx += 2 {
+			thinned = append(thinned, entries[idx])
+		}
+		entries = thinned
+	}
+	err = f.IndexFile.Truncate(0)
+	if err != nil {
+		return fmt.Errorf("cannot truncate index: %w", err)
+	}
+	_, err = f.IndexFile.WriteAt(encodeIndexEntries(entries), 0)
+	if err != nil {
+		return fmt.Errorf("cannot write index: %w", err)
+	}
+	return nil
+}
+
+// returns the entries for data in [startOffset, endOffset).  the first entry is clamped to startOffset
+func liveIndexEntries(entries []IndexEntry, startOffset int64, endOffset int64) []IndexEntry {
+	var rtn []IndexEntry
+	for idx, entry := range entries {
+		if entry.Offset >= endOffset {
+			break
+		}
+		if idx+1 < len(entries) && entries[idx+1].Offset <= startOffset {
+			continue
+		}
+		if entry.Offset < startOffset {
+			entry.Offset = startOffset
+		}
+		rtn = append(rtn, entry)
+	}
+	return rtn
+}
+
+// returns the index entries for the data currently in the file
+func (f *File) ReadIndex(ctx context.Context) ([]IndexEntry, error) {
+	if f.IndexFile == nil {
+		return nil, ErrNoIndex
+	}
+	err := f.flock(ctx, syscall.LOCK_SH)
+	if err != nil {
+		return nil, err
+	}
+	defer f.unflock()
+	err = f.readMeta()
+	if err != nil {
+		return nil, err
+	}
+	return f.internalReadLiveIndex()
+}
+
+func (f *File) internalReadLiveIndex() ([]IndexEntry, error) {
+	entries, err := f.readIndexEntries()
+	if err != nil {
+		return nil, err
+	}
+	return liveIndexEntries(entries, f.FileOffset, f.FileOffset+totalChunksSize(f.getFileChunks())), nil
+}
+
+// returns (offset, data, err) for the data written in [startTs, endTs) (unix millis, endTs of 0 means no end).
+// data is limited to maxSize bytes (from the start of the range)
+func (f *File) ReadTimeRange(ctx context.Context, startTs int64, endTs int64, maxSize int64) (int64, []byte, error) {
+	if f.IndexFile == nil {
+		return 0, nil, ErrNoIndex
+	}
+	err := f.flock(ctx, syscall.LOCK_SH)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.unflock()
+	err = f.readMeta()
+	if err != nil {
+		return 0, nil, err
+	}
+	entries, err := f.internalReadLiveIndex()
+	if err != nil {
+		return 0, nil, err
+	}
+	startOffset, endOffset := timeRangeOffsets(entries, f.FileOffset+totalChunksSize(f.getFileChunks()), startTs, endTs)
+	if startOffset >= endOffset {
+		return startOffset, nil, nil
+	}
+	readSize := endOffset - startOffset
+	if maxSize > 0 && readSize > maxSize {
+		readSize = maxSize
+	}
+	buf := make([]byte, readSize)
+	realOffset, nr, err := f.internalReadNext(buf, startOffset)
+	return realOffset, buf[0:nr], err
+}
+
+// returns the [startOffset, endOffset) of the data written in [startTs, endTs) given the live index entries
+func timeRangeOffsets(entries []IndexEntry, dataEnd int64, startTs int64, endTs int64) (int64, int64) {
+	startOffset, endOffset := dataEnd, dataEnd
+	for _, entry := range entries {
+		if entry.Ts >= startTs && startOffset == dataEnd {
+			startOffset = entry.Offset
+		}
+		if endTs > 0 && entry.Ts >= endTs {
+			endOffset = entry.Offset
+			break
+		}
+	}
+	return startOffset, endOffset
+}
+
+func nowMs() int64 {
+	return time.Now().UnixMilli()
+}
@@ -0,0 +1,139 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cirfile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// drops all but the newest keepSize bytes of data (and their index entries) from fileName, which can be
+// a cirfile or a compressed file (see compress.go).  the file is rewritten (under a unique temp name, then
+// renamed) so the space is freed on disk.  like CompressCirFile, data written by a writer that opened the
+// cirfile before the truncation finished is lost, so only truncate files that are no longer being written.
+// returns the stat of the truncated file.
+func TruncateCirFile(ctx context.Context, fileName string, keepSize int64) (*Stat, error) {
+	if keepSize < 0 {
+		return nil, fmt.Errorf("invalid keepsize[%d]", keepSize)
+	}
+	f, err := OpenCirFile(fileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		err = truncateCompressedFile(fileName, keepSize)
+		if err != nil {
+			return nil, err
+		}
+		return StatCompressedFile(fileName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = f.truncateData(ctx, fileName, keepSize)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	return StatCirFile(ctx, fileName)
+}
+
+// returns the newest keepSize bytes of cf as a new CompressedFile (cf is not modified)
+func (cf *CompressedFile) tail(keepSize int64) *CompressedFile {
+	dataEnd := cf.FileOffset + int64(len(cf.Data))
+	rtn := &CompressedFile{Location: cf.Location, MaxSize: cf.MaxSize, FileOffset: cf.FileOffset, Data: cf.Data}
+	if int64(len(cf.Data)) > keepSize {
+		rtn.FileOffset = dataEnd - keepSize
+		rtn.Data = cf.Data[int64(len(cf.Data))-keepSize:]
+	}
+	if cf.Index != nil {
+		// non-nil, an empty index is still an index
+		rtn.Index = append([]IndexEntry{}, liveIndexEntries(cf.Index, rtn.FileOffset, dataEnd)...)
+	}
+	return rtn
+}
+
+func (f *File) truncateData(ctx context.Context, fileName string, keepSize int64) error {
+	err := f.flock(ctx, syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer f.unflock()
+	err = f.readMeta()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, totalChunksSize(f.getFileChunks()))
+	_, nr, err := f.internalReadNext(buf, 0)
+	if err != nil {
+		return err
+	}
+	if int64(nr) <= keepSize {
+		return nil
+	}
+	cf := &CompressedFile{Location: fileName, MaxSize: f.MaxSize, FileOffset: f.FileOffset, Data: buf[0:nr]}
+	if f.IndexFile != nil {
+		cf.Index, err = f.internalReadLiveIndex()
+		if err != nil {
+			return err
+		}
+		if cf.Index == nil {
+			cf.Index = []IndexEntry{}
+		}
+	}
+	return writeCirFileFromCompressed(fileName, cf.tail(keepSize))
+}
+
+func truncateCompressedFile(fileName string, keepSize int64) error {
+	zFileName := CompressedFileName(fileName)
+	zFd, err := os.Open(zFileName)
+	if err != nil {
+		return err
+	}
+	defer zFd.Close()
+	// same lock as DecompressCirFile
+	err = syscall.Flock(int(zFd.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return fmt.Errorf("cannot lock compressed file: %w", err)
+	}
+	defer syscall.Flock(int(zFd.Fd()), syscall.LOCK_UN)
+	finfo, err := zFd.Stat()
+	if err != nil {
+		return err
+	}
+	cf, err := readCompressedFd(zFd, zFileName, finfo.Size())
+	if err != nil {
+		return err
+	}
+	if int64(len(cf.Data)) <= keepSize {
+		return nil
+	}
+	cf = cf.tail(keepSize)
+	tmpFd, err := os.CreateTemp(filepath.Dir(zFileName), filepath.Base(zFileName)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("cannot create temp file: %w", err)
+	}
+	hdr := compressedHeader{MaxSize: cf.MaxSize, FileOffset: cf.FileOffset, DataSize: int64(len(cf.Data)), NumIndex: -1}
+	if cf.Index != nil {
+		hdr.NumIndex = int64(len(cf.Index))
+	}
+	writeErr := writeCompressedFile(tmpFd, hdr, cf.Index, cf.Data)
+	closeErr := tmpFd.Close()
+	if writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr != nil {
+		os.Remove(tmpFd.Name())
+		return fmt.Errorf("cannot write compressed file: %w", writeErr)
+	}
+	invalidateCompressedCache(zFileName)
+	err = os.Rename(tmpFd.Name(), zFileName)
+	if err != nil {
+		os.Remove(tmpFd.Name())
+		return fmt.Errorf("cannot rename compressed file: %w", err)
+	}
+	return nil
+}
@@ -4,6 +4,7 @@
 package cmdtail
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"io"
@@ -14,6 +15,7 @@ import (
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/wavetermdev/waveterm/waveshell/pkg/base"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/cirfile"
 	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
 )
 
@@ -189,16 +191,37 @@ func (t *Tailer) readDataFromFile(fileName string, pos int64, maxBytes int) ([]b
 	return buf[0:nr], nil
 }
 
+// ptyout files are cirfiles, returns (real-offset, data, error).  real-offset can be greater
+// than pos if the data at pos has already been overwritten.
+func (t *Tailer) readDataFromPtyFile(fileName string, pos int64, maxBytes int) (int64, []byte, error) {
+	file, err := cirfile.OpenCirFile(fileName)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer file.Close()
+	return file.ReadAtWithMax(context.Background(), pos, int64(maxBytes))
+}
+
+// returns the logical length (end offset) of the ptyout cirfile
+func getPtyFileLen(fileName string) (int64, error) {
+	stat, err := cirfile.StatCirFile(context.Background(), fileName)
+	if err != nil {
+		return 0, err
+	}
+	return stat.FileOffset + stat.DataSize, nil
+}
+
 func (t *Tailer) makeCmdDataPacket(entry CmdWatchEntry, pos TailPos) (*packet.CmdDataPacketType, error) {
 	dataPacket := packet.MakeCmdDataPacket(pos.ReqId)
 	dataPacket.CK = entry.CmdKey
 	dataPacket.PtyPos = pos.TailPtyPos
 	dataPacket.RunPos = pos.TailRunPos
 	if entry.FilePtyLen > pos.TailPtyPos {
-		ptyData, err := t.readDataFromFile(t.Gen.PtyOutFile(entry.CmdKey), pos.TailPtyPos, MaxDataBytes)
+		realOffset, ptyData, err := t.readDataFromPtyFile(t.Gen.PtyOutFile(entry.CmdKey), pos.TailPtyPos, MaxDataBytes)
 		if err != nil {
 			return nil, err
 		}
+		dataPacket.PtyPos = realOffset
 		dataPacket.PtyData64 = base64.StdEncoding.EncodeToString(ptyData)
 		dataPacket.PtyDataLen = len(ptyData)
 	}
@@ -221,6 +244,7 @@ func (t *Tailer) runSingleDataTransfer(key base.CommandKey, reqId string) (*pack
 	if !foundPos {
 		return nil, false, nil
 	}
+	startPos := pos
 	dataPacket, dataErr := t.makeCmdDataPacket(entry, pos)
 
 	t.Lock.Lock()
@@ -230,7 +254,7 @@ func (t *Tailer) runSingleDataTransfer(key base.CommandKey, reqId string) (*pack
 		return nil, false, nil
 	}
 	// pos was updated between first and second get, throw out data-packet and re-run
-	if pos.TailPtyPos != dataPacket.PtyPos || pos.TailRunPos != dataPacket.RunPos {
+	if pos.TailPtyPos != startPos.TailPtyPos || pos.TailRunPos != startPos.TailRunPos {
 		return nil, true, nil
 	}
 	if dataErr != nil {
@@ -239,7 +263,7 @@ func (t *Tailer) runSingleDataTransfer(key base.CommandKey, reqId string) (*pack
 		t.updateTailPos_nolock(key, reqId, pos)
 		return nil, false, dataErr
 	}
-	pos.TailPtyPos += int64(dataPacket.PtyDataLen)
+	pos.TailPtyPos = max(pos.TailPtyPos, dataPacket.PtyPos+int64(dataPacket.PtyDataLen))
 	pos.TailRunPos += int64(dataPacket.RunDataLen)
 	if pos.IsCurrent(entry) {
 		// we caught up, tail position equals file length
@@ -308,10 +332,22 @@ func (t *Tailer) updateFile(relFileName string) {
 	if m == nil {
 		return
 	}
-	finfo, err := os.Stat(relFileName)
-	if err != nil {
-		t.Sender.SendPacket(packet.FmtMessagePacket("error trying to stat file '%s': %v", relFileName, err))
-		return
+	fileType := m[3]
+	var fileLen int64
+	if fileType == FileTypePty {
+		ptyLen, err := getPtyFileLen(relFileName)
+		if err != nil {
+			t.Sender.SendPacket(packet.FmtMessagePacket("error trying to stat file '%s': %v", relFileName, err))
+			return
+		}
+		fileLen = ptyLen
+	} else {
+		finfo, err := os.Stat(relFileName)
+		if err != nil {
+			t.Sender.SendPacket(packet.FmtMessagePacket("error trying to stat file '%s': %v", relFileName, err))
+			return
+		}
+		fileLen = finfo.Size()
 	}
 	cmdKey := base.MakeCommandKey(m[1], m[2])
 	t.Lock.Lock()
@@ -320,11 +356,10 @@ func (t *Tailer) updateFile(relFileName string) {
 	if !foundEntry {
 		return
 	}
-	fileType := m[3]
 	if fileType == FileTypePty {
-		entry.FilePtyLen = finfo.Size()
+		entry.FilePtyLen = fileLen
 	} else if fileType == FileTypeRun {
-		entry.FileRunLen = finfo.Size()
+		entry.FileRunLen = fileLen
 	}
 	t.WatchList[cmdKey] = entry
 	for _, pos := range entry.Tails {
@@ -365,9 +400,9 @@ func max(v1 int64, v2 int64) int64 {
 }
 
 func (entry *CmdWatchEntry) fillFilePos(gen FileNameGenerator) {
-	ptyInfo, _ := os.Stat(gen.PtyOutFile(entry.CmdKey))
-	if ptyInfo != nil {
-		entry.FilePtyLen = ptyInfo.Size()
+	ptyLen, err := getPtyFileLen(gen.PtyOutFile(entry.CmdKey))
+	if err == nil {
+		entry.FilePtyLen = ptyLen
 	}
 	runoutInfo, _ := os.Stat(gen.RunOutFile(entry.CmdKey))
 	if runoutInfo != nil {
@@ -407,7 +442,6 @@ func (t *Tailer) RemoveWatch(pk *packet.UntailCmdPacketType) {
 func (t *Tailer) AddFileWatches_nolock(key base.CommandKey, ptyOnly bool) error {
 	ptyName := t.Gen.PtyOutFile(key)
 	runName := t.Gen.RunOutFile(key)
-	fmt.Printf("WATCH> add %s\n", ptyName)
 	err := t.Watcher.Add(ptyName)
 	if err != nil {
 		return err
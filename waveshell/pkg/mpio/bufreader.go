@@ -15,7 +15,8 @@ type FdReader struct {
 	M             *Multiplexer
 	FdNum         int
 	Fd            io.ReadCloser
-	BufSize       int
+	BufSize       int // bytes sent but not yet acked
+	Window        int // max BufSize (credit), see Multiplexer.SetReadWindow
 	Closed        bool
 	ShouldCloseFd bool
 	IsPty         bool
@@ -28,6 +29,7 @@ func MakeFdReader(m *Multiplexer, fd io.ReadCloser, fdNum int, shouldCloseFd boo
 		FdNum:         fdNum,
 		Fd:            fd,
 		BufSize:       0,
+		Window:        m.ReadWindow,
 		ShouldCloseFd: shouldCloseFd,
 		IsPty:         isPty,
 	}
@@ -40,6 +42,7 @@ func (r *FdReader) Close() {
 	if r.Closed {
 		return
 	}
+	r.Closed = true
 	if r.Fd != nil && r.ShouldCloseFd {
 		r.Fd.Close()
 	}
@@ -74,16 +77,32 @@ func (r *FdReader) sendPacket_unlock(pk packet.PacketType) {
 	r.M.sendPacket(pk)
 }
 
+// blocks until there is credit to send more data.  returns (credit, success)
+func (r *FdReader) waitForCredit() (int, bool) {
+	r.CVar.L.Lock()
+	defer r.CVar.L.Unlock()
+	for {
+		if r.Closed {
+			return 0, false
+		}
+		bufAvail := r.Window - r.BufSize
+		if bufAvail > 0 {
+			return bufAvail, true
+		}
+		r.CVar.Wait()
+	}
+}
+
 // returns (success)
 func (r *FdReader) WriteWait(data []byte, isEof bool) bool {
 	r.CVar.L.Lock()
 	defer r.CVar.L.Unlock()
 	for {
-		bufAvail := ReadBufSize - r.BufSize
+		bufAvail := r.Window - r.BufSize
 		if r.Closed {
 			return false
 		}
-		if bufAvail == 0 {
+		if bufAvail <= 0 {
 			r.CVar.Wait()
 			continue
 		}
@@ -121,7 +140,13 @@ func (r *FdReader) ReadLoop(wg *sync.WaitGroup) {
 	}
 	buf := make([]byte, 4096)
 	for {
-		nr, err := r.Fd.Read(buf)
+		// wait for acks before reading more, so a fast producer is blocked by the fd
+		// (instead of having its output queued in the packet sender)
+		credit, isOpen := r.waitForCredit()
+		if !isOpen {
+			return
+		}
+		nr, err := r.Fd.Read(buf[0:min(credit, len(buf))])
 		if r.isClosed() {
 			return // should not send data or error if we already closed the fd
 		}
@@ -19,6 +19,11 @@ const WriteBufSize = 128 * 1024
 const MaxSingleWriteSize = 4 * 1024
 const MaxTotalRunDataSize = 10 * ReadBufSize
 
+// per-fd flow control window for FdReaders (max unacked bytes)
+const DefaultReadWindow = ReadBufSize
+const MinReadWindow = 4 * 1024
+const MaxReadWindow = 1024 * 1024
+
 type Multiplexer struct {
 	Lock            *sync.Mutex
 	CK              base.CommandKey
@@ -27,10 +32,11 @@ type Multiplexer struct {
 	RunData         map[int]*FdReader // synchronized
 	CloseAfterStart []*os.File        // synchronized
 
-	Sender  *packet.PacketSender
-	Input   *packet.PacketParser
-	Started bool
-	UPR     packet.UnknownPacketReporter
+	Sender     *packet.PacketSender
+	Input      *packet.PacketParser
+	Started    bool
+	UPR        packet.UnknownPacketReporter
+	ReadWindow int
 
 	Debug bool
 }
@@ -40,12 +46,27 @@ func MakeMultiplexer(ck base.CommandKey, upr packet.UnknownPacketReporter) *Mult
 		upr = packet.DefaultUPR{}
 	}
 	return &Multiplexer{
-		Lock:      &sync.Mutex{},
-		CK:        ck,
-		FdReaders: make(map[int]*FdReader),
-		FdWriters: make(map[int]*FdWriter),
-		UPR:       upr,
+		Lock:       &sync.Mutex{},
+		CK:         ck,
+		FdReaders:  make(map[int]*FdReader),
+		FdWriters:  make(map[int]*FdWriter),
+		UPR:        upr,
+		ReadWindow: DefaultReadWindow,
+	}
+}
+
+// sets the flow control window (clamped to [MinReadWindow, MaxReadWindow]) for all readers.
+// must be called before the readers are created.
+func (m *Multiplexer) SetReadWindow(window int) {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	if window < MinReadWindow {
+		window = MinReadWindow
+	}
+	if window > MaxReadWindow {
+		window = MaxReadWindow
 	}
+	m.ReadWindow = window
 }
 
 func (m *Multiplexer) Close() {
@@ -0,0 +1,131 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package mpio
+
+import (
+	"encoding/base64"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wavetermdev/waveterm/waveshell/pkg/base"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
+)
+
+// produces data as fast as it is read, counts the bytes read
+type fastProducer struct {
+	Lock      *sync.Mutex
+	BytesRead int
+	Limit     int
+}
+
+func (p *fastProducer) Read(buf []byte) (int, error) {
+	p.Lock.Lock()
+	defer p.Lock.Unlock()
+	if p.BytesRead >= p.Limit {
+		return 0, io.EOF
+	}
+	n := len(buf)
+	if n > p.Limit-p.BytesRead {
+		n = p.Limit - p.BytesRead
+	}
+	p.BytesRead += n
+	return n, nil
+}
+
+func (p *fastProducer) Close() error {
+	return nil
+}
+
+func (p *fastProducer) getBytesRead() int {
+	p.Lock.Lock()
+	defer p.Lock.Unlock()
+	return p.BytesRead
+}
+
+func TestReadWindow(t *testing.T) {
+	const window = 16 * 1024
+	const total = 256 * 1024
+	m := MakeMultiplexer(base.MakeCommandKey("screen", "line"), nil)
+	m.SetReadWindow(window)
+	packetCh := make(chan packet.PacketType)
+	m.Sender = packet.MakeChannelPacketSender(packetCh)
+	producer := &fastProducer{Lock: &sync.Mutex{}, Limit: total}
+	m.MakeRawFdReader(1, producer, false, false)
+	fr := m.FdReaders[1]
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go fr.ReadLoop(&wg)
+	// slow consumer, acks every packet after a delay
+	var acked int
+	for acked < total {
+		pk := <-packetCh
+		dataPk, ok := pk.(*packet.DataPacketType)
+		if !ok {
+			t.Fatalf("unexpected packet: %s", packet.AsString(pk))
+		}
+		if dataPk.Error != "" {
+			t.Fatalf("data error: %s", dataPk.Error)
+		}
+		data, _ := base64.StdEncoding.DecodeString(dataPk.Data64)
+		time.Sleep(100 * time.Microsecond)
+		if unacked := producer.getBytesRead() - acked; unacked > window {
+			t.Fatalf("read %d bytes past the acked position, window is %d", unacked, window)
+		}
+		if bufSize := fr.GetBufSize(); bufSize > window {
+			t.Fatalf("reader bufsize %d exceeds window %d", bufSize, window)
+		}
+		acked += len(data)
+		m.processAckPacket(m.makeDataAckPacket(1, len(data), nil))
+	}
+	wg.Wait()
+}
+
+func TestReadWindowClose(t *testing.T) {
+	m := MakeMultiplexer(base.MakeCommandKey("screen", "line"), nil)
+	m.SetReadWindow(0)
+	if m.ReadWindow != MinReadWindow {
+		t.Fatalf("window should be clamped to %d, got %d", MinReadWindow, m.ReadWindow)
+	}
+	packetCh := make(chan packet.PacketType, 100)
+	m.Sender = packet.MakeChannelPacketSender(packetCh)
+	producer := &fastProducer{Lock: &sync.Mutex{}, Limit: 1024 * 1024}
+	m.MakeRawFdReader(1, producer, false, false)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go m.FdReaders[1].ReadLoop(&wg)
+	// never acked, the reader must send exactly one window of data, block, and exit on close
+	var bytesSent int
+	for bytesSent < MinReadWindow {
+		select {
+		case pk := <-packetCh:
+			dataPk, ok := pk.(*packet.DataPacketType)
+			if !ok {
+				t.Fatalf("unexpected packet: %s", packet.AsString(pk))
+			}
+			data, _ := base64.StdEncoding.DecodeString(dataPk.Data64)
+			bytesSent += len(data)
+		case <-time.After(time.Second):
+			t.Fatalf("reader sent %d bytes, expected %d", bytesSent, MinReadWindow)
+		}
+	}
+	m.Close()
+	doneCh := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+	case <-time.After(time.Second):
+		t.Fatalf("reader did not exit after close")
+	}
+	if bytesSent != MinReadWindow || len(packetCh) > 0 {
+		t.Errorf("expected reader to stop at the window (%d), sent %d (+%d packets)", MinReadWindow, bytesSent, len(packetCh))
+	}
+	if bytesRead := producer.getBytesRead(); bytesRead != MinReadWindow {
+		t.Errorf("expected reader to stop at the window (%d), read %d", MinReadWindow, bytesRead)
+	}
+}
@@ -0,0 +1,428 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/wavetermdev/waveterm/waveshell/pkg/base"
+)
+
+// binary framing (used when the peer advertises the "binframe" capability, see PacketSender.SetPeerCapabilities):
+//   ##B[len]\n[payload]
+// payload:
+//   uvarint(jsonlen) [json] uvarint(numsegments) [segment]*
+// segment:
+//   flags(1 byte) [uvarint(rawlen) if compressed] uvarint(datalen) [data]
+// the json is the packet with its data fields cleared, the segments hold the raw (or compressed)
+// bytes for those fields.  compression is per-stream (per ck/fd or rpc), the compressor state
+// carries over between packets of the same stream (each packet is sync-flushed).
+
+const (
+	Compression_None    = ""
+	Compression_Deflate = "deflate"
+)
+
+const BinaryFramePrefix = "##B"
+const MaxBinaryFrameSize = 64 * 1024 * 1024
+const MinCompressSize = 32
+const MaxCompressStreams = 16
+
+const (
+	segFlag_Deflate   = 0x01
+	segFlag_NewStream = 0x02
+)
+
+type binarySegment struct {
+	StreamKey string // empty for segments that are never compressed
+	Data      []byte
+	EndStream bool
+}
+
+// returns a copy of the packet with the data fields cleared, and the segments holding the data.
+// returns nil if the packet type does not carry data (it is sent as json)
+func extractBinarySegments(pk PacketType) (PacketType, []binarySegment, error) {
+	switch p := pk.(type) {
+	case *DataPacketType:
+		data, err := base64.StdEncoding.DecodeString(p.Data64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid data64: %w", err)
+		}
+		pkCopy := *p
+		pkCopy.Data64 = ""
+		streamKey := fmt.Sprintf("data:%s:%d", p.CK, p.FdNum)
+		return &pkCopy, []binarySegment{{StreamKey: streamKey, Data: data, EndStream: p.Eof || p.Error != ""}}, nil
+
+	case *CmdDataPacketType:
+		ptyData, err := base64.StdEncoding.DecodeString(p.PtyData64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid ptydata64: %w", err)
+		}
+		runData, err := base64.StdEncoding.DecodeString(p.RunData64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid rundata64: %w", err)
+		}
+		pkCopy := *p
+		pkCopy.PtyData64 = ""
+		pkCopy.RunData64 = ""
+		segs := []binarySegment{
+			{StreamKey: fmt.Sprintf("cmddata:%s:%s:pty", p.RespId, p.CK), Data: ptyData},
+			{StreamKey: fmt.Sprintf("cmddata:%s:%s:run", p.RespId, p.CK), Data: runData},
+		}
+		return &pkCopy, segs, nil
+
+	case *FileDataPacketType:
+		pkCopy := *p
+		pkCopy.Data = nil
+		streamKey := fmt.Sprintf("filedata:%s", p.RespId)
+		return &pkCopy, []binarySegment{{StreamKey: streamKey, Data: p.Data, EndStream: p.GetResponseDone()}}, nil
+
+	default:
+		return nil, nil, nil
+	}
+}
+
+func injectBinarySegments(pk PacketType, segs [][]byte) error {
+	switch p := pk.(type) {
+	case *DataPacketType:
+		if len(segs) != 1 {
+			return fmt.Errorf("invalid number of segments for %s packet: %d", p.GetType(), len(segs))
+		}
+		p.Data64 = base64.StdEncoding.EncodeToString(segs[0])
+		return nil
+
+	case *CmdDataPacketType:
+		if len(segs) != 2 {
+			return fmt.Errorf("invalid number of segments for %s packet: %d", p.GetType(), len(segs))
+		}
+		p.PtyData64 = base64.StdEncoding.EncodeToString(segs[0])
+		p.RunData64 = base64.StdEncoding.EncodeToString(segs[1])
+		return nil
+
+	case *FileDataPacketType:
+		if len(segs) != 1 {
+			return fmt.Errorf("invalid number of segments for %s packet: %d", p.GetType(), len(segs))
+		}
+		if len(segs[0]) > 0 {
+			p.Data = segs[0]
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("packet type %s cannot be sent with binary framing", pk.GetType())
+	}
+}
+
+// tracks least-recently-used order for compression streams.  the encoder and decoder see
+// the same sequence of packets, so they evict the same streams.
+type streamLru struct {
+	Counter  int64
+	LastUsed map[string]int64
+}
+
+func makeStreamLru() *streamLru {
+	return &streamLru{LastUsed: make(map[string]int64)}
+}
+
+func (lru *streamLru) touch(key string) {
+	lru.Counter++
+	lru.LastUsed[key] = lru.Counter
+}
+
+func (lru *streamLru) remove(key string) {
+	delete(lru.LastUsed, key)
+}
+
+// returns "" if there is nothing to evict
+func (lru *streamLru) evictKey(maxSize int) string {
+	if len(lru.LastUsed) <= maxSize {
+		return ""
+	}
+	var rtnKey string
+	var rtnTs int64
+	for key, ts := range lru.LastUsed {
+		if rtnKey == "" || ts < rtnTs {
+			rtnKey = key
+			rtnTs = ts
+		}
+	}
+	return rtnKey
+}
+
+type deflateStreamWriter struct {
+	Buf    *bytes.Buffer
+	Writer *flate.Writer
+}
+
+func makeDeflateStreamWriter() *deflateStreamWriter {
+	buf := &bytes.Buffer{}
+	writer, _ := flate.NewWriter(buf, flate.BestSpeed) // only errors on invalid level
+	return &deflateStreamWriter{Buf: buf, Writer: writer}
+}
+
+func (sw *deflateStreamWriter) compress(data []byte) ([]byte, error) {
+	sw.Buf.Reset()
+	_, err := sw.Writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = sw.Writer.Flush()
+	if err != nil {
+		return nil, err
+	}
+	rtn := make([]byte, sw.Buf.Len())
+	copy(rtn, sw.Buf.Bytes())
+	return rtn, nil
+}
+
+type deflateStreamReader struct {
+	Src    *bytes.Buffer
+	Reader io.ReadCloser
+}
+
+func makeDeflateStreamReader() *deflateStreamReader {
+	// bytes.Buffer is an io.ByteReader, so flate will not read ahead past the sync-flush of the last packet
+	src := &bytes.Buffer{}
+	return &deflateStreamReader{Src: src, Reader: flate.NewReader(src)}
+}
+
+func (sr *deflateStreamReader) decompress(data []byte, rawLen int) ([]byte, error) {
+	sr.Src.Write(data)
+	rtn := make([]byte, rawLen)
+	_, err := io.ReadFull(sr.Reader, rtn)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing stream data: %w", err)
+	}
+	return rtn, nil
+}
+
+// not thread-safe, owned by the PacketSender write loop
+type binaryFrameEncoder struct {
+	Lru     *streamLru
+	Streams map[string]*deflateStreamWriter
+}
+
+func makeBinaryFrameEncoder() *binaryFrameEncoder {
+	return &binaryFrameEncoder{Lru: makeStreamLru(), Streams: make(map[string]*deflateStreamWriter)}
+}
+
+func (enc *binaryFrameEncoder) endStream(streamKey string) {
+	delete(enc.Streams, streamKey)
+	enc.Lru.remove(streamKey)
+}
+
+// returns (nil, nil) if the packet should be sent as json
+func (enc *binaryFrameEncoder) marshalPacket(pk PacketType, compression string) ([]byte, error) {
+	pkCopy, segs, err := extractBinarySegments(pk)
+	if err != nil || pkCopy == nil {
+		// not a data packet (or invalid base64 data), let the json marshaler handle it
+		return nil, nil
+	}
+	jsonBytes, err := json.Marshal(pkCopy)
+	if err != nil {
+		return nil, &SendError{IsMarshalError: true, PacketType: pk.GetType(), Err: err}
+	}
+	var payload bytes.Buffer
+	writeUvarint(&payload, uint64(len(jsonBytes)))
+	payload.Write(jsonBytes)
+	writeUvarint(&payload, uint64(len(segs)))
+	for _, seg := range segs {
+		err = enc.writeSegment(&payload, seg, compression)
+		if err != nil {
+			return nil, &SendError{IsMarshalError: true, PacketType: pk.GetType(), Err: err}
+		}
+	}
+	var outBuf bytes.Buffer
+	outBuf.WriteByte('\n')
+	outBuf.WriteString(fmt.Sprintf("%s%d\n", BinaryFramePrefix, payload.Len()))
+	outBuf.Write(payload.Bytes())
+	return outBuf.Bytes(), nil
+}
+
+func writeUvarint(buf *bytes.Buffer, val uint64) {
+	var varBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(varBuf[:], val)
+	buf.Write(varBuf[:n])
+}
+
+func (enc *binaryFrameEncoder) writeSegment(buf *bytes.Buffer, seg binarySegment, compression string) error {
+	if seg.EndStream {
+		defer enc.endStream(seg.StreamKey)
+	}
+	if compression != Compression_Deflate || seg.StreamKey == "" || len(seg.Data) < MinCompressSize {
+		buf.WriteByte(0)
+		writeUvarint(buf, uint64(len(seg.Data)))
+		buf.Write(seg.Data)
+		return nil
+	}
+	var flags byte = segFlag_Deflate
+	stream := enc.Streams[seg.StreamKey]
+	if stream == nil {
+		flags |= segFlag_NewStream
+		stream = makeDeflateStreamWriter()
+		enc.Streams[seg.StreamKey] = stream
+	}
+	enc.Lru.touch(seg.StreamKey)
+	if evictKey := enc.Lru.evictKey(MaxCompressStreams); evictKey != "" {
+		enc.endStream(evictKey)
+	}
+	compData, err := stream.compress(seg.Data)
+	if err != nil {
+		return err
+	}
+	buf.WriteByte(flags)
+	writeUvarint(buf, uint64(len(seg.Data)))
+	writeUvarint(buf, uint64(len(compData)))
+	buf.Write(compData)
+	return nil
+}
+
+func (enc *binaryFrameEncoder) sendPacket(w io.Writer, pk PacketType, compression string) (bool, error) {
+	outBytes, err := enc.marshalPacket(pk, compression)
+	if err != nil {
+		return true, err
+	}
+	if outBytes == nil {
+		return false, nil
+	}
+	if GlobalDebug {
+		base.Logf("SEND(bin)> %s\n", AsString(pk))
+	}
+	_, err = w.Write(outBytes)
+	if err != nil {
+		return true, &SendError{IsWriteError: true, PacketType: pk.GetType(), Err: err}
+	}
+	return true, nil
+}
+
+// not thread-safe, owned by the PacketParser read loop
+type binaryFrameDecoder struct {
+	Lru     *streamLru
+	Streams map[string]*deflateStreamReader
+}
+
+func makeBinaryFrameDecoder() *binaryFrameDecoder {
+	return &binaryFrameDecoder{Lru: makeStreamLru(), Streams: make(map[string]*deflateStreamReader)}
+}
+
+func (dec *binaryFrameDecoder) endStream(streamKey string) {
+	delete(dec.Streams, streamKey)
+	dec.Lru.remove(streamKey)
+}
+
+// returns -1 if the line is not a binary frame header
+func parseBinaryFrameHeader(line string) int {
+	if !strings.HasPrefix(line, BinaryFramePrefix) || !strings.HasSuffix(line, "\n") {
+		return -1
+	}
+	frameLen, err := strconv.Atoi(line[len(BinaryFramePrefix) : len(line)-1])
+	if err != nil || frameLen < 0 || frameLen > MaxBinaryFrameSize {
+		return -1
+	}
+	return frameLen
+}
+
+func readBinaryLen(r *bytes.Reader) (int, error) {
+	val, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, err
+	}
+	if val > MaxBinaryFrameSize {
+		return 0, fmt.Errorf("invalid length %d", val)
+	}
+	return int(val), nil
+}
+
+func readBinaryBytes(r *bytes.Reader) ([]byte, error) {
+	dataLen, err := readBinaryLen(r)
+	if err != nil {
+		return nil, err
+	}
+	if dataLen > r.Len() {
+		return nil, fmt.Errorf("invalid length %d (remaining %d)", dataLen, r.Len())
+	}
+	rtn := make([]byte, dataLen)
+	_, err = io.ReadFull(r, rtn)
+	return rtn, err
+}
+
+func (dec *binaryFrameDecoder) unmarshalPacket(payload []byte) (PacketType, error) {
+	r := bytes.NewReader(payload)
+	jsonBytes, err := readBinaryBytes(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading binary packet json: %w", err)
+	}
+	pk, err := ParseJsonPacket(jsonBytes)
+	if err != nil {
+		return nil, err
+	}
+	_, segs, err := extractBinarySegments(pk)
+	if err != nil {
+		return nil, err
+	}
+	numSegs, err := readBinaryLen(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading binary packet segments: %w", err)
+	}
+	if numSegs != len(segs) {
+		return nil, fmt.Errorf("invalid number of segments for %s packet: %d", pk.GetType(), numSegs)
+	}
+	segData := make([][]byte, numSegs)
+	for idx, seg := range segs {
+		segData[idx], err = dec.readSegment(r, seg.StreamKey)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s packet segment: %w", pk.GetType(), err)
+		}
+	}
+	err = injectBinarySegments(pk, segData)
+	if err != nil {
+		return nil, err
+	}
+	// stream end is determined by the packet metadata (eof/error), which is in the json
+	for _, seg := range segs {
+		if seg.EndStream {
+			dec.endStream(seg.StreamKey)
+		}
+	}
+	return pk, nil
+}
+
+func (dec *binaryFrameDecoder) readSegment(r *bytes.Reader, streamKey string) ([]byte, error) {
+	flags, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if flags&segFlag_Deflate == 0 {
+		return readBinaryBytes(r)
+	}
+	rawLen, err := readBinaryLen(r)
+	if err != nil {
+		return nil, err
+	}
+	compData, err := readBinaryBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	stream := dec.Streams[streamKey]
+	if flags&segFlag_NewStream != 0 {
+		stream = makeDeflateStreamReader()
+		dec.Streams[streamKey] = stream
+	}
+	if stream == nil {
+		return nil, fmt.Errorf("no compression stream for %q", streamKey)
+	}
+	dec.Lru.touch(streamKey)
+	if evictKey := dec.Lru.evictKey(MaxCompressStreams); evictKey != "" {
+		dec.endStream(evictKey)
+	}
+	return stream.decompress(compData, rawLen)
+}
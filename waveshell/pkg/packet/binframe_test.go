@@ -0,0 +1,155 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/wavetermdev/waveterm/waveshell/pkg/base"
+)
+
+type countingWriter struct {
+	W     io.Writer
+	Count int
+}
+
+func (cw *countingWriter) Write(data []byte) (int, error) {
+	cw.Count += len(data)
+	return cw.W.Write(data)
+}
+
+func makeTestData(rnd *rand.Rand, size int) []byte {
+	rtn := make([]byte, size)
+	for idx := range rtn {
+		if rnd.Intn(8) == 0 {
+			rtn[idx] = byte(rnd.Intn(256))
+		} else {
+			rtn[idx] = "$ ls -l /usr/bin\n"[idx%17]
+		}
+	}
+	return rtn
+}
+
+// sends the packets through a sender/parser pair, returns the received packets and the number of bytes written
+func sendTestPackets(t *testing.T, peerCapabilities []string, pks []PacketType) ([]PacketType, int) {
+	pr, pw := io.Pipe()
+	cw := &countingWriter{W: pw}
+	sender := MakePacketSender(cw, nil)
+	parser := MakePacketParser(pr, nil)
+	sender.SetPeerCapabilities(peerCapabilities)
+	go func() {
+		for _, pk := range pks {
+			sender.SendPacket(pk)
+		}
+		sender.Close()
+		sender.WaitForDone()
+		pw.Close()
+	}()
+	var rtn []PacketType
+	for pk := range parser.MainCh {
+		rtn = append(rtn, pk)
+	}
+	if parser.GetErr() != nil {
+		t.Fatalf("parser error: %v", parser.GetErr())
+	}
+	return rtn, cw.Count
+}
+
+func makeTestPackets() []PacketType {
+	rnd := rand.New(rand.NewSource(5))
+	var rtn []PacketType
+	for i := 0; i < 500; i++ {
+		ck := base.MakeCommandKey("screen", fmt.Sprintf("line-%d", rnd.Intn(MaxCompressStreams*2)))
+		switch rnd.Intn(4) {
+		case 0:
+			pk := &DataPacketType{Type: DataPacketStr, CK: ck, FdNum: rnd.Intn(2)}
+			pk.Data64 = base64.StdEncoding.EncodeToString(makeTestData(rnd, rnd.Intn(2000)))
+			pk.Eof = rnd.Intn(20) == 0
+			rtn = append(rtn, pk)
+		case 1:
+			pk := MakeCmdDataPacket("req-1")
+			pk.CK = ck
+			ptyData := makeTestData(rnd, rnd.Intn(2000))
+			pk.PtyData64 = base64.StdEncoding.EncodeToString(ptyData)
+			pk.PtyDataLen = len(ptyData)
+			pk.RunData64 = base64.StdEncoding.EncodeToString(makeTestData(rnd, rnd.Intn(40)))
+			rtn = append(rtn, pk)
+		case 2:
+			pk := MakeFileDataPacket(fmt.Sprintf("file-%d", rnd.Intn(3)))
+			pk.Data = makeTestData(rnd, rnd.Intn(5000))
+			pk.Eof = rnd.Intn(10) == 0
+			rtn = append(rtn, pk)
+		default:
+			rtn = append(rtn, MakeMessagePacket(fmt.Sprintf("message %d", i)))
+		}
+	}
+	return rtn
+}
+
+func TestBinaryFraming(t *testing.T) {
+	pks := makeTestPackets()
+	jsonPks, jsonSize := sendTestPackets(t, nil, pks)
+	rawPks, rawSize := sendTestPackets(t, []string{Capability_BinaryFraming}, pks)
+	deflatePks, deflateSize := sendTestPackets(t, []string{Capability_BinaryFraming, Capability_Deflate}, pks)
+	for _, rtnPks := range [][]PacketType{jsonPks, rawPks, deflatePks} {
+		if len(rtnPks) != len(pks) {
+			t.Fatalf("wrong number of packets received: %d, expected %d", len(rtnPks), len(pks))
+		}
+		for idx, pk := range pks {
+			if AsString(rtnPks[idx]) != AsString(pk) {
+				t.Fatalf("packet %d mismatch:\n%s\n%s", idx, AsString(rtnPks[idx]), AsString(pk))
+			}
+		}
+	}
+	if rawSize >= jsonSize || deflateSize >= rawSize {
+		t.Errorf("bad frame sizes json=%d raw=%d deflate=%d", jsonSize, rawSize, deflateSize)
+	}
+	t.Logf("sizes json=%d raw=%d deflate=%d", jsonSize, rawSize, deflateSize)
+}
+
+func TestBinaryFramingInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("##B5\nxxxxx\n")
+	SendPacket(&buf, MakeMessagePacket("after"))
+	parser := MakePacketParser(&buf, nil)
+	pk := <-parser.MainCh
+	if pk == nil || pk.GetType() != RawPacketStr {
+		t.Fatalf("expected raw packet for invalid binary frame, got %v", pk)
+	}
+	pk = <-parser.MainCh
+	if msgPk, ok := pk.(*MessagePacketType); !ok || msgPk.Message != "after" {
+		t.Fatalf("expected message packet after invalid binary frame, got %v", pk)
+	}
+}
+
+func TestSetPeerCapabilities(t *testing.T) {
+	sender := MakePacketSender(io.Discard, nil)
+	defer sender.Close()
+	if binary, compression := sender.getFraming(); binary || compression != Compression_None {
+		t.Errorf("new sender should use json framing")
+	}
+	sender.SetPeerCapabilities([]string{Capability_Deflate})
+	if binary, _ := sender.getFraming(); binary {
+		t.Errorf("deflate without binframe should stay on json framing")
+	}
+	sender.SetPeerCapabilities([]string{Capability_BinaryFraming})
+	if binary, compression := sender.getFraming(); !binary || compression != Compression_None {
+		t.Errorf("bad framing: binary=%v compression=%q", binary, compression)
+	}
+	for _, capabilities := range [][]string{ServerCapabilities, ClientCapabilities} {
+		sender.SetPeerCapabilities(capabilities)
+		if binary, compression := sender.getFraming(); !binary || compression != Compression_Deflate {
+			t.Errorf("bad framing for %v: binary=%v compression=%q", capabilities, binary, compression)
+		}
+	}
+	sender.SetPeerCapabilities(nil)
+	if binary, compression := sender.getFraming(); binary || compression != Compression_None {
+		t.Errorf("peer without capabilities should switch back to json framing")
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package packet
+
+// capabilities are exchanged in the init handshake:
+//
+//	server -> client: the server's init packet (MakeServerInitPacket)
+//	client -> server: an init packet sent back by the client (only if the server has Capability_ClientInit)
+//
+// check capabilities (not versions) before using a feature, older versions just have fewer capabilities.
+const (
+	Capability_ClientInit    = "clientinit"    // server accepts an init packet from the client
+	Capability_BinaryFraming = "binframe"      // can parse binary frames (binframe.go)
+	Capability_Deflate       = "deflate"       // can decompress deflate binary frame segments
+	Capability_CmdTail       = "cmdtail"       // server runs detached commands (with shell state), getcmd/untailcmd tail them
+	Capability_Fish          = "fish"          // server supports the fish shell
+	Capability_ListDir       = "listdir"       // streamfile supports ListDir (paginated directory entries)
+	Capability_FollowFile    = "followfile"    // streamfile supports Follow (and the unfollowfile packet)
+	Capability_WriteFileOpts = "writefileopts" // writefile supports MkDirs/Perm/ModTs and returns Size/Sha256
+	Capability_FileDataAck   = "filedataack"   // streamfile/writefile support a flow control Window (filedataack packets)
+	Capability_CompProviders = "compproviders" // compgen supports the CompGenType_* provider types (and returns descs)
+	Capability_FileSha256    = "filesha256"    // streamfile/writefile support Sha256 (hashes computed from the file on disk)
+)
+
+// advertised in the waveshell server's init packet
+var ServerCapabilities = []string{
+	Capability_ClientInit,
+	Capability_BinaryFraming,
+	Capability_Deflate,
+	Capability_CmdTail,
+	Capability_Fish,
+	Capability_ListDir,
+	Capability_FollowFile,
+	Capability_WriteFileOpts,
+	Capability_FileDataAck,
+	Capability_CompProviders,
+	Capability_FileSha256,
+}
+
+// advertised in the client's init packet (sent to the server)
+var ClientCapabilities = []string{
+	Capability_BinaryFraming,
+	Capability_Deflate,
+}
+
+func (pk *InitPacketType) HasCapability(capability string) bool {
+	return hasCapability(pk.Capabilities, capability)
+}
+
+func hasCapability(capabilities []string, capability string) bool {
+	for _, c := range capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
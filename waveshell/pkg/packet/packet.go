@@ -23,6 +23,7 @@ import (
 // single(detached): <init, >run, >cmddata, >cmddone, <cmdstart
 // server          : <init, >run, >cmddata, >cmddone, <cmdstart, <>data, <>dataack, <cmddone
 //                   >cd, >getcmd, >untailcmd, >input, <resp
+//                   >init (optional, sent if the server has the "clientinit" capability, see capabilities.go)
 // all             : <>error, <>message, <>ping, <raw
 //
 // >streamfile, <streamfileresp, <filedata*
@@ -45,10 +46,11 @@ const (
 	DonePacketStr           = "done"
 	CmdErrorPacketStr       = "cmderror" // command
 	MessagePacketStr        = "message"
-	GetCmdPacketStr         = "getcmd"    // rpc
-	UntailCmdPacketStr      = "untailcmd" // rpc
-	CdPacketStr             = "cd"        // rpc
-	CmdDataPacketStr        = "cmddata"   // rpc-response
+	GetCmdPacketStr         = "getcmd"       // rpc
+	UntailCmdPacketStr      = "untailcmd"    // rpc
+	UnfollowFilePacketStr   = "unfollowfile" // rpc (no response, ends a streamfile follow)
+	CdPacketStr             = "cd"           // rpc
+	CmdDataPacketStr        = "cmddata"      // rpc-response
 	RawPacketStr            = "raw"
 	SpecialInputPacketStr   = "sinput"         // command
 	CompGenPacketStr        = "compgen"        // rpc
@@ -60,7 +62,8 @@ const (
 	WriteFileReadyPacketStr = "writefileready" // rpc-response
 	WriteFileDonePacketStr  = "writefiledone"  // rpc-response
 	FileDataPacketStr       = "filedata"
-	LogPacketStr            = "log" // logging packet (sent from waveshell back to server)
+	FileDataAckPacketStr    = "filedataack" // rpc (no response) for streamfile, rpc-response for writefile
+	LogPacketStr            = "log"         // logging packet (sent from waveshell back to server)
 	ShellStatePacketStr     = "shellstate"
 
 	OpenAIPacketStr   = "openai" // other
@@ -70,8 +73,13 @@ const (
 const (
 	ShellType_bash = "bash"
 	ShellType_zsh  = "zsh"
+	ShellType_fish = "fish"
 )
 
+func IsValidShellType(shellType string) bool {
+	return shellType == ShellType_bash || shellType == ShellType_zsh || shellType == ShellType_fish
+}
+
 const PacketSenderQueueSize = 20
 
 const PacketEOFStr = "EOF"
@@ -92,6 +100,7 @@ func init() {
 	TypeStrToFactory[CmdDonePacketStr] = reflect.TypeOf(CmdDonePacketType{})
 	TypeStrToFactory[GetCmdPacketStr] = reflect.TypeOf(GetCmdPacketType{})
 	TypeStrToFactory[UntailCmdPacketStr] = reflect.TypeOf(UntailCmdPacketType{})
+	TypeStrToFactory[UnfollowFilePacketStr] = reflect.TypeOf(UnfollowFilePacketType{})
 	TypeStrToFactory[InitPacketStr] = reflect.TypeOf(InitPacketType{})
 	TypeStrToFactory[CdPacketStr] = reflect.TypeOf(CdPacketType{})
 	TypeStrToFactory[CmdDataPacketStr] = reflect.TypeOf(CmdDataPacketType{})
@@ -107,6 +116,7 @@ func init() {
 	TypeStrToFactory[StreamFileResponseStr] = reflect.TypeOf(StreamFileResponseType{})
 	TypeStrToFactory[OpenAIPacketStr] = reflect.TypeOf(OpenAIPacketType{})
 	TypeStrToFactory[FileDataPacketStr] = reflect.TypeOf(FileDataPacketType{})
+	TypeStrToFactory[FileDataAckPacketStr] = reflect.TypeOf(FileDataAckPacketType{})
 	TypeStrToFactory[WriteFilePacketStr] = reflect.TypeOf(WriteFilePacketType{})
 	TypeStrToFactory[WriteFileReadyPacketStr] = reflect.TypeOf(WriteFileReadyPacketType{})
 	TypeStrToFactory[WriteFileDonePacketStr] = reflect.TypeOf(WriteFileDonePacketType{})
@@ -116,6 +126,7 @@ func init() {
 	var _ RpcPacketType = (*RunPacketType)(nil)
 	var _ RpcPacketType = (*GetCmdPacketType)(nil)
 	var _ RpcPacketType = (*UntailCmdPacketType)(nil)
+	var _ RpcPacketType = (*UnfollowFilePacketType)(nil)
 	var _ RpcPacketType = (*CdPacketType)(nil)
 	var _ RpcPacketType = (*CompGenPacketType)(nil)
 	var _ RpcPacketType = (*ReInitPacketType)(nil)
@@ -127,6 +138,8 @@ func init() {
 	var _ RpcResponsePacketType = (*CmdDataPacketType)(nil)
 	var _ RpcResponsePacketType = (*StreamFileResponseType)(nil)
 	var _ RpcResponsePacketType = (*FileDataPacketType)(nil)
+	var _ RpcPacketType = (*FileDataAckPacketType)(nil)
+	var _ RpcResponsePacketType = (*FileDataAckPacketType)(nil)
 	var _ RpcResponsePacketType = (*WriteFileReadyPacketType)(nil)
 	var _ RpcResponsePacketType = (*WriteFileDonePacketType)(nil)
 	var _ RpcResponsePacketType = (*ShellStatePacketType)(nil)
@@ -194,11 +207,14 @@ func MakePingPacket() *PingPacketType {
 }
 
 type FileDataPacketType struct {
-	Type   string `json:"type"`
-	RespId string `json:"respid"`
-	Data   []byte `json:"data"`
-	Eof    bool   `json:"eof,omitempty"`
-	Error  string `json:"error,omitempty"`
+	Type      string `json:"type"`
+	RespId    string `json:"respid"`
+	Data      []byte `json:"data"`
+	Eof       bool   `json:"eof,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"` // follow mode, file was truncated (Data starts at offset 0)
+	Rotated   bool   `json:"rotated,omitempty"`   // follow mode, file was replaced (Data starts at offset 0 of the new file)
+	Sha256    string `json:"sha256,omitempty"`    // streamfile with Sha256 set, hex sha256 of the bytes read from the file (on the Eof packet)
 }
 
 func (*FileDataPacketType) GetType() string {
@@ -220,6 +236,36 @@ func (p *FileDataPacketType) GetResponseDone() bool {
 	return p.Eof || p.Error != ""
 }
 
+// flow control for streamfile/writefile requests that set a Window.  ReqId is the reqid of the
+// streamfile/writefile request, Pos is the total number of data bytes consumed (read by the client
+// for streamfile, written to the file for writefile).  the sender keeps at most Window bytes unacked.
+type FileDataAckPacketType struct {
+	Type   string `json:"type"`
+	ReqId  string `json:"reqid"`
+	Pos    int64  `json:"pos"`
+	Cancel bool   `json:"cancel,omitempty"` // streamfile only, stop sending data
+}
+
+func (*FileDataAckPacketType) GetType() string {
+	return FileDataAckPacketStr
+}
+
+func (p *FileDataAckPacketType) GetReqId() string {
+	return p.ReqId
+}
+
+func (p *FileDataAckPacketType) GetResponseId() string {
+	return p.ReqId
+}
+
+func (p *FileDataAckPacketType) GetResponseDone() bool {
+	return false
+}
+
+func MakeFileDataAckPacket(reqId string, pos int64) *FileDataAckPacketType {
+	return &FileDataAckPacketType{Type: FileDataAckPacketStr, ReqId: reqId, Pos: pos}
+}
+
 type DataPacketType struct {
 	Type   string          `json:"type"`
 	CK     base.CommandKey `json:"ck"`
@@ -352,6 +398,24 @@ func MakeUntailCmdPacket() *UntailCmdPacketType {
 	return &UntailCmdPacketType{Type: UntailCmdPacketStr}
 }
 
+// ReqId is the reqid of the streamfile (Follow) request to stop
+type UnfollowFilePacketType struct {
+	Type  string `json:"type"`
+	ReqId string `json:"reqid"`
+}
+
+func (*UnfollowFilePacketType) GetType() string {
+	return UnfollowFilePacketStr
+}
+
+func (p *UnfollowFilePacketType) GetReqId() string {
+	return p.ReqId
+}
+
+func MakeUnfollowFilePacket(reqId string) *UnfollowFilePacketType {
+	return &UnfollowFilePacketType{Type: UnfollowFilePacketStr, ReqId: reqId}
+}
+
 type GetCmdPacketType struct {
 	Type    string          `json:"type"`
 	ReqId   string          `json:"reqid"`
@@ -416,6 +480,12 @@ type StreamFilePacketType struct {
 	Path      string  `json:"path"`
 	ByteRange []int64 `json:"byterange"`          // works like the http "Range" header (multiple ranges are not allowed)
 	StatOnly  bool    `json:"statonly,omitempty"` // set if you just want the stat response (no data returned)
+	ListDir   bool    `json:"listdir,omitempty"`  // if Path is a directory, return its entries (sorted by name) in the response
+	DirOffset int     `json:"diroffset,omitempty"`
+	DirLimit  int     `json:"dirlimit,omitempty"` // 0 (or too large) means the server max (1000)
+	Follow    bool    `json:"follow,omitempty"`   // keep streaming appended data (like tail -f) until an unfollowfile packet is sent
+	Window    int64   `json:"window,omitempty"`   // if set, max unacked data bytes (client sends filedataack packets)
+	Sha256    bool    `json:"sha256,omitempty"`   // if set, the Eof data packet has the sha256 of the data read from the file
 }
 
 func (*StreamFilePacketType) GetType() string {
@@ -437,14 +507,22 @@ type FileInfo struct {
 	IsDir    bool   `json:"isdir,omitempty"`
 	Perm     int    `json:"perm"`
 	NotFound bool   `json:"notfound,omitempty"` // when NotFound is set, Perm will be set to permission for directory
+
+	// set for directory entries (ListDir)
+	Mode          uint32 `json:"mode,omitempty"` // full fs.FileMode (type bits + perm)
+	IsSymlink     bool   `json:"issymlink,omitempty"`
+	SymlinkTarget string `json:"symlinktarget,omitempty"`
 }
 
 type StreamFileResponseType struct {
-	Type   string    `json:"type"`
-	RespId string    `json:"respid"`
-	Done   bool      `json:"done,omitempty"`
-	Info   *FileInfo `json:"info,omitempty"`
-	Error  string    `json:"error,omitempty"`
+	Type         string      `json:"type"`
+	RespId       string      `json:"respid"`
+	Done         bool        `json:"done,omitempty"`
+	Info         *FileInfo   `json:"info,omitempty"`
+	Entries      []*FileInfo `json:"entries,omitempty"` // ListDir (Name is the base name)
+	TotalEntries int         `json:"totalentries,omitempty"`
+	HasMore      bool        `json:"hasmore,omitempty"`
+	Error        string      `json:"error,omitempty"`
 }
 
 func (*StreamFileResponseType) GetType() string {
@@ -478,6 +556,24 @@ func IsValidCompGenType(t string) bool {
 	return (t == "file" || t == "command" || t == "directory" || t == "variable")
 }
 
+// compgen types for command specific completions (not passed to bash compgen).
+// responses include "descs" (parallel to "comps")
+const (
+	CompGenType_GitBranch       = "gitbranch"
+	CompGenType_SshHost         = "sshhost"
+	CompGenType_MakeTarget      = "maketarget"
+	CompGenType_DockerContainer = "dockercontainer"
+	CompGenType_DockerImage     = "dockerimage"
+)
+
+func IsProviderCompGenType(t string) bool {
+	switch t {
+	case CompGenType_GitBranch, CompGenType_SshHost, CompGenType_MakeTarget, CompGenType_DockerContainer, CompGenType_DockerImage:
+		return true
+	}
+	return false
+}
+
 func (*CompGenPacketType) GetType() string {
 	return CompGenPacketStr
 }
@@ -624,18 +720,19 @@ func FmtMessagePacket(fmtStr string, args ...interface{}) *MessagePacketType {
 }
 
 type InitPacketType struct {
-	Type          string `json:"type"`
-	RespId        string `json:"respid,omitempty"`
-	Version       string `json:"version"`
-	BuildTime     string `json:"buildtime,omitempty"`
-	MShellHomeDir string `json:"mshellhomedir,omitempty"`
-	HomeDir       string `json:"homedir,omitempty"`
-	User          string `json:"user,omitempty"`
-	HostName      string `json:"hostname,omitempty"`
-	NotFound      bool   `json:"notfound,omitempty"`
-	UName         string `json:"uname,omitempty"`
-	Shell         string `json:"shell,omitempty"`
-	RemoteId      string `json:"remoteid,omitempty"`
+	Type          string   `json:"type"`
+	RespId        string   `json:"respid,omitempty"`
+	Version       string   `json:"version"`
+	BuildTime     string   `json:"buildtime,omitempty"`
+	MShellHomeDir string   `json:"mshellhomedir,omitempty"`
+	HomeDir       string   `json:"homedir,omitempty"`
+	User          string   `json:"user,omitempty"`
+	HostName      string   `json:"hostname,omitempty"`
+	NotFound      bool     `json:"notfound,omitempty"`
+	UName         string   `json:"uname,omitempty"`
+	Shell         string   `json:"shell,omitempty"`
+	RemoteId      string   `json:"remoteid,omitempty"`
+	Capabilities  []string `json:"capabilities,omitempty"`
 }
 
 func (*InitPacketType) GetType() string {
@@ -693,6 +790,18 @@ type CmdDonePacketType struct {
 	DurationMs     int64           `json:"durationms"`
 	FinalState     *ShellState     `json:"finalstate,omitempty"`
 	FinalStateDiff *ShellStateDiff `json:"finalstatediff,omitempty"`
+	RUsage         *CmdRUsageType  `json:"rusage,omitempty"`
+}
+
+// resource usage of the command (the shell process and its waited-for children)
+type CmdRUsageType struct {
+	UserTimeMs int64 `json:"utimems"`
+	SysTimeMs  int64 `json:"stimems"`
+	MaxRssKB   int64 `json:"maxrsskb"`
+	InBlock    int64 `json:"inblock"`  // block input operations
+	OutBlock   int64 `json:"outblock"` // block output operations
+	VolCsw     int64 `json:"nvcsw"`    // voluntary context switches
+	InvolCsw   int64 `json:"nivcsw"`   // involuntary context switches
 }
 
 func (*CmdDonePacketType) GetType() string {
@@ -714,6 +823,7 @@ type CmdStartPacketType struct {
 	CK        base.CommandKey `json:"ck"`
 	Pid       int             `json:"pid,omitempty"`
 	MShellPid int             `json:"mshellpid,omitempty"`
+	TtyName   string          `json:"ttyname,omitempty"` // detached commands, pty used by the server to resize
 }
 
 func (*CmdStartPacketType) GetType() string {
@@ -757,7 +867,7 @@ type RunPacketType struct {
 	Type          string          `json:"type"`
 	ReqId         string          `json:"reqid"`
 	CK            base.CommandKey `json:"ck"`
-	ShellType     string          `json:"shelltype"` // new in v0.6.0 (either "bash" or "zsh") (set by remote.go)
+	ShellType     string          `json:"shelltype"` // new in v0.6.0 ("bash", "zsh", or "fish") (set by remote.go)
 	Command       string          `json:"command"`
 	State         *ShellState     `json:"state,omitempty"`
 	StateDiff     *ShellStateDiff `json:"statediff,omitempty"`
@@ -768,6 +878,7 @@ type RunPacketType struct {
 	RunData       []RunDataType   `json:"rundata,omitempty"`
 	Detached      bool            `json:"detached,omitempty"`
 	ReturnState   bool            `json:"returnstate,omitempty"`
+	ReadWindow    int             `json:"readwindow,omitempty"` // flow control window (bytes) per output fd, 0 for the default
 }
 
 func (*RunPacketType) GetType() string {
@@ -846,6 +957,11 @@ type WriteFilePacketType struct {
 	ReqId   string `json:"reqid"`
 	UseTemp bool   `json:"usetemp,omitempty"`
 	Path    string `json:"path"`
+	MkDirs  bool   `json:"mkdirs,omitempty"` // create missing parent directories
+	Perm    *int   `json:"perm,omitempty"`   // if set, chmod the file after writing (permission bits only, 0 is allowed)
+	ModTs   int64  `json:"modts,omitempty"`  // if set (unix ms), set the file's mtime after writing
+	Window  int64  `json:"window,omitempty"` // if set, the server acks written bytes with filedataack packets
+	Sha256  bool   `json:"sha256,omitempty"` // if set, the file is re-read after closing to compute the done packet's Sha256
 }
 
 func (*WriteFilePacketType) GetType() string {
@@ -889,6 +1005,8 @@ type WriteFileDonePacketType struct {
 	Type   string `json:"type"`
 	RespId string `json:"reqid"`
 	Error  string `json:"error,omitempty"`
+	Size   int64  `json:"size,omitempty"`   // bytes written
+	Sha256 string `json:"sha256,omitempty"` // hex sha256 of the file (re-read from disk if Sha256 was requested, otherwise of the bytes received)
 }
 
 func (*WriteFileDonePacketType) GetType() string {
@@ -1068,12 +1186,14 @@ func SendCmdError(w io.Writer, ck base.CommandKey, err error) error {
 }
 
 type PacketSender struct {
-	Lock       *sync.Mutex
-	SendCh     chan PacketType
-	Done       bool
-	DoneCh     chan bool
-	ErrHandler func(*PacketSender, PacketType, error)
-	ExitErr    error
+	Lock          *sync.Mutex
+	SendCh        chan PacketType
+	Done          bool
+	DoneCh        chan bool
+	ErrHandler    func(*PacketSender, PacketType, error)
+	ExitErr       error
+	BinaryFraming bool
+	Compression   string
 }
 
 func MakePacketSender(output io.Writer, errHandler func(*PacketSender, PacketType, error)) *PacketSender {
@@ -1086,8 +1206,9 @@ func MakePacketSender(output io.Writer, errHandler func(*PacketSender, PacketTyp
 	go func() {
 		defer close(sender.DoneCh)
 		defer sender.Close()
+		encoder := makeBinaryFrameEncoder()
 		for pk := range sender.SendCh {
-			err := SendPacket(output, pk)
+			err := sender.sendPacket(output, encoder, pk)
 			if err != nil {
 				sender.goHandleError(pk, err)
 				if serr, ok := err.(*SendError); ok && serr.IsMarshalError {
@@ -1105,6 +1226,40 @@ func MakePacketSender(output io.Writer, errHandler func(*PacketSender, PacketTyp
 	return sender
 }
 
+func (sender *PacketSender) getFraming() (bool, string) {
+	sender.Lock.Lock()
+	defer sender.Lock.Unlock()
+	return sender.BinaryFraming, sender.Compression
+}
+
+// sets the framing for packets sent *to* the peer from the capabilities in the peer's init packet.
+// older waveshell (or wavesrv) versions do not advertise capabilities and stay on json framing.
+// parsers accept both framings, so this can be switched at any point (packets already queued
+// are sent with the new framing)
+func (sender *PacketSender) SetPeerCapabilities(capabilities []string) {
+	binaryFraming := hasCapability(capabilities, Capability_BinaryFraming)
+	compression := Compression_None
+	if binaryFraming && hasCapability(capabilities, Capability_Deflate) {
+		compression = Compression_Deflate
+	}
+	sender.Lock.Lock()
+	defer sender.Lock.Unlock()
+	sender.BinaryFraming = binaryFraming
+	sender.Compression = compression
+}
+
+// only called from the write loop (encoder is not thread-safe)
+func (sender *PacketSender) sendPacket(output io.Writer, encoder *binaryFrameEncoder, pk PacketType) error {
+	binaryFraming, compression := sender.getFraming()
+	if binaryFraming && pk != nil {
+		sent, err := encoder.sendPacket(output, pk, compression)
+		if sent {
+			return err
+		}
+	}
+	return SendPacket(output, pk)
+}
+
 func (sender *PacketSender) SendLogPacket(entry wlog.LogEntry) {
 	sender.SendPacket(MakeLogPacket(entry))
 }
@@ -6,6 +6,7 @@ package packet
 import (
 	"bufio"
 	"context"
+	"fmt"
 	"io"
 	"strconv"
 	"strings"
@@ -198,6 +199,7 @@ func MakePacketParser(input io.Reader, opts *PacketParserOpts) *PacketParser {
 	}
 	ignoreUntilValid := opts.IgnoreUntilValid
 	bufReader := bufio.NewReader(input)
+	decoder := makeBinaryFrameDecoder()
 	go func() {
 		defer func() {
 			close(parser.MainCh)
@@ -214,6 +216,23 @@ func MakePacketParser(input io.Reader, opts *PacketParserOpts) *PacketParser {
 			if line == "\n" {
 				continue
 			}
+			// ##B[len]\n[binary payload]
+			if frameLen := parseBinaryFrameHeader(line); frameLen >= 0 {
+				payload := make([]byte, frameLen)
+				_, err = io.ReadFull(bufReader, payload)
+				if err != nil {
+					parser.SetErr(fmt.Errorf("reading binary packet: %w", err))
+					return
+				}
+				ignoreUntilValid = false
+				pk, err := decoder.unmarshalPacket(payload)
+				if err != nil {
+					parser.MainCh <- MakeRawPacket(fmt.Sprintf("invalid binary packet: %v", err))
+					continue
+				}
+				parser.sendPacket(pk)
+				continue
+			}
 			// ##[len][json]\n
 			// ##14{"hello":true}\n
 			// ##N{...}
@@ -250,14 +269,18 @@ func MakePacketParser(input io.Reader, opts *PacketParserOpts) *PacketParser {
 				wlog.LogLogEntry(logPk.Entry)
 				continue
 			}
-			if parser.RpcHandler {
-				sent := parser.trySendRpcResponse(pk)
-				if sent {
-					continue
-				}
-			}
-			parser.MainCh <- pk
+			parser.sendPacket(pk)
 		}
 	}()
 	return parser
 }
+
+func (p *PacketParser) sendPacket(pk PacketType) {
+	if p.RpcHandler {
+		sent := p.trySendRpcResponse(pk)
+		if sent {
+			return
+		}
+	}
+	p.MainCh <- pk
+}
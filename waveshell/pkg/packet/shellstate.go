@@ -57,7 +57,7 @@ func ParseShellStateVersion(fullVersionStr string) (string, string, error) {
 	}
 	shell := fields[0]
 	version := fields[1]
-	if shell != ShellType_zsh && shell != ShellType_bash {
+	if !IsValidShellType(shell) {
 		return "", "", fmt.Errorf("invalid shellstate shell type: %q", fullVersionStr)
 	}
 	if !semver.IsValid(version) {
@@ -0,0 +1,266 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wavetermdev/waveterm/waveshell/pkg/base"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
+)
+
+const CompProviderTimeout = 2 * time.Second
+
+var makeTargetRe = regexp.MustCompile(`^([a-zA-Z0-9_][a-zA-Z0-9_./-]*)\s*:([^=]|$)`)
+
+type compValue struct {
+	Value string
+	Desc  string
+}
+
+// returns (comps, descs, hasmore, err) for the packet.CompGenType_* types
+func runProviderCompGen(cwd string, compType string, prefix string) ([]string, []string, bool, error) {
+	var values []compValue
+	var err error
+	switch compType {
+	case packet.CompGenType_GitBranch:
+		values, err = compGitBranches(cwd)
+	case packet.CompGenType_SshHost:
+		values = compSshHosts(base.GetHomeDir())
+	case packet.CompGenType_MakeTarget:
+		values, err = compMakeTargets(cwd)
+	case packet.CompGenType_DockerContainer:
+		values, err = compDockerContainers()
+	case packet.CompGenType_DockerImage:
+		values, err = compDockerImages()
+	default:
+		return nil, nil, false, fmt.Errorf("invalid compgen type '%s'", compType)
+	}
+	if err != nil {
+		return nil, nil, false, err
+	}
+	comps, descs, hasMore := filterCompValues(values, prefix)
+	return comps, descs, hasMore, nil
+}
+
+// filters by prefix, sorts and removes duplicates (first desc wins), limited to packet.MaxCompGenValues
+func filterCompValues(values []compValue, prefix string) ([]string, []string, bool) {
+	seen := make(map[string]bool)
+	var filtered []compValue
+	for _, val := range values {
+		if val.Value == "" || seen[val.Value] || !strings.HasPrefix(val.Value, prefix) {
+			continue
+		}
+		seen[val.Value] = true
+		filtered = append(filtered, val)
+	}
+	sort.SliceStable(filtered, func(i int, j int) bool {
+		return filtered[i].Value < filtered[j].Value
+	})
+	hasMore := false
+	if len(filtered) > packet.MaxCompGenValues {
+		hasMore = true
+		filtered = filtered[0:packet.MaxCompGenValues]
+	}
+	comps := make([]string, len(filtered))
+	descs := make([]string, len(filtered))
+	for idx, val := range filtered {
+		comps[idx] = val.Value
+		descs[idx] = val.Desc
+	}
+	return comps, descs, hasMore
+}
+
+// runs a helper command, a missing binary is not an error (just no completions)
+func runCompProviderCmd(cwd string, name string, args ...string) ([]string, error) {
+	if _, err := exec.LookPath(name); err != nil {
+		return nil, nil
+	}
+	ctx, cancelFn := context.WithTimeout(context.Background(), CompProviderTimeout)
+	defer cancelFn()
+	ecmd := exec.CommandContext(ctx, name, args...)
+	ecmd.Dir = cwd
+	outputBytes, err := ecmd.Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%s timed out", name)
+		}
+		// not a git repo, docker daemon not running, etc.
+		return nil, nil
+	}
+	var lines []string
+	for _, line := range strings.Split(string(outputBytes), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+func compGitBranches(cwd string) ([]compValue, error) {
+	lines, err := runCompProviderCmd(cwd, "git", "for-each-ref", "--format=%(refname)", "refs/heads", "refs/tags", "refs/remotes")
+	if err != nil {
+		return nil, err
+	}
+	var rtn []compValue
+	for _, refName := range lines {
+		if strings.HasPrefix(refName, "refs/heads/") {
+			rtn = append(rtn, compValue{Value: strings.TrimPrefix(refName, "refs/heads/"), Desc: "branch"})
+		} else if strings.HasPrefix(refName, "refs/tags/") {
+			rtn = append(rtn, compValue{Value: strings.TrimPrefix(refName, "refs/tags/"), Desc: "tag"})
+		} else if strings.HasPrefix(refName, "refs/remotes/") && !strings.HasSuffix(refName, "/HEAD") {
+			rtn = append(rtn, compValue{Value: strings.TrimPrefix(refName, "refs/remotes/"), Desc: "remote branch"})
+		}
+	}
+	return rtn, nil
+}
+
+func compSshHosts(homeDir string) []compValue {
+	var rtn []compValue
+	if fd, err := os.Open(filepath.Join(homeDir, ".ssh", "config")); err == nil {
+		rtn = append(rtn, parseSshConfigHosts(fd)...)
+		fd.Close()
+	}
+	if fd, err := os.Open(filepath.Join(homeDir, ".ssh", "known_hosts")); err == nil {
+		rtn = append(rtn, parseKnownHosts(fd)...)
+		fd.Close()
+	}
+	return rtn
+}
+
+// Host entries (without patterns), the desc is the HostName
+func parseSshConfigHosts(r io.Reader) []compValue {
+	var rtn []compValue
+	var curHosts []int // indexes into rtn for the current Host block
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		key := strings.ToLower(fields[0])
+		if key == "host" {
+			curHosts = nil
+			for _, host := range fields[1:] {
+				if strings.ContainsAny(host, "*?!") {
+					continue
+				}
+				curHosts = append(curHosts, len(rtn))
+				rtn = append(rtn, compValue{Value: host})
+			}
+		} else if key == "match" {
+			curHosts = nil
+		} else if key == "hostname" {
+			for _, idx := range curHosts {
+				rtn[idx].Desc = fields[1]
+			}
+		}
+	}
+	return rtn
+}
+
+// skips hashed entries, "[host]:port" entries are returned as host
+func parseKnownHosts(r io.Reader) []compValue {
+	var rtn []compValue
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], "|") {
+			continue
+		}
+		hostsField := fields[0]
+		if strings.HasPrefix(hostsField, "@") && len(fields) > 2 {
+			// @cert-authority or @revoked marker
+			hostsField = fields[1]
+		}
+		for _, host := range strings.Split(hostsField, ",") {
+			if strings.HasPrefix(host, "[") {
+				if endIdx := strings.Index(host, "]"); endIdx > 0 {
+					host = host[1:endIdx]
+				}
+			}
+			if host == "" || strings.ContainsAny(host, "*?!") {
+				continue
+			}
+			rtn = append(rtn, compValue{Value: host, Desc: "known_hosts"})
+		}
+	}
+	return rtn
+}
+
+func compMakeTargets(cwd string) ([]compValue, error) {
+	for _, name := range []string{"GNUmakefile", "makefile", "Makefile"} {
+		fd, err := os.Open(filepath.Join(cwd, name))
+		if err != nil {
+			continue
+		}
+		defer fd.Close()
+		return parseMakeTargets(fd), nil
+	}
+	return nil, nil
+}
+
+// explicit targets (no patterns or special .TARGETS), the desc is taken from a "## comment"
+// on the rule line or on the line above
+func parseMakeTargets(r io.Reader) []compValue {
+	var rtn []compValue
+	var lastComment string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "##") {
+			lastComment = strings.TrimSpace(strings.TrimLeft(line, "#"))
+			continue
+		}
+		match := makeTargetRe.FindStringSubmatch(line)
+		if match != nil && !strings.HasPrefix(match[1], ".") {
+			desc := lastComment
+			if commentIdx := strings.Index(line, "##"); commentIdx > 0 {
+				desc = strings.TrimSpace(line[commentIdx+2:])
+			}
+			rtn = append(rtn, compValue{Value: match[1], Desc: desc})
+		}
+		lastComment = ""
+	}
+	return rtn
+}
+
+func compDockerContainers() ([]compValue, error) {
+	lines, err := runCompProviderCmd("", "docker", "ps", "-a", "--format", "{{.Names}}\t{{.Image}} ({{.State}})")
+	if err != nil {
+		return nil, err
+	}
+	var rtn []compValue
+	for _, line := range lines {
+		name, desc, _ := strings.Cut(line, "\t")
+		rtn = append(rtn, compValue{Value: name, Desc: desc})
+	}
+	return rtn, nil
+}
+
+func compDockerImages() ([]compValue, error) {
+	lines, err := runCompProviderCmd("", "docker", "images", "--format", "{{.Repository}}:{{.Tag}}\t{{.Size}}")
+	if err != nil {
+		return nil, err
+	}
+	var rtn []compValue
+	for _, line := range lines {
+		name, desc, _ := strings.Cut(line, "\t")
+		if strings.Contains(name, "<none>") {
+			continue
+		}
+		rtn = append(rtn, compValue{Value: name, Desc: desc})
+	}
+	return rtn, nil
+}
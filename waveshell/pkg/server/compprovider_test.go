@@ -0,0 +1,84 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSshHosts(t *testing.T) {
+	config := `
+# comment
+Host dev dev2
+    HostName dev.example.com
+    User mike
+Host *.internal !bad
+    User admin
+Host bastion
+  hostname 10.0.0.1
+Match host foo
+  HostName ignored
+`
+	hosts := parseSshConfigHosts(strings.NewReader(config))
+	if len(hosts) != 3 {
+		t.Fatalf("bad hosts: %v", hosts)
+	}
+	if hosts[0].Value != "dev" || hosts[0].Desc != "dev.example.com" || hosts[1].Desc != "dev.example.com" {
+		t.Errorf("bad host entries: %v", hosts)
+	}
+	if hosts[2].Value != "bastion" || hosts[2].Desc != "10.0.0.1" {
+		t.Errorf("bad bastion entry: %v", hosts[2])
+	}
+	knownHosts := `github.com,140.82.112.3 ssh-ed25519 AAAA
+|1|hashed|entry ssh-rsa AAAA
+[git.example.com]:2222 ssh-rsa AAAA
+@cert-authority *.example.com ssh-rsa AAAA
+`
+	hosts = parseKnownHosts(strings.NewReader(knownHosts))
+	var names []string
+	for _, host := range hosts {
+		names = append(names, host.Value)
+	}
+	if strings.Join(names, " ") != "github.com 140.82.112.3 git.example.com" {
+		t.Errorf("bad known hosts: %v", names)
+	}
+}
+
+func TestParseMakeTargets(t *testing.T) {
+	makefile := `
+VERSION := 1.0
+.PHONY: build test
+
+## build the binary
+build: deps
+	go build ./...
+
+test: ## run the tests
+	go test ./...
+
+%.o: %.c
+	cc -c $<
+
+deps:
+	go mod download
+`
+	targets := parseMakeTargets(strings.NewReader(makefile))
+	if len(targets) != 3 {
+		t.Fatalf("bad targets: %v", targets)
+	}
+	if targets[0].Value != "build" || targets[0].Desc != "build the binary" {
+		t.Errorf("bad build target: %v", targets[0])
+	}
+	if targets[1].Value != "test" || targets[1].Desc != "run the tests" {
+		t.Errorf("bad test target: %v", targets[1])
+	}
+	if targets[2].Value != "deps" || targets[2].Desc != "" {
+		t.Errorf("bad deps target: %v", targets[2])
+	}
+	comps, descs, hasMore := filterCompValues(append(targets, compValue{Value: "build", Desc: "dup"}), "b")
+	if len(comps) != 1 || comps[0] != "build" || descs[0] != "build the binary" || hasMore {
+		t.Errorf("bad filter: %v %v %v", comps, descs, hasMore)
+	}
+}
@@ -5,8 +5,11 @@ package server
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
 	"os"
@@ -19,6 +22,7 @@ import (
 
 	"github.com/alessio/shellescape"
 	"github.com/wavetermdev/waveterm/waveshell/pkg/base"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/cmdtail"
 	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
 	"github.com/wavetermdev/waveterm/waveshell/pkg/shellapi"
 	"github.com/wavetermdev/waveterm/waveshell/pkg/shexec"
@@ -48,14 +52,43 @@ type MServer struct {
 	MainInput           *packet.PacketParser
 	Sender              *packet.PacketSender
 	ClientMap           map[base.CommandKey]*shexec.ClientProc
+	DetachedCmds        map[base.CommandKey]*packet.CmdStartPacketType // running detached commands (input is sent directly, not through ClientMap)
 	Debug               bool
 	StateMap            *ShellStateMap
 	WriteErrorCh        chan bool // closed if there is a I/O write error
 	WriteErrorChOnce    *sync.Once
 	WriteFileContextMap map[string]*WriteFileContext
+	Tailer              *cmdtail.Tailer               // created on first getcmd
+	ClientCapabilities  []string                      // from the client's init packet (empty for older clients)
+	FollowMap           map[string]context.CancelFunc // streamfile reqid -> cancel (for Follow requests)
+	StreamWindowMap     map[string]*streamWindow      // streamfile reqid -> flow control (for Window requests)
 	Done                bool
 }
 
+// file names for detached commands (used by the tailer)
+type cmdFileNameGen struct{}
+
+func (cmdFileNameGen) PtyOutFile(ck base.CommandKey) string {
+	fileNames, err := base.GetCommandFileNames(ck)
+	if err != nil {
+		return ""
+	}
+	return fileNames.PtyOutFile
+}
+
+func (cmdFileNameGen) RunOutFile(ck base.CommandKey) string {
+	fileNames, err := base.GetCommandFileNames(ck)
+	if err != nil {
+		return ""
+	}
+	return fileNames.RunnerOutFile
+}
+
+func (cmdFileNameGen) SessionDir(sessionId string) string {
+	sdir, _ := base.EnsureSessionDir(sessionId)
+	return sdir
+}
+
 type WriteFileContext struct {
 	CVar       *sync.Cond
 	Data       []*packet.FileDataPacketType
@@ -70,6 +103,48 @@ func (m *MServer) Close() {
 	m.Lock.Lock()
 	defer m.Lock.Unlock()
 	m.Done = true
+	if m.Tailer != nil {
+		m.Tailer.Close()
+	}
+}
+
+func (m *MServer) getTailer() (*cmdtail.Tailer, error) {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	if m.Tailer != nil {
+		return m.Tailer, nil
+	}
+	tailer, err := cmdtail.MakeTailer(m.Sender, cmdFileNameGen{})
+	if err != nil {
+		return nil, err
+	}
+	go tailer.Run()
+	m.Tailer = tailer
+	return tailer, nil
+}
+
+// streams the output files of a (detached) command as cmddata packets, used to reattach after a reconnect
+func (m *MServer) getCmd(getPk *packet.GetCmdPacketType) {
+	tailer, err := m.getTailer()
+	if err != nil {
+		m.Sender.SendErrorResponse(getPk.ReqId, fmt.Errorf("cannot create tailer: %w", err))
+		return
+	}
+	upToDate, err := tailer.AddWatch(getPk)
+	if err != nil {
+		m.Sender.SendErrorResponse(getPk.ReqId, err)
+		return
+	}
+	if upToDate {
+		m.Sender.SendResponse(getPk.ReqId, true)
+	}
+}
+
+func (m *MServer) setClientInit(initPk *packet.InitPacketType) {
+	m.Lock.Lock()
+	m.ClientCapabilities = initPk.Capabilities
+	m.Lock.Unlock()
+	m.Sender.SetPeerCapabilities(initPk.Capabilities)
 }
 
 func (m *MServer) checkDone() bool {
@@ -149,7 +224,15 @@ func (m *MServer) ProcessCommandPacket(pk packet.CommandPacketType) {
 	}
 	m.Lock.Lock()
 	cproc := m.ClientMap[ck]
+	detachedStartPk := m.DetachedCmds[ck]
 	m.Lock.Unlock()
+	if detachedStartPk != nil {
+		err := shexec.ProcessDetachedInputPacket(detachedStartPk, pk)
+		if err != nil {
+			m.Sender.SendCmdError(ck, err)
+		}
+		return
+	}
 	if cproc == nil {
 		m.Sender.SendCmdError(ck, fmt.Errorf("no client proc for ck '%s', pk=%s", ck, packet.AsString(pk)))
 		return
@@ -231,6 +314,15 @@ func (m *MServer) runMixedCompGen(compPk *packet.CompGenPacketType) {
 
 func (m *MServer) runCompGen(compPk *packet.CompGenPacketType) {
 	reqId := compPk.GetReqId()
+	if packet.IsProviderCompGenType(compPk.CompType) {
+		comps, descs, hasMore, err := runProviderCompGen(compPk.Cwd, compPk.CompType, compPk.Prefix)
+		if err != nil {
+			m.Sender.SendErrorResponse(reqId, err)
+			return
+		}
+		m.Sender.SendResponse(reqId, map[string]interface{}{"comps": comps, "descs": descs, "hasmore": hasMore})
+		return
+	}
 	if compPk.CompType == "file" || compPk.CompType == "command" {
 		m.runMixedCompGen(compPk)
 		return
@@ -331,6 +423,24 @@ func copyFile(dstName string, srcName string) error {
 	return dstFd.Close()
 }
 
+// applies the optional Perm and ModTs from a writefile packet
+func setFileAttrs(pk *packet.WriteFilePacketType) error {
+	if pk.Perm != nil {
+		err := os.Chmod(pk.Path, fs.FileMode(*pk.Perm).Perm())
+		if err != nil {
+			return fmt.Errorf("cannot set file permissions: %v", err)
+		}
+	}
+	if pk.ModTs != 0 {
+		modTime := time.UnixMilli(pk.ModTs)
+		err := os.Chtimes(pk.Path, modTime, modTime)
+		if err != nil {
+			return fmt.Errorf("cannot set file modification time: %v", err)
+		}
+	}
+	return nil
+}
+
 func (m *MServer) writeFile(pk *packet.WriteFilePacketType, wfc *WriteFileContext) {
 	defer wfc.setDone()
 	if pk.Path == "" {
@@ -339,6 +449,15 @@ func (m *MServer) writeFile(pk *packet.WriteFilePacketType, wfc *WriteFileContex
 		m.Sender.SendPacket(resp)
 		return
 	}
+	if pk.MkDirs {
+		err := os.MkdirAll(filepath.Dir(pk.Path), 0o777) // respects umask
+		if err != nil {
+			resp := packet.MakeWriteFileReadyPacket(pk.ReqId)
+			resp.Error = fmt.Sprintf("cannot create parent directories: %v", err)
+			m.Sender.SendPacket(resp)
+			return
+		}
+	}
 	err := checkFileWritable(pk.Path)
 	if err != nil {
 		resp := packet.MakeWriteFileReadyPacket(pk.ReqId)
@@ -374,6 +493,8 @@ func (m *MServer) writeFile(pk *packet.WriteFilePacketType, wfc *WriteFileContex
 	wfc.CVar.L.Lock()
 	defer wfc.CVar.L.Unlock()
 	var doneErr error
+	var bytesWritten int64
+	hasher := sha256.New()
 	for {
 		if wfc.Done {
 			break
@@ -398,6 +519,11 @@ func (m *MServer) writeFile(pk *packet.WriteFilePacketType, wfc *WriteFileContex
 				doneErr = fmt.Errorf("error writing data to file: %v", err)
 				break
 			}
+			hasher.Write(dataPk.Data)
+			bytesWritten += int64(len(dataPk.Data))
+			if pk.Window > 0 {
+				m.Sender.SendPacket(packet.MakeFileDataAckPacket(pk.ReqId, bytesWritten))
+			}
 		}
 		if dataPk.Eof {
 			break
@@ -413,19 +539,47 @@ func (m *MServer) writeFile(pk *packet.WriteFilePacketType, wfc *WriteFileContex
 		} else {
 			// copy file between writeFd.Name() and pk.Path
 			copyErr := copyFile(pk.Path, writeFd.Name())
-			if err != nil {
+			if copyErr != nil {
 				doneErr = fmt.Errorf("error writing file: %v", copyErr)
 			}
 			os.Remove(writeFd.Name())
 		}
 	}
+	var fileHash string
+	if doneErr == nil && pk.Sha256 {
+		// hash what actually ended up on disk (not just what was received).  before setFileAttrs, the new perms might not allow reading
+		fileHash, doneErr = hashFile(pk.Path)
+	} else if doneErr == nil {
+		fileHash = hex.EncodeToString(hasher.Sum(nil))
+	}
+	if doneErr == nil {
+		doneErr = setFileAttrs(pk)
+	}
 	donePk := packet.MakeWriteFileDonePacket(pk.ReqId)
 	if doneErr != nil {
 		donePk.Error = doneErr.Error()
+	} else {
+		donePk.Size = bytesWritten
+		donePk.Sha256 = fileHash
 	}
 	m.Sender.SendPacket(donePk)
 }
 
+// returns the hex sha256 of the file's contents
+func hashFile(fileName string) (string, error) {
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return "", fmt.Errorf("cannot re-read file: %v", err)
+	}
+	defer fd.Close()
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, fd)
+	if err != nil {
+		return "", fmt.Errorf("cannot re-read file: %v", err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
 func (m *MServer) returnStreamFileNewFileResponse(pk *packet.StreamFilePacketType) {
 	// ok, file doesn't exist, so try to check the directory at least to see if we can write a file here
 	resp := packet.MakeStreamFileResponse(pk.ReqId)
@@ -481,6 +635,15 @@ func (m *MServer) streamFile(pk *packet.StreamFilePacketType) {
 		m.Sender.SendPacket(resp)
 		return
 	}
+	if finfo.IsDir() && pk.ListDir {
+		m.listDir(pk, resp)
+		return
+	}
+	if pk.Follow && (finfo.IsDir() || len(pk.ByteRange) > 1) {
+		resp.Error = "follow requires a file and an open-ended byte range"
+		m.Sender.SendPacket(resp)
+		return
+	}
 	// like the http Range header.  range header is end inclusive.  for us, endByte is non-inclusive (so we add 1)
 	var startByte, endByte int64
 	if len(pk.ByteRange) == 0 {
@@ -505,7 +668,7 @@ func (m *MServer) streamFile(pk *packet.StreamFilePacketType) {
 	if endByte > finfo.Size() {
 		endByte = finfo.Size()
 	}
-	if startByte >= endByte {
+	if startByte >= endByte && !pk.Follow {
 		resp.Done = true
 		m.Sender.SendPacket(resp)
 		return
@@ -516,13 +679,42 @@ func (m *MServer) streamFile(pk *packet.StreamFilePacketType) {
 		m.Sender.SendPacket(resp)
 		return
 	}
+	if pk.Follow {
+		// registered before the response so an unfollowfile sent right after it is not missed
+		ctx := m.registerFollow(pk.ReqId)
+		m.Sender.SendPacket(resp)
+		m.followFile(ctx, pk, fd, startByte)
+		return
+	}
 	defer fd.Close()
+	var sw *streamWindow
+	if pk.Window > 0 {
+		// registered before the response so no acks are missed
+		sw = m.registerStreamWindow(pk.ReqId)
+		defer m.unregisterStreamWindow(pk.ReqId)
+	}
 	m.Sender.SendPacket(resp)
 	var buffer [MaxFileDataPacketSize]byte
 	var sentDone bool
+	var sentPos int64
+	var hasher hash.Hash
+	if pk.Sha256 {
+		hasher = sha256.New()
+	}
 	first := true
 	for ; startByte < endByte; startByte += MaxFileDataPacketSize {
-		if !first {
+		if sw != nil {
+			err = sw.waitForWindow(sentPos, int64Min(pk.Window, MaxFileDataWindow))
+			if err == errStreamCanceled {
+				return
+			}
+			if err != nil {
+				dataPk := packet.MakeFileDataPacket(pk.ReqId)
+				dataPk.Error = err.Error()
+				m.Sender.SendPacket(dataPk)
+				return
+			}
+		} else if !first {
 			// throttle packet sending @ 1000 packets/s, or 16M/s
 			time.Sleep(1 * time.Millisecond)
 		}
@@ -533,12 +725,19 @@ func (m *MServer) streamFile(pk *packet.StreamFilePacketType) {
 		dataPk := packet.MakeFileDataPacket(pk.ReqId)
 		dataPk.Data = make([]byte, nr)
 		copy(dataPk.Data, bufSlice)
+		if hasher != nil {
+			hasher.Write(dataPk.Data)
+		}
 		if err == io.EOF {
 			dataPk.Eof = true
+			if hasher != nil {
+				dataPk.Sha256 = hex.EncodeToString(hasher.Sum(nil))
+			}
 		} else if err != nil {
 			dataPk.Error = err.Error()
 		}
 		m.Sender.SendPacket(dataPk)
+		sentPos += int64(nr)
 		if dataPk.GetResponseDone() {
 			sentDone = true
 			break
@@ -547,6 +746,9 @@ func (m *MServer) streamFile(pk *packet.StreamFilePacketType) {
 	if !sentDone {
 		dataPk := packet.MakeFileDataPacket(pk.ReqId)
 		dataPk.Eof = true
+		if hasher != nil {
+			dataPk.Sha256 = hex.EncodeToString(hasher.Sum(nil))
+		}
 		m.Sender.SendPacket(dataPk)
 	}
 	return
@@ -587,6 +789,30 @@ func (m *MServer) ProcessRpcPacket(pk packet.RpcPacketType) {
 		go m.writeFile(writePk, wfc)
 		return
 	}
+	if getPk, ok := pk.(*packet.GetCmdPacketType); ok {
+		go m.getCmd(getPk)
+		return
+	}
+	if ackPk, ok := pk.(*packet.FileDataAckPacketType); ok {
+		// no response (flow control for streamfile)
+		m.ackStreamFile(ackPk)
+		return
+	}
+	if unfollowPk, ok := pk.(*packet.UnfollowFilePacketType); ok {
+		// no response, the follow ends with an Eof filedata packet
+		m.unfollowFile(unfollowPk.ReqId)
+		return
+	}
+	if untailPk, ok := pk.(*packet.UntailCmdPacketType); ok {
+		tailer, err := m.getTailer()
+		if err != nil {
+			m.Sender.SendErrorResponse(reqId, err)
+			return
+		}
+		tailer.RemoveWatch(untailPk)
+		m.Sender.SendResponse(reqId, true)
+		return
+	}
 	m.Sender.SendErrorResponse(reqId, fmt.Errorf("invalid rpc type '%s'", pk.GetType()))
 	return
 }
@@ -663,24 +889,46 @@ func (m *MServer) runCommand(runPacket *packet.RunPacketType) {
 	go func() {
 		defer func() {
 			r := recover()
-			finalPk := packet.MakeCmdFinalPacket(runPacket.CK)
-			finalPk.Ts = time.Now().UnixMilli()
-			if r != nil {
-				finalPk.Error = fmt.Sprintf("%s", r)
+			// detached commands report cmddone through their runout file, a cmdfinal would hang them up
+			if !runPacket.Detached || r != nil {
+				finalPk := packet.MakeCmdFinalPacket(runPacket.CK)
+				finalPk.Ts = time.Now().UnixMilli()
+				if r != nil {
+					finalPk.Error = fmt.Sprintf("%s", r)
+				}
+				m.Sender.SendPacket(finalPk)
 			}
-			m.Sender.SendPacket(finalPk)
 			m.Lock.Lock()
 			delete(m.ClientMap, runPacket.CK)
+			delete(m.DetachedCmds, runPacket.CK)
 			m.Lock.Unlock()
 			cproc.Close()
 		}()
 		shexec.SendRunPacketAndRunData(context.Background(), cproc.Input, runPacket)
+		if runPacket.Detached {
+			m.proxyDetachedOutput(runPacket.CK, cproc)
+			return
+		}
 		cproc.ProxySingleOutput(runPacket.CK, m.Sender, func(pk packet.PacketType) {
 			m.clientPacketCallback(runPacket.ShellType, pk)
 		})
 	}()
 }
 
+// the detached single process only sends its cmdstart (or an error response), then writes
+// the command's output to its ptyout/runout files (tailed with getcmd).  we wait for it to exit.
+func (m *MServer) proxyDetachedOutput(ck base.CommandKey, cproc *shexec.ClientProc) {
+	for pk := range cproc.Output.MainCh {
+		if startPk, ok := pk.(*packet.CmdStartPacketType); ok {
+			m.Lock.Lock()
+			m.DetachedCmds[ck] = startPk
+			m.Lock.Unlock()
+		}
+		m.Sender.SendPacket(pk)
+	}
+	cproc.Cmd.Wait()
+}
+
 func (m *MServer) packetSenderErrorHandler(sender *packet.PacketSender, pk packet.PacketType, err error) {
 	if serr, ok := err.(*packet.SendError); ok && serr.IsMarshalError {
 		msg := packet.MakeMessagePacket(err.Error())
@@ -723,6 +971,10 @@ func (server *MServer) runReadLoop() {
 			server.addFileDataPacket(fileDataPk)
 			continue
 		}
+		if initPk, ok := pk.(*packet.InitPacketType); ok {
+			server.setClientInit(initPk)
+			continue
+		}
 		server.Sender.SendMessageFmt("invalid packet '%s' sent to mshell server", packet.AsString(pk))
 		continue
 	}
@@ -736,11 +988,14 @@ func RunServer() (int, error) {
 	server := &MServer{
 		Lock:                &sync.Mutex{},
 		ClientMap:           make(map[base.CommandKey]*shexec.ClientProc),
+		DetachedCmds:        make(map[base.CommandKey]*packet.CmdStartPacketType),
 		StateMap:            MakeShellStateMap(),
 		Debug:               debug,
 		WriteErrorCh:        make(chan bool),
 		WriteErrorChOnce:    &sync.Once{},
 		WriteFileContextMap: make(map[string]*WriteFileContext),
+		FollowMap:           make(map[string]context.CancelFunc),
+		StreamWindowMap:     make(map[string]*streamWindow),
 	}
 	if debug {
 		packet.GlobalDebug = true
@@ -0,0 +1,300 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
+)
+
+const MaxDirEntries = 1000
+const FollowPollTime = 250 * time.Millisecond
+const StreamAckTimeout = 30 * time.Second
+
+// max flow control window for streamfile/writefile (stays below MaxWriteFileContextData packets)
+const MaxFileDataWindow = 1024 * 1024
+
+// returns the (sorted) entries of dirName in [offset, offset+limit) and the total number of entries
+func readDirEntries(dirName string, offset int, limit int) ([]*packet.FileInfo, int, error) {
+	dirEntries, err := os.ReadDir(dirName)
+	if err != nil {
+		return nil, 0, err
+	}
+	total := len(dirEntries)
+	if limit <= 0 || limit > MaxDirEntries {
+		limit = MaxDirEntries
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= total {
+		return nil, total, nil
+	}
+	endIdx := offset + limit
+	if endIdx > total {
+		endIdx = total
+	}
+	rtn := make([]*packet.FileInfo, 0, endIdx-offset)
+	for _, dirEntry := range dirEntries[offset:endIdx] {
+		rtn = append(rtn, makeDirEntryInfo(dirName, dirEntry))
+	}
+	return rtn, total, nil
+}
+
+func makeDirEntryInfo(dirName string, dirEntry fs.DirEntry) *packet.FileInfo {
+	rtn := &packet.FileInfo{Name: dirEntry.Name()}
+	info, err := dirEntry.Info() // lstat
+	if err != nil {
+		// removed since the ReadDir
+		rtn.NotFound = true
+		return rtn
+	}
+	rtn.Size = info.Size()
+	rtn.ModTs = info.ModTime().UnixMilli()
+	rtn.IsDir = info.IsDir()
+	rtn.Perm = int(info.Mode().Perm())
+	rtn.Mode = uint32(info.Mode())
+	if info.Mode()&fs.ModeSymlink != 0 {
+		fullPath := filepath.Join(dirName, dirEntry.Name())
+		rtn.IsSymlink = true
+		rtn.SymlinkTarget, _ = os.Readlink(fullPath)
+		// so symlinked directories can be browsed
+		if targetInfo, err := os.Stat(fullPath); err == nil && targetInfo.IsDir() {
+			rtn.IsDir = true
+		}
+	}
+	return rtn
+}
+
+func (m *MServer) listDir(pk *packet.StreamFilePacketType, resp *packet.StreamFileResponseType) {
+	entries, total, err := readDirEntries(pk.Path, pk.DirOffset, pk.DirLimit)
+	if err != nil {
+		resp.Error = fmt.Sprintf("cannot read directory %q: %v", pk.Path, err)
+		m.Sender.SendPacket(resp)
+		return
+	}
+	resp.Entries = entries
+	resp.TotalEntries = total
+	resp.HasMore = pk.DirOffset+len(entries) < total
+	resp.Done = true
+	m.Sender.SendPacket(resp)
+}
+
+// follows a file (like tail -f --follow=name).  Pos is the next byte to send from Fd.
+// when the file shrinks the next data packet is marked Truncated (and starts at 0), when
+// Path is replaced by a new file (log rotation) the old file is drained and the next data
+// packet is marked Rotated.
+type fileFollower struct {
+	ReqId     string
+	Path      string
+	Fd        *os.File
+	Pos       int64
+	Send      func(pk *packet.FileDataPacketType)
+	truncated bool
+	rotated   bool
+}
+
+func (ff *fileFollower) Close() {
+	if ff.Fd != nil {
+		ff.Fd.Close()
+		ff.Fd = nil
+	}
+}
+
+// sends everything appended since the last poll, then checks for rotation
+func (ff *fileFollower) poll() error {
+	finfo, err := ff.Fd.Stat()
+	if err != nil {
+		return err
+	}
+	if finfo.Size() < ff.Pos {
+		ff.Pos = 0
+		ff.truncated = true
+	}
+	err = ff.sendData(finfo.Size())
+	if err != nil {
+		return err
+	}
+	pathInfo, err := os.Stat(ff.Path)
+	if err != nil || os.SameFile(finfo, pathInfo) {
+		// removed (not yet re-created) files are not errors, keep waiting
+		return nil
+	}
+	newFd, err := os.Open(ff.Path)
+	if err != nil {
+		return nil
+	}
+	ff.Fd.Close()
+	ff.Fd = newFd
+	ff.Pos = 0
+	ff.rotated = true
+	return ff.sendData(pathInfo.Size())
+}
+
+func (ff *fileFollower) sendData(endPos int64) error {
+	first := true
+	for ff.Pos < endPos || ff.truncated || ff.rotated {
+		if !first {
+			time.Sleep(1 * time.Millisecond)
+		}
+		first = false
+		buf := make([]byte, int64Min(MaxFileDataPacketSize, endPos-ff.Pos))
+		nr, err := ff.Fd.ReadAt(buf, ff.Pos)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		dataPk := packet.MakeFileDataPacket(ff.ReqId)
+		dataPk.Data = buf[0:nr]
+		dataPk.Truncated = ff.truncated
+		dataPk.Rotated = ff.rotated
+		ff.truncated = false
+		ff.rotated = false
+		ff.Pos += int64(nr)
+		ff.Send(dataPk)
+		if nr == 0 {
+			// file shrank since the stat, picked up on the next poll
+			break
+		}
+	}
+	return nil
+}
+
+func (m *MServer) registerFollow(reqId string) context.Context {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	m.FollowMap[reqId] = cancelFn
+	return ctx
+}
+
+func (m *MServer) unregisterFollow(reqId string) {
+	m.Lock.Lock()
+	cancelFn := m.FollowMap[reqId]
+	delete(m.FollowMap, reqId)
+	m.Lock.Unlock()
+	if cancelFn != nil {
+		cancelFn()
+	}
+}
+
+func (m *MServer) unfollowFile(reqId string) {
+	m.Lock.Lock()
+	cancelFn := m.FollowMap[reqId]
+	m.Lock.Unlock()
+	if cancelFn != nil {
+		cancelFn()
+	}
+}
+
+// takes ownership of fd.  streams from startPos until an unfollowfile packet is received (ends with Eof).
+// ctx comes from registerFollow (called by the caller before it sends the streamfile response)
+func (m *MServer) followFile(ctx context.Context, pk *packet.StreamFilePacketType, fd *os.File, startPos int64) {
+	defer m.unregisterFollow(pk.ReqId)
+	ff := &fileFollower{
+		ReqId: pk.ReqId,
+		Path:  pk.Path,
+		Fd:    fd,
+		Pos:   startPos,
+		Send:  func(dataPk *packet.FileDataPacketType) { m.Sender.SendPacket(dataPk) },
+	}
+	defer ff.Close()
+	ticker := time.NewTicker(FollowPollTime)
+	defer ticker.Stop()
+	for {
+		err := ff.poll()
+		if err != nil {
+			dataPk := packet.MakeFileDataPacket(pk.ReqId)
+			dataPk.Error = err.Error()
+			m.Sender.SendPacket(dataPk)
+			return
+		}
+		if m.checkDone() {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			dataPk := packet.MakeFileDataPacket(pk.ReqId)
+			dataPk.Eof = true
+			m.Sender.SendPacket(dataPk)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// flow control for a streamfile request with a Window
+type streamWindow struct {
+	Lock     *sync.Mutex
+	AckPos   int64
+	Canceled bool
+	AckCh    chan bool // non-blocking send on every ack
+}
+
+var errStreamCanceled = errors.New("stream canceled")
+
+func (m *MServer) registerStreamWindow(reqId string) *streamWindow {
+	sw := &streamWindow{Lock: &sync.Mutex{}, AckCh: make(chan bool, 1)}
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	m.StreamWindowMap[reqId] = sw
+	return sw
+}
+
+func (m *MServer) unregisterStreamWindow(reqId string) {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+	delete(m.StreamWindowMap, reqId)
+}
+
+func (m *MServer) ackStreamFile(ackPk *packet.FileDataAckPacketType) {
+	m.Lock.Lock()
+	sw := m.StreamWindowMap[ackPk.ReqId]
+	m.Lock.Unlock()
+	if sw == nil {
+		return
+	}
+	sw.Lock.Lock()
+	if ackPk.Pos > sw.AckPos {
+		sw.AckPos = ackPk.Pos
+	}
+	if ackPk.Cancel {
+		sw.Canceled = true
+	}
+	sw.Lock.Unlock()
+	select {
+	case sw.AckCh <- true:
+	default:
+	}
+}
+
+// blocks until less than window bytes (of sentPos) are unacked
+func (sw *streamWindow) waitForWindow(sentPos int64, window int64) error {
+	timer := time.NewTimer(StreamAckTimeout)
+	defer timer.Stop()
+	for {
+		sw.Lock.Lock()
+		ackPos, canceled := sw.AckPos, sw.Canceled
+		sw.Lock.Unlock()
+		if canceled {
+			return errStreamCanceled
+		}
+		if sentPos-ackPos < window {
+			return nil
+		}
+		select {
+		case <-sw.AckCh:
+		case <-timer.C:
+			return fmt.Errorf("flow control timeout, no ack received for %v", StreamAckTimeout)
+		}
+	}
+}
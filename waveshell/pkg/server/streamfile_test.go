@@ -0,0 +1,224 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
+)
+
+func TestReadDirEntries(t *testing.T) {
+	dirName := t.TempDir()
+	for i := 0; i < 5; i++ {
+		os.WriteFile(filepath.Join(dirName, fmt.Sprintf("f%d", i)), []byte("hello"), 0644)
+	}
+	os.Mkdir(filepath.Join(dirName, "subdir"), 0755)
+	os.Symlink("subdir", filepath.Join(dirName, "zlink"))
+	entries, total, err := readDirEntries(dirName, 0, 0)
+	if err != nil {
+		t.Fatalf("error reading dir: %v", err)
+	}
+	if total != 7 || len(entries) != 7 {
+		t.Fatalf("wrong number of entries: total=%d len=%d", total, len(entries))
+	}
+	if entries[0].Name != "f0" || entries[0].Size != 5 || entries[0].IsDir || entries[0].Perm != 0644 {
+		t.Errorf("bad file entry: %#v", entries[0])
+	}
+	if !entries[5].IsDir || entries[5].IsSymlink {
+		t.Errorf("bad dir entry: %#v", entries[5])
+	}
+	if !entries[6].IsSymlink || entries[6].SymlinkTarget != "subdir" || !entries[6].IsDir {
+		t.Errorf("bad symlink entry: %#v", entries[6])
+	}
+	entries, total, _ = readDirEntries(dirName, 4, 2)
+	if total != 7 || len(entries) != 2 || entries[0].Name != "f4" || entries[1].Name != "subdir" {
+		t.Errorf("bad page: total=%d entries=%v", total, entries)
+	}
+	entries, _, _ = readDirEntries(dirName, 10, 2)
+	if len(entries) != 0 {
+		t.Errorf("expected no entries past the end, got %d", len(entries))
+	}
+}
+
+func TestFileFollower(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.log")
+	appendFile := func(str string) {
+		fd, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatalf("cannot open file: %v", err)
+		}
+		fd.WriteString(str)
+		fd.Close()
+	}
+	appendFile("line1\n")
+	fd, err := os.Open(fileName)
+	if err != nil {
+		t.Fatalf("cannot open file: %v", err)
+	}
+	var pks []*packet.FileDataPacketType
+	ff := &fileFollower{Path: fileName, Fd: fd, Send: func(pk *packet.FileDataPacketType) { pks = append(pks, pk) }}
+	defer ff.Close()
+	pollData := func(expected string, truncated bool, rotated bool) {
+		t.Helper()
+		pks = nil
+		err := ff.poll()
+		if err != nil {
+			t.Fatalf("poll error: %v", err)
+		}
+		var data string
+		for _, pk := range pks {
+			data += string(pk.Data)
+		}
+		if data != expected {
+			t.Fatalf("poll data mismatch, got %q, expected %q", data, expected)
+		}
+		if expected != "" && (pks[0].Truncated != truncated || pks[0].Rotated != rotated) {
+			t.Fatalf("bad flags truncated=%v rotated=%v", pks[0].Truncated, pks[0].Rotated)
+		}
+	}
+	pollData("line1\n", false, false)
+	pollData("", false, false)
+	appendFile("line2\nline3\n")
+	pollData("line2\nline3\n", false, false)
+	os.Truncate(fileName, 0)
+	appendFile("new\n")
+	pollData("new\n", true, false)
+	appendFile("old\n")
+	os.Rename(fileName, fileName+".1")
+	pollData("old\n", false, false)
+	appendFile("rotated\n")
+	pks = nil
+	ff.poll()
+	if len(pks) != 1 || !pks[0].Rotated || string(pks[0].Data) != "rotated\n" {
+		t.Fatalf("bad rotation packets: %v", pks)
+	}
+}
+
+func TestStreamWindow(t *testing.T) {
+	m := &MServer{Lock: &sync.Mutex{}, StreamWindowMap: make(map[string]*streamWindow)}
+	sw := m.registerStreamWindow("req-1")
+	if err := sw.waitForWindow(100, 1000); err != nil {
+		t.Fatalf("should not block inside the window: %v", err)
+	}
+	doneCh := make(chan error)
+	go func() {
+		doneCh <- sw.waitForWindow(1500, 1000)
+	}()
+	m.ackStreamFile(packet.MakeFileDataAckPacket("req-1", 200))
+	select {
+	case err := <-doneCh:
+		t.Fatalf("should still be blocked (1300 bytes unacked), got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	m.ackStreamFile(packet.MakeFileDataAckPacket("req-1", 600))
+	if err := <-doneCh; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cancelPk := packet.MakeFileDataAckPacket("req-1", 600)
+	cancelPk.Cancel = true
+	m.ackStreamFile(cancelPk)
+	if err := sw.waitForWindow(1600, 1000); err != errStreamCanceled {
+		t.Fatalf("expected cancel error, got %v", err)
+	}
+	m.unregisterStreamWindow("req-1")
+	if len(m.StreamWindowMap) != 0 {
+		t.Errorf("stream window not unregistered")
+	}
+}
+
+func makeTestServer() (*MServer, chan packet.PacketType) {
+	packetCh := make(chan packet.PacketType, 100)
+	m := &MServer{
+		Lock:                &sync.Mutex{},
+		Sender:              packet.MakeChannelPacketSender(packetCh),
+		StreamWindowMap:     make(map[string]*streamWindow),
+		WriteFileContextMap: make(map[string]*WriteFileContext),
+	}
+	return m, packetCh
+}
+
+func TestStreamFileSha256(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "data")
+	data := make([]byte, 3*MaxFileDataPacketSize+100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	os.WriteFile(fileName, data, 0644)
+	m, packetCh := makeTestServer()
+	streamPk := packet.MakeStreamFilePacket()
+	streamPk.ReqId = "req-1"
+	streamPk.Path = fileName
+	streamPk.Sha256 = true
+	go m.streamFile(streamPk)
+	if resp, ok := (<-packetCh).(*packet.StreamFileResponseType); !ok || resp.Error != "" {
+		t.Fatalf("bad streamfile response: %v", resp)
+	}
+	var numBytes int
+	for {
+		dataPk, ok := (<-packetCh).(*packet.FileDataPacketType)
+		if !ok || dataPk.Error != "" {
+			t.Fatalf("bad data packet: %v", dataPk)
+		}
+		numBytes += len(dataPk.Data)
+		if !dataPk.Eof {
+			if dataPk.Sha256 != "" {
+				t.Errorf("sha256 should only be set on the eof packet")
+			}
+			continue
+		}
+		expectedHash := sha256.Sum256(data)
+		if dataPk.Sha256 != hex.EncodeToString(expectedHash[:]) {
+			t.Errorf("bad sha256 %q", dataPk.Sha256)
+		}
+		break
+	}
+	if numBytes != len(data) {
+		t.Errorf("read %d bytes, expected %d", numBytes, len(data))
+	}
+}
+
+func TestWriteFileSha256(t *testing.T) {
+	dirName := t.TempDir()
+	for _, perm := range []int{0, 0640} {
+		fileName := filepath.Join(dirName, fmt.Sprintf("out-%o", perm))
+		m, packetCh := makeTestServer()
+		writePk := packet.MakeWriteFilePacket()
+		writePk.ReqId = fmt.Sprintf("req-%o", perm)
+		writePk.Path = fileName
+		writePk.Perm = &perm
+		writePk.Sha256 = true
+		wfc := m.getWriteFileContext(writePk.ReqId)
+		go m.writeFile(writePk, wfc)
+		if readyPk, ok := (<-packetCh).(*packet.WriteFileReadyPacketType); !ok || readyPk.Error != "" {
+			t.Fatalf("bad ready packet: %v", readyPk)
+		}
+		dataPk := packet.MakeFileDataPacket(writePk.ReqId)
+		dataPk.Data = []byte("hello world\n")
+		dataPk.Eof = true
+		m.addFileDataPacket(dataPk)
+		donePk, ok := (<-packetCh).(*packet.WriteFileDonePacketType)
+		if !ok || donePk.Error != "" {
+			t.Fatalf("bad done packet: %v", donePk)
+		}
+		expectedHash := sha256.Sum256([]byte("hello world\n"))
+		if donePk.Sha256 != hex.EncodeToString(expectedHash[:]) || donePk.Size != 12 {
+			t.Errorf("bad done packet sha256=%q size=%d", donePk.Sha256, donePk.Size)
+		}
+		finfo, err := os.Stat(fileName)
+		if err != nil {
+			t.Fatalf("cannot stat file: %v", err)
+		}
+		if int(finfo.Mode().Perm()) != perm {
+			t.Errorf("bad file mode %v, expected %o", finfo.Mode().Perm(), perm)
+		}
+	}
+}
@@ -0,0 +1,561 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package shellapi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/alessio/shellescape"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/base"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/shellenv"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/simpleexpand"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/statediff"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/utilfn"
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/scbase"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+const BaseFishOpts = ``
+
+const FishShellVersionCmdStr = `echo fish v$version`
+const RemoteFishPath = "fish"
+
+const RunFishSudoCommandFmt = `sudo -n -C %d fish /dev/fd/%d`
+const RunFishSudoPasswordCommandFmt = `cat /dev/fd/%d | sudo -k -S -C %d fish -c "echo '[from-mshell]'; exec %d>&-; fish /dev/fd/%d < /dev/fd/%d"`
+
+// fish abbreviations are stored in ShellState.Aliases (there are no aliases in fish, "alias" just creates a function)
+const FishAbbrParamType = "abbr"
+const FishFunctionParamType = "functions"
+const FishExitTrapFnName = "_waveshell_exittrap"
+
+// read-only, per-process, or too large to carry around in the state
+var FishIgnoreVars = map[string]bool{
+	"_":                 true,
+	"argv":              true,
+	"CMD_DURATION":      true,
+	"COLUMNS":           true,
+	"EUID":              true,
+	"FISH_VERSION":      true,
+	"fish_kill_signal":  true,
+	"fish_killring":     true,
+	"fish_pid":          true,
+	"fish_private_mode": true,
+	"history":           true,
+	"hostname":          true,
+	"last_pid":          true,
+	"LINES":             true,
+	"pipestatus":        true,
+	"PWD":               true,
+	"SHLVL":             true,
+	"status":            true,
+	"status_generation": true,
+	"umask":             true,
+	"version":           true,
+}
+
+// fish internals and our own temporaries
+var FishIgnoreVarPrefixes = []string{"__fish_", "__waveshell_"}
+
+// do not use these directly, call GetLocalMajorVersion()
+var localFishMajorVersionOnce = &sync.Once{}
+var localFishMajorVersion = ""
+
+type fishShellApi struct{}
+
+func (f fishShellApi) GetShellType() string {
+	return packet.ShellType_fish
+}
+
+func (f fishShellApi) MakeExitTrap(fdNum int) string {
+	return MakeFishExitTrap(fdNum)
+}
+
+func (f fishShellApi) GetLocalMajorVersion() string {
+	return GetLocalFishMajorVersion()
+}
+
+func (f fishShellApi) GetLocalShellPath() string {
+	return GetLocalFishPath()
+}
+
+func (f fishShellApi) GetRemoteShellPath() string {
+	return RemoteFishPath
+}
+
+func (f fishShellApi) MakeRunCommand(cmdStr string, opts RunCommandOpts) string {
+	if !opts.Sudo {
+		return cmdStr
+	}
+	if opts.SudoWithPass {
+		return fmt.Sprintf(RunFishSudoPasswordCommandFmt, opts.PwFdNum, opts.MaxFdNum+1, opts.PwFdNum, opts.CommandFdNum, opts.CommandStdinFdNum)
+	} else {
+		return fmt.Sprintf(RunFishSudoCommandFmt, opts.MaxFdNum+1, opts.CommandFdNum)
+	}
+}
+
+// fish has no --rcfile, the init command runs after the user's config files
+func (f fishShellApi) MakeShExecCommand(cmdStr string, rcFileName string, usePty bool) *exec.Cmd {
+	initCmd := "source " + fishQuote(rcFileName)
+	if usePty {
+		return exec.Command(GetLocalFishPath(), "-C", initCmd, "-i", "-c", cmdStr)
+	} else {
+		return exec.Command(GetLocalFishPath(), "-C", initCmd, "-c", cmdStr)
+	}
+}
+
+func (f fishShellApi) GetShellState() (*packet.ShellState, error) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), GetStateTimeout)
+	defer cancelFn()
+	cmdStr := GetFishShellStateCmd(StateOutputFdNum)
+	ecmd := exec.CommandContext(ctx, GetLocalFishPath(), "-l", "-i", "-c", cmdStr)
+	_, outputBytes, err := RunCommandWithExtraFd(ecmd, StateOutputFdNum)
+	if err != nil {
+		return nil, err
+	}
+	return f.ParseShellStateOutput(outputBytes)
+}
+
+func (f fishShellApi) GetBaseShellOpts() string {
+	return BaseFishOpts
+}
+
+func (f fishShellApi) ParseShellStateOutput(output []byte) (*packet.ShellState, error) {
+	return parseFishShellStateOutput(output)
+}
+
+func (f fishShellApi) MakeRcFileStr(pk *packet.RunPacketType) string {
+	var rcBuf bytes.Buffer
+	rcBuf.WriteString(f.GetBaseShellOpts() + "\n")
+	varDecls := shellenv.VarDeclsFromState(pk.State)
+	for _, varDecl := range varDecls {
+		if isFishIgnoreVar(varDecl.Name) || varDecl.IsReadOnly() || !isFishSafeVarName(varDecl.Name) {
+			continue
+		}
+		// exported scalars come in through the environment (fish splits *PATH variables on import).
+		// exported lists are flattened when parsed, so only non-exported lists need the array form.
+		if varDecl.IsExport() {
+			continue
+		}
+		rcBuf.WriteString(makeFishSetStmt(varDecl))
+		rcBuf.WriteString("\n")
+	}
+	if pk.State == nil {
+		return rcBuf.String()
+	}
+
+	// abbreviations (values are the "abbr --add ..." lines from "abbr --show")
+	abbrMap, err := DecodeZshMap([]byte(pk.State.Aliases))
+	if err != nil {
+		base.Logf("error decoding fish abbreviations: %v\n", err)
+		rcBuf.WriteString("# error decoding fish abbreviations\n")
+	} else {
+		for _, abbrKey := range utilfn.GetOrderedStringerMapKeys(abbrMap) {
+			rcBuf.WriteString(abbrMap[abbrKey])
+			rcBuf.WriteString("\n")
+		}
+	}
+
+	// functions (values are the full "function ... end" definitions)
+	fnMap, err := DecodeZshMap([]byte(pk.State.Funcs))
+	if err != nil {
+		base.Logf("error decoding fish functions: %v\n", err)
+		rcBuf.WriteString("# error decoding fish functions\n")
+	} else {
+		for _, fnKey := range utilfn.GetOrderedStringerMapKeys(fnMap) {
+			rcBuf.WriteString(fnMap[fnKey])
+			rcBuf.WriteString("\n")
+		}
+	}
+	return rcBuf.String()
+}
+
+func isFishIgnoreVar(name string) bool {
+	if FishIgnoreVars[name] {
+		return true
+	}
+	for _, prefix := range FishIgnoreVarPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// fish variable names are alphanumerics and underscores
+func isFishSafeVarName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, ch := range name {
+		if ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9') {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// fish treats variables that end in PATH as colon separated lists (joined with ":" when exported)
+func isFishPathVar(name string) bool {
+	return strings.HasSuffix(name, "PATH")
+}
+
+// inside single quotes fish only interprets \\ and \'
+func fishQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	isSafe := true
+	for _, ch := range s {
+		if ch == '_' || ch == '-' || ch == '.' || ch == '/' || ch == ':' || ch == '=' || ch == '+' || ch == ',' || ch == '@' || ch == '%' {
+			continue
+		}
+		if (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9') {
+			continue
+		}
+		isSafe = false
+		break
+	}
+	if isSafe {
+		return s
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// encodes the elements of a fish variable as a (bash quoted) decl value.
+// path variables and exported lists are joined (the way fish exports them), other lists become "( 'a' 'b' )" with the "a" flag
+func makeFishDecl(name string, isExport bool, elems []string) *shellenv.DeclareDeclType {
+	decl := &shellenv.DeclareDeclType{Name: name}
+	if isExport {
+		decl.AddFlag("x")
+	}
+	if isFishPathVar(name) {
+		decl.Value = shellescape.Quote(strings.Join(elems, ":"))
+		return decl
+	}
+	if len(elems) == 1 || isExport {
+		decl.Value = shellescape.Quote(strings.Join(elems, " "))
+		return decl
+	}
+	decl.AddFlag("a")
+	var quotedElems []string
+	for _, elem := range elems {
+		quotedElems = append(quotedElems, shellescape.Quote(elem))
+	}
+	decl.Value = "(" + strings.Join(quotedElems, " ") + ")"
+	return decl
+}
+
+// inverse of makeFishDecl
+func getFishDeclElems(decl *shellenv.DeclareDeclType) ([]string, error) {
+	ectx := simpleexpand.SimpleExpandContext{}
+	if !decl.IsArray() {
+		val, _ := simpleexpand.SimpleExpandPartialWord(ectx, decl.Value, false)
+		if isFishPathVar(decl.Name) {
+			if val == "" {
+				return nil, nil
+			}
+			return strings.Split(val, ":"), nil
+		}
+		return []string{val}, nil
+	}
+	arrStr := strings.TrimSpace(decl.Value)
+	if !strings.HasPrefix(arrStr, "(") || !strings.HasSuffix(arrStr, ")") {
+		return nil, fmt.Errorf("invalid fish list value for %q", decl.Name)
+	}
+	arrStr = arrStr[1 : len(arrStr)-1]
+	var rtn []string
+	err := syntax.NewParser().Words(strings.NewReader(arrStr), func(word *syntax.Word) bool {
+		val, _ := simpleexpand.SimpleExpandWord(ectx, word, arrStr)
+		rtn = append(rtn, val)
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid fish list value for %q: %w", decl.Name, err)
+	}
+	return rtn, nil
+}
+
+func makeFishSetStmt(decl *shellenv.DeclareDeclType) string {
+	elems, err := getFishDeclElems(decl)
+	if err != nil {
+		return "# " + strings.ReplaceAll(err.Error(), "\n", " ")
+	}
+	scopeArgs := "-g"
+	if decl.IsExport() {
+		scopeArgs = "-gx"
+	}
+	if isFishPathVar(decl.Name) && len(elems) > 0 {
+		return fmt.Sprintf("set %s %s (string split ':' -- %s)", scopeArgs, decl.Name, fishQuote(strings.Join(elems, ":")))
+	}
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("set %s %s", scopeArgs, decl.Name))
+	for _, elem := range elems {
+		buf.WriteString(" ")
+		buf.WriteString(fishQuote(elem))
+	}
+	return buf.String()
+}
+
+// the output is a stream of null terminated fields (fish strings cannot contain nulls):
+//
+//	version, cwd, then records:
+//	  "V [x|-] [count] [name]" followed by count elements
+//	  "A" followed by an "abbr --add" line
+//	  "F [name]" followed by the function's source file and its definition
+//	  "G" followed by the git branch (if any), always last
+func GetFishShellStateCmd(fdNum int) string {
+	cmd := `
+begin
+    string join0 -- "[%FISHVERSION%]" (pwd)
+    for __waveshell_name in (set --names)
+        switch $__waveshell_name
+            case [%IGNOREVARS%]
+                continue
+        end
+        set -qg $__waveshell_name; or continue
+        set -l __waveshell_flags -
+        set -qx $__waveshell_name; and set __waveshell_flags x
+        string join0 -- "V $__waveshell_flags "(count $$__waveshell_name)" $__waveshell_name"
+        string join0 -- $$__waveshell_name
+    end
+    for __waveshell_line in (abbr --show)
+        string join0 -- A $__waveshell_line
+    end
+    for __waveshell_name in (functions --all --names)
+        test $__waveshell_name = [%EXITTRAPFN%]; and continue
+        set -l __waveshell_fnpath (functions --details -- $__waveshell_name)
+        # autoloaded functions (and fish's own) will be loaded again, no need to carry them in the state
+        string match -q -- "$__fish_data_dir/*" $__waveshell_fnpath; and continue
+        contains -- (string replace -r '/[^/]*$' '' -- $__waveshell_fnpath) $fish_function_path; and continue
+        string join0 -- "F $__waveshell_name" $__waveshell_fnpath (functions --no-details -- $__waveshell_name | string collect)
+    end
+    string join0 -- G (git rev-parse --abbrev-ref HEAD 2>/dev/null)
+end > [%OUTPUTFD%]
+`
+	var ignorePatterns []string
+	for _, name := range utilfn.GetOrderedMapKeys(FishIgnoreVars) {
+		ignorePatterns = append(ignorePatterns, fishQuote(name))
+	}
+	for _, prefix := range FishIgnoreVarPrefixes {
+		ignorePatterns = append(ignorePatterns, "'"+prefix+"*'")
+	}
+	cmd = strings.TrimSpace(cmd)
+	cmd = strings.ReplaceAll(cmd, "[%FISHVERSION%]", "fish v$version")
+	cmd = strings.ReplaceAll(cmd, "[%IGNOREVARS%]", strings.Join(ignorePatterns, " "))
+	cmd = strings.ReplaceAll(cmd, "[%EXITTRAPFN%]", FishExitTrapFnName)
+	cmd = strings.ReplaceAll(cmd, "[%OUTPUTFD%]", fmt.Sprintf("/dev/fd/%d", fdNum))
+	return cmd
+}
+
+func MakeFishExitTrap(fdNum int) string {
+	stateCmd := GetFishShellStateCmd(fdNum)
+	fmtStr := `
+function %s --on-event fish_exit
+    %s
+end
+`
+	return fmt.Sprintf(fmtStr, FishExitTrapFnName, stateCmd)
+}
+
+// the name is the first argument after "--" ("abbr -a --position command -- gco 'git checkout'")
+func getFishAbbrName(abbrLine string) string {
+	fields := strings.Fields(abbrLine)
+	for idx, field := range fields {
+		if field == "--" && idx+1 < len(fields) {
+			return fields[idx+1]
+		}
+	}
+	if len(fields) > 0 {
+		return fields[len(fields)-1]
+	}
+	return ""
+}
+
+func parseFishShellStateOutput(outputBytes []byte) (*packet.ShellState, error) {
+	if scbase.IsDevMode() && DebugState {
+		writeStateToFile(packet.ShellType_fish, outputBytes)
+	}
+	fields := strings.Split(string(outputBytes), "\x00")
+	if len(fields) > 0 && fields[len(fields)-1] == "" {
+		fields = fields[0 : len(fields)-1]
+	}
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("invalid fish shell state output, wrong number of fields, fields=%d", len(fields))
+	}
+	rtn := &packet.ShellState{}
+	rtn.Version = strings.TrimSpace(fields[0])
+	if rtn.GetShellType() != packet.ShellType_fish {
+		return nil, fmt.Errorf("invalid fish shell state output, wrong shell type")
+	}
+	if _, _, err := packet.ParseShellStateVersion(rtn.Version); err != nil {
+		return nil, fmt.Errorf("invalid fish shell state output, invalid version: %v", err)
+	}
+	rtn.Cwd = stripNewLineChars(fields[1])
+	declMap := make(map[string]*shellenv.DeclareDeclType)
+	abbrMap := make(ZshMap)
+	fnMap := make(ZshMap)
+	var pvarBuf bytes.Buffer
+	idx := 2
+	for idx < len(fields) {
+		recordFields := strings.SplitN(fields[idx], " ", 4)
+		idx++
+		switch recordFields[0] {
+		case "V":
+			if len(recordFields) != 4 {
+				return nil, fmt.Errorf("invalid fish shell state output, bad var record %q", fields[idx-1])
+			}
+			numElems, err := strconv.Atoi(recordFields[2])
+			if err != nil || numElems < 0 || idx+numElems > len(fields) {
+				return nil, fmt.Errorf("invalid fish shell state output, bad var count %q", fields[idx-1])
+			}
+			name := recordFields[3]
+			elems := fields[idx : idx+numElems]
+			idx += numElems
+			if isFishIgnoreVar(name) {
+				continue
+			}
+			declMap[name] = makeFishDecl(name, recordFields[1] == "x", elems)
+		case "A":
+			if idx >= len(fields) {
+				return nil, fmt.Errorf("invalid fish shell state output, missing abbreviation")
+			}
+			abbrLine := fields[idx]
+			idx++
+			abbrMap[ZshParamKey{ParamType: FishAbbrParamType, ParamName: getFishAbbrName(abbrLine)}] = abbrLine
+		case "F":
+			if len(recordFields) < 2 || idx+2 > len(fields) {
+				return nil, fmt.Errorf("invalid fish shell state output, bad function record %q", fields[idx-1])
+			}
+			fnName := strings.SplitN(fields[idx-1], " ", 2)[1]
+			fnBody := fields[idx+1]
+			idx += 2
+			fnMap[ZshParamKey{ParamType: FishFunctionParamType, ParamName: fnName}] = fnBody
+		case "G":
+			var gitBranch string
+			if idx < len(fields) {
+				gitBranch = stripNewLineChars(fields[idx])
+			}
+			idx = len(fields)
+			pvarBuf.WriteString("GITBRANCH " + gitBranch)
+			pvarBuf.WriteByte(0)
+		default:
+			return nil, fmt.Errorf("invalid fish shell state output, unknown record %q", fields[idx-1])
+		}
+	}
+	rtn.Aliases = string(EncodeZshMap(abbrMap))
+	rtn.Funcs = string(EncodeZshMap(fnMap))
+	pvarMap := parsePVarOutput(pvarBuf.Bytes(), false)
+	utilfn.CombineMaps(declMap, pvarMap)
+	rtn.ShellVars = shellenv.SerializeDeclMap(declMap)
+	return rtn, nil
+}
+
+func execGetLocalFishShellVersion() string {
+	ctx, cancelFn := context.WithTimeout(context.Background(), GetStateTimeout)
+	defer cancelFn()
+	ecmd := exec.CommandContext(ctx, "fish", "-c", FishShellVersionCmdStr)
+	out, err := ecmd.Output()
+	if err != nil {
+		return ""
+	}
+	versionStr := strings.TrimSpace(string(out))
+	if strings.Index(versionStr, "fish ") == -1 {
+		return ""
+	}
+	return versionStr
+}
+
+func GetLocalFishMajorVersion() string {
+	localFishMajorVersionOnce.Do(func() {
+		fullVersion := execGetLocalFishShellVersion()
+		localFishMajorVersion = packet.GetMajorVersion(fullVersion)
+	})
+	return localFishMajorVersion
+}
+
+func GetLocalFishPath() string {
+	if runtime.GOOS == "darwin" {
+		macShell := GetMacUserShell()
+		if strings.Index(macShell, "fish") != -1 {
+			return shellescape.Quote(macShell)
+		}
+	}
+	return "fish"
+}
+
+func (fishShellApi) MakeShellStateDiff(oldState *packet.ShellState, oldStateHash string, newState *packet.ShellState) (*packet.ShellStateDiff, error) {
+	if oldState == nil {
+		return nil, fmt.Errorf("cannot diff, oldState is nil")
+	}
+	if newState == nil {
+		return nil, fmt.Errorf("cannot diff, newState is nil")
+	}
+	if !packet.StateVersionsCompatible(oldState.Version, newState.Version) {
+		return nil, fmt.Errorf("cannot diff, incompatible shell versions: %q %q", oldState.Version, newState.Version)
+	}
+	rtn := &packet.ShellStateDiff{}
+	rtn.BaseHash = oldStateHash
+	rtn.Version = newState.Version // always set version in the diff
+	if oldState.Cwd != newState.Cwd {
+		rtn.Cwd = newState.Cwd
+	}
+	rtn.Error = newState.Error
+	oldVars := shellenv.ShellStateVarsToMap(oldState.ShellVars)
+	newVars := shellenv.ShellStateVarsToMap(newState.ShellVars)
+	rtn.VarsDiff = statediff.MakeMapDiff(oldVars, newVars)
+	var err error
+	rtn.AliasesDiff, err = makeZshMapDiff(oldState.Aliases, newState.Aliases)
+	if err != nil {
+		return nil, err
+	}
+	rtn.FuncsDiff, err = makeZshMapDiff(oldState.Funcs, newState.Funcs)
+	if err != nil {
+		return nil, err
+	}
+	return rtn, nil
+}
+
+func (fishShellApi) ApplyShellStateDiff(oldState *packet.ShellState, diff *packet.ShellStateDiff) (*packet.ShellState, error) {
+	if oldState == nil {
+		return nil, fmt.Errorf("cannot apply diff, oldState is nil")
+	}
+	if diff == nil {
+		return oldState, nil
+	}
+	rtnState := &packet.ShellState{}
+	var err error
+	rtnState.Version = oldState.Version
+	if _, _, diffVersionErr := packet.ParseShellStateVersion(diff.Version); diffVersionErr == nil {
+		rtnState.Version = diff.Version
+	}
+	rtnState.Cwd = oldState.Cwd
+	if diff.Cwd != "" {
+		rtnState.Cwd = diff.Cwd
+	}
+	rtnState.Error = diff.Error
+	oldVars := shellenv.ShellStateVarsToMap(oldState.ShellVars)
+	newVars, err := statediff.ApplyMapDiff(oldVars, diff.VarsDiff)
+	if err != nil {
+		return nil, fmt.Errorf("applying mapdiff 'vars': %v", err)
+	}
+	rtnState.ShellVars = shellenv.StrMapToShellStateVars(newVars)
+	rtnState.Aliases, err = applyZshMapDiff(oldState.Aliases, diff.AliasesDiff)
+	if err != nil {
+		return nil, fmt.Errorf("applying diff 'aliases': %v", err)
+	}
+	rtnState.Funcs, err = applyZshMapDiff(oldState.Funcs, diff.FuncsDiff)
+	if err != nil {
+		return nil, fmt.Errorf("applying diff 'funcs': %v", err)
+	}
+	return rtnState, nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package shellapi
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/shellenv"
+)
+
+func makeFishTestOutput(records ...string) []byte {
+	return []byte(strings.Join(records, "\x00") + "\x00")
+}
+
+func TestParseFishShellState(t *testing.T) {
+	output := makeFishTestOutput(
+		"fish v3.7.1", "/home/user",
+		"V x 3 PATH", "/usr/local/bin", "/usr/bin", "/bin",
+		"V - 2 mylist", "a b", "it's",
+		"V - 1 greeting", "hello",
+		"V - 0 empty",
+		"V x 1 FISH_VERSION", "3.7.1",
+		"A", "abbr -a -- gco 'git checkout'",
+		"F ll", "stdin", "function ll\n    ls -l $argv\nend",
+		"G", "main",
+	)
+	state, err := parseFishShellStateOutput(output)
+	if err != nil {
+		t.Fatalf("error parsing fish state: %v", err)
+	}
+	if state.GetShellType() != packet.ShellType_fish || state.Cwd != "/home/user" {
+		t.Errorf("bad fish state: %q %q", state.Version, state.Cwd)
+	}
+	declMap := shellenv.DeclMapFromState(state)
+	if declMap["FISH_VERSION"] != nil {
+		t.Errorf("FISH_VERSION should be ignored")
+	}
+	if declMap["PROMPTVAR_GITBRANCH"] == nil || declMap["PROMPTVAR_GITBRANCH"].Value != "main" {
+		t.Errorf("bad git branch: %#v", declMap["PROMPTVAR_GITBRANCH"])
+	}
+	envMap := shellenv.EnvMapFromState(state)
+	if envMap["PATH"] != "/usr/local/bin:/usr/bin:/bin" {
+		t.Errorf("bad PATH env: %q", envMap["PATH"])
+	}
+	elems, err := getFishDeclElems(declMap["mylist"])
+	if err != nil || len(elems) != 2 || elems[0] != "a b" || elems[1] != "it's" {
+		t.Errorf("bad list elems: %q %v", elems, err)
+	}
+	abbrMap, _ := DecodeZshMap([]byte(state.Aliases))
+	if abbrMap[ZshParamKey{ParamType: FishAbbrParamType, ParamName: "gco"}] != "abbr -a -- gco 'git checkout'" {
+		t.Errorf("bad abbreviations: %v", abbrMap)
+	}
+	fnMap, _ := DecodeZshMap([]byte(state.Funcs))
+	if !strings.HasPrefix(fnMap[ZshParamKey{ParamType: FishFunctionParamType, ParamName: "ll"}], "function ll") {
+		t.Errorf("bad functions: %v", fnMap)
+	}
+
+	rcStr := fishShellApi{}.MakeRcFileStr(&packet.RunPacketType{State: state})
+	for _, expected := range []string{
+		`set -g mylist 'a b' 'it\'s'`,
+		"set -g greeting hello",
+		"set -g empty\n",
+		"abbr -a -- gco 'git checkout'",
+		"function ll\n",
+	} {
+		if !strings.Contains(rcStr, expected) {
+			t.Errorf("rcfile missing %q:\n%s", expected, rcStr)
+		}
+	}
+	if strings.Contains(rcStr, "PATH") {
+		t.Errorf("exported PATH should come from the environment:\n%s", rcStr)
+	}
+
+	if _, err := parseFishShellStateOutput(makeFishTestOutput("zsh v5.9", "/")); err == nil {
+		t.Errorf("expected wrong shell type to fail")
+	}
+	if _, err := parseFishShellStateOutput(makeFishTestOutput("fish v3.7.1", "/", "V - 5 short", "a")); err == nil {
+		t.Errorf("expected bad var count to fail")
+	}
+}
+
+func TestFishShellStateDiff(t *testing.T) {
+	sapi := fishShellApi{}
+	oldState, err := parseFishShellStateOutput(makeFishTestOutput("fish v3.7.1", "/", "V - 1 a", "1", "A", "abbr -a -- g git", "G"))
+	if err != nil {
+		t.Fatalf("error parsing old state: %v", err)
+	}
+	newState, err := parseFishShellStateOutput(makeFishTestOutput("fish v3.7.2", "/tmp", "V - 2 a", "1", "2", "F f", "stdin", "function f\nend", "G"))
+	if err != nil {
+		t.Fatalf("error parsing new state: %v", err)
+	}
+	diff, err := sapi.MakeShellStateDiff(oldState, "hash", newState)
+	if err != nil {
+		t.Fatalf("error making diff: %v", err)
+	}
+	applied, err := sapi.ApplyShellStateDiff(oldState, diff)
+	if err != nil {
+		t.Fatalf("error applying diff: %v", err)
+	}
+	if applied.Version != newState.Version || applied.Cwd != newState.Cwd || string(applied.ShellVars) != string(newState.ShellVars) ||
+		applied.Aliases != newState.Aliases || applied.Funcs != newState.Funcs {
+		t.Errorf("applied diff does not match new state")
+	}
+	if _, err := sapi.MakeShellStateDiff(oldState, "hash", &packet.ShellState{Version: "fish v4.0.0"}); err == nil {
+		t.Errorf("expected diff across major versions to fail")
+	}
+}
+
+func TestFishQuote(t *testing.T) {
+	tests := map[string]string{
+		"":           "''",
+		"simple":     "simple",
+		"/usr/bin":   "/usr/bin",
+		"a b":        "'a b'",
+		"it's":       `'it\'s'`,
+		`back\slash`: `'back\\slash'`,
+		"$HOME":      "'$HOME'",
+	}
+	for input, expected := range tests {
+		if rtn := fishQuote(input); rtn != expected {
+			t.Errorf("fishQuote(%q) => %q, expected %q", input, rtn, expected)
+		}
+	}
+	if getFishAbbrName("abbr -a --position command -- gco 'git checkout'") != "gco" {
+		t.Errorf("bad abbr name")
+	}
+}
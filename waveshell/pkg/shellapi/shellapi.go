@@ -76,6 +76,9 @@ func DetectLocalShellType() string {
 	if strings.HasPrefix(file, "zsh") {
 		return packet.ShellType_zsh
 	}
+	if strings.HasPrefix(file, "fish") {
+		return packet.ShellType_fish
+	}
 	return packet.ShellType_bash
 }
 
@@ -88,6 +91,10 @@ func HasShell(shellType string) bool {
 		_, err := exec.LookPath("zsh")
 		return err != nil
 	}
+	if shellType == packet.ShellType_fish {
+		_, err := exec.LookPath("fish")
+		return err == nil
+	}
 	return false
 }
 
@@ -98,6 +105,9 @@ func MakeShellApi(shellType string) (ShellApi, error) {
 	if shellType == packet.ShellType_zsh {
 		return &zshShellApi{}, nil
 	}
+	if shellType == packet.ShellType_fish {
+		return &fishShellApi{}, nil
+	}
 	return nil, fmt.Errorf("shell type not supported: %s", shellType)
 }
 
@@ -236,6 +236,10 @@ func MakeClientProc(ctx context.Context, ecmd ConnInterface) (*ClientProc, error
 		return nil, WaveshellLaunchError{InitPk: initPk}
 	}
 	cproc.InitPk = initPk
+	if initPk.HasCapability(packet.Capability_ClientInit) {
+		sender.SendPacket(MakeClientInitPacket())
+	}
+	sender.SetPeerCapabilities(initPk.Capabilities)
 	return cproc, nil
 }
 
@@ -110,6 +110,7 @@ type ShExecType struct {
 	Multiplexer    *mpio.Multiplexer
 	Detached       bool
 	DetachedOutput *packet.PacketSender
+	DetachedPtyOut *cirfile.File // detached commands, the .ptyout file (created before the command starts)
 	RunnerOutFd    *os.File
 	MsgSender      *packet.PacketSender // where to send out-of-band messages back to calling proceess
 	ReturnState    *ReturnStateBuf
@@ -172,21 +173,92 @@ func (s *ShExecType) processSpecialInputPacket(pk *packet.SpecialInputPacketType
 		s.Cmd.Process.Signal(syscall.SIGWINCH)
 	}
 	if pk.SigName != "" {
-		var signal syscall.Signal
-		sigNumInt, err := strconv.Atoi(pk.SigName)
-		if err == nil {
-			signal = syscall.Signal(sigNumInt)
-		} else {
-			signal = unix.SignalNum(pk.SigName)
-		}
-		if signal == 0 {
-			return fmt.Errorf("error signal %q not found, cannot send", pk.SigName)
+		signal, err := parseSigName(pk.SigName)
+		if err != nil {
+			return err
 		}
-		s.SendSignal(syscall.Signal(signal))
+		s.SendSignal(signal)
 	}
 	return nil
 }
 
+func parseSigName(sigName string) (syscall.Signal, error) {
+	var signal syscall.Signal
+	sigNumInt, err := strconv.Atoi(sigName)
+	if err == nil {
+		signal = syscall.Signal(sigNumInt)
+	} else {
+		signal = unix.SignalNum(sigName)
+	}
+	if signal == 0 {
+		return 0, fmt.Errorf("error signal %q not found, cannot send", sigName)
+	}
+	return signal, nil
+}
+
+// detached commands are not attached to the server's packet streams.  input goes to the command's
+// stdin fifo, winsize changes go to its tty (startPk.TtyName), and signals go to its process group.
+func ProcessDetachedInputPacket(startPk *packet.CmdStartPacketType, pk packet.CommandPacketType) error {
+	switch inputPk := pk.(type) {
+	case *packet.DataPacketType:
+		if inputPk.FdNum != 0 {
+			return fmt.Errorf("invalid fd %d for detached command input", inputPk.FdNum)
+		}
+		data, err := base64.StdEncoding.DecodeString(inputPk.Data64)
+		if err != nil {
+			return fmt.Errorf("decoding input data: %w", err)
+		}
+		if len(data) == 0 {
+			return nil
+		}
+		fileNames, err := base.GetCommandFileNames(startPk.CK)
+		if err != nil {
+			return err
+		}
+		// non-blocking, fails if the command is no longer reading its stdin fifo
+		fifoFd, err := os.OpenFile(fileNames.StdinFifo, os.O_WRONLY|syscall.O_NONBLOCK, 0600)
+		if err != nil {
+			return fmt.Errorf("cannot open stdin fifo: %w", err)
+		}
+		defer fifoFd.Close()
+		_, err = fifoFd.Write(data)
+		if err != nil {
+			return fmt.Errorf("writing to stdin fifo: %w", err)
+		}
+		return nil
+
+	case *packet.SpecialInputPacketType:
+		if inputPk.WinSize != nil {
+			if startPk.TtyName == "" {
+				return fmt.Errorf("cannot change winsize, no tty for detached command")
+			}
+			ttyFd, err := os.OpenFile(startPk.TtyName, os.O_RDWR|syscall.O_NOCTTY, 0)
+			if err != nil {
+				return fmt.Errorf("cannot open tty: %w", err)
+			}
+			defer ttyFd.Close()
+			winSize := &pty.Winsize{
+				Rows: uint16(base.BoundInt(inputPk.WinSize.Rows, MinTermRows, MaxTermRows)),
+				Cols: uint16(base.BoundInt(inputPk.WinSize.Cols, MinTermCols, MaxTermCols)),
+			}
+			pty.Setsize(ttyFd, winSize)
+			syscall.Kill(startPk.Pid, syscall.SIGWINCH)
+		}
+		if inputPk.SigName != "" {
+			signal, err := parseSigName(inputPk.SigName)
+			if err != nil {
+				return err
+			}
+			// detached commands are started with Setsid, so pid is also the process group id
+			return syscall.Kill(-startPk.Pid, signal)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("invalid packet '%s' for detached command", pk.GetType())
+	}
+}
+
 func (s ShExecUPR) UnknownPacket(pk packet.PacketType) {
 	if pk.GetType() == packet.SpecialInputPacketStr {
 		inputPacket := pk.(*packet.SpecialInputPacketType)
@@ -265,54 +337,6 @@ func MakeRunnerExec(ck base.CommandKey) (*exec.Cmd, error) {
 	return ecmd, nil
 }
 
-func MakeDetachedExecCmd(pk *packet.RunPacketType, cmdTty *os.File) (*exec.Cmd, error) {
-	sapi, err := shellapi.MakeShellApi(pk.ShellType)
-	if err != nil {
-		return nil, err
-	}
-	state := pk.State
-	if state == nil {
-		state = &packet.ShellState{}
-	}
-	ecmd := exec.Command(sapi.GetLocalShellPath(), "-c", pk.Command)
-	if !pk.StateComplete {
-		ecmd.Env = os.Environ()
-	}
-	shellutil.UpdateCmdEnv(ecmd, shellenv.EnvMapFromState(state))
-	shellutil.UpdateCmdEnv(ecmd, shellutil.MShellEnvVars(getTermType(pk)))
-	if state.Cwd != "" {
-		ecmd.Dir = base.ExpandHomeDir(state.Cwd)
-	}
-	if HasDupStdin(pk.Fds) {
-		return nil, fmt.Errorf("cannot detach command with dup stdin")
-	}
-	ecmd.Stdin = cmdTty
-	ecmd.Stdout = cmdTty
-	ecmd.Stderr = cmdTty
-	ecmd.SysProcAttr = &syscall.SysProcAttr{
-		Setsid:  true,
-		Setctty: true,
-	}
-	extraFiles := make([]*os.File, 0, MaxFdNum+1)
-	if len(pk.Fds) > 0 {
-		return nil, fmt.Errorf("invalid fd %d passed to detached command", pk.Fds[0].FdNum)
-	}
-	for _, runData := range pk.RunData {
-		if runData.FdNum >= len(extraFiles) {
-			extraFiles = extraFiles[:runData.FdNum+1]
-		}
-		var err error
-		extraFiles[runData.FdNum], err = MakeSimpleStaticWriterPipe(runData.Data)
-		if err != nil {
-			return nil, err
-		}
-	}
-	if len(extraFiles) > FirstExtraFilesFdNum {
-		ecmd.ExtraFiles = extraFiles[FirstExtraFilesFdNum:]
-	}
-	return ecmd, nil
-}
-
 // this will never return (unless there is an error creating/opening the file), as fifoFile will never EOF
 func MakeAndCopyStdinFifo(dst *os.File, fifoName string) error {
 	os.Remove(fifoName)
@@ -403,6 +427,7 @@ type SSHOpts struct {
 	SSHIdentity    string
 	SSHUser        string
 	SSHPort        int
+	SSHProxyJump   string
 	SSHErrorsToTty bool
 	BatchMode      bool
 }
@@ -471,6 +496,10 @@ func (opts SSHOpts) MakeSSHExecCmd(remoteCommand string, sapi shellapi.ShellApi)
 			portOpt := fmt.Sprintf("-p %d", opts.SSHPort)
 			moreSSHOpts = append(moreSSHOpts, portOpt)
 		}
+		if opts.SSHProxyJump != "" {
+			jumpOpt := fmt.Sprintf("-J %s", shellescape.Quote(opts.SSHProxyJump))
+			moreSSHOpts = append(moreSSHOpts, jumpOpt)
+		}
 		if opts.SSHErrorsToTty {
 			errFdStr := "-E /dev/tty"
 			moreSSHOpts = append(moreSSHOpts, errFdStr)
@@ -794,40 +823,30 @@ func (s *ShExecType) SendSignal(sig syscall.Signal) {
 	}
 }
 
-func RunCommandSimple(pk *packet.RunPacketType, sender *packet.PacketSender, fromServer bool) (rtnShExec *ShExecType, rtnErr error) {
-	sapi, err := shellapi.MakeShellApi(pk.ShellType)
-	if err != nil {
-		return nil, err
-	}
+// sets cmd.Cmd to run pk.Command in a shell initialized with pk.State (via an rcfile), and cmd.ReturnState if
+// pk.ReturnState is set.  returns the write end of the returnstate pipe (nil if not returning state), the caller
+// passes it to the command and closes it after the command is started.
+func setupShellExecCmd(cmd *ShExecType, pk *packet.RunPacketType) (rtnStateWriter *os.File, rtnErr error) {
+	sapi := cmd.SAPI
 	state := pk.State
-	if state == nil {
-		return nil, fmt.Errorf("invalid run packet, no state")
-	}
-	cmd := MakeShExec(pk.CK, nil, sapi)
 	defer func() {
-		// on error, call cmd.Close()
-		if rtnErr != nil {
-			cmd.Close()
+		if rtnErr != nil && rtnStateWriter != nil {
+			rtnStateWriter.Close()
 		}
 	}()
-	if fromServer {
-		msgUpr := packet.MessageUPR{CK: pk.CK, Sender: sender}
-		upr := ShExecUPR{ShExec: cmd, UPR: msgUpr}
-		cmd.Multiplexer.UPR = upr
-		cmd.MsgSender = sender
+	cleanupRtn := func(err error) (*os.File, error) {
+		return rtnStateWriter, err
 	}
-	var rtnStateWriter *os.File
 	rcFileStr := sapi.MakeRcFileStr(pk)
 	if pk.ReturnState {
 		pr, pw, err := os.Pipe()
 		if err != nil {
-			return nil, fmt.Errorf("cannot create returnstate pipe: %v", err)
+			return cleanupRtn(fmt.Errorf("cannot create returnstate pipe: %v", err))
 		}
 		cmd.ReturnState = MakeReturnStateBuf()
 		cmd.ReturnState.Reader = pr
 		cmd.ReturnState.FdNum = RtnStateFdNum
 		rtnStateWriter = pw
-		defer pw.Close()
 		trapCmdStr := sapi.MakeExitTrap(cmd.ReturnState.FdNum)
 		rcFileStr += trapCmdStr
 	}
@@ -849,31 +868,31 @@ func RunCommandSimple(pk *packet.RunPacketType, sender *packet.PacketSender, fro
 	if isOldBashVersion {
 		rcFileDir, err := base.EnsureRcFilesDir()
 		if err != nil {
-			return nil, err
+			return cleanupRtn(err)
 		}
 		rcFileName = path.Join(rcFileDir, uuid.New().String())
 		err = os.WriteFile(rcFileName, []byte(rcFileStr), 0600)
 		if err != nil {
-			return nil, fmt.Errorf("could not write temp rcfile: %w", err)
+			return cleanupRtn(fmt.Errorf("could not write temp rcfile: %w", err))
 		}
 		cmd.TmpRcFileName = rcFileName
 	} else if sapi.GetShellType() == packet.ShellType_zsh {
 		rcFileDir, err := base.EnsureRcFilesDir()
 		if err != nil {
-			return nil, err
+			return cleanupRtn(err)
 		}
 		zdotdir = path.Join(rcFileDir, uuid.New().String())
 		os.Mkdir(zdotdir, 0700)
 		rcFileName = path.Join(zdotdir, ".zshenv")
 		err = os.WriteFile(rcFileName, []byte(rcFileStr), 0600)
 		if err != nil {
-			return nil, fmt.Errorf("could not write temp rcfile: %w", err)
+			return cleanupRtn(fmt.Errorf("could not write temp rcfile: %w", err))
 		}
 		cmd.TmpRcFileName = zdotdir
 	} else {
 		rcFileFdNum, err := AddRunData(pk, rcFileStr, "rcfile")
 		if err != nil {
-			return nil, err
+			return cleanupRtn(err)
 		}
 		rcFileName = fmt.Sprintf("/dev/fd/%d", rcFileFdNum)
 	}
@@ -896,6 +915,41 @@ func RunCommandSimple(pk *packet.RunPacketType, sender *packet.PacketSender, fro
 	if state.Cwd != "" {
 		cmd.Cmd.Dir = base.ExpandHomeDir(state.Cwd)
 	}
+	return rtnStateWriter, nil
+}
+
+func RunCommandSimple(pk *packet.RunPacketType, sender *packet.PacketSender, fromServer bool) (rtnShExec *ShExecType, rtnErr error) {
+	sapi, err := shellapi.MakeShellApi(pk.ShellType)
+	if err != nil {
+		return nil, err
+	}
+	state := pk.State
+	if state == nil {
+		return nil, fmt.Errorf("invalid run packet, no state")
+	}
+	cmd := MakeShExec(pk.CK, nil, sapi)
+	defer func() {
+		// on error, call cmd.Close()
+		if rtnErr != nil {
+			cmd.Close()
+		}
+	}()
+	if fromServer {
+		msgUpr := packet.MessageUPR{CK: pk.CK, Sender: sender}
+		upr := ShExecUPR{ShExec: cmd, UPR: msgUpr}
+		cmd.Multiplexer.UPR = upr
+		cmd.MsgSender = sender
+	}
+	if pk.ReadWindow > 0 {
+		cmd.Multiplexer.SetReadWindow(pk.ReadWindow)
+	}
+	rtnStateWriter, err := setupShellExecCmd(cmd, pk)
+	if err != nil {
+		return nil, err
+	}
+	if rtnStateWriter != nil {
+		defer rtnStateWriter.Close()
+	}
 	err = ValidateRemoteFds(pk.Fds)
 	if err != nil {
 		return nil, err
@@ -1047,13 +1101,11 @@ func copyToCirFile(dest *cirfile.File, src io.Reader) error {
 		if nr > 0 {
 			appendErr = dest.AppendData(context.Background(), buf[0:nr])
 		}
-		if readErr != nil && readErr != io.EOF {
-			return readErr
-		}
 		if appendErr != nil {
 			return appendErr
 		}
-		if readErr == io.EOF {
+		if readErr != nil {
+			// reading from a pty returns EIO (not EOF) once the command's tty is closed
 			return nil
 		}
 	}
@@ -1075,11 +1127,10 @@ func (cmd *ShExecType) DetachedWait(startPacket *packet.CmdStartPacketType) {
 	if err != nil {
 		cmd.DetachedOutput.SendCmdError(cmd.CK, fmt.Errorf("cannot dup2 stdin to runout: %w", err))
 	}
-	ptyOutFile, err := cirfile.CreateCirFile(cmd.FileNames.PtyOutFile, cmd.MaxPtySize)
-	if err != nil {
-		cmd.DetachedOutput.SendCmdError(cmd.CK, fmt.Errorf("cannot open ptyout file '%s': %w", cmd.FileNames.PtyOutFile, err))
-		// don't return (command is already running)
+	if cmd.ReturnState != nil {
+		go cmd.ReturnState.Run()
 	}
+	ptyOutFile := cmd.DetachedPtyOut
 	ptyCopyDone := make(chan bool)
 	go func() {
 		// copy pty output to .ptyout file
@@ -1098,26 +1149,61 @@ func (cmd *ShExecType) DetachedWait(startPacket *packet.CmdStartPacketType) {
 		}
 	}()
 	donePacket := cmd.WaitForCommand()
-	cmd.DetachedOutput.SendPacket(donePacket)
+	// all pty output must be in the ptyout file before the cmddone packet is written
 	<-ptyCopyDone
+	cmd.DetachedOutput.SendPacket(donePacket)
 	cmd.Close()
 }
 
-func RunCommandDetached(pk *packet.RunPacketType, sender *packet.PacketSender) (*ShExecType, *packet.CmdStartPacketType, error) {
+func RunCommandDetached(pk *packet.RunPacketType, sender *packet.PacketSender) (rtnShExec *ShExecType, rtnStartPk *packet.CmdStartPacketType, rtnErr error) {
 	sapi, err := shellapi.MakeShellApi(pk.ShellType)
 	if err != nil {
 		return nil, nil, err
 	}
+	if pk.State == nil {
+		return nil, nil, fmt.Errorf("invalid run packet, no state")
+	}
+	if !pk.UsePty {
+		return nil, nil, fmt.Errorf("cannot detach command without a pty")
+	}
+	if len(pk.Fds) > 0 {
+		return nil, nil, fmt.Errorf("invalid fd %d passed to detached command", pk.Fds[0].FdNum)
+	}
 	fileNames, err := base.GetCommandFileNames(pk.CK)
 	if err != nil {
 		return nil, nil, err
 	}
-	runOutInfo, err := os.Stat(fileNames.RunnerOutFile)
-	if err == nil { // non-nil error will be caught by regular OpenFile below
-		// must have size 0
-		if runOutInfo.Size() != 0 {
-			return nil, nil, fmt.Errorf("cmdkey '%s' was already used (runout len=%d)", pk.CK, runOutInfo.Size())
+	if _, err := os.Stat(fileNames.StdinFifo); err == nil {
+		// the stdin fifo is removed when the command finishes
+		return nil, nil, fmt.Errorf("cmdkey '%s' is already running", pk.CK)
+	}
+	// cmdkey is being re-used (e.g. /line:restart), remove the old output files
+	sessionId, cmdId := pk.CK.Split()
+	err = base.CleanUpCmdFiles(sessionId, cmdId)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot clean up old files for cmdkey '%s': %w", pk.CK, err)
+	}
+	cmd := MakeShExec(pk.CK, nil, sapi)
+	defer func() {
+		if rtnErr != nil {
+			if cmd.DetachedPtyOut != nil {
+				cmd.DetachedPtyOut.Close()
+			}
+			cmd.Close()
 		}
+	}()
+	cmd.FileNames = fileNames
+	cmd.Detached = true
+	cmd.MaxPtySize = DefaultMaxPtySize
+	if pk.TermOpts != nil && pk.TermOpts.MaxPtySize > 0 {
+		cmd.MaxPtySize = base.BoundInt64(pk.TermOpts.MaxPtySize, MinMaxPtySize, MaxMaxPtySize)
+	}
+	rtnStateWriter, err := setupShellExecCmd(cmd, pk)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rtnStateWriter != nil {
+		defer rtnStateWriter.Close()
 	}
 	cmdPty, cmdTty, err := pty.Open()
 	if err != nil {
@@ -1127,35 +1213,56 @@ func RunCommandDetached(pk *packet.RunPacketType, sender *packet.PacketSender) (
 	defer func() {
 		cmdTty.Close()
 	}()
-	cmd := MakeShExec(pk.CK, nil, sapi)
-	cmd.FileNames = fileNames
 	cmd.CmdPty = cmdPty
-	cmd.Detached = true
-	cmd.MaxPtySize = DefaultMaxPtySize
-	if pk.TermOpts != nil && pk.TermOpts.MaxPtySize > 0 {
-		cmd.MaxPtySize = base.BoundInt64(pk.TermOpts.MaxPtySize, MinMaxPtySize, MaxMaxPtySize)
+	shellutil.UpdateCmdEnv(cmd.Cmd, shellutil.MShellEnvVars(getTermType(pk)))
+	cmd.Cmd.Stdin = cmdTty
+	cmd.Cmd.Stdout = cmdTty
+	cmd.Cmd.Stderr = cmdTty
+	cmd.Cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid:  true,
+		Setctty: true,
+	}
+	// the ptyout file must exist before the cmdstart packet is sent (so it can be tailed)
+	cmd.DetachedPtyOut, err = cirfile.CreateCirFile(fileNames.PtyOutFile, cmd.MaxPtySize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot create ptyout file '%s': %w", fileNames.PtyOutFile, err)
 	}
 	cmd.RunnerOutFd, err = os.OpenFile(fileNames.RunnerOutFile, os.O_TRUNC|os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
 	if err != nil {
 		return nil, nil, fmt.Errorf("cannot open runout file '%s': %w", fileNames.RunnerOutFile, err)
 	}
 	cmd.DetachedOutput = packet.MakePacketSender(cmd.RunnerOutFd, nil)
-	ecmd, err := MakeDetachedExecCmd(pk, cmdTty)
-	if err != nil {
-		return nil, nil, err
+	extraFiles := make([]*os.File, 0, MaxFdNum+1)
+	for _, runData := range pk.RunData {
+		if runData.FdNum >= len(extraFiles) {
+			extraFiles = extraFiles[:runData.FdNum+1]
+		}
+		extraFiles[runData.FdNum], err = MakeSimpleStaticWriterPipe(runData.Data)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if cmd.ReturnState != nil {
+		if cmd.ReturnState.FdNum >= len(extraFiles) {
+			extraFiles = extraFiles[:cmd.ReturnState.FdNum+1]
+		}
+		extraFiles[cmd.ReturnState.FdNum] = rtnStateWriter
+	}
+	if len(extraFiles) > FirstExtraFilesFdNum {
+		cmd.Cmd.ExtraFiles = extraFiles[FirstExtraFilesFdNum:]
 	}
-	cmd.Cmd = ecmd
 	SetupSignalsForDetach()
-	err = ecmd.Start()
+	err = cmd.Cmd.Start()
 	if err != nil {
 		return nil, nil, fmt.Errorf("starting command: %w", err)
 	}
-	for _, fd := range ecmd.ExtraFiles {
-		if fd != cmdTty {
+	for _, fd := range cmd.Cmd.ExtraFiles {
+		if fd != nil && fd != rtnStateWriter {
 			fd.Close()
 		}
 	}
 	startPacket := cmd.MakeCmdStartPacket(pk.ReqId)
+	startPacket.TtyName = cmdTty.Name()
 	return cmd, startPacket, nil
 }
 
@@ -1170,6 +1277,31 @@ func GetExitCode(err error) int {
 	}
 }
 
+// returns nil if the process has not exited (or rusage is not available on this platform)
+func GetCmdRUsage(ps *os.ProcessState) *packet.CmdRUsageType {
+	if ps == nil {
+		return nil
+	}
+	rusage, ok := ps.SysUsage().(*syscall.Rusage)
+	if !ok || rusage == nil {
+		return nil
+	}
+	maxRssKB := int64(rusage.Maxrss)
+	if runtime.GOOS == "darwin" {
+		// darwin reports maxrss in bytes (linux uses kilobytes)
+		maxRssKB = maxRssKB / 1024
+	}
+	return &packet.CmdRUsageType{
+		UserTimeMs: ps.UserTime().Milliseconds(),
+		SysTimeMs:  ps.SystemTime().Milliseconds(),
+		MaxRssKB:   maxRssKB,
+		InBlock:    int64(rusage.Inblock),
+		OutBlock:   int64(rusage.Oublock),
+		VolCsw:     int64(rusage.Nvcsw),
+		InvolCsw:   int64(rusage.Nivcsw),
+	}
+}
+
 func (c *ShExecType) ProcWait() error {
 	exitErr := c.Cmd.Wait()
 	base.Logf("procwait: %v\n", exitErr)
@@ -1204,6 +1336,7 @@ func (c *ShExecType) WaitForCommand() *packet.CmdDonePacketType {
 	donePacket.Ts = endTs.UnixMilli()
 	donePacket.ExitCode = GetExitCode(exitErr)
 	donePacket.DurationMs = int64(cmdDuration / time.Millisecond)
+	donePacket.RUsage = GetCmdRUsage(c.Cmd.ProcessState)
 	if c.FileNames != nil {
 		os.Remove(c.FileNames.StdinFifo) // best effort (no need to check error)
 	}
@@ -1246,9 +1379,18 @@ func MakeServerInitPacket() (*packet.InitPacketType, error) {
 	if err != nil {
 		return nil, err
 	}
+	initPacket.Capabilities = packet.ServerCapabilities
 	return initPacket, nil
 }
 
+// sent back to the server to advertise the client's capabilities
+func MakeClientInitPacket() *packet.InitPacketType {
+	initPacket := packet.MakeInitPacket()
+	initPacket.Version = base.MShellVersion
+	initPacket.Capabilities = packet.ClientCapabilities
+	return initPacket
+}
+
 func ParseEnv0(env []byte) map[string]string {
 	envLines := bytes.Split(env, []byte{0})
 	rtn := make(map[string]string)
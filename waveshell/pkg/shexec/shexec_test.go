@@ -0,0 +1,28 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package shexec
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestGetCmdRUsage(t *testing.T) {
+	if GetCmdRUsage(nil) != nil {
+		t.Errorf("expected nil rusage for nil process state")
+	}
+	ecmd := exec.Command("/bin/sh", "-c", "i=0; while [ $i -lt 20000 ]; do i=$((i+1)); done")
+	err := ecmd.Run()
+	if err != nil {
+		t.Skipf("cannot run /bin/sh: %v", err)
+	}
+	rusage := GetCmdRUsage(ecmd.ProcessState)
+	if rusage == nil {
+		t.Fatalf("expected rusage for exited process")
+	}
+	if rusage.MaxRssKB <= 0 {
+		t.Errorf("bad rusage: %#v", rusage)
+	}
+	t.Logf("rusage: %#v", rusage)
+}
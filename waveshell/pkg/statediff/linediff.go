@@ -11,7 +11,11 @@ import (
 )
 
 const LineDiffVersion_0 = 0
-const LineDiffVersion = 1
+const LineDiffVersion_1 = 1
+const LineDiffVersion = 2
+
+// past this edit distance we fall back to the (linear) greedy diff
+const MaxLineDiffEditDistance = 1000
 
 type SingleLineEntry struct {
 	LineVal int
@@ -123,12 +127,13 @@ func (diff LineDiffType) Encode_v0() []byte {
 	return buf.Bytes()
 }
 
+// version 1 is no longer used, but kept here as a reference for decoding
 // version 1 updates the diff to include the split-string
 // it also encodes all the strings with run-length encoding
-func (diff LineDiffType) Encode() []byte {
+func (diff LineDiffType) Encode_v1() []byte {
 	var buf bytes.Buffer
 	viBuf := make([]byte, binary.MaxVarintLen64)
-	putUVarint(&buf, viBuf, LineDiffVersion)
+	putUVarint(&buf, viBuf, LineDiffVersion_1)
 	putEncodedString(&buf, viBuf, diff.SplitString)
 	putUVarint(&buf, viBuf, len(diff.Lines))
 	for _, entry := range diff.Lines {
@@ -139,6 +144,65 @@ func (diff LineDiffType) Encode() []byte {
 	return buf.Bytes()
 }
 
+// version 2 encodes each entry as a uvarint of (run<<1 | isOld), old entries are followed by a
+// signed varint of the line offset relative to the end of the previous old entry.
+// LCS diffs reference old lines in order, so the offsets are almost always 0 or small.
+func (diff LineDiffType) Encode() []byte {
+	var buf bytes.Buffer
+	viBuf := make([]byte, binary.MaxVarintLen64)
+	putUVarint(&buf, viBuf, LineDiffVersion)
+	putEncodedString(&buf, viBuf, diff.SplitString)
+	putUVarint(&buf, viBuf, len(diff.Lines))
+	oldPos := 0
+	for _, entry := range diff.Lines {
+		if entry.LineVal == 0 {
+			putUVarint(&buf, viBuf, entry.Run<<1)
+			continue
+		}
+		putUVarint(&buf, viBuf, entry.Run<<1|1)
+		l := binary.PutVarint(viBuf, int64(entry.LineVal-1-oldPos))
+		buf.Write(viBuf[0:l])
+		oldPos = entry.LineVal - 1 + entry.Run
+	}
+	writeEncodedStringArray(&buf, viBuf, diff.NewData)
+	return buf.Bytes()
+}
+
+func (rtn *LineDiffType) readEncodedRelativeLines(buf *bytes.Buffer) error {
+	linesLen64, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return fmt.Errorf("invalid diff, cannot read lines length: %v", err)
+	}
+	linesLen := int(linesLen64)
+	if linesLen > buf.Len() {
+		return fmt.Errorf("invalid diff, bad lines length: %d", linesLen)
+	}
+	rtn.Lines = make([]SingleLineEntry, linesLen)
+	oldPos := 0
+	for idx := 0; idx < linesLen; idx++ {
+		runVal64, err := binary.ReadUvarint(buf)
+		if err != nil {
+			return fmt.Errorf("invalid diff, cannot read line-run %d: %v", idx, err)
+		}
+		run := int(runVal64 >> 1)
+		if runVal64&1 == 0 {
+			rtn.Lines[idx] = SingleLineEntry{LineVal: 0, Run: run}
+			continue
+		}
+		offset, err := binary.ReadVarint(buf)
+		if err != nil {
+			return fmt.Errorf("invalid diff, cannot read line %d: %v", idx, err)
+		}
+		lineIdx := oldPos + int(offset)
+		if lineIdx < 0 {
+			return fmt.Errorf("invalid diff, bad line offset %d", idx)
+		}
+		rtn.Lines[idx] = SingleLineEntry{LineVal: lineIdx + 1, Run: run}
+		oldPos = lineIdx + run
+	}
+	return nil
+}
+
 func (rtn *LineDiffType) readEncodedLines(buf *bytes.Buffer) error {
 	linesLen64, err := binary.ReadUvarint(buf)
 	if err != nil {
@@ -194,7 +258,7 @@ func (rtn *LineDiffType) Decode(diffBytes []byte) error {
 	if version == LineDiffVersion_0 {
 		return rtn.Decode_v0(diffBytes)
 	}
-	if version != LineDiffVersion {
+	if version != LineDiffVersion_1 && version != LineDiffVersion {
 		return fmt.Errorf("invalid diff, bad version: %d", version)
 	}
 	rtn.Version = int(version)
@@ -203,7 +267,11 @@ func (rtn *LineDiffType) Decode(diffBytes []byte) error {
 		return fmt.Errorf("invalid diff, cannot read split-string: %v", err)
 	}
 	rtn.SplitString = splitString
-	err = rtn.readEncodedLines(r)
+	if version == LineDiffVersion_1 {
+		err = rtn.readEncodedLines(r)
+	} else {
+		err = rtn.readEncodedRelativeLines(r)
+	}
 	if err != nil {
 		return err
 	}
@@ -236,7 +304,179 @@ func (rtn *LineDiffType) Decode_v0(diffBytes []byte) error {
 	return nil
 }
 
+// returns the (oldIdx, newIdx) pairs of a longest common subsequence (in order), using Myers' O((N+M)D) algorithm.
+// returns false if the edit distance is larger than maxD
+func lcsMatches(a []int, b []int, maxD int) ([][2]int, bool) {
+	n, m := len(a), len(b)
+	if maxD > n+m {
+		maxD = n + m
+	}
+	offset := maxD + 1
+	v := make([]int, 2*maxD+3)
+	// trace[d] is the window v[-d-1 .. d+1] at the start of round d (indexed by k+d+1)
+	var trace [][]int
+	for d := 0; d <= maxD; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrackLcs(trace, n, m), true
+			}
+		}
+	}
+	return nil, false
+}
+
+func backtrackLcs(trace [][]int, x int, y int) [][2]int {
+	var rtn [][2]int
+	for d := len(trace) - 1; d > 0; d-- {
+		tv := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && tv[k-1+d+1] < tv[k+1+d+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := tv[prevK+d+1]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			rtn = append(rtn, [2]int{x, y})
+		}
+		x, y = prevX, prevY
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		rtn = append(rtn, [2]int{x, y})
+	}
+	for i, j := 0, len(rtn)-1; i < j; i, j = i+1, j-1 {
+		rtn[i], rtn[j] = rtn[j], rtn[i]
+	}
+	return rtn
+}
+
+// returns newToOld (-1 for lines not in the LCS), or false if the edit distance is too large
+func matchLines(oldData []string, newData []string) ([]int, bool) {
+	newToOld := make([]int, len(newData))
+	for idx := range newToOld {
+		newToOld[idx] = -1
+	}
+	// common prefix and suffix are matched directly (keeps Myers small)
+	prefixLen := 0
+	for prefixLen < len(oldData) && prefixLen < len(newData) && oldData[prefixLen] == newData[prefixLen] {
+		newToOld[prefixLen] = prefixLen
+		prefixLen++
+	}
+	suffixLen := 0
+	for suffixLen < len(oldData)-prefixLen && suffixLen < len(newData)-prefixLen && oldData[len(oldData)-1-suffixLen] == newData[len(newData)-1-suffixLen] {
+		newToOld[len(newData)-1-suffixLen] = len(oldData) - 1 - suffixLen
+		suffixLen++
+	}
+	oldMid := oldData[prefixLen : len(oldData)-suffixLen]
+	newMid := newData[prefixLen : len(newData)-suffixLen]
+	if len(oldMid) == 0 || len(newMid) == 0 {
+		return newToOld, true
+	}
+	lineIds := make(map[string]int)
+	toIds := func(lines []string) []int {
+		rtn := make([]int, len(lines))
+		for idx, line := range lines {
+			id, found := lineIds[line]
+			if !found {
+				id = len(lineIds)
+				lineIds[line] = id
+			}
+			rtn[idx] = id
+		}
+		return rtn
+	}
+	matches, ok := lcsMatches(toIds(oldMid), toIds(newMid), MaxLineDiffEditDistance)
+	if !ok {
+		return nil, false
+	}
+	for _, match := range matches {
+		newToOld[prefixLen+match[1]] = prefixLen + match[0]
+	}
+	return newToOld, true
+}
+
+// LCS based diff.  lines in the LCS reference their matched old line, other lines reference an equal
+// old line if there is one (so moved lines are not stored again), and the rest are stored in NewData.
 func makeLineDiff(oldData []string, newData []string, splitString string) LineDiffType {
+	newToOld, ok := matchLines(oldData, newData)
+	if !ok {
+		return makeGreedyLineDiff(oldData, newData, splitString)
+	}
+	var rtn LineDiffType
+	rtn.Version = LineDiffVersion
+	rtn.SplitString = splitString
+	rtn.Lines = make([]SingleLineEntry, 0)
+	oldDataMap := make(map[string]int) // 0-indexed
+	for idx, str := range oldData {
+		if _, found := oldDataMap[str]; !found {
+			oldDataMap[str] = idx
+		}
+	}
+	var cur *SingleLineEntry
+	addOld := func(oldIdx int) {
+		if cur != nil && cur.LineVal != 0 && cur.LineVal-1+cur.Run == oldIdx {
+			cur.Run++
+			return
+		}
+		if cur != nil {
+			rtn.Lines = append(rtn.Lines, *cur)
+		}
+		cur = &SingleLineEntry{LineVal: oldIdx + 1, Run: 1}
+	}
+	for newIdx, str := range newData {
+		if oldIdx := newToOld[newIdx]; oldIdx >= 0 {
+			addOld(oldIdx)
+			continue
+		}
+		if cur != nil && cur.LineVal != 0 {
+			nextOld := cur.LineVal - 1 + cur.Run
+			if nextOld < len(oldData) && oldData[nextOld] == str {
+				addOld(nextOld)
+				continue
+			}
+		}
+		if oldIdx, found := oldDataMap[str]; found {
+			addOld(oldIdx)
+			continue
+		}
+		rtn.NewData = append(rtn.NewData, str)
+		if cur != nil && cur.LineVal == 0 {
+			cur.Run++
+			continue
+		}
+		if cur != nil {
+			rtn.Lines = append(rtn.Lines, *cur)
+		}
+		cur = &SingleLineEntry{LineVal: 0, Run: 1}
+	}
+	if cur != nil {
+		rtn.Lines = append(rtn.Lines, *cur)
+	}
+	return rtn
+}
+
+// maps each new line to its first occurrence in the old data and extends runs greedily.
+// linear, but duplicate lines and reorderings produce large diffs (used when the edit distance is too large for LCS)
+func makeGreedyLineDiff(oldData []string, newData []string, splitString string) LineDiffType {
 	var rtn LineDiffType
 	rtn.Version = LineDiffVersion
 	rtn.SplitString = splitString
@@ -6,6 +6,8 @@ package statediff
 import (
 	"encoding/binary"
 	"fmt"
+	"math/rand"
+	"os/exec"
 	"strings"
 	"testing"
 
@@ -138,6 +140,73 @@ func TestLineDiffVersion0(t *testing.T) {
 	}
 }
 
+func TestLineDiffVersion1(t *testing.T) {
+	str1 := strings.Join([]string{"a", "b", "c", "d", "e"}, "\n")
+	str2 := strings.Join([]string{"a", "x", "e", "b"}, "\n")
+	diff := makeGreedyLineDiff(strings.Split(str1, "\n"), strings.Split(str2, "\n"), "\n")
+	encDiff1 := diff.Encode_v1()
+	var decDiff LineDiffType
+	err := decDiff.Decode(encDiff1)
+	if err != nil {
+		t.Fatalf("error decoding diff: %v\n", err)
+	}
+	if decDiff.Version != LineDiffVersion_1 {
+		t.Errorf("bad version")
+	}
+	out, err := ApplyLineDiff(str1, encDiff1)
+	if err != nil {
+		t.Fatalf("error in diff: %v", err)
+	}
+	if out != str2 {
+		t.Errorf("bad diff output")
+	}
+}
+
+func TestLineDiffLCS(t *testing.T) {
+	// the greedy diff maps the duplicate "}" to its first occurrence, which breaks up the following run
+	oldLines := []string{"f1 ()", "{", "}", "f2 ()", "{", "    b", "}", "f3 ()", "{", "    c", "}"}
+	newLines := []string{"f1 ()", "{", "}", "f2 ()", "{", "    b", "    b2", "}", "f3 ()", "{", "    c", "}"}
+	oldStr := strings.Join(oldLines, "\n")
+	newStr := strings.Join(newLines, "\n")
+	diff := makeLineDiff(oldLines, newLines, "\n")
+	if len(diff.Lines) != 3 || len(diff.NewData) != 1 {
+		t.Errorf("expected LCS diff with 3 entries and 1 new line, got:")
+		diff.Dump()
+	}
+	greedyDiff := makeGreedyLineDiff(oldLines, newLines, "\n")
+	if len(diff.Lines) >= len(greedyDiff.Lines) {
+		t.Errorf("expected LCS diff (%d entries) to be smaller than greedy diff (%d entries)", len(diff.Lines), len(greedyDiff.Lines))
+	}
+	testLineDiff(t, oldStr, newStr, "\n")
+	testLineDiff(t, newStr, oldStr, "\n")
+
+	// random edits (small alphabet, lots of duplicates) always round-trip
+	rng := rand.New(rand.NewSource(1))
+	randLines := func(n int) []string {
+		var rtn []string
+		for i := 0; i < n; i++ {
+			rtn = append(rtn, string(rune('a'+rng.Intn(5))))
+		}
+		return rtn
+	}
+	for i := 0; i < 200; i++ {
+		testLineDiff(t, strings.Join(randLines(rng.Intn(30)), "\n"), strings.Join(randLines(rng.Intn(30)), "\n"), "\n")
+	}
+}
+
+// edit distance beyond MaxLineDiffEditDistance falls back to the greedy diff
+func TestLineDiffLarge(t *testing.T) {
+	var oldLines, newLines []string
+	for i := 0; i <= MaxLineDiffEditDistance; i++ {
+		oldLines = append(oldLines, fmt.Sprintf("old %d", i))
+		newLines = append(newLines, fmt.Sprintf("new %d", i), fmt.Sprintf("old %d", i))
+	}
+	if _, ok := matchLines(oldLines, newLines); ok {
+		t.Errorf("expected edit distance to exceed the max")
+	}
+	testLineDiff(t, strings.Join(oldLines, "\n"), strings.Join(newLines, "\n"), "\n")
+}
+
 func TestMapDiff(t *testing.T) {
 	m1 := map[string][]byte{"a": []byte("5"), "b": []byte("hello"), "c": []byte("mike")}
 	m2 := map[string][]byte{"a": []byte("5"), "b": []byte("goodbye"), "d": []byte("more")}
@@ -185,3 +254,88 @@ func TestVarint(t *testing.T) {
 	viLen = binary.PutUvarint(viBuf, 1)
 	fmt.Printf("%#v\n", viBuf[0:viLen])
 }
+
+// real state dumps (from the local shells, benchmarks are skipped if they are not installed)
+func getStateDump(b *testing.B, shell string, cmdStr string) string {
+	if _, err := exec.LookPath(shell); err != nil {
+		b.Skipf("%s not installed", shell)
+	}
+	out, err := exec.Command(shell, "-c", cmdStr).Output()
+	if err != nil || len(out) == 0 {
+		b.Skipf("cannot get %s state dump: %v", shell, err)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// the previous diff (greedy, v1 encoding) vs the LCS diff (v2 encoding).
+// typical edits between two commands: a line added to a function, lines removed, one line changed, and a block moved
+func makeStateDumpEdits(lines []string) map[string][]string {
+	// edit right before a duplicated line (the end of a function) near the middle of the dump
+	mid := len(lines) / 2
+	for mid < len(lines)-1 && lines[mid] != "}" {
+		mid++
+	}
+	rtn := make(map[string][]string)
+	insert := []string{"    echo new"}
+	rtn["insert"] = append(append(append([]string{}, lines[:mid]...), insert...), lines[mid:]...)
+	deleteStart := mid - 10
+	if deleteStart < 0 {
+		deleteStart = 0
+	}
+	rtn["delete"] = append(append([]string{}, lines[:deleteStart]...), lines[mid:]...)
+	changed := append([]string{}, lines...)
+	changeIdx := mid - 1
+	if changeIdx < 0 {
+		changeIdx = 0
+	}
+	if changeIdx < len(changed) {
+		changed[changeIdx] = changed[changeIdx] + " # changed"
+	}
+	rtn["change"] = changed
+	blockEnd := mid + 20
+	if blockEnd > len(lines) {
+		blockEnd = len(lines)
+	}
+	moved := append(append([]string{}, lines[mid:blockEnd]...), lines[:mid]...)
+	rtn["move"] = append(moved, lines[blockEnd:]...)
+	return rtn
+}
+
+func benchmarkStateDump(b *testing.B, dump string) {
+	oldLines := strings.Split(dump, "\n")
+	edits := makeStateDumpEdits(oldLines)
+	for _, editName := range []string{"insert", "delete", "change", "move"} {
+		newLines := edits[editName]
+		b.Run(editName+"/v1", func(b *testing.B) {
+			var size int
+			for i := 0; i < b.N; i++ {
+				diff := makeGreedyLineDiff(oldLines, newLines, "\n")
+				size = len(diff.Encode_v1())
+			}
+			b.ReportMetric(float64(size), "bytes")
+		})
+		b.Run(editName+"/lcs", func(b *testing.B) {
+			var size int
+			for i := 0; i < b.N; i++ {
+				diff := makeLineDiff(oldLines, newLines, "\n")
+				size = len(diff.Encode())
+			}
+			b.ReportMetric(float64(size), "bytes")
+		})
+	}
+}
+
+func BenchmarkLineDiffBashFuncs(b *testing.B) {
+	dump := getStateDump(b, "bash", `for f in /usr/share/bash-completion/bash_completion /usr/share/bash-completion/completions/*; do source "$f"; done 2>/dev/null; declare -f`)
+	benchmarkStateDump(b, dump)
+}
+
+func BenchmarkLineDiffZshFuncs(b *testing.B) {
+	dump := getStateDump(b, "zsh", `autoload -U compinit && compinit -u && for f in ${(k)functions}; do autoload +X $f 2>/dev/null; done; functions`)
+	benchmarkStateDump(b, dump)
+}
+
+func BenchmarkLineDiffZshAliases(b *testing.B) {
+	dump := getStateDump(b, "zsh", `source ~/.zshrc 2>/dev/null; alias -L`)
+	benchmarkStateDump(b, dump)
+}
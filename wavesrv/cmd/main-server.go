@@ -64,6 +64,11 @@ const InitialTelemetryWait = 30 * time.Second
 const TelemetryTick = 30 * time.Minute
 const TelemetryInterval = 8 * time.Hour
 
+const InitialPtyCompressWait = 2 * time.Minute
+const PtyCompressInterval = 10 * time.Minute
+const InitialRetentionWait = 5 * time.Minute
+const RetentionInterval = 1 * time.Hour
+
 const MaxWriteFileMemSize = 20 * (1024 * 1024) // 20M
 
 // these are set at build time
@@ -327,7 +332,30 @@ func HandleGetPtyOut(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(fmt.Sprintf(ErrorInvalidLineId, err)))
 		return
 	}
-	realOffset, data, err := sstore.ReadFullPtyOutFile(r.Context(), screenId, lineId)
+	if qvals.Get("index") == "1" {
+		entries, err := sstore.ReadPtyOutIndex(r.Context(), screenId, lineId)
+		if err != nil {
+			WriteJsonError(w, err)
+			return
+		}
+		WriteJsonSuccess(w, entries)
+		return
+	}
+	var realOffset int64
+	var data []byte
+	var err error
+	if qvals.Get("startts") != "" || qvals.Get("endts") != "" {
+		// output by time range (unix millis), requires a pty file with an index
+		startTs, endTs, parseErr := parsePtyOutTimeRange(qvals.Get("startts"), qvals.Get("endts"))
+		if parseErr != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(html.EscapeString(parseErr.Error())))
+			return
+		}
+		realOffset, data, err = sstore.ReadPtyOutFileTimeRange(r.Context(), screenId, lineId, startTs, endTs, 0)
+	} else {
+		realOffset, data, err = sstore.ReadFullPtyOutFile(r.Context(), screenId, lineId)
+	}
 	if err != nil {
 		if errors.Is(err, fs.ErrNotExist) {
 			w.WriteHeader(http.StatusOK)
@@ -342,6 +370,27 @@ func HandleGetPtyOut(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
+func parsePtyOutTimeRange(startStr string, endStr string) (int64, int64, error) {
+	var startTs, endTs int64
+	var err error
+	if startStr != "" {
+		startTs, err = strconv.ParseInt(startStr, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid startts: %v", err)
+		}
+	}
+	if endStr != "" {
+		endTs, err = strconv.ParseInt(endStr, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid endts: %v", err)
+		}
+	}
+	if endTs > 0 && endTs <= startTs {
+		return 0, 0, fmt.Errorf("endts must be greater than startts")
+	}
+	return startTs, endTs, nil
+}
+
 type writeFileParamsType struct {
 	ScreenId string `json:"screenid"`
 	LineId   string `json:"lineid"`
@@ -767,6 +816,73 @@ func telemetryLoop() {
 	}
 }
 
+func compressPtyFilesWrapper() {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		log.Printf("[error] in compressPtyFilesWrapper: %v\n", r)
+		debug.PrintStack()
+	}()
+	ctx, cancelFn := context.WithTimeout(context.Background(), PtyCompressInterval)
+	defer cancelFn()
+	numCompressed, err := sstore.CompressDonePtyFiles(ctx)
+	if err != nil {
+		log.Printf("[error] compressing pty files: %v\n", err)
+	}
+	if numCompressed > 0 {
+		log.Printf("[wave] compressed %d pty files\n", numCompressed)
+	}
+}
+
+// compresses the pty files of finished commands (see sstore.CompressDonePtyFiles)
+func ptyCompressLoop() {
+	time.Sleep(InitialPtyCompressWait)
+	for {
+		compressPtyFilesWrapper()
+		time.Sleep(PtyCompressInterval)
+	}
+}
+
+func retentionWrapper() {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		log.Printf("[error] in retentionWrapper: %v\n", r)
+		debug.PrintStack()
+	}()
+	ctx, cancelFn := context.WithTimeout(context.Background(), RetentionInterval)
+	defer cancelFn()
+	clientData, err := sstore.EnsureClientData(ctx)
+	if err != nil {
+		log.Printf("[error] retention, cannot get client data: %v\n", err)
+		return
+	}
+	opts := clientData.ClientOpts.Retention
+	if opts.IsEmpty() {
+		return
+	}
+	result, err := sstore.RunRetention(ctx, *opts, false)
+	if err != nil {
+		log.Printf("[error] applying retention rules: %v\n", err)
+	}
+	if result != nil && result.NumApplied > 0 {
+		log.Printf("[wave] retention applied %d actions (%d skipped), freed %d bytes\n", result.NumApplied, result.NumSkipped, result.FreedSize)
+	}
+}
+
+// applies the client retention rules (see sstore.RunRetention)
+func retentionLoop() {
+	time.Sleep(InitialRetentionWait)
+	for {
+		retentionWrapper()
+		time.Sleep(RetentionInterval)
+	}
+}
+
 // watch stdin, kill server if stdin is closed
 func stdinReadWatch() {
 	buf := make([]byte, 1024)
@@ -830,6 +946,20 @@ func main() {
 		log.Printf("[error] cannot acquire wave lock (another instance of wavesrv is likely running): %v\n", err)
 		return
 	}
+	if len(os.Args) >= 2 && os.Args[1] == "--restore" {
+		// restores a /db:backup file (before the db is opened), the db is migrated up on the next start
+		if len(os.Args) < 3 {
+			log.Printf("[error] usage: wavesrv --restore [backup-file]\n")
+			return
+		}
+		manifest, err := sstore.RestoreBackup(os.Args[2])
+		if err != nil {
+			log.Printf("[error] restore: %v\n", err)
+			return
+		}
+		log.Printf("[wave] restored backup %q (db version %d, created %s), previous data saved with prefix %q\n", os.Args[2], manifest.DBVersion, time.UnixMilli(manifest.CreatedTs).Format(time.RFC3339), sstore.PreRestorePrefix)
+		return
+	}
 	if len(os.Args) >= 2 && strings.HasPrefix(os.Args[1], "--migrate") {
 		err := sstore.MigrateCommandOpts(os.Args[1:])
 		if err != nil {
@@ -848,12 +978,18 @@ func main() {
 		log.Printf("[error] migrate up: %v\n", err)
 		return
 	}
+	err = sstore.EnsureHistoryFts(context.Background())
+	if err != nil {
+		// non-fatal, history search falls back to LIKE queries
+		log.Printf("[error] ensuring history fts index: %v\n", err)
+	}
 	clientData, err := sstore.EnsureClientData(context.Background())
 	if err != nil {
 		log.Printf("[error] ensuring client data: %v\n", err)
 		return
 	}
 	log.Printf("userid = %s\n", clientData.UserId)
+	remote.SetReadWindow(clientData.ClientOpts.ReadWindow)
 	err = sstore.EnsureLocalRemote(context.Background())
 	if err != nil {
 		log.Printf("[error] ensuring local remote: %v\n", err)
@@ -883,6 +1019,8 @@ func main() {
 	sstore.UpdateActivityWrap(context.Background(), sstore.ActivityUpdate{NumConns: remote.NumRemotes()}, "numconns") // set at least one record into activity
 	installSignalHandlers()
 	go telemetryLoop()
+	go ptyCompressLoop()
+	go retentionLoop()
 	go stdinReadWatch()
 	go runWebSocketServer()
 	go func() {
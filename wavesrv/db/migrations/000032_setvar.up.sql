@@ -0,0 +1,8 @@
+CREATE TABLE setvar (
+    scope varchar(20) NOT NULL,
+    scopeid varchar(36) NOT NULL,
+    name varchar(50) NOT NULL,
+    value text NOT NULL,
+    updatedts bigint NOT NULL,
+    PRIMARY KEY (scope, scopeid, name)
+);
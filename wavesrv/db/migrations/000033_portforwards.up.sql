@@ -0,0 +1 @@
+ALTER TABLE remote ADD COLUMN portforwards json NOT NULL DEFAULT '[]';
@@ -0,0 +1 @@
+ALTER TABLE cmd ADD COLUMN rusage json NOT NULL DEFAULT 'null';
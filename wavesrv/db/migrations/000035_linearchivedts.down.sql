@@ -0,0 +1 @@
+ALTER TABLE line DROP COLUMN archivedts;
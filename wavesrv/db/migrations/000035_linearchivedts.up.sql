@@ -0,0 +1,3 @@
+ALTER TABLE line ADD COLUMN archivedts bigint NOT NULL DEFAULT 0;
+-- the archive time of already archived lines is unknown, age them from now
+UPDATE line SET archivedts = CAST(strftime('%s', 'now') AS INTEGER) * 1000 WHERE archived;
@@ -0,0 +1,33 @@
+-- the FTS index (created at startup, see EnsureHistoryFts) is keyed off historyrowid
+DROP TRIGGER IF EXISTS history_fts_ai;
+DROP TRIGGER IF EXISTS history_fts_ad;
+DROP TRIGGER IF EXISTS history_fts_au;
+DROP TABLE IF EXISTS history_fts;
+
+CREATE TABLE history_old (
+    historyid varchar(36) PRIMARY KEY,
+    ts bigint NOT NULL,
+    userid varchar(36) NOT NULL,
+    sessionid varchar(36) NOT NULL,
+    screenid varchar(36) NOT NULL,
+    lineid int NOT NULL,
+    remoteownerid varchar(36) NOT NULL,
+    remoteid varchar(36) NOT NULL,
+    remotename varchar(50) NOT NULL,
+    haderror boolean NOT NULL,
+    cmdstr text NOT NULL,
+    ismetacmd boolean,
+    linenum int NOT NULL DEFAULT 0,
+    exitcode int NULL DEFAULT NULL,
+    durationms int NULL DEFAULT NULL,
+    festate json NOT NULL DEFAULT '{}',
+    tags json NOT NULL DEFAULT '{}',
+    status varchar(10) NOT NULL DEFAULT 'unknown'
+);
+
+INSERT INTO history_old (historyid, ts, userid, sessionid, screenid, lineid, remoteownerid, remoteid, remotename, haderror, cmdstr, ismetacmd, linenum, exitcode, durationms, festate, tags, status)
+SELECT historyid, ts, userid, sessionid, screenid, lineid, remoteownerid, remoteid, remotename, haderror, cmdstr, ismetacmd, linenum, exitcode, durationms, festate, tags, status
+FROM history;
+
+DROP TABLE history;
+ALTER TABLE history_old RENAME TO history;
@@ -0,0 +1,28 @@
+CREATE TABLE history_new (
+    historyrowid INTEGER PRIMARY KEY,
+    historyid varchar(36) NOT NULL UNIQUE,
+    ts bigint NOT NULL,
+    userid varchar(36) NOT NULL,
+    sessionid varchar(36) NOT NULL,
+    screenid varchar(36) NOT NULL,
+    lineid int NOT NULL,
+    remoteownerid varchar(36) NOT NULL,
+    remoteid varchar(36) NOT NULL,
+    remotename varchar(50) NOT NULL,
+    haderror boolean NOT NULL,
+    cmdstr text NOT NULL,
+    ismetacmd boolean,
+    linenum int NOT NULL DEFAULT 0,
+    exitcode int NULL DEFAULT NULL,
+    durationms int NULL DEFAULT NULL,
+    festate json NOT NULL DEFAULT '{}',
+    tags json NOT NULL DEFAULT '{}',
+    status varchar(10) NOT NULL DEFAULT 'unknown'
+);
+
+INSERT INTO history_new (historyrowid, historyid, ts, userid, sessionid, screenid, lineid, remoteownerid, remoteid, remotename, haderror, cmdstr, ismetacmd, linenum, exitcode, durationms, festate, tags, status)
+SELECT rowid, historyid, ts, userid, sessionid, screenid, lineid, remoteownerid, remoteid, remotename, haderror, cmdstr, ismetacmd, linenum, exitcode, durationms, festate, tags, status
+FROM history;
+
+DROP TABLE history;
+ALTER TABLE history_new RENAME TO history;
@@ -0,0 +1,194 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmdrunner
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+	"unicode/utf8"
+
+	"github.com/wavetermdev/waveterm/waveshell/pkg/cirfile"
+)
+
+const LineExportFormat_Asciicast = "asciicast"
+
+// asciinema v2 (https://docs.asciinema.org/manual/asciicast/v2/)
+// a json header line, followed by one [time, type, data] json array per line (time is in seconds)
+const AsciicastVersion = 2
+const AsciicastEventType_Output = "o"
+const MaxAsciicastFileSize = 50 * 1024 * 1024
+const AsciicastMinFrameMs = 10 // replayed events closer together than this are written together
+
+type asciicastHeader struct {
+	Version       int     `json:"version"`
+	Width         int     `json:"width"`
+	Height        int     `json:"height"`
+	Timestamp     int64   `json:"timestamp,omitempty"`
+	IdleTimeLimit float64 `json:"idle_time_limit,omitempty"`
+	Title         string  `json:"title,omitempty"`
+}
+
+type asciicastEvent struct {
+	Time float64
+	Data string
+}
+
+// returns (complete, tail) where tail is an incomplete utf-8 sequence at the end of data (if any)
+func splitUtf8Tail(data []byte) ([]byte, []byte) {
+	for idx := len(data) - 1; idx >= 0 && idx >= len(data)-utf8.UTFMax; idx-- {
+		if !utf8.RuneStart(data[idx]) {
+			continue
+		}
+		if !utf8.FullRune(data[idx:]) {
+			return data[0:idx], data[idx:]
+		}
+		break
+	}
+	return data, nil
+}
+
+// converts pty output into asciicast events.  data starts at baseOffset, entries is the (cirfile) timing
+// index for data.  each index entry becomes an event, times are relative to the first entry.
+// without an index all of the output is a single event at time 0.
+func makeAsciicastEvents(data []byte, baseOffset int64, entries []cirfile.IndexEntry) []asciicastEvent {
+	var rtn []asciicastEvent
+	var carry []byte
+	var lastMs int64
+	addEvent := func(ms int64, chunk []byte) {
+		chunk = append(carry, chunk...)
+		chunk, carry = splitUtf8Tail(chunk)
+		carry = append([]byte(nil), carry...)
+		lastMs = ms
+		if len(chunk) > 0 {
+			rtn = append(rtn, asciicastEvent{Time: float64(ms) / 1000, Data: string(chunk)})
+		}
+	}
+	var startTs int64
+	if len(entries) > 0 {
+		startTs = entries[0].Ts
+	}
+	pos := int64(0)
+	for idx, entry := range entries {
+		if idx+1 < len(entries) && entries[idx+1].Offset <= baseOffset {
+			continue
+		}
+		endPos := int64(len(data))
+		if idx+1 < len(entries) && entries[idx+1].Offset-baseOffset < endPos {
+			endPos = entries[idx+1].Offset - baseOffset
+		}
+		if endPos <= pos {
+			continue
+		}
+		addEvent(entry.Ts-startTs, data[pos:endPos])
+		pos = endPos
+	}
+	if pos < int64(len(data)) {
+		addEvent(lastMs, data[pos:])
+	}
+	if len(carry) > 0 {
+		// truncated utf-8 at the end of the output (encoded as U+FFFD)
+		rtn = append(rtn, asciicastEvent{Time: float64(lastMs) / 1000, Data: string(carry)})
+	}
+	return rtn
+}
+
+func writeAsciicast(w io.Writer, header asciicastHeader, events []asciicastEvent) error {
+	bufw := bufio.NewWriter(w)
+	barr, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	bufw.Write(barr)
+	bufw.WriteByte('\n')
+	for _, event := range events {
+		barr, err = json.Marshal([]interface{}{event.Time, AsciicastEventType_Output, event.Data})
+		if err != nil {
+			return err
+		}
+		bufw.Write(barr)
+		bufw.WriteByte('\n')
+	}
+	return bufw.Flush()
+}
+
+// only output ("o") events are returned, other event types (input, markers, resize) are skipped
+func readAsciicast(r io.Reader) (*asciicastHeader, []asciicastEvent, error) {
+	bufr := bufio.NewReader(r)
+	var header *asciicastHeader
+	var rtn []asciicastEvent
+	lineNum := 0
+	for {
+		line, readErr := bufr.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return nil, nil, readErr
+		}
+		lineNum++
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			if header == nil {
+				header = &asciicastHeader{}
+				err := json.Unmarshal(line, header)
+				if err != nil {
+					return nil, nil, fmt.Errorf("invalid asciicast header: %v", err)
+				}
+				if header.Version != AsciicastVersion {
+					return nil, nil, fmt.Errorf("unsupported asciicast version %d (only v%d is supported)", header.Version, AsciicastVersion)
+				}
+			} else {
+				var eventArr []json.RawMessage
+				err := json.Unmarshal(line, &eventArr)
+				if err != nil || len(eventArr) < 3 {
+					return nil, nil, fmt.Errorf("invalid asciicast event on line %d", lineNum)
+				}
+				var event asciicastEvent
+				var eventType string
+				if json.Unmarshal(eventArr[0], &event.Time) != nil || json.Unmarshal(eventArr[1], &eventType) != nil || json.Unmarshal(eventArr[2], &event.Data) != nil {
+					return nil, nil, fmt.Errorf("invalid asciicast event on line %d", lineNum)
+				}
+				if eventType == AsciicastEventType_Output {
+					rtn = append(rtn, event)
+				}
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+	}
+	if header == nil {
+		return nil, nil, fmt.Errorf("empty asciicast file")
+	}
+	return header, rtn, nil
+}
+
+type asciicastFrame struct {
+	Delay time.Duration // delay before writing Data
+	Data  string
+}
+
+// groups events into frames for replay.  delays are divided by speed and capped at maxWait (0 is no cap),
+// events less than AsciicastMinFrameMs apart (after scaling) are merged into one frame
+func makeAsciicastFrames(events []asciicastEvent, speed float64, maxWait time.Duration) []asciicastFrame {
+	var rtn []asciicastFrame
+	var frameTime float64 // event time of the current frame
+	for _, event := range events {
+		delay := time.Duration((event.Time - frameTime) / speed * float64(time.Second))
+		if len(rtn) > 0 && delay < AsciicastMinFrameMs*time.Millisecond {
+			rtn[len(rtn)-1].Data += event.Data
+			continue
+		}
+		if delay < 0 {
+			delay = 0
+		}
+		if maxWait > 0 && delay > maxWait {
+			delay = maxWait
+		}
+		frameTime = event.Time
+		rtn = append(rtn, asciicastFrame{Delay: delay, Data: event.Data})
+	}
+	return rtn
+}
@@ -0,0 +1,85 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmdrunner
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wavetermdev/waveterm/waveshell/pkg/cirfile"
+)
+
+func TestAsciicastRoundTrip(t *testing.T) {
+	// "é" is split across the index entries at offset 108
+	data := []byte("hello\r\n\xc3\xa9 world\r\n")
+	entries := []cirfile.IndexEntry{{Offset: 100, Ts: 5000}, {Offset: 108, Ts: 5250}, {Offset: 112, Ts: 7000}}
+	events := makeAsciicastEvents(data, 100, entries)
+	if len(events) != 3 {
+		t.Fatalf("bad events: %#v", events)
+	}
+	if events[0].Time != 0 || events[0].Data != "hello\r\n" {
+		t.Errorf("bad first event: %#v", events[0])
+	}
+	if events[1].Time != 0.25 || events[1].Data != "é wo" {
+		t.Errorf("bad second event: %#v", events[1])
+	}
+	if events[2].Time != 2 || events[2].Data != "rld\r\n" {
+		t.Errorf("bad third event: %#v", events[2])
+	}
+	var buf bytes.Buffer
+	header := asciicastHeader{Version: AsciicastVersion, Width: 120, Height: 40, Timestamp: 1700000000, Title: "ls"}
+	err := writeAsciicast(&buf, header, events)
+	if err != nil {
+		t.Fatalf("error writing: %v", err)
+	}
+	if !strings.HasPrefix(buf.String(), `{"version":2,"width":120,"height":40,"timestamp":1700000000,"title":"ls"}`+"\n[0,\"o\",\"hello\\r\\n\"]\n") {
+		t.Errorf("bad asciicast output: %q", buf.String())
+	}
+	// extra event types are skipped
+	buf.WriteString(`[2.5, "i", "q"]` + "\n" + `[3, "m", ""]`)
+	rtnHeader, rtnEvents, err := readAsciicast(&buf)
+	if err != nil {
+		t.Fatalf("error reading: %v", err)
+	}
+	if *rtnHeader != header {
+		t.Errorf("bad header: %#v", rtnHeader)
+	}
+	if len(rtnEvents) != len(events) {
+		t.Fatalf("bad read events: %#v", rtnEvents)
+	}
+	for idx := range events {
+		if rtnEvents[idx] != events[idx] {
+			t.Errorf("event %d mismatch: %#v %#v", idx, rtnEvents[idx], events[idx])
+		}
+	}
+	// no index
+	events = makeAsciicastEvents(data, 0, nil)
+	if len(events) != 1 || events[0].Time != 0 || events[0].Data != string(data) {
+		t.Errorf("bad no-index events: %#v", events)
+	}
+	_, _, err = readAsciicast(strings.NewReader(`{"version":1,"width":80,"height":24}`))
+	if err == nil {
+		t.Errorf("v1 should not be supported")
+	}
+}
+
+func TestAsciicastFrames(t *testing.T) {
+	events := []asciicastEvent{{0, "a"}, {0.004, "b"}, {0.008, "c"}, {0.012, "d"}, {10, "e"}}
+	frames := makeAsciicastFrames(events, 1, 2*time.Second)
+	if len(frames) != 3 {
+		t.Fatalf("bad frames: %#v", frames)
+	}
+	if frames[0].Data != "abc" || frames[1].Data != "d" || frames[1].Delay != 12*time.Millisecond {
+		t.Errorf("bad merged frames: %#v", frames)
+	}
+	if frames[2].Delay != 2*time.Second {
+		t.Errorf("maxwait not applied: %#v", frames[2])
+	}
+	frames = makeAsciicastFrames(events, 4, 0)
+	if len(frames) != 2 || frames[0].Data != "abcd" || frames[1].Delay != 2500*time.Millisecond {
+		t.Errorf("bad speed frames: %#v", frames)
+	}
+}
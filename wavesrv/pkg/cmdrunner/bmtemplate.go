@@ -0,0 +1,70 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmdrunner
+
+import (
+	"regexp"
+	"unicode/utf8"
+
+	"github.com/wavetermdev/waveterm/waveshell/pkg/utilfn"
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/shparse"
+)
+
+// bookmark templates use {{name}} placeholders, e.g. "ssh {{host}} git checkout {{branch}}"
+var bmPlaceholderRe = regexp.MustCompile(`\{\{([a-zA-Z_][a-zA-Z0-9_-]*)\}\}`)
+
+// returns the unique placeholder names in order of first appearance
+func getBookmarkPlaceholders(cmdStr string) []string {
+	var rtn []string
+	seen := make(map[string]bool)
+	for _, m := range bmPlaceholderRe.FindAllStringSubmatch(cmdStr, -1) {
+		if seen[m[1]] {
+			continue
+		}
+		seen[m[1]] = true
+		rtn = append(rtn, m[1])
+	}
+	return rtn
+}
+
+// the kwargs for running the expanded command, template params are removed (they are only values for
+// the template, so a param named like a /run kwarg, e.g. {{wterm}}, does not change how the command runs)
+func makeBookmarkRunKwargs(kwargs map[string]string, cmdStr string) map[string]string {
+	params := getBookmarkPlaceholders(cmdStr)
+	rtn := make(map[string]string)
+	for key, val := range kwargs {
+		if utilfn.ContainsStr(params, key) {
+			continue
+		}
+		rtn[key] = val
+	}
+	return rtn
+}
+
+// substitutes each placeholder with its value.  values are inserted using shparse's completion
+// extension, so they are quoted correctly for the context they appear in (bare word, single quotes,
+// double quotes, etc.).  substituted values are never re-scanned for placeholders.
+func expandBookmarkTemplate(cmdStr string, values map[string]string) string {
+	searchStart := 0
+	for {
+		loc := bmPlaceholderRe.FindStringSubmatchIndex(cmdStr[searchStart:])
+		if loc == nil {
+			return cmdStr
+		}
+		startIdx := searchStart + loc[0]
+		endIdx := searchStart + loc[1]
+		name := cmdStr[searchStart+loc[2] : searchStart+loc[3]]
+		baseStr := cmdStr[:startIdx] + cmdStr[endIdx:]
+		sp := utilfn.StrWithPos{Str: baseStr, Pos: utf8.RuneCountInString(baseStr[:startIdx])}
+		value := values[name]
+		if value != "" {
+			words := shparse.Tokenize(sp.Str)
+			cmds := shparse.ParseCommands(words)
+			cpos := shparse.FindCompletionPos(cmds, sp.Pos)
+			sp = cpos.Extend(sp, value, false)
+		}
+		cmdStr = sp.Str
+		searchStart = len(string([]rune(sp.Str)[:sp.Pos]))
+	}
+}
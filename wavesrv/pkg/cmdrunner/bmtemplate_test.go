@@ -0,0 +1,41 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmdrunner
+
+import (
+	"testing"
+)
+
+func testExpandBookmark(t *testing.T, cmdStr string, values map[string]string, expected string) {
+	rtn := expandBookmarkTemplate(cmdStr, values)
+	if rtn != expected {
+		t.Errorf("expand bookmark %q => %q, expected %q", cmdStr, rtn, expected)
+	}
+}
+
+func TestExpandBookmarkTemplate(t *testing.T) {
+	testExpandBookmark(t, "ssh {{host}}", map[string]string{"host": "myhost"}, "ssh myhost")
+	testExpandBookmark(t, "ls {{dir}}", map[string]string{"dir": "foo bar"}, `ls foo\ bar`)
+	testExpandBookmark(t, "echo {{x}}", map[string]string{"x": "$(rm -rf /)"}, `echo \$\(rm\ -rf\ /\)`)
+	testExpandBookmark(t, `git commit -m "{{msg}}"`, map[string]string{"msg": `say "hi" $HOME`}, `git commit -m "say \"hi\" \$HOME"`)
+	testExpandBookmark(t, `echo '{{x}}'`, map[string]string{"x": "it's"}, `echo 'it'\''s'`)
+	testExpandBookmark(t, "git checkout {{branch}} && echo {{branch}}", map[string]string{"branch": "main"}, "git checkout main && echo main")
+	testExpandBookmark(t, "echo {{a}}{{b}}", map[string]string{"a": "{{b}}", "b": "x"}, `echo \{\{b\}\}x`)
+	testExpandBookmark(t, "echo {{empty}}done", map[string]string{}, "echo done")
+	names := getBookmarkPlaceholders("{{b}} {{a}} {{b}} {{ not }}")
+	if len(names) != 2 || names[0] != "b" || names[1] != "a" {
+		t.Errorf("bad placeholders: %v", names)
+	}
+}
+
+func TestMakeBookmarkRunKwargs(t *testing.T) {
+	kwargs := map[string]string{"host": "myhost", "wterm": "30x100", "nohist": "1"}
+	rtn := makeBookmarkRunKwargs(kwargs, "ssh {{host}} echo {{wterm}}")
+	if len(rtn) != 1 || rtn["nohist"] != "1" {
+		t.Errorf("template params should be removed from the run kwargs: %v", rtn)
+	}
+	if len(kwargs) != 3 {
+		t.Errorf("kwargs should not be modified: %v", kwargs)
+	}
+}
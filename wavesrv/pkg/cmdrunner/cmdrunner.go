@@ -9,9 +9,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"io/fs"
 	"log"
+	"math"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -20,16 +20,19 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 	"unicode"
 
+	"github.com/alessio/shellescape"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/kevinburke/ssh_config"
 	"github.com/wavetermdev/waveterm/waveshell/pkg/base"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/cirfile"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/mpio"
 	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
-	"github.com/wavetermdev/waveterm/waveshell/pkg/server"
 	"github.com/wavetermdev/waveterm/waveshell/pkg/shellenv"
 	"github.com/wavetermdev/waveterm/waveshell/pkg/shellutil"
 	"github.com/wavetermdev/waveterm/waveshell/pkg/shexec"
@@ -44,6 +47,7 @@ import (
 	"github.com/wavetermdev/waveterm/wavesrv/pkg/scbus"
 	"github.com/wavetermdev/waveterm/wavesrv/pkg/scpacket"
 	"github.com/wavetermdev/waveterm/wavesrv/pkg/sstore"
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/userinput"
 	"golang.org/x/mod/semver"
 )
 
@@ -81,6 +85,9 @@ const TsFormatStr = "2006-01-02 15:04:05"
 const OpenAIPacketTimeout = 10 * time.Second
 const OpenAIStreamTimeout = 5 * time.Minute
 
+const DefaultTailBytes = 8 * 1024
+const ViewTailDrainTimeout = 5 * time.Second
+
 const OpenAICloudCompletionTelemetryOffErrorMsg = "In order to protect against abuse, you must have telemetry turned on in order to use Wave's free AI features.  If you do not want to turn telemetry on, you can still use Wave's AI features by adding your own OpenAI key in Settings.  Note that when you use your own key, requests are not proxied through Wave's servers and will be sent directly to the OpenAI API."
 
 const (
@@ -94,33 +101,34 @@ const (
 var ColorNames = []string{"yellow", "blue", "pink", "mint", "cyan", "violet", "orange", "green", "red", "white"}
 var TabIcons = []string{"square", "sparkle", "fire", "ghost", "cloud", "compass", "crown", "droplet", "graduation-cap", "heart", "file"}
 var RemoteColorNames = []string{"red", "green", "yellow", "blue", "magenta", "cyan", "white", "orange"}
-var RemoteSetArgs = []string{"alias", "connectmode", "key", "password", "autoinstall", "color"}
+var RemoteSetArgs = []string{"alias", "connectmode", "key", "password", "autoinstall", "color", "proxyjump"}
 var ConfirmFlags = []string{"hideshellprompt"}
 var SidebarNames = []string{"main"}
 var ThemeNames = []string{"light", "dark"}
 
 var ScreenCmds = []string{"run", "comment", "cd", "cr", "clear", "sw", "reset", "signal", "chat"}
 var NoHistCmds = []string{"_compgen", "line", "history", "_killserver"}
-var GlobalCmds = []string{"session", "screen", "remote", "set", "client", "telemetry", "bookmark", "bookmarks"}
+var GlobalCmds = []string{"session", "screen", "remote", "set", "client", "telemetry", "storage", "db", "bookmark", "bookmarks"}
 
 var SetVarNameMap map[string]string = map[string]string{
-	"tabcolor": "screen.tabcolor",
-	"tabicon":  "screen.tabicon",
-	"pterm":    "screen.pterm",
-	"anchor":   "screen.anchor",
-	"focus":    "screen.focus",
-	"line":     "screen.line",
-	"index":    "screen.index",
+	"tabcolor":  "screen.tabcolor",
+	"tabicon":   "screen.tabicon",
+	"pterm":     "screen.pterm",
+	"anchor":    "screen.anchor",
+	"focus":     "screen.focus",
+	"line":      "screen.line",
+	"index":     "screen.index",
+	"shellpref": "screen.shellpref",
 }
 
 var SetVarScopes = []SetVarScope{
 	{ScopeName: "global", VarNames: []string{}},
-	{ScopeName: "client", VarNames: []string{"telemetry"}},
-	{ScopeName: "session", VarNames: []string{"name", "pos"}},
-	{ScopeName: "screen", VarNames: []string{"name", "tabcolor", "tabicon", "pos", "pterm", "anchor", "focus", "line", "index"}},
+	{ScopeName: "client", VarNames: []string{"telemetry", "pterm", "remote", "shellpref"}, StoredVarNames: []string{"pterm", "remote", "shellpref"}},
+	{ScopeName: "session", VarNames: []string{"name", "pos", "pterm", "remote", "shellpref"}, StoredVarNames: []string{"pterm", "remote", "shellpref"}},
+	{ScopeName: "screen", VarNames: []string{"name", "tabcolor", "tabicon", "pos", "pterm", "anchor", "focus", "line", "index", "shellpref"}, StoredVarNames: []string{"pterm", "shellpref"}},
 	{ScopeName: "line", VarNames: []string{}},
 	// connection = remote, remote = remoteinstance
-	{ScopeName: "connection", VarNames: []string{"alias", "connectmode", "key", "password", "autoinstall", "color"}},
+	{ScopeName: "connection", VarNames: []string{"alias", "connectmode", "key", "password", "autoinstall", "color", "pterm", "shellpref"}, StoredVarNames: []string{"pterm", "shellpref"}},
 	{ScopeName: "remote", VarNames: []string{}},
 }
 
@@ -140,6 +148,10 @@ var depthContextKey = contextType("depth")
 type SetVarScope struct {
 	ScopeName string
 	VarNames  []string
+
+	// subset of VarNames that are persisted in the setvar table.
+	// the rest are fields on the scope object and are set with the scope's :set command
+	StoredVarNames []string
 }
 
 type historyContextType struct {
@@ -203,6 +215,8 @@ func init() {
 	registerCmdFn("remote:installcancel", RemoteInstallCancelCommand)
 	registerCmdFn("remote:reset", RemoteResetCommand)
 	registerCmdFn("remote:parse", RemoteConfigParseCommand)
+	registerCmdFn("remote:forward", RemoteForwardCommand)
+	registerCmdFn("remote:unforward", RemoteUnforwardCommand)
 
 	registerCmdFn("copyfile", CopyFileCommand)
 
@@ -220,6 +234,8 @@ func init() {
 	registerCmdFn("line:set", LineSetCommand)
 	registerCmdFn("line:restart", LineRestartCommand)
 	registerCmdFn("line:minimize", LineMinimizeCommand)
+	registerCmdFn("line:export", LineExportCommand)
+	registerCmdFn("line:import", LineImportCommand)
 
 	registerCmdFn("client", ClientCommand)
 	registerCmdFn("client:show", ClientShowCommand)
@@ -241,6 +257,13 @@ func init() {
 	registerCmdFn("telemetry:send", TelemetrySendCommand)
 	registerCmdFn("telemetry:show", TelemetryShowCommand)
 
+	registerCmdFn("storage", StorageCommand)
+	registerCmdFn("storage:show", StorageShowCommand)
+	registerCmdFn("storage:set", StorageSetCommand)
+	registerCmdFn("storage:gc", StorageGcCommand)
+
+	registerCmdFn("db:backup", DbBackupCommand)
+
 	registerCmdFn("releasecheck", ReleaseCheckCommand)
 	registerCmdFn("releasecheck:autoon", ReleaseCheckOnCommand)
 	registerCmdFn("releasecheck:autooff", ReleaseCheckOffCommand)
@@ -248,11 +271,23 @@ func init() {
 	registerCmdFn("history", HistoryCommand)
 	registerCmdFn("history:viewall", HistoryViewAllCommand)
 	registerCmdFn("history:purge", HistoryPurgeCommand)
+	registerCmdFn("history:export", HistoryExportCommand)
+	registerCmdFn("history:import", HistoryImportCommand)
 
 	registerCmdFn("bookmarks:show", BookmarksShowCommand)
 
 	registerCmdFn("bookmark:set", BookmarkSetCommand)
 	registerCmdFn("bookmark:delete", BookmarkDeleteCommand)
+	registerCmdFn("bookmark:run", BookmarkRunCommand)
+
+	registerCmdFn("playbook:create", PlaybookCreateCommand)
+	registerCmdFn("playbook:showall", PlaybookShowAllCommand)
+	registerCmdFn("playbook:show", PlaybookShowCommand)
+	registerCmdFn("playbook:addentry", PlaybookAddEntryCommand)
+	registerCmdFn("playbook:removeentry", PlaybookRemoveEntryCommand)
+	registerCmdFn("playbook:reorder", PlaybookReorderCommand)
+	registerCmdFn("playbook:delete", PlaybookDeleteCommand)
+	registerCmdFn("playbook:run", PlaybookRunCommand)
 
 	registerCmdFn("chat", OpenAICommand)
 
@@ -263,6 +298,8 @@ func init() {
 
 	registerCmdFn("view:stat", ViewStatCommand)
 	registerCmdFn("view:test", ViewTestCommand)
+	registerCmdFn("view:ls", ViewLsCommand)
+	registerCmdFn("view:tail", ViewTailCommand)
 
 	registerCmdFn("edit:test", EditTestCommand)
 
@@ -425,6 +462,53 @@ func resolveNonNegInt(arg string, def int) (int, error) {
 	return ival, nil
 }
 
+// "0", "1024", "10K", "500M", "2G" (binary units)
+func resolveByteSize(arg string) (int64, error) {
+	numStr := strings.TrimSuffix(strings.ToUpper(arg), "B")
+	var mult int64 = 1
+	if len(numStr) > 0 {
+		switch numStr[len(numStr)-1] {
+		case 'K':
+			mult = 1024
+		case 'M':
+			mult = 1024 * 1024
+		case 'G':
+			mult = 1024 * 1024 * 1024
+		}
+		if mult > 1 {
+			numStr = numStr[:len(numStr)-1]
+		}
+	}
+	if !isAllDigits(numStr) {
+		return 0, fmt.Errorf("invalid size %q (use bytes or a K, M or G suffix)", arg)
+	}
+	ival, err := strconv.ParseInt(numStr, 10, 64)
+	if err != nil || ival > math.MaxInt64/mult {
+		return 0, fmt.Errorf("invalid size %q (too large)", arg)
+	}
+	return ival * mult, nil
+}
+
+// "0", "30d", "12h", "90m" (returned in milliseconds)
+func resolveAgeMs(arg string) (int64, error) {
+	if arg == "0" {
+		return 0, nil
+	}
+	if strings.HasSuffix(arg, "d") && isAllDigits(arg[:len(arg)-1]) {
+		dayMs := 24 * int64(time.Hour/time.Millisecond)
+		days, err := strconv.ParseInt(arg[:len(arg)-1], 10, 64)
+		if err != nil || days > math.MaxInt64/dayMs {
+			return 0, fmt.Errorf("invalid age %q (too large)", arg)
+		}
+		return days * dayMs, nil
+	}
+	dur, err := time.ParseDuration(arg)
+	if err != nil || dur < 0 {
+		return 0, fmt.Errorf("invalid age %q (use a number of days like 30d, or a duration like 12h)", arg)
+	}
+	return dur.Milliseconds(), nil
+}
+
 var histExpansionRe = regexp.MustCompile(`^!(\d+)$`)
 
 func doCmdHistoryExpansion(ctx context.Context, ids resolvedIds, cmdStr string) (string, error) {
@@ -496,7 +580,7 @@ func SyncCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.U
 	runPacket.ReqId = uuid.New().String()
 	runPacket.CK = base.MakeCommandKey(ids.ScreenId, scbase.GenWaveUUID())
 	runPacket.UsePty = true
-	ptermVal := defaultStr(pk.Kwargs["wterm"], DefaultPTERM)
+	ptermVal := defaultStr(pk.Kwargs["wterm"], getDefaultPTerm(ctx, ids))
 	runPacket.TermOpts, err = GetUITermOpts(pk.UIContext.WinSize, ptermVal)
 	if err != nil {
 		return nil, fmt.Errorf("/sync error, invalid 'wterm' value %q: %v", ptermVal, err)
@@ -507,6 +591,7 @@ func SyncCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.U
 		SessionId: ids.SessionId,
 		ScreenId:  ids.ScreenId,
 		RemotePtr: ids.Remote.RemotePtr,
+		ShellType: ids.Remote.ShellType,
 	}
 	cmd, callback, err := remote.RunCommand(ctx, rcOpts, runPacket)
 	if callback != nil {
@@ -591,13 +676,31 @@ func RunCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.Up
 		ctxWithDepth := context.WithValue(ctx, depthContextKey, evalDepth+1)
 		return EvalCommand(ctxWithDepth, newPk)
 	}
+	lineState := make(map[string]any)
+	if templateArg != "" {
+		lineState[sstore.LineState_Template] = templateArg
+	}
+	if langArg != "" {
+		lineState[sstore.LineState_Lang] = langArg
+	}
+	_, err = startRunCommand(ctx, pk, ids, cmdStr, renderer, lineState)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// runs cmdStr on the screen's remote and adds its line.  the line update is sent asynchronously
+// on the MainUpdateBus.  returns the new cmd (the command is still running).
+func startRunCommand(ctx context.Context, pk *scpacket.FeCommandPacketType, ids resolvedIds, cmdStr string, renderer string, lineState map[string]any) (*sstore.CmdType, error) {
 	isRtnStateCmd := IsReturnStateCommand(cmdStr)
 	// runPacket.State is set in remote.RunCommand()
 	runPacket := packet.MakeRunPacket()
 	runPacket.ReqId = uuid.New().String()
 	runPacket.CK = base.MakeCommandKey(ids.ScreenId, scbase.GenWaveUUID())
 	runPacket.UsePty = true
-	ptermVal := defaultStr(pk.Kwargs["wterm"], DefaultPTERM)
+	ptermVal := defaultStr(pk.Kwargs["wterm"], getDefaultPTerm(ctx, ids))
+	var err error
 	runPacket.TermOpts, err = GetUITermOpts(pk.UIContext.WinSize, ptermVal)
 	if err != nil {
 		return nil, fmt.Errorf("/run error, invalid 'pterm' value %q: %v", ptermVal, err)
@@ -608,6 +711,7 @@ func RunCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.Up
 		SessionId: ids.SessionId,
 		ScreenId:  ids.ScreenId,
 		RemotePtr: ids.Remote.RemotePtr,
+		ShellType: ids.Remote.ShellType,
 	}
 	cmd, callback, err := remote.RunCommand(ctx, rcOpts, runPacket)
 	if callback != nil {
@@ -617,13 +721,6 @@ func RunCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.Up
 		return nil, err
 	}
 	cmd.RawCmdStr = pk.GetRawStr()
-	lineState := make(map[string]any)
-	if templateArg != "" {
-		lineState[sstore.LineState_Template] = templateArg
-	}
-	if langArg != "" {
-		lineState[sstore.LineState_Lang] = langArg
-	}
 	update, err := addLineForCmd(ctx, "/run", true, ids, cmd, renderer, lineState)
 	if err != nil {
 		return nil, err
@@ -633,7 +730,7 @@ func RunCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.Up
 	// so if we return this directly it sometimes gets evaluated first.  by pushing it on the MainBus
 	// it ensures it happens after the command creation event.
 	scbus.MainUpdateBus.DoScreenUpdate(ids.ScreenId, update)
-	return nil, nil
+	return cmd, nil
 }
 
 func implementRunInSidebar(ctx context.Context, screenId string, lineId string) (*sstore.ScreenType, error) {
@@ -1181,344 +1278,6 @@ func deferWriteCmdStatus(ctx context.Context, cmd *sstore.CmdType, startTime tim
 	scbus.MainUpdateBus.DoScreenUpdate(cmd.ScreenId, update)
 }
 
-func checkForWriteReady(ctx context.Context, iter *packet.RpcResponseIter) (string, error) {
-	readyIf, err := iter.Next(ctx)
-	if err != nil {
-		return "", fmt.Errorf("error getting write ready response: %v\r\n", err)
-	}
-	readyPk, ok := readyIf.(*packet.WriteFileReadyPacketType)
-	if !ok {
-		return "", fmt.Errorf("bad write ready packet received %v", readyIf)
-	}
-	if readyPk.Error != "" {
-		return "", fmt.Errorf("ready error: %v", readyPk.Error)
-	}
-	return readyPk.RespId, nil
-}
-
-func checkForWriteFinished(ctx context.Context, iter *packet.RpcResponseIter) error {
-	doneIf, err := iter.Next(ctx)
-	if err != nil {
-		return fmt.Errorf("error while getting done response: %v", err)
-	}
-	writeDonePk, ok := doneIf.(*packet.WriteFileDonePacketType)
-	if !ok {
-		return fmt.Errorf("bad done packet received: %T", doneIf)
-	}
-	if writeDonePk.Error != "" {
-		return fmt.Errorf("done error: %v", writeDonePk.Error)
-	}
-	return nil
-}
-
-func doCopyLocalFileToRemote(ctx context.Context, cmd *sstore.CmdType, remote_msh *remote.MShellProc, localPath string, destPath string, outputPos int64) {
-	var exitSuccess bool
-	startTime := time.Now()
-	defer func() {
-		deferWriteCmdStatus(ctx, cmd, startTime, exitSuccess, outputPos)
-	}()
-	localFile, err := os.Open(localPath)
-	if err != nil {
-		writeStringToPty(ctx, cmd, fmt.Sprintf("Error, unable to open file %v: %v\r\n", localFile, localPath), &outputPos)
-		return
-	}
-	defer localFile.Close()
-	writePk := packet.MakeWriteFilePacket()
-	writePk.ReqId = uuid.New().String()
-	writePk.Path = destPath
-	iter, err := remote_msh.WriteFile(ctx, writePk)
-	if err != nil {
-		writeStringToPty(ctx, cmd, fmt.Sprintf("Error starting file write: %v\r\n", err), &outputPos)
-		return
-	}
-	defer iter.Close()
-	_, err = checkForWriteReady(ctx, iter)
-	if err != nil {
-		writeStringToPty(ctx, cmd, fmt.Sprintf("Write ready packet error: %v\r\n", err), &outputPos)
-		return
-	}
-	fileStat, err := localFile.Stat()
-	if err != nil {
-		writeStringToPty(ctx, cmd, fmt.Sprintf("error: could not get file stat: %v", err), &outputPos)
-		return
-	}
-	fileSizeBytes := fileStat.Size()
-	bytesWritten := int64(0)
-	lastFileTransferPercentage := float64(0)
-	fileTransferPercentage := float64(0)
-	writeStringToPty(ctx, cmd, fmt.Sprintf("Source File Size: %s\r\n", prettyPrintByteSize(fileSizeBytes)), &outputPos)
-	writeStringToPty(ctx, cmd, "[", &outputPos)
-	var buffer [server.MaxFileDataPacketSize]byte
-	bufSlice := buffer[:]
-	for {
-		dataPk := packet.MakeFileDataPacket(writePk.ReqId)
-		bytesRead, err := io.ReadFull(localFile, bufSlice)
-		if err == io.ErrUnexpectedEOF || err == io.EOF {
-			dataPk.Eof = true
-		} else if err != nil {
-			dataErr := fmt.Sprintf("error reading file data: %v", err)
-			dataPk.Error = dataErr
-			remote_msh.SendFileData(dataPk)
-			writeStringToPty(ctx, cmd, dataErr, &outputPos)
-			return
-		}
-		if bytesRead > 0 {
-			dataPk.Data = make([]byte, bytesRead)
-			copy(dataPk.Data, bufSlice[0:bytesRead])
-			bytesWritten += int64(len(dataPk.Data))
-			fileTransferPercentage = float64(bytesWritten) / float64(fileSizeBytes)
-
-			if fileTransferPercentage-lastFileTransferPercentage > float64(0.05) {
-				writeStringToPty(ctx, cmd, "-", &outputPos)
-				lastFileTransferPercentage = fileTransferPercentage
-			}
-		}
-		remote_msh.SendFileData(dataPk)
-		if dataPk.Eof {
-			break
-		}
-	}
-	err = checkForWriteFinished(ctx, iter)
-	if err != nil {
-		writeStringToPty(ctx, cmd, fmt.Sprintf("Write finished packet error %v", err), &outputPos)
-		return
-	}
-	writeStringToPty(ctx, cmd, "] done. \r\n", &outputPos)
-	writeStringToPty(ctx, cmd, fmt.Sprintf("Finished transferring. Transferred %v bytes\r\n", fileSizeBytes), &outputPos)
-	exitSuccess = true
-}
-
-func getStatusBarString(filePercentageInt int) string {
-	statusBarString := "\x1b[2k\r["
-	for count := 0; count < 20; count++ {
-		if (filePercentageInt - count*5) > 0 {
-			statusBarString += "-"
-		} else {
-			statusBarString += " "
-		}
-	}
-	if filePercentageInt < 100 {
-		statusBarString += fmt.Sprintf("] %v%%", filePercentageInt)
-	} else {
-		statusBarString += "]"
-	}
-	return statusBarString
-}
-
-func doCopyRemoteFileToRemote(ctx context.Context, cmd *sstore.CmdType, sourceMsh *remote.MShellProc, destMsh *remote.MShellProc, sourcePath string, destPath string, outputPos int64) {
-	var exitSuccess bool
-	startTime := time.Now()
-	defer func() {
-		deferWriteCmdStatus(ctx, cmd, startTime, exitSuccess, outputPos)
-	}()
-	streamPk := packet.MakeStreamFilePacket()
-	streamPk.ReqId = uuid.New().String()
-	streamPk.Path = sourcePath
-	sourceStreamIter, err := sourceMsh.StreamFile(ctx, streamPk)
-	if err != nil {
-		writeStringToPty(ctx, cmd, fmt.Sprintf("Error getting file data packet: %v\r\n", err), &outputPos)
-		return
-	}
-	defer sourceStreamIter.Close()
-	respIf, err := sourceStreamIter.Next(ctx)
-	if err != nil {
-		writeStringToPty(ctx, cmd, fmt.Sprintf("Error getting next packet: %v\r\n", err), &outputPos)
-		return
-	}
-	resp, ok := respIf.(*packet.StreamFileResponseType)
-	if !ok {
-		writeStringToPty(ctx, cmd, fmt.Sprintf("Error in getting packet response: %v\r\n", err), &outputPos)
-		return
-	}
-	if resp == nil || resp.Error != "" {
-		writeStringToPty(ctx, cmd, fmt.Sprintf("Response packet has error: %v\r\n", err), &outputPos)
-		return
-	}
-	fileSizeBytes := resp.Info.Size
-	if fileSizeBytes == 0 {
-		writeStringToPty(ctx, cmd, "Source file does not exist or is empty - exiting\r\n", &outputPos)
-		return
-	}
-	writeStringToPty(ctx, cmd, fmt.Sprintf("Source File Size: %v\r\n", prettyPrintByteSize(fileSizeBytes)), &outputPos)
-	writePk := packet.MakeWriteFilePacket()
-	writePk.ReqId = uuid.New().String()
-	writePk.Path = destPath
-	destWriteIter, err := destMsh.WriteFile(ctx, writePk)
-	if err != nil {
-		writeStringToPty(ctx, cmd, fmt.Sprintf("Error starting file write: %v\r\n", err), &outputPos)
-		return
-	}
-	defer destWriteIter.Close()
-	_, err = checkForWriteReady(ctx, destWriteIter)
-	if err != nil {
-		writeStringToPty(ctx, cmd, fmt.Sprintf("Write ready packet error: %v\r\n", err), &outputPos)
-		return
-	}
-	bytesWritten := int64(0)
-	lastFilePercentageInt := int(0)
-	fileTransferPercentage := float64(0)
-	writeStringToPty(ctx, cmd, "[", &outputPos)
-	for {
-		dataPkIf, err := sourceStreamIter.Next(ctx)
-		if err != nil {
-			log.Printf("error in read-file while getting data: %v\n", err)
-			return
-		}
-		if dataPkIf == nil {
-			break
-		}
-		dataPk, ok := dataPkIf.(*packet.FileDataPacketType)
-		if !ok {
-			writeStringToPty(ctx, cmd, fmt.Sprintf("error in read-file, invalid data packet type: %T\r\n", dataPkIf), &outputPos)
-			return
-		}
-		if dataPk.Error != "" {
-			writeStringToPty(ctx, cmd, fmt.Sprintf("in read-file, data packet error: %s\r\n", dataPk.Error), &outputPos)
-			return
-		}
-		writeDataPk := packet.MakeFileDataPacket(writePk.ReqId)
-		writeDataPk.Eof = dataPk.Eof
-		writeDataPk.Error = dataPk.Error
-		writeDataPk.Type = dataPk.Type
-		writeDataPk.Data = make([]byte, int64(len(dataPk.Data)))
-		copy(writeDataPk.Data, dataPk.Data)
-		err = destMsh.SendFileData(writeDataPk)
-		if err != nil {
-			writeStringToPty(ctx, cmd, fmt.Sprintf("error sending file to dest: %v\r\n", err), &outputPos)
-			return
-		}
-		bytesWritten += int64(len(dataPk.Data))
-		fileTransferPercentage = float64(bytesWritten) / float64(fileSizeBytes)
-		filePercentageInt := int(fileTransferPercentage * 100)
-		if filePercentageInt-lastFilePercentageInt > 5 {
-			statusBarString := getStatusBarString(filePercentageInt)
-			writeStringToPty(ctx, cmd, statusBarString, &outputPos)
-			lastFilePercentageInt = filePercentageInt
-		}
-	}
-	err = checkForWriteFinished(ctx, destWriteIter)
-	if err != nil {
-		writeStringToPty(ctx, cmd, fmt.Sprintf("\r\nWrite finished packet error %v", err), &outputPos)
-		return
-	}
-	writeStringToPty(ctx, cmd, getStatusBarString(100), &outputPos)
-	writeStringToPty(ctx, cmd, " done. \r\n", &outputPos)
-	writeStringToPty(ctx, cmd, fmt.Sprintf("Finished transferring. Transferred %v bytes\r\n", bytesWritten), &outputPos)
-	exitSuccess = true
-}
-
-func doCopyLocalFileToLocal(ctx context.Context, cmd *sstore.CmdType, sourcePath string, destPath string, outputPos int64) {
-	var exitSuccess bool
-	var bytesWritten int64
-	startTime := time.Now()
-	defer func() {
-		deferWriteCmdStatus(ctx, cmd, startTime, exitSuccess, outputPos)
-	}()
-	sourceFile, err := os.Open(sourcePath)
-	if err != nil {
-		writeStringToPty(ctx, cmd, fmt.Sprintf("error opening source file %v", err), &outputPos)
-		return
-	}
-	defer sourceFile.Close()
-	sourceFileStat, err := sourceFile.Stat()
-	if err != nil {
-		writeStringToPty(ctx, cmd, fmt.Sprintf("error getting filestat %v", err), &outputPos)
-		return
-	}
-	fileSizeBytes := sourceFileStat.Size()
-	writeStringToPty(ctx, cmd, fmt.Sprintf("Source File Size: %v\r\n", prettyPrintByteSize(fileSizeBytes)), &outputPos)
-	destFile, err := os.Create(destPath)
-	if err != nil {
-		writeStringToPty(ctx, cmd, fmt.Sprintf("error creating dest file %v", err), &outputPos)
-		return
-	}
-	defer destFile.Close()
-	bytesWritten, err = io.Copy(destFile, sourceFile)
-	if err != nil {
-		writeStringToPty(ctx, cmd, fmt.Sprintf("error copying files %v", err), &outputPos)
-		return
-	}
-	writeStringToPty(ctx, cmd, fmt.Sprintf("Finished transferring. Transferred %v bytes\r\n", bytesWritten), &outputPos)
-	exitSuccess = true
-}
-
-func doCopyRemoteFileToLocal(ctx context.Context, cmd *sstore.CmdType, remote_msh *remote.MShellProc, sourcePath string, localPath string, outputPos int64) {
-	var exitSuccess bool
-	startTime := time.Now()
-	defer func() {
-		deferWriteCmdStatus(ctx, cmd, startTime, exitSuccess, outputPos)
-	}()
-	streamPk := packet.MakeStreamFilePacket()
-	streamPk.ReqId = uuid.New().String()
-	streamPk.Path = sourcePath
-	iter, err := remote_msh.StreamFile(ctx, streamPk)
-	if err != nil {
-		writeStringToPty(ctx, cmd, fmt.Sprintf("Error getting file data packet: %v\r\n", err), &outputPos)
-		return
-	}
-	defer iter.Close()
-	respIf, err := iter.Next(ctx)
-	if err != nil {
-		writeStringToPty(ctx, cmd, fmt.Sprintf("Error getting next packet: %v\r\n", err), &outputPos)
-		return
-	}
-	resp, ok := respIf.(*packet.StreamFileResponseType)
-	if !ok {
-		writeStringToPty(ctx, cmd, fmt.Sprintf("Error in getting packet response: %v\r\n", err), &outputPos)
-		return
-	}
-	if resp == nil || resp.Error != "" {
-		writeStringToPty(ctx, cmd, fmt.Sprintf("Response packet has error: %v\r\n", err), &outputPos)
-		return
-	}
-	fileSizeBytes := resp.Info.Size
-	if fileSizeBytes == 0 {
-		writeStringToPty(ctx, cmd, "Source file doesn't exist or file is empty - exiting\r\n", &outputPos)
-		return
-	}
-	writeStringToPty(ctx, cmd, fmt.Sprintf("Source File Size: %s\r\n", prettyPrintByteSize(fileSizeBytes)), &outputPos)
-	localFile, err := os.Create(localPath)
-	if err != nil {
-		writeStringToPty(ctx, cmd, fmt.Sprintf("Error creating file on local %v\r\n", err), &outputPos)
-		return
-	}
-	defer localFile.Close()
-	bytesWritten := int64(0)
-	lastFileTransferPercentage := float64(0)
-	fileTransferPercentage := float64(0)
-	writeStringToPty(ctx, cmd, "[", &outputPos)
-	for {
-		dataPkIf, err := iter.Next(ctx)
-		if err != nil {
-			log.Printf("error in read-file while getting data: %v\n", err)
-			return
-		}
-		if dataPkIf == nil {
-			break
-		}
-		dataPk, ok := dataPkIf.(*packet.FileDataPacketType)
-		if !ok {
-			writeStringToPty(ctx, cmd, fmt.Sprintf("error in read-file, invalid data packet type: %T\r\n", dataPkIf), &outputPos)
-			return
-		}
-		if dataPk.Error != "" {
-			writeStringToPty(ctx, cmd, fmt.Sprintf("in read-file, data packet error: %s", dataPk.Error), &outputPos)
-			return
-		}
-		localFile.Write(dataPk.Data)
-		bytesWritten += int64(len(dataPk.Data))
-		fileTransferPercentage = float64(bytesWritten) / float64(fileSizeBytes)
-
-		if fileTransferPercentage-lastFileTransferPercentage > float64(0.05) {
-			writeStringToPty(ctx, cmd, "-", &outputPos)
-			lastFileTransferPercentage = fileTransferPercentage
-		}
-	}
-	writeStringToPty(ctx, cmd, "] done. \r\n", &outputPos)
-	writeStringToPty(ctx, cmd, fmt.Sprintf("Finished transferring. Transferred %v bytes\n", fileSizeBytes), &outputPos)
-	exitSuccess = true
-}
-
 func writeStringToPty(ctx context.Context, cmd *sstore.CmdType, outputString string, outputPos *int64) {
 	outBytes := []byte(outputString)
 	update, err := sstore.AppendToCmdPtyBlob(ctx, cmd.ScreenId, cmd.LineId, outBytes, *outputPos)
@@ -1548,8 +1307,12 @@ func parseCopyFileParam(info string) (remote string, path string, err error) {
 }
 
 func CopyFileCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
-	if len(pk.Args) == 0 {
-		return nil, fmt.Errorf("usage: /copyfile [file to copy] local=[path to copy to on local]")
+	if len(pk.Args) < 2 {
+		return nil, fmt.Errorf("usage: /copyfile [remote]:source [remote]:dest [recursive=1] [include=globs] [exclude=globs] [preserve=0] [verify=0] [dryrun=1] [window=bytes]")
+	}
+	copyOpts, err := parseCopyFileOpts(pk)
+	if err != nil {
+		return nil, fmt.Errorf("/copyfile %v", err)
 	}
 	ids, err := resolveUiIds(ctx, pk, R_Screen|R_Session|R_RemoteConnected)
 	if err != nil {
@@ -1671,15 +1434,15 @@ func CopyFileCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scb
 	}
 	scbus.MainUpdateBus.DoScreenUpdate(cmd.ScreenId, update)
 	update = scbus.MakeUpdatePacket()
-	if destRemote == LocalRemote && sourceRemote == LocalRemote {
-		go doCopyLocalFileToLocal(context.Background(), cmd, sourceFullPath, destFullPath, outputPos)
-	} else if destRemote == LocalRemote && sourceRemote != LocalRemote {
-		go doCopyRemoteFileToLocal(context.Background(), cmd, sourceMsh, sourceFullPath, destFullPath, outputPos)
-	} else if destRemote != LocalRemote && sourceRemote == LocalRemote {
-		go doCopyLocalFileToRemote(context.Background(), cmd, destMsh, sourceFullPath, destFullPath, outputPos)
-	} else if destRemote != LocalRemote && sourceRemote != LocalRemote {
-		go doCopyRemoteFileToRemote(context.Background(), cmd, sourceMsh, destMsh, sourceFullPath, destFullPath, outputPos)
+	src := copyEndpoint{Path: sourceFullPath}
+	if sourceRemote != LocalRemote {
+		src.Msh = sourceMsh
 	}
+	dest := copyEndpoint{Path: destFullPath}
+	if destRemote != LocalRemote {
+		dest.Msh = destMsh
+	}
+	go doCopyFiles(context.Background(), cmd, src, dest, copyOpts, outputPos)
 	return update, nil
 }
 
@@ -1722,28 +1485,127 @@ func RemoteDisconnectCommand(ctx context.Context, pk *scpacket.FeCommandPacketTy
 	return createRemoteViewRemoteIdUpdate(ids.Remote.RemotePtr.RemoteId), nil
 }
 
-func makeRemoteEditUpdate_new(err error) scbus.UpdatePacket {
-	redit := &sstore.RemoteEditType{
-		RemoteEdit: true,
+func resolvePortForwardType(arg string) (string, error) {
+	switch strings.TrimPrefix(arg, "-") {
+	case "L", sstore.PortForwardTypeLocal:
+		return sstore.PortForwardTypeLocal, nil
+	case "R", sstore.PortForwardTypeRemote:
+		return sstore.PortForwardTypeRemote, nil
+	case "D", sstore.PortForwardTypeDynamic:
+		return sstore.PortForwardTypeDynamic, nil
 	}
-	if err != nil {
-		redit.ErrorStr = err.Error()
-	}
-	return createRemoteViewRemoteEditUpdate(redit)
+	return "", fmt.Errorf("invalid forward type %q, must be %s", arg, formatStrs([]string{"L (local)", "R (remote)", "D (dynamic)"}, "or", false))
 }
 
-func makeRemoteEditErrorReturn_new(visual bool, err error) (scbus.UpdatePacket, error) {
-	if visual {
-		return makeRemoteEditUpdate_new(err), nil
+func makePortForwardsInfoUpdate(displayName string, states []*sstore.PortForwardStateType) scbus.UpdatePacket {
+	var buf bytes.Buffer
+	if len(states) == 0 {
+		buf.WriteString("no port forwards\n")
 	}
-	return nil, err
+	for idx, state := range states {
+		statusStr := state.Status
+		if state.Status == sstore.PortForwardStatusActive && state.NumConns > 0 {
+			statusStr = fmt.Sprintf("%s (%d conns)", state.Status, state.NumConns)
+		}
+		if state.ErrorStr != "" {
+			statusStr = fmt.Sprintf("%s: %s", state.Status, state.ErrorStr)
+		}
+		buf.WriteString(fmt.Sprintf("  %3d  %s  %-40s %s\n", idx+1, state.ForwardId[0:8], state.PortForwardType.String(), statusStr))
+	}
+	update := scbus.MakeUpdatePacket()
+	update.AddUpdate(sstore.InfoMsgType{
+		InfoTitle: fmt.Sprintf("port forwards for [%s]", displayName),
+		InfoLines: splitLinesForInfo(buf.String()),
+	})
+	return update
 }
 
-func makeRemoteEditUpdate_edit(ids resolvedIds, err error) scbus.UpdatePacket {
-	redit := &sstore.RemoteEditType{
-		RemoteEdit: true,
+func RemoteForwardCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
+	ids, err := resolveUiIds(ctx, pk, R_Session|R_Screen|R_Remote)
+	if err != nil {
+		return nil, err
 	}
-	redit.RemoteId = ids.Remote.RemotePtr.RemoteId
+	if len(pk.Args) == 0 {
+		return makePortForwardsInfoUpdate(ids.Remote.DisplayName, ids.Remote.RState.PortForwards), nil
+	}
+	if len(pk.Args) != 2 {
+		return nil, fmt.Errorf("usage: /remote:forward [L|R|D] [forward], e.g. /remote:forward L 8080:localhost:80")
+	}
+	fwdType, err := resolvePortForwardType(pk.Args[0])
+	if err != nil {
+		return nil, fmt.Errorf("/remote:forward %v", err)
+	}
+	fwd, err := remote.ParsePortForwardSpec(fwdType, pk.Args[1])
+	if err != nil {
+		return nil, fmt.Errorf("/remote:forward %v", err)
+	}
+	err = ids.Remote.MShell.AddPortForward(ctx, fwd)
+	if err != nil {
+		return nil, fmt.Errorf("/remote:forward %v", err)
+	}
+	rstate := ids.Remote.MShell.GetRemoteRuntimeState()
+	return makePortForwardsInfoUpdate(ids.Remote.DisplayName, rstate.PortForwards), nil
+}
+
+// accepts a 1-based forward number, a forwardid (or prefix), or the forward spec as shown in /remote:forward
+func resolvePortForwardArg(states []*sstore.PortForwardStateType, arg string) (string, error) {
+	if isAllDigits(arg) {
+		num, _ := strconv.Atoi(arg)
+		if num < 1 || num > len(states) {
+			return "", fmt.Errorf("forward number %d out of range (%d forwards)", num, len(states))
+		}
+		return states[num-1].ForwardId, nil
+	}
+	for _, state := range states {
+		if state.ForwardId == arg || (len(arg) >= 8 && strings.HasPrefix(state.ForwardId, arg)) || state.PortForwardType.String() == arg {
+			return state.ForwardId, nil
+		}
+	}
+	return "", fmt.Errorf("port forward %q not found", arg)
+}
+
+func RemoteUnforwardCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
+	ids, err := resolveUiIds(ctx, pk, R_Session|R_Screen|R_Remote)
+	if err != nil {
+		return nil, err
+	}
+	if len(pk.Args) == 0 {
+		return nil, fmt.Errorf("/remote:unforward requires an argument (forward number or id)")
+	}
+	forwardId, err := resolvePortForwardArg(ids.Remote.RState.PortForwards, strings.Join(pk.Args, " "))
+	if err != nil {
+		return nil, fmt.Errorf("/remote:unforward %v", err)
+	}
+	err = ids.Remote.MShell.RemovePortForward(ctx, forwardId)
+	if err != nil {
+		return nil, fmt.Errorf("/remote:unforward %v", err)
+	}
+	rstate := ids.Remote.MShell.GetRemoteRuntimeState()
+	return makePortForwardsInfoUpdate(ids.Remote.DisplayName, rstate.PortForwards), nil
+}
+
+func makeRemoteEditUpdate_new(err error) scbus.UpdatePacket {
+	redit := &sstore.RemoteEditType{
+		RemoteEdit: true,
+	}
+	if err != nil {
+		redit.ErrorStr = err.Error()
+	}
+	return createRemoteViewRemoteEditUpdate(redit)
+}
+
+func makeRemoteEditErrorReturn_new(visual bool, err error) (scbus.UpdatePacket, error) {
+	if visual {
+		return makeRemoteEditUpdate_new(err), nil
+	}
+	return nil, err
+}
+
+func makeRemoteEditUpdate_edit(ids resolvedIds, err error) scbus.UpdatePacket {
+	redit := &sstore.RemoteEditType{
+		RemoteEdit: true,
+	}
+	redit.RemoteId = ids.Remote.RemotePtr.RemoteId
 	if ids.Remote.RemoteCopy.SSHOpts != nil {
 		redit.KeyStr = ids.Remote.RemoteCopy.SSHOpts.SSHIdentity
 		redit.HasPassword = (ids.Remote.RemoteCopy.SSHOpts.SSHPassword != "")
@@ -1859,8 +1721,8 @@ func parseRemoteEditArgs(isNew bool, pk *scpacket.FeCommandPacketType, isLocal b
 	if pk.Kwargs["shellpref"] != "" {
 		shellPref = pk.Kwargs["shellpref"]
 	}
-	if shellPref != "" && shellPref != packet.ShellType_bash && shellPref != packet.ShellType_zsh && shellPref != sstore.ShellTypePref_Detect {
-		return nil, fmt.Errorf("invalid shellpref %q, must be %s", shellPref, formatStrs([]string{packet.ShellType_bash, packet.ShellType_zsh, sstore.ShellTypePref_Detect}, "or", false))
+	if shellPref != "" && !packet.IsValidShellType(shellPref) && shellPref != sstore.ShellTypePref_Detect {
+		return nil, fmt.Errorf("invalid shellpref %q, must be %s", shellPref, formatStrs([]string{packet.ShellType_bash, packet.ShellType_zsh, packet.ShellType_fish, sstore.ShellTypePref_Detect}, "or", false))
 	}
 	var connectMode string
 	if isNew {
@@ -1885,9 +1747,17 @@ func parseRemoteEditArgs(isNew bool, pk *scpacket.FeCommandPacketType, isLocal b
 		}
 	}
 	sshPassword := pk.Kwargs["password"]
+	proxyJump := strings.TrimSpace(pk.Kwargs["proxyjump"])
+	if proxyJump != "" {
+		err := remote.ValidateProxyJump(proxyJump)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxyjump: %v", err)
+		}
+	}
 	if sshOpts != nil {
 		sshOpts.SSHIdentity = keyFile
 		sshOpts.SSHPassword = sshPassword
+		sshOpts.SSHProxyJump = proxyJump
 	}
 
 	// set up editmap
@@ -1919,6 +1789,12 @@ func parseRemoteEditArgs(isNew bool, pk *scpacket.FeCommandPacketType, isLocal b
 	if _, found := pk.Kwargs["shellpref"]; found {
 		editMap[sstore.RemoteField_ShellPref] = shellPref
 	}
+	if _, found := pk.Kwargs["proxyjump"]; found {
+		if isLocal {
+			return nil, fmt.Errorf("Cannot edit proxyjump for 'local' remote")
+		}
+		editMap[sstore.RemoteField_ProxyJump] = proxyJump
+	}
 
 	return &RemoteEditArgs{
 		SSHOpts:       sshOpts,
@@ -2182,6 +2058,8 @@ func NewHostInfo(hostName string) (*HostInfoType, error) {
 		shellPref = "bash"
 	} else if cfgWaveOptions["shellpref"] == "zsh" {
 		shellPref = "zsh"
+	} else if cfgWaveOptions["shellpref"] == "fish" {
+		shellPref = "fish"
 	}
 
 	outHostInfo := new(HostInfoType)
@@ -2814,7 +2692,7 @@ func OpenAICommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus
 		opts.MaxTokens = openai.DefaultMaxTokens
 	}
 	promptStr := firstArg(pk)
-	ptermVal := defaultStr(pk.Kwargs["wterm"], DefaultPTERM)
+	ptermVal := defaultStr(pk.Kwargs["wterm"], getDefaultPTerm(ctx, ids))
 	pkTermOpts, err := GetUITermOpts(pk.UIContext.WinSize, ptermVal)
 	if err != nil {
 		return nil, fmt.Errorf("openai error, invalid 'pterm' value %q: %v", ptermVal, err)
@@ -3032,10 +2910,15 @@ func updateHistoryContext(ctx context.Context, line *sstore.LineType, cmd *sstor
 	hctx.FeState = feState
 }
 
-func makeInfoFromComps(compType string, comps []string, hasMore bool) scbus.UpdatePacket {
-	sort.Slice(comps, func(i int, j int) bool {
-		c1 := comps[i]
-		c2 := comps[j]
+// descs is optional (parallel to comps)
+func makeInfoFromComps(compType string, comps []string, descs []string, hasMore bool) scbus.UpdatePacket {
+	idxs := make([]int, len(comps))
+	for idx := range idxs {
+		idxs[idx] = idx
+	}
+	sort.Slice(idxs, func(i int, j int) bool {
+		c1 := comps[idxs[i]]
+		c2 := comps[idxs[j]]
 		c1mc := strings.HasPrefix(c1, "^")
 		c2mc := strings.HasPrefix(c2, "^")
 		if c1mc && !c2mc {
@@ -3046,13 +2929,25 @@ func makeInfoFromComps(compType string, comps []string, hasMore bool) scbus.Upda
 		}
 		return c1 < c2
 	})
-	if len(comps) == 0 {
-		comps = []string{"(no completions)"}
+	sortedComps := make([]string, len(comps))
+	var sortedDescs []string
+	if len(descs) == len(comps) {
+		sortedDescs = make([]string, len(descs))
+	}
+	for i, idx := range idxs {
+		sortedComps[i] = comps[idx]
+		if sortedDescs != nil {
+			sortedDescs[i] = descs[idx]
+		}
+	}
+	if len(sortedComps) == 0 {
+		sortedComps = []string{"(no completions)"}
 	}
 	update := scbus.MakeUpdatePacket()
 	update.AddUpdate(sstore.InfoMsgType{
 		InfoTitle:     fmt.Sprintf("%s completions", compType),
-		InfoComps:     comps,
+		InfoComps:     sortedComps,
+		InfoCompDescs: sortedDescs,
 		InfoCompsMore: hasMore,
 	})
 	return update
@@ -3185,7 +3080,7 @@ func CompGenCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbu
 	}
 	if showComps {
 		compStrs := crtn.GetCompDisplayStrs()
-		return makeInfoFromComps(crtn.CompType, compStrs, crtn.HasMore), nil
+		return makeInfoFromComps(crtn.CompType, compStrs, crtn.GetCompDescs(), crtn.HasMore), nil
 	}
 	if newSP == nil || cmdSP == *newSP {
 		return nil, nil
@@ -3454,7 +3349,14 @@ func SessionShowCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (
 	buf.WriteString(fmt.Sprintf("  %-15s %d\n", "lines", stats.NumLines))
 	buf.WriteString(fmt.Sprintf("  %-15s %d\n", "cmds", stats.NumCmds))
 	buf.WriteString(fmt.Sprintf("  %-15s %0.2fM\n", "disksize", float64(stats.DiskStats.TotalSize)/1000000))
+	if stats.DiskStats.NumCompressedFiles > 0 {
+		buf.WriteString(fmt.Sprintf("  %-15s %d files, %0.2fM (%0.2fM raw)\n", "disk-compressed", stats.DiskStats.NumCompressedFiles, float64(stats.DiskStats.CompressedSize)/1000000, float64(stats.DiskStats.CompressedRawSize)/1000000))
+	}
 	buf.WriteString(fmt.Sprintf("  %-15s %s\n", "disk-location", stats.DiskStats.Location))
+	err = writeSetVarsInfo(ctx, &buf, sstore.SetVarScope_Session, ids.SessionId)
+	if err != nil {
+		return nil, err
+	}
 	update := scbus.MakeUpdatePacket()
 	update.AddUpdate(sstore.InfoMsgType{
 		InfoTitle: "session info",
@@ -3568,7 +3470,7 @@ func RemoteResetCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (
 	shellType := ids.Remote.ShellType
 	if pk.Kwargs["shell"] != "" {
 		shellArg := pk.Kwargs["shell"]
-		if shellArg != packet.ShellType_bash && shellArg != packet.ShellType_zsh {
+		if !packet.IsValidShellType(shellArg) {
 			return nil, fmt.Errorf("/reset invalid shell type %q", shellArg)
 		}
 		shellType = shellArg
@@ -3648,6 +3550,125 @@ func HistoryPurgeCommand(ctx context.Context, pk *scpacket.FeCommandPacketType)
 	return sstore.InfoMsgUpdate("removed history items"), nil
 }
 
+func HistoryExportCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
+	if len(pk.Args) == 0 {
+		return nil, fmt.Errorf("/history:export requires an argument (file name)")
+	}
+	fileName := base.ExpandHomeDir(pk.Args[0])
+	if !filepath.IsAbs(fileName) {
+		return nil, fmt.Errorf("/history:export file must be absolute, cannot be a relative path")
+	}
+	opts := sstore.HistoryQueryOpts{}
+	opts.SearchText = pk.Kwargs["text"]
+	if pk.Kwargs["searchsession"] != "" {
+		sessionId, err := resolveSessionArg(pk.Kwargs["searchsession"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid searchsession: %v", err)
+		}
+		opts.SessionId = sessionId
+	}
+	if pk.Kwargs["searchremote"] != "" {
+		rptr, err := resolveRemoteArg(pk.Kwargs["searchremote"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid searchremote: %v", err)
+		}
+		if rptr != nil {
+			opts.RemoteId = rptr.RemoteId
+		}
+	}
+	opts.NoMeta = !resolveBool(pk.Kwargs["meta"], true)
+	err := resolveHistoryFilterArgs(pk, &opts)
+	if err != nil {
+		return nil, err
+	}
+	hitems, err := sstore.GetAllHistoryItems(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("/history:export error getting history: %v", err)
+	}
+	fd, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("/history:export cannot open file: %v", err)
+	}
+	defer fd.Close()
+	err = writeHistoryJsonL(fd, hitems)
+	if err != nil {
+		return nil, fmt.Errorf("/history:export error writing file: %v", err)
+	}
+	return sstore.InfoMsgUpdate("exported %d history items to %q", len(hitems), fileName), nil
+}
+
+// format=jsonl imports a file written by /history:export (from the local filesystem).
+// format=bash|zsh imports the shell's history file (default ~/.bash_history or ~/.zsh_history) from the local
+// remote, or from remote=[remote], the items are attributed to (and named for) that remote.
+func HistoryImportCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
+	format := defaultStr(pk.Kwargs["format"], HistoryFormat_JsonL)
+	if !utilfn.ContainsStr(HistoryImportFormats, format) {
+		return nil, fmt.Errorf("/history:import invalid format %q, must be %s", format, formatStrs(HistoryImportFormats, "or", false))
+	}
+	var hitems []*sstore.HistoryItemType
+	var fileName string
+	if format == HistoryFormat_JsonL {
+		if len(pk.Args) == 0 {
+			return nil, fmt.Errorf("/history:import requires an argument (file name)")
+		}
+		var err error
+		fileName, err = resolveFile(pk.Args[0])
+		if err != nil {
+			return nil, fmt.Errorf("/history:import invalid file: %v", err)
+		}
+		fd, err := os.Open(fileName)
+		if err != nil {
+			return nil, fmt.Errorf("/history:import cannot open file: %v", err)
+		}
+		defer fd.Close()
+		hitems, err = readHistoryJsonL(fd)
+		if err != nil {
+			return nil, fmt.Errorf("/history:import error reading %q: %v", fileName, err)
+		}
+	} else {
+		if pk.Kwargs["remote"] == "" {
+			localRemote := remote.GetLocalRemote()
+			if localRemote == nil {
+				return nil, fmt.Errorf("/history:import no local remote found")
+			}
+			pk.Kwargs["remote"] = localRemote.GetRemoteId()
+		}
+		ids, err := resolveUiIds(ctx, pk, R_Session|R_Screen|R_RemoteConnected)
+		if err != nil {
+			return nil, err
+		}
+		fileName = historyImportDefaultFiles[format]
+		if len(pk.Args) > 0 && pk.Args[0] != "" {
+			fileName = pk.Args[0]
+		}
+		homeDir := ids.Remote.RState.RemoteVars["home"]
+		if (fileName == "~" || strings.HasPrefix(fileName, "~/")) && homeDir != "" {
+			fileName = filepath.Join(homeDir, fileName[1:])
+		} else if !filepath.IsAbs(fileName) {
+			fileName = filepath.Join(ids.Remote.FeState["cwd"], fileName)
+		}
+		data, modTs, err := readRemoteFile(ctx, ids.Remote.MShell, fileName, MaxHistoryImportFileSize)
+		if err != nil {
+			return nil, fmt.Errorf("/history:import error reading %q: %v", fileName, err)
+		}
+		var entries []shellHistoryEntry
+		if format == HistoryFormat_Bash {
+			entries = parseBashHistory(data)
+		} else {
+			entries = parseZshHistory(data)
+		}
+		if modTs <= 0 {
+			modTs = time.Now().UnixMilli()
+		}
+		hitems = makeImportedHistoryItems(entries, format, ids.Remote.RemotePtr, modTs)
+	}
+	numInserted, err := sstore.ImportHistoryItems(ctx, hitems)
+	if err != nil {
+		return nil, fmt.Errorf("/history:import error inserting history: %v", err)
+	}
+	return sstore.InfoMsgUpdate("imported %d history items from %q (%d already present)", numInserted, fileName, len(hitems)-numInserted), nil
+}
+
 const HistoryViewPageSize = 50
 
 var cmdFilterLs = regexp.MustCompile(`^ls(\s|$)`)
@@ -3667,6 +3688,64 @@ func historyCmdFilter(hitem *sstore.HistoryItemType) bool {
 	return true
 }
 
+var HistoryQueryModes = []string{sstore.HistoryQueryMode_Substring, sstore.HistoryQueryMode_Token, sstore.HistoryQueryMode_Prefix}
+
+// defaults to substring, token/prefix (ranked when the FTS index is available) must be asked for
+func resolveHistoryQueryMode(modeArg string) (string, error) {
+	if modeArg == "" {
+		return sstore.HistoryQueryMode_Substring, nil
+	}
+	if !utilfn.ContainsStr(HistoryQueryModes, modeArg) {
+		return "", fmt.Errorf("invalid querymode %q, must be %s", modeArg, formatStrs(HistoryQueryModes, "or", false))
+	}
+	return modeArg, nil
+}
+
+// structured filters for /history:viewall, these are pushed down into the history query
+func resolveHistoryFilterArgs(pk *scpacket.FeCommandPacketType, opts *sstore.HistoryQueryOpts) error {
+	opts.FailedOnly = resolveBool(pk.Kwargs["failed"], false)
+	if pk.Kwargs["exitcode"] != "" {
+		exitCode, err := strconv.ParseInt(pk.Kwargs["exitcode"], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid exitcode (must be an integer): %v", err)
+		}
+		opts.ExitCode = &exitCode
+	}
+	minDur, err := resolveNonNegInt(pk.Kwargs["mindur"], 0)
+	if err != nil {
+		return fmt.Errorf("invalid mindur (must be milliseconds): %v", err)
+	}
+	maxDur, err := resolveNonNegInt(pk.Kwargs["maxdur"], 0)
+	if err != nil {
+		return fmt.Errorf("invalid maxdur (must be milliseconds): %v", err)
+	}
+	if maxDur > 0 && minDur > maxDur {
+		return fmt.Errorf("invalid duration range, mindur is greater than maxdur")
+	}
+	opts.MinDurationMs = int64(minDur)
+	opts.MaxDurationMs = int64(maxDur)
+	opts.CwdPrefix = pk.Kwargs["cwd"]
+	beforeTs, err := resolveNonNegInt(pk.Kwargs["beforets"], 0)
+	if err != nil {
+		return fmt.Errorf("invalid beforets (must be unixtime (milliseconds)): %v", err)
+	}
+	afterTs, err := resolveNonNegInt(pk.Kwargs["afterts"], 0)
+	if err != nil {
+		return fmt.Errorf("invalid afterts (must be unixtime (milliseconds)): %v", err)
+	}
+	opts.BeforeTs = int64(beforeTs)
+	opts.AfterTs = int64(afterTs)
+	tagMap := resolveCommaSepListToMap(pk.Kwargs["tags"])
+	for tag := range tagMap {
+		if tag == "" {
+			continue
+		}
+		opts.Tags = append(opts.Tags, tag)
+	}
+	sort.Strings(opts.Tags)
+	return nil
+}
+
 func HistoryViewAllCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
 	_, err := resolveUiIds(ctx, pk, 0)
 	if err != nil {
@@ -3684,6 +3763,10 @@ func HistoryViewAllCommand(ctx context.Context, pk *scpacket.FeCommandPacketType
 	if pk.Kwargs["text"] != "" {
 		opts.SearchText = pk.Kwargs["text"]
 	}
+	opts.QueryMode, err = resolveHistoryQueryMode(pk.Kwargs["querymode"])
+	if err != nil {
+		return nil, err
+	}
 	if pk.Kwargs["searchsession"] != "" {
 		sessionId, err := resolveSessionArg(pk.Kwargs["searchsession"])
 		if err != nil {
@@ -3718,6 +3801,10 @@ func HistoryViewAllCommand(ctx context.Context, pk *scpacket.FeCommandPacketType
 	if err != nil {
 		return nil, fmt.Errorf("invalid meta arg (must be boolean): %v", err)
 	}
+	err = resolveHistoryFilterArgs(pk, &opts)
+	if err != nil {
+		return nil, err
+	}
 	hresult, err := sstore.GetHistoryItems(ctx, opts)
 	if err != nil {
 		return nil, err
@@ -3773,6 +3860,11 @@ func HistoryCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbu
 		hScreenId = ""
 	}
 	hopts := sstore.HistoryQueryOpts{MaxItems: maxItems, SessionId: hSessionId, ScreenId: hScreenId}
+	hopts.SearchText = pk.Kwargs["text"]
+	hopts.QueryMode, err = resolveHistoryQueryMode(pk.Kwargs["querymode"])
+	if err != nil {
+		return nil, err
+	}
 	hresult, err := sstore.GetHistoryItems(ctx, hopts)
 	if err != nil {
 		return nil, err
@@ -3944,7 +4036,7 @@ func LineRestartCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (
 	runPacket.CK = base.MakeCommandKey(ids.ScreenId, lineId)
 	runPacket.UsePty = true
 	// TODO how can we preseve the original termopts?
-	runPacket.TermOpts, err = GetUITermOpts(pk.UIContext.WinSize, DefaultPTERM)
+	runPacket.TermOpts, err = GetUITermOpts(pk.UIContext.WinSize, getDefaultPTerm(ctx, ids))
 	if err != nil {
 		return nil, fmt.Errorf("error getting creating termopts for command: %w", err)
 	}
@@ -3966,7 +4058,7 @@ func LineRestartCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (
 		return nil, err
 	}
 	newTs := time.Now().UnixMilli()
-	err = sstore.UpdateCmdForRestart(ctx, runPacket.CK, newTs, cmd.CmdPid, cmd.RemotePid, convertTermOpts(runPacket.TermOpts))
+	err = sstore.UpdateCmdForRestart(ctx, runPacket.CK, newTs, cmd.Status, cmd.CmdPid, cmd.RemotePid, convertTermOpts(runPacket.TermOpts))
 	if err != nil {
 		return nil, fmt.Errorf("error updating cmd for restart: %w", err)
 	}
@@ -4158,8 +4250,14 @@ func BookmarkSetCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (
 	if cmdStr, found := pk.Kwargs["cmdstr"]; found {
 		editMap[sstore.BookmarkField_CmdStr] = cmdStr
 	}
+	if alias, found := pk.Kwargs["alias"]; found {
+		if alias != "" && !bookmarkAliasRe.MatchString(alias) {
+			return nil, fmt.Errorf("invalid bookmark alias %q (must start with a letter, max %d characters of letters, digits, '_', '-' or '.')", alias, MaxBookmarkAliasLen)
+		}
+		editMap[sstore.BookmarkField_Alias] = alias
+	}
 	if len(editMap) == 0 {
-		return nil, fmt.Errorf("no fields set, can set %s", formatStrs([]string{"desc", "cmdstr"}, "or", false))
+		return nil, fmt.Errorf("no fields set, can set %s", formatStrs([]string{"desc", "cmdstr", "alias"}, "or", false))
 	}
 	err = sstore.EditBookmark(ctx, bookmarkId, editMap)
 	if err != nil {
@@ -4199,116 +4297,557 @@ func BookmarkDeleteCommand(ctx context.Context, pk *scpacket.FeCommandPacketType
 	return update, nil
 }
 
-func LineBookmarkCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
-	ids, err := resolveUiIds(ctx, pk, R_Session|R_Screen)
-	if err != nil {
-		return nil, err
-	}
+const MaxPlaybookNameLen = 100
+
+func resolvePlaybookArg(ctx context.Context, pk *scpacket.FeCommandPacketType) (*sstore.PlaybookType, error) {
 	if len(pk.Args) == 0 {
-		return nil, fmt.Errorf("/line:bookmark requires an argument (line number or id)")
+		return nil, fmt.Errorf("%s requires an argument (playbook name or id)", GetCmdStr(pk))
 	}
-	lineArg := pk.Args[0]
-	lineId, err := sstore.FindLineIdByArg(ctx, ids.ScreenId, lineArg)
+	playbookId, err := sstore.GetPlaybookIdByArg(ctx, pk.Args[0])
 	if err != nil {
-		return nil, fmt.Errorf("error looking up lineid: %v", err)
+		return nil, fmt.Errorf("error trying to resolve playbook: %v", err)
 	}
-	if lineId == "" {
-		return nil, fmt.Errorf("line %q not found", lineArg)
+	if playbookId == "" {
+		return nil, fmt.Errorf("playbook %q not found", pk.Args[0])
 	}
-	_, cmdObj, err := sstore.GetLineCmdByLineId(ctx, ids.ScreenId, lineId)
+	playbook, err := sstore.GetPlaybookById(ctx, playbookId)
 	if err != nil {
-		return nil, fmt.Errorf("/line:bookmark error getting line: %v", err)
+		return nil, fmt.Errorf("error retrieving playbook: %v", err)
 	}
-	if cmdObj == nil {
-		return nil, fmt.Errorf("cannot bookmark non-cmd line")
+	if playbook == nil {
+		return nil, fmt.Errorf("playbook %q not found", pk.Args[0])
 	}
-	existingBmIds, err := sstore.GetBookmarkIdsByCmdStr(ctx, cmdObj.CmdStr)
-	if err != nil {
-		return nil, fmt.Errorf("error trying to retrieve current boookmarks: %v", err)
+	return playbook, nil
+}
+
+// entryArg can be a 1-based entry number, an alias, or an entry id (or 8-character id prefix)
+func resolvePlaybookEntryArg(playbook *sstore.PlaybookType, entryArg string) (int, *sstore.PlaybookEntry, error) {
+	if isAllDigits(entryArg) {
+		entryNum, _ := strconv.Atoi(entryArg)
+		if entryNum < 1 || entryNum > len(playbook.Entries) {
+			return 0, nil, fmt.Errorf("entry %d out of range (playbook has %d entries)", entryNum, len(playbook.Entries))
+		}
+		return entryNum - 1, playbook.Entries[entryNum-1], nil
 	}
-	var newBmId string
-	if len(existingBmIds) > 0 {
-		newBmId = existingBmIds[0]
-	} else {
-		newBm := &sstore.BookmarkType{
-			BookmarkId:  uuid.New().String(),
-			CreatedTs:   time.Now().UnixMilli(),
-			CmdStr:      cmdObj.CmdStr,
-			Alias:       "",
-			Tags:        nil,
-			Description: "",
+	for idx, entry := range playbook.Entries {
+		if entry.Alias != "" && entry.Alias == entryArg {
+			return idx, entry, nil
 		}
-		err = sstore.InsertBookmark(ctx, newBm)
-		if err != nil {
-			return nil, fmt.Errorf("cannot insert bookmark: %v", err)
+		if entry.EntryId == entryArg || (len(entryArg) == 8 && strings.HasPrefix(entry.EntryId, entryArg)) {
+			return idx, entry, nil
 		}
-		newBmId = newBm.BookmarkId
 	}
-	bms, err := sstore.GetBookmarks(ctx, "")
-	update := scbus.MakeUpdatePacket()
-	update.AddUpdate(&sstore.MainViewUpdate{
-		MainView:      sstore.MainViewBookmarks,
-		BookmarksView: &sstore.BookmarksUpdate{Bookmarks: bms, SelectedBookmark: newBmId},
-	})
-	return update, nil
+	return 0, nil, fmt.Errorf("entry %q not found in playbook %q", entryArg, playbook.PlaybookName)
 }
 
-func LinePinCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
-	return nil, nil
+func writePlaybookInfo(buf *bytes.Buffer, playbook *sstore.PlaybookType) {
+	buf.WriteString(fmt.Sprintf("  %-15s %s\n", "playbookid", playbook.PlaybookId))
+	buf.WriteString(fmt.Sprintf("  %-15s %s\n", "name", playbook.PlaybookName))
+	if playbook.Description != "" {
+		buf.WriteString(fmt.Sprintf("  %-15s %s\n", "description", playbook.Description))
+	}
+	buf.WriteString(fmt.Sprintf("  %-15s %d\n", "entries", len(playbook.Entries)))
+	for idx, entry := range playbook.Entries {
+		aliasStr := ""
+		if entry.Alias != "" {
+			aliasStr = fmt.Sprintf("[%s] ", entry.Alias)
+		}
+		buf.WriteString(fmt.Sprintf("    %3d  %s %s%s\n", idx+1, entry.EntryId[0:8], aliasStr, strings.ReplaceAll(entry.CmdStr, "\n", "\\n")))
+		if entry.Description != "" {
+			buf.WriteString(fmt.Sprintf("              %s\n", entry.Description))
+		}
+	}
 }
 
-func LineStarCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
-	ids, err := resolveUiIds(ctx, pk, R_Session|R_Screen)
-	if err != nil {
-		return nil, err
+func PlaybookCreateCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
+	if len(pk.Args) == 0 || strings.TrimSpace(pk.Args[0]) == "" {
+		return nil, fmt.Errorf("/playbook:create requires an argument (playbook name)")
 	}
-	if len(pk.Args) == 0 {
-		return nil, fmt.Errorf("/line:star requires an argument (line number or id)")
+	name := strings.TrimSpace(pk.Args[0])
+	if len(name) > MaxPlaybookNameLen {
+		return nil, fmt.Errorf("playbook name too long, max length is %d", MaxPlaybookNameLen)
 	}
-	if len(pk.Args) > 2 {
-		return nil, fmt.Errorf("/line:star only takes up to 2 arguments (line-number and star-value)")
+	if isAllDigits(name) {
+		return nil, fmt.Errorf("playbook name cannot be all digits")
 	}
-	lineArg := pk.Args[0]
-	lineId, err := sstore.FindLineIdByArg(ctx, ids.ScreenId, lineArg)
+	playbook, err := sstore.CreatePlaybook(ctx, name, pk.Kwargs["desc"])
 	if err != nil {
-		return nil, fmt.Errorf("error looking up lineid: %v", err)
-	}
-	if lineId == "" {
-		return nil, fmt.Errorf("line %q not found", lineArg)
+		return nil, fmt.Errorf("/playbook:create error: %v", err)
 	}
-	starVal, err := resolveNonNegInt(pk.Args[1], 1)
+	return sstore.InfoMsgUpdate("playbook %q created", playbook.PlaybookName), nil
+}
+
+func PlaybookShowAllCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
+	playbooks, err := sstore.GetAllPlaybooks(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("/line:star invalid star-value (not integer): %v", err)
+		return nil, fmt.Errorf("/playbook:showall error: %v", err)
 	}
-	if starVal > 5 {
-		return nil, fmt.Errorf("/line:star invalid star-value must be in the range of 0-5")
+	var buf bytes.Buffer
+	for _, playbook := range playbooks {
+		buf.WriteString(fmt.Sprintf("  %-20s %s  (%d entries)\n", playbook.PlaybookName, playbook.PlaybookId[0:8], len(playbook.Entries)))
 	}
-	err = sstore.UpdateLineStar(ctx, ids.ScreenId, lineId, starVal)
-	if err != nil {
-		return nil, fmt.Errorf("/line:star error updating star value: %v", err)
+	if len(playbooks) == 0 {
+		buf.WriteString("  no playbooks\n")
 	}
-	lineObj, err := sstore.GetLineById(ctx, ids.ScreenId, lineId)
+	update := scbus.MakeUpdatePacket()
+	update.AddUpdate(sstore.InfoMsgType{
+		InfoTitle: "all playbooks",
+		InfoLines: splitLinesForInfo(buf.String()),
+	})
+	return update, nil
+}
+
+func PlaybookShowCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
+	playbook, err := resolvePlaybookArg(ctx, pk)
 	if err != nil {
-		return nil, fmt.Errorf("/line:star error getting line: %v", err)
-	}
-	if lineObj == nil {
-		// no line (which is strange given we checked for it above).  just return a nop.
-		return nil, nil
+		return nil, err
 	}
+	var buf bytes.Buffer
+	writePlaybookInfo(&buf, playbook)
 	update := scbus.MakeUpdatePacket()
-	sstore.AddLineUpdate(update, lineObj, nil)
+	update.AddUpdate(sstore.InfoMsgType{
+		InfoTitle: fmt.Sprintf("playbook %q", playbook.PlaybookName),
+		InfoLines: splitLinesForInfo(buf.String()),
+	})
 	return update, nil
 }
 
-func LineArchiveCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
-	ids, err := resolveUiIds(ctx, pk, R_Session|R_Screen)
+// /playbook:addentry [playbook] [cmdstr] alias=... desc=...
+func PlaybookAddEntryCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
+	playbook, err := resolvePlaybookArg(ctx, pk)
 	if err != nil {
 		return nil, err
 	}
-	if len(pk.Args) == 0 {
-		return nil, fmt.Errorf("/line:archive requires an argument (line number or id)")
+	if len(pk.Args) < 2 || strings.TrimSpace(pk.Args[1]) == "" {
+		return nil, fmt.Errorf("/playbook:addentry requires two arguments (playbook, command)")
 	}
-	lineArg := pk.Args[0]
+	cmdStr := strings.TrimSpace(pk.Args[1])
+	if len(cmdStr) > MaxCommandLen {
+		return nil, fmt.Errorf("command length too long len:%d, max:%d", len(cmdStr), MaxCommandLen)
+	}
+	alias := pk.Kwargs["alias"]
+	if alias != "" {
+		if isAllDigits(alias) {
+			return nil, fmt.Errorf("entry alias cannot be all digits")
+		}
+		if _, _, err := resolvePlaybookEntryArg(playbook, alias); err == nil {
+			return nil, fmt.Errorf("entry alias %q already exists in playbook %q", alias, playbook.PlaybookName)
+		}
+	}
+	nowTs := time.Now().UnixMilli()
+	entry := &sstore.PlaybookEntry{
+		PlaybookId:  playbook.PlaybookId,
+		EntryId:     uuid.New().String(),
+		Alias:       alias,
+		CmdStr:      cmdStr,
+		CreatedTs:   nowTs,
+		UpdatedTs:   nowTs,
+		Description: pk.Kwargs["desc"],
+	}
+	err = sstore.AddPlaybookEntry(ctx, entry)
+	if err != nil {
+		return nil, fmt.Errorf("/playbook:addentry error: %v", err)
+	}
+	return sstore.InfoMsgUpdate("added entry %d to playbook %q", len(playbook.Entries)+1, playbook.PlaybookName), nil
+}
+
+// /playbook:removeentry [playbook] [entry]
+func PlaybookRemoveEntryCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
+	playbook, err := resolvePlaybookArg(ctx, pk)
+	if err != nil {
+		return nil, err
+	}
+	if len(pk.Args) < 2 {
+		return nil, fmt.Errorf("/playbook:removeentry requires two arguments (playbook, entry)")
+	}
+	_, entry, err := resolvePlaybookEntryArg(playbook, pk.Args[1])
+	if err != nil {
+		return nil, err
+	}
+	err = sstore.RemovePlaybookEntry(ctx, playbook.PlaybookId, entry.EntryId)
+	if err != nil {
+		return nil, fmt.Errorf("/playbook:removeentry error: %v", err)
+	}
+	return sstore.InfoMsgUpdate("removed entry from playbook %q", playbook.PlaybookName), nil
+}
+
+// /playbook:reorder [playbook] [entry] index=[new 1-based position]
+func PlaybookReorderCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
+	playbook, err := resolvePlaybookArg(ctx, pk)
+	if err != nil {
+		return nil, err
+	}
+	if len(pk.Args) < 2 {
+		return nil, fmt.Errorf("/playbook:reorder requires two arguments (playbook, entry)")
+	}
+	_, entry, err := resolvePlaybookEntryArg(playbook, pk.Args[1])
+	if err != nil {
+		return nil, err
+	}
+	if pk.Kwargs["index"] == "" {
+		return nil, fmt.Errorf("/playbook:reorder requires an index (new position of entry)")
+	}
+	newIdx, err := resolvePosInt(pk.Kwargs["index"], 1)
+	if err != nil {
+		return nil, fmt.Errorf("invalid new entry index: %v", err)
+	}
+	err = sstore.SetPlaybookEntryIdx(ctx, playbook.PlaybookId, entry.EntryId, newIdx-1)
+	if err != nil {
+		return nil, fmt.Errorf("/playbook:reorder error: %v", err)
+	}
+	return sstore.InfoMsgUpdate("playbook %q entries reordered", playbook.PlaybookName), nil
+}
+
+func PlaybookDeleteCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
+	playbook, err := resolvePlaybookArg(ctx, pk)
+	if err != nil {
+		return nil, err
+	}
+	err = sstore.DeletePlaybook(ctx, playbook.PlaybookId)
+	if err != nil {
+		return nil, fmt.Errorf("/playbook:delete error: %v", err)
+	}
+	return sstore.InfoMsgUpdate("playbook %q deleted", playbook.PlaybookName), nil
+}
+
+// /playbook:run [playbook] continue=[bool]
+// runs the entries sequentially on the current screen's remote.  stops on the first command that
+// does not finish with exit code 0 unless continue=1 is passed.  the run gets its own line which
+// reports progress, ^C (or /signal) on that line stops the playbook.
+func PlaybookRunCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
+	ids, err := resolveUiIds(ctx, pk, R_Session|R_Screen|R_RemoteConnected)
+	if err != nil {
+		return nil, fmt.Errorf("/playbook:run error: %w", err)
+	}
+	playbook, err := resolvePlaybookArg(ctx, pk)
+	if err != nil {
+		return nil, err
+	}
+	if len(playbook.Entries) == 0 {
+		return nil, fmt.Errorf("playbook %q has no entries", playbook.PlaybookName)
+	}
+	continueOnError := resolveBool(pk.Kwargs["continue"], false)
+	termopts := sstore.TermOpts{Rows: shellutil.DefaultTermRows, Cols: shellutil.DefaultTermCols, FlexRows: true, MaxPtySize: remote.DefaultMaxPtySize}
+	cmd, err := makeDynCmd(ctx, "playbook run", ids, pk.GetRawStr(), termopts)
+	if err != nil {
+		return nil, err
+	}
+	update, err := addLineForCmd(ctx, "/playbook:run", false, ids, cmd, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	update.AddUpdate(sstore.InteractiveUpdate(pk.Interactive))
+	scbus.MainUpdateBus.DoScreenUpdate(cmd.ScreenId, update)
+	go runPlaybook(context.Background(), cmd, ids, pk.UIContext, playbook, continueOnError)
+	return scbus.MakeUpdatePacket(), nil
+}
+
+// runs as a local cmd (see remote.RegisterLocalCmd), so ^C or /signal stops the playbook (and interrupts
+// the running entry)
+func runPlaybook(ctx context.Context, cmd *sstore.CmdType, ids resolvedIds, uiContext *scpacket.UIContextType, playbook *sstore.PlaybookType, continueOnError bool) {
+	var outputPos int64
+	var exitSuccess bool
+	startTime := time.Now()
+	defer func() {
+		deferWriteCmdStatus(ctx, cmd, startTime, exitSuccess, outputPos)
+	}()
+	runCtx, cancelFn := context.WithCancel(ctx)
+	defer cancelFn()
+	ck := base.MakeCommandKey(cmd.ScreenId, cmd.LineId)
+	remote.RegisterLocalCmd(ck, cancelFn)
+	defer remote.UnregisterLocalCmd(ck)
+	numEntries := len(playbook.Entries)
+	writeStringToPty(ctx, cmd, fmt.Sprintf("Running playbook %q (%d entries)\r\n", playbook.PlaybookName, numEntries), &outputPos)
+	runEntry := func(idx int, entry *sstore.PlaybookEntry) (bool, error) {
+		writeStringToPty(ctx, cmd, fmt.Sprintf("[%d/%d] %s\r\n", idx+1, numEntries, entry.CmdStr), &outputPos)
+		return runPlaybookEntry(runCtx, ids, uiContext, entry)
+	}
+	numRun, numFailed, err := runPlaybookEntries(runCtx, playbook.Entries, continueOnError, runEntry)
+	if err != nil {
+		writeStringToPty(ctx, cmd, fmt.Sprintf("Playbook stopped, %v (ran %d entries, %d failed)\r\n", err, numRun, numFailed), &outputPos)
+		return
+	}
+	writeStringToPty(ctx, cmd, fmt.Sprintf("Playbook finished, ran %d entries (%d failed)\r\n", numRun, numFailed), &outputPos)
+	exitSuccess = (numFailed == 0)
+}
+
+// runs the entries in order, runEntry returns once the entry's command is done (false if it failed).
+// stops at the first entry that cannot be run, and at the first failed entry unless continueOnError is set.
+// returns the number of entries run and failed, and an error if the playbook stopped early.
+func runPlaybookEntries(ctx context.Context, entries []*sstore.PlaybookEntry, continueOnError bool, runEntry func(int, *sstore.PlaybookEntry) (bool, error)) (int, int, error) {
+	var numRun, numFailed int
+	for idx, entry := range entries {
+		if ctx.Err() != nil {
+			return numRun, numFailed, fmt.Errorf("interrupted before entry %d", idx+1)
+		}
+		ok, err := runEntry(idx, entry)
+		if err != nil {
+			if ctx.Err() != nil {
+				return numRun, numFailed, fmt.Errorf("interrupted at entry %d", idx+1)
+			}
+			return numRun, numFailed, fmt.Errorf("entry %d error: %w", idx+1, err)
+		}
+		numRun++
+		if ok {
+			continue
+		}
+		numFailed++
+		if !continueOnError {
+			return numRun, numFailed, fmt.Errorf("entry %d failed", idx+1)
+		}
+	}
+	return numRun, numFailed, nil
+}
+
+// starts the entry's command on the screen and waits for it to finish, returns true if it exited with code 0.
+// if ctx is canceled while waiting the command is interrupted (SIGINT).
+func runPlaybookEntry(ctx context.Context, ids resolvedIds, uiContext *scpacket.UIContextType, entry *sstore.PlaybookEntry) (bool, error) {
+	entryPk := scpacket.MakeFeCommandPacket()
+	entryPk.MetaCmd = "run"
+	entryPk.Args = []string{entry.CmdStr}
+	entryPk.Kwargs = make(map[string]string)
+	entryPk.RawStr = entry.CmdStr
+	entryPk.UIContext = uiContext
+	cmd, err := startRunCommand(ctx, entryPk, ids, entry.CmdStr, "", make(map[string]any))
+	if err != nil {
+		return false, err
+	}
+	ck := base.MakeCommandKey(cmd.ScreenId, cmd.LineId)
+	msh := ids.Remote.MShell
+	err = msh.WaitForCmdDone(ctx, ck)
+	if err != nil {
+		siPk := packet.MakeSpecialInputPacket()
+		siPk.CK = ck
+		siPk.SigName = "SIGINT"
+		sigErr := msh.SendSpecialInput(siPk)
+		if sigErr != nil {
+			log.Printf("error interrupting playbook entry %s: %v\n", ck, sigErr)
+		}
+		return false, err
+	}
+	doneCmd, err := sstore.GetCmdByScreenId(ctx, cmd.ScreenId, cmd.LineId)
+	if err != nil {
+		return false, fmt.Errorf("cannot get status: %v", err)
+	}
+	if doneCmd == nil {
+		return false, fmt.Errorf("cannot get status (cmd not found)")
+	}
+	return doneCmd.Status == sstore.CmdStatusDone && doneCmd.ExitCode == 0, nil
+}
+
+const MaxBookmarkAliasLen = 50
+const BookmarkParamTimeout = 60 * time.Second
+
+var bookmarkAliasRe = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_.-]{0,49}$`)
+
+// /bookmark:run [bookmark] [name=value...]
+// runs the bookmark's command on the current screen.  {{name}} placeholders in the command are filled in
+// from the kwargs, the user is prompted for any that are missing.
+func BookmarkRunCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
+	ids, err := resolveUiIds(ctx, pk, R_Session|R_Screen|R_RemoteConnected)
+	if err != nil {
+		return nil, fmt.Errorf("/bookmark:run error: %w", err)
+	}
+	if len(pk.Args) == 0 {
+		return nil, fmt.Errorf("/bookmark:run requires one argument (bookmark alias or id)")
+	}
+	bookmarkId, err := sstore.GetBookmarkIdByArg(ctx, pk.Args[0])
+	if err != nil {
+		return nil, fmt.Errorf("error trying to resolve bookmark: %v", err)
+	}
+	if bookmarkId == "" {
+		return nil, fmt.Errorf("bookmark %q not found", pk.Args[0])
+	}
+	bm, err := sstore.GetBookmarkById(ctx, bookmarkId, "")
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving bookmark: %v", err)
+	}
+	if bm == nil {
+		return nil, fmt.Errorf("bookmark %q not found", pk.Args[0])
+	}
+	values := make(map[string]string)
+	var missing []string
+	for _, name := range getBookmarkPlaceholders(bm.CmdStr) {
+		if val, found := pk.Kwargs[name]; found {
+			values[name] = val
+		} else {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		_, err = runBookmarkCmd(ctx, pk, ids, bm, values)
+		if err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+	// prompting has to happen outside of the command request
+	go func() {
+		for _, name := range missing {
+			val, err := promptBookmarkParam(bm, name)
+			if err != nil {
+				scbus.MainUpdateBus.DoScreenUpdate(ids.ScreenId, sstore.InfoMsgUpdate("/bookmark:run canceled: %v", err))
+				return
+			}
+			values[name] = val
+		}
+		_, err := runBookmarkCmd(context.Background(), pk, ids, bm, values)
+		if err != nil {
+			scbus.MainUpdateBus.DoScreenUpdate(ids.ScreenId, sstore.InfoMsgUpdate("/bookmark:run error: %v", err))
+		}
+	}()
+	return nil, nil
+}
+
+func promptBookmarkParam(bm *sstore.BookmarkType, name string) (string, error) {
+	request := &userinput.UserInputRequestType{
+		ResponseType: "text",
+		QueryText:    fmt.Sprintf("Enter a value for {{%s}} in:\n%s", name, bm.CmdStr),
+		Title:        "Bookmark Parameter",
+	}
+	ctx, cancelFn := context.WithTimeout(context.Background(), BookmarkParamTimeout)
+	defer cancelFn()
+	response, err := userinput.GetUserInput(ctx, scbus.MainRpcBus, request)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("timed out waiting for value for {{%s}}", name)
+		}
+		return "", fmt.Errorf("no value for {{%s}}: %v", name, err)
+	}
+	if response.ErrorMsg != "" {
+		return "", fmt.Errorf("%s", response.ErrorMsg)
+	}
+	return response.Text, nil
+}
+
+func runBookmarkCmd(ctx context.Context, pk *scpacket.FeCommandPacketType, ids resolvedIds, bm *sstore.BookmarkType, values map[string]string) (*sstore.CmdType, error) {
+	cmdStr := strings.TrimSpace(expandBookmarkTemplate(bm.CmdStr, values))
+	if cmdStr == "" {
+		return nil, fmt.Errorf("bookmark command is empty")
+	}
+	if len(cmdStr) > MaxCommandLen {
+		return nil, fmt.Errorf("command length too long len:%d, max:%d", len(cmdStr), MaxCommandLen)
+	}
+	runPk := scpacket.MakeFeCommandPacket()
+	runPk.MetaCmd = "run"
+	runPk.Args = []string{cmdStr}
+	runPk.Kwargs = makeBookmarkRunKwargs(pk.Kwargs, bm.CmdStr)
+	runPk.RawStr = cmdStr
+	runPk.UIContext = pk.UIContext
+	runPk.Interactive = pk.Interactive
+	return startRunCommand(ctx, runPk, ids, cmdStr, "", make(map[string]any))
+}
+
+func LineBookmarkCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
+	ids, err := resolveUiIds(ctx, pk, R_Session|R_Screen)
+	if err != nil {
+		return nil, err
+	}
+	if len(pk.Args) == 0 {
+		return nil, fmt.Errorf("/line:bookmark requires an argument (line number or id)")
+	}
+	lineArg := pk.Args[0]
+	lineId, err := sstore.FindLineIdByArg(ctx, ids.ScreenId, lineArg)
+	if err != nil {
+		return nil, fmt.Errorf("error looking up lineid: %v", err)
+	}
+	if lineId == "" {
+		return nil, fmt.Errorf("line %q not found", lineArg)
+	}
+	_, cmdObj, err := sstore.GetLineCmdByLineId(ctx, ids.ScreenId, lineId)
+	if err != nil {
+		return nil, fmt.Errorf("/line:bookmark error getting line: %v", err)
+	}
+	if cmdObj == nil {
+		return nil, fmt.Errorf("cannot bookmark non-cmd line")
+	}
+	existingBmIds, err := sstore.GetBookmarkIdsByCmdStr(ctx, cmdObj.CmdStr)
+	if err != nil {
+		return nil, fmt.Errorf("error trying to retrieve current boookmarks: %v", err)
+	}
+	var newBmId string
+	if len(existingBmIds) > 0 {
+		newBmId = existingBmIds[0]
+	} else {
+		newBm := &sstore.BookmarkType{
+			BookmarkId:  uuid.New().String(),
+			CreatedTs:   time.Now().UnixMilli(),
+			CmdStr:      cmdObj.CmdStr,
+			Alias:       "",
+			Tags:        nil,
+			Description: "",
+		}
+		err = sstore.InsertBookmark(ctx, newBm)
+		if err != nil {
+			return nil, fmt.Errorf("cannot insert bookmark: %v", err)
+		}
+		newBmId = newBm.BookmarkId
+	}
+	bms, err := sstore.GetBookmarks(ctx, "")
+	update := scbus.MakeUpdatePacket()
+	update.AddUpdate(&sstore.MainViewUpdate{
+		MainView:      sstore.MainViewBookmarks,
+		BookmarksView: &sstore.BookmarksUpdate{Bookmarks: bms, SelectedBookmark: newBmId},
+	})
+	return update, nil
+}
+
+func LinePinCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
+	return nil, nil
+}
+
+func LineStarCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
+	ids, err := resolveUiIds(ctx, pk, R_Session|R_Screen)
+	if err != nil {
+		return nil, err
+	}
+	if len(pk.Args) == 0 {
+		return nil, fmt.Errorf("/line:star requires an argument (line number or id)")
+	}
+	if len(pk.Args) > 2 {
+		return nil, fmt.Errorf("/line:star only takes up to 2 arguments (line-number and star-value)")
+	}
+	lineArg := pk.Args[0]
+	lineId, err := sstore.FindLineIdByArg(ctx, ids.ScreenId, lineArg)
+	if err != nil {
+		return nil, fmt.Errorf("error looking up lineid: %v", err)
+	}
+	if lineId == "" {
+		return nil, fmt.Errorf("line %q not found", lineArg)
+	}
+	starVal, err := resolveNonNegInt(pk.Args[1], 1)
+	if err != nil {
+		return nil, fmt.Errorf("/line:star invalid star-value (not integer): %v", err)
+	}
+	if starVal > 5 {
+		return nil, fmt.Errorf("/line:star invalid star-value must be in the range of 0-5")
+	}
+	err = sstore.UpdateLineStar(ctx, ids.ScreenId, lineId, starVal)
+	if err != nil {
+		return nil, fmt.Errorf("/line:star error updating star value: %v", err)
+	}
+	lineObj, err := sstore.GetLineById(ctx, ids.ScreenId, lineId)
+	if err != nil {
+		return nil, fmt.Errorf("/line:star error getting line: %v", err)
+	}
+	if lineObj == nil {
+		// no line (which is strange given we checked for it above).  just return a nop.
+		return nil, nil
+	}
+	update := scbus.MakeUpdatePacket()
+	sstore.AddLineUpdate(update, lineObj, nil)
+	return update, nil
+}
+
+func LineArchiveCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
+	ids, err := resolveUiIds(ctx, pk, R_Session|R_Screen)
+	if err != nil {
+		return nil, err
+	}
+	if len(pk.Args) == 0 {
+		return nil, fmt.Errorf("/line:archive requires an argument (line number or id)")
+	}
+	lineArg := pk.Args[0]
 	lineId, err := sstore.FindLineIdByArg(ctx, ids.ScreenId, lineArg)
 	if err != nil {
 		return nil, fmt.Errorf("error looking up lineid: %v", err)
@@ -4480,8 +5019,19 @@ func LineShowCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scb
 			buf.WriteString(fmt.Sprintf("  %-15s %s\n", "file", "-"))
 		} else {
 			fileDataStr := fmt.Sprintf("v%d data=%d offset=%d max=%s", stat.Version, stat.DataSize, stat.FileOffset, scbase.NumFormatB2(stat.MaxSize))
+			if stat.Compressed {
+				fileDataStr += fmt.Sprintf(" compressed=%s", scbase.NumFormatB2(stat.CompressedSize))
+			}
 			buf.WriteString(fmt.Sprintf("  %-15s %s\n", "file", stat.Location))
 			buf.WriteString(fmt.Sprintf("  %-15s %s\n", "file-data", fileDataStr))
+			if stat.HasIndex {
+				entries, _ := sstore.ReadPtyOutIndex(ctx, cmd.ScreenId, cmd.LineId)
+				if len(entries) > 0 {
+					firstTs := time.UnixMilli(entries[0].Ts).Format(TsFormatStr)
+					lastTs := time.UnixMilli(entries[len(entries)-1].Ts).Format(TsFormatStr)
+					buf.WriteString(fmt.Sprintf("  %-15s %d entries, %s - %s\n", "file-index", len(entries), firstTs, lastTs))
+				}
+			}
 		}
 		if cmd.RestartTs > 0 {
 			restartTs := time.UnixMilli(cmd.RestartTs)
@@ -4493,6 +5043,13 @@ func LineShowCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scb
 			buf.WriteString(fmt.Sprintf("  %-15s %d\n", "exitcode", cmd.ExitCode))
 			buf.WriteString(fmt.Sprintf("  %-15s %dms\n", "duration", cmd.DurationMs))
 		}
+		if cmd.RUsage != nil {
+			ru := cmd.RUsage
+			buf.WriteString(fmt.Sprintf("  %-15s user=%dms sys=%dms\n", "cpu", ru.UserTimeMs, ru.SysTimeMs))
+			buf.WriteString(fmt.Sprintf("  %-15s %s\n", "maxrss", scbase.NumFormatB2(ru.MaxRssKB*1024)))
+			buf.WriteString(fmt.Sprintf("  %-15s in=%d out=%d\n", "blockio", ru.InBlock, ru.OutBlock))
+			buf.WriteString(fmt.Sprintf("  %-15s voluntary=%d involuntary=%d\n", "ctxswitches", ru.VolCsw, ru.InvolCsw))
+		}
 	}
 	stateStr := dbutil.QuickJson(line.LineState)
 	if len(stateStr) > 80 {
@@ -4507,13 +5064,179 @@ func LineShowCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scb
 	return update, nil
 }
 
+// writes the line's output to a local file as an asciinema v2 recording.  event timing comes from
+// the ptyout file's timing index (older lines without an index are written as a single event)
+func LineExportCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
+	ids, err := resolveUiIds(ctx, pk, R_Session|R_Screen)
+	if err != nil {
+		return nil, err
+	}
+	if len(pk.Args) < 2 {
+		return nil, fmt.Errorf("usage: /line:export [line] [file] [format=asciicast]")
+	}
+	format := defaultStr(pk.Kwargs["format"], LineExportFormat_Asciicast)
+	if format != LineExportFormat_Asciicast {
+		return nil, fmt.Errorf("/line:export invalid format %q, must be %q", format, LineExportFormat_Asciicast)
+	}
+	lineArg := pk.Args[0]
+	fileName := base.ExpandHomeDir(pk.Args[1])
+	if !filepath.IsAbs(fileName) {
+		return nil, fmt.Errorf("/line:export file must be absolute, cannot be a relative path")
+	}
+	lineId, err := sstore.FindLineIdByArg(ctx, ids.ScreenId, lineArg)
+	if err != nil {
+		return nil, fmt.Errorf("error looking up lineid: %v", err)
+	}
+	if lineId == "" {
+		return nil, fmt.Errorf("line %q not found", lineArg)
+	}
+	line, cmd, err := sstore.GetLineCmdByLineId(ctx, ids.ScreenId, lineId)
+	if err != nil {
+		return nil, fmt.Errorf("error getting line: %v", err)
+	}
+	if line == nil {
+		return nil, fmt.Errorf("line %q not found", lineArg)
+	}
+	if cmd == nil {
+		return nil, fmt.Errorf("/line:export line %q has no terminal output", lineArg)
+	}
+	baseOffset, data, err := sstore.ReadFullPtyOutFile(ctx, cmd.ScreenId, cmd.LineId)
+	if err != nil {
+		return nil, fmt.Errorf("/line:export error reading output: %v", err)
+	}
+	entries, err := sstore.ReadPtyOutIndex(ctx, cmd.ScreenId, cmd.LineId)
+	if err != nil && !errors.Is(err, cirfile.ErrNoIndex) {
+		return nil, fmt.Errorf("/line:export error reading output index: %v", err)
+	}
+	header := asciicastHeader{
+		Version:   AsciicastVersion,
+		Width:     int(cmd.TermOpts.Cols),
+		Height:    int(cmd.TermOpts.Rows),
+		Timestamp: line.Ts / 1000,
+		Title:     cmd.CmdStr,
+	}
+	events := makeAsciicastEvents(data, baseOffset, entries)
+	fd, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("/line:export cannot open file: %v", err)
+	}
+	defer fd.Close()
+	err = writeAsciicast(fd, header, events)
+	if err != nil {
+		return nil, fmt.Errorf("/line:export error writing file: %v", err)
+	}
+	return sstore.InfoMsgUpdate("exported line %d (%d events) to %q", line.LineNum, len(events), fileName), nil
+}
+
+// replays a local asciinema v2 recording (.cast) into a new line.  speed=N plays N times faster,
+// maxwait=secs caps idle time between events (defaults to the recording's idle_time_limit).
+// the replay can be stopped with ^C
+func LineImportCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
+	ids, err := resolveUiIds(ctx, pk, R_Session|R_Screen|R_Remote)
+	if err != nil {
+		return nil, err
+	}
+	if len(pk.Args) == 0 {
+		return nil, fmt.Errorf("/line:import requires an argument (file name)")
+	}
+	fileName, err := resolveFile(pk.Args[0])
+	if err != nil {
+		return nil, fmt.Errorf("/line:import invalid file: %v", err)
+	}
+	speed := 1.0
+	if pk.Kwargs["speed"] != "" {
+		speed, err = strconv.ParseFloat(pk.Kwargs["speed"], 64)
+		if err != nil || speed <= 0 {
+			return nil, fmt.Errorf("/line:import invalid speed %q, must be a positive number", pk.Kwargs["speed"])
+		}
+	}
+	finfo, err := os.Stat(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("/line:import cannot stat file: %v", err)
+	}
+	if finfo.Size() > MaxAsciicastFileSize {
+		return nil, fmt.Errorf("/line:import file is too large (%s), max is %s", scbase.NumFormatB2(finfo.Size()), scbase.NumFormatB2(MaxAsciicastFileSize))
+	}
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("/line:import cannot open file: %v", err)
+	}
+	defer fd.Close()
+	header, events, err := readAsciicast(fd)
+	if err != nil {
+		return nil, fmt.Errorf("/line:import %v", err)
+	}
+	maxWaitSecs := header.IdleTimeLimit
+	if pk.Kwargs["maxwait"] != "" {
+		maxWaitSecs, err = strconv.ParseFloat(pk.Kwargs["maxwait"], 64)
+		if err != nil || maxWaitSecs < 0 {
+			return nil, fmt.Errorf("/line:import invalid maxwait %q, must be a non-negative number of seconds", pk.Kwargs["maxwait"])
+		}
+	}
+	frames := makeAsciicastFrames(events, speed, time.Duration(maxWaitSecs*float64(time.Second)))
+	var totalSize int64
+	for _, frame := range frames {
+		totalSize += int64(len(frame.Data))
+	}
+	termopts := sstore.TermOpts{
+		Rows:       int64(base.BoundInt(header.Height, shexec.MinTermRows, shexec.MaxTermRows)),
+		Cols:       int64(base.BoundInt(header.Width, shexec.MinTermCols, shexec.MaxTermCols)),
+		FlexRows:   true,
+		MaxPtySize: base.BoundInt64(totalSize, remote.DefaultMaxPtySize, shexec.MaxMaxPtySize),
+	}
+	cmd, err := makeDynCmd(ctx, "line import", ids, pk.GetRawStr(), termopts)
+	if err != nil {
+		return nil, err
+	}
+	update, err := addLineForCmd(ctx, "/line:import", false, ids, cmd, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	update.AddUpdate(sstore.InteractiveUpdate(pk.Interactive))
+	scbus.MainUpdateBus.DoScreenUpdate(cmd.ScreenId, update)
+	go doLineImportReplay(cmd, frames)
+	return scbus.MakeUpdatePacket(), nil
+}
+
+func doLineImportReplay(cmd *sstore.CmdType, frames []asciicastFrame) {
+	ctx := context.Background()
+	replayCtx, cancelFn := context.WithCancel(ctx)
+	defer cancelFn()
+	ck := base.MakeCommandKey(cmd.ScreenId, cmd.LineId)
+	remote.RegisterLocalCmd(ck, cancelFn)
+	defer remote.UnregisterLocalCmd(ck)
+	var outputPos int64
+	var exitSuccess bool
+	startTime := time.Now()
+	defer func() {
+		deferWriteCmdStatus(ctx, cmd, startTime, exitSuccess, outputPos)
+	}()
+	for _, frame := range frames {
+		if frame.Delay > 0 {
+			timer := time.NewTimer(frame.Delay)
+			select {
+			case <-timer.C:
+			case <-replayCtx.Done():
+				timer.Stop()
+				writeStringToPty(ctx, cmd, "\r\n[replay interrupted]\r\n", &outputPos)
+				return
+			}
+		}
+		writeStringToPty(ctx, cmd, frame.Data, &outputPos)
+	}
+	exitSuccess = true
+}
+
 func SetCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
 	var setMap map[string]map[string]string
 	setMap = make(map[string]map[string]string)
-	_, err := resolveUiIds(ctx, pk, 0) // best effort
+	ids, err := resolveUiIds(ctx, pk, 0) // best effort
 	if err != nil {
 		return nil, err
 	}
+	if len(pk.Args) == 0 {
+		return makeSetVarsInfoUpdate(ctx, ids)
+	}
 	for argIdx, rawArgVal := range pk.Args {
 		eqIdx := strings.Index(rawArgVal, "=")
 		if eqIdx == -1 {
@@ -4530,14 +5253,222 @@ func SetCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.Up
 		}
 		setMap[scopeName][varName] = argVal
 	}
-	return nil, nil
+	update := scbus.MakeUpdatePacket()
+	var varsUpdated []string
+	for _, varScope := range SetVarScopes {
+		scopeMap := setMap[varScope.ScopeName]
+		if len(scopeMap) == 0 {
+			continue
+		}
+		fieldVars := make(map[string]string)
+		for varName, varVal := range scopeMap {
+			varsUpdated = append(varsUpdated, varScope.ScopeName+"."+varName)
+			if !utilfn.ContainsStr(varScope.StoredVarNames, varName) {
+				fieldVars[varName] = varVal
+				continue
+			}
+			err = setStoredVar(ctx, ids, varScope.ScopeName, varName, varVal)
+			if err != nil {
+				return nil, fmt.Errorf("/set %s.%s: %v", varScope.ScopeName, varName, err)
+			}
+		}
+		if len(fieldVars) > 0 {
+			err = setFieldVars(ctx, pk, varScope.ScopeName, fieldVars, update)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	sort.Strings(varsUpdated)
+	update.AddUpdate(sstore.InfoMsgType{
+		InfoMsg:   fmt.Sprintf("set %s", formatStrs(varsUpdated, "and", false)),
+		TimeoutMs: 2000,
+	})
+	return update, nil
+}
+
+func getSetVarScopeId(ids resolvedIds, scopeName string) (string, error) {
+	switch scopeName {
+	case sstore.SetVarScope_Client:
+		return "", nil
+	case sstore.SetVarScope_Session:
+		if ids.SessionId == "" {
+			return "", fmt.Errorf("no current session")
+		}
+		return ids.SessionId, nil
+	case sstore.SetVarScope_Screen:
+		if ids.ScreenId == "" {
+			return "", fmt.Errorf("no current screen")
+		}
+		return ids.ScreenId, nil
+	case sstore.SetVarScope_Connection:
+		if ids.Remote == nil {
+			return "", fmt.Errorf("no current connection")
+		}
+		return ids.Remote.RemotePtr.RemoteId, nil
+	}
+	return "", fmt.Errorf("invalid scope %q", scopeName)
+}
+
+// returns the value to store (empty string unsets the var)
+func validateSetVarValue(varName string, varVal string) (string, error) {
+	if varVal == "" {
+		return "", nil
+	}
+	switch varName {
+	case sstore.SetVar_PTerm:
+		_, err := parseSingleTermStr(varVal)
+		if err != nil {
+			return "", err
+		}
+	case sstore.SetVar_Remote:
+		rstate := remote.ResolveRemoteRef(varVal)
+		if rstate == nil {
+			return "", fmt.Errorf("cannot resolve remote %q: not found", varVal)
+		}
+		return rstate.RemoteId, nil
+	case sstore.SetVar_ShellPref:
+		if !packet.IsValidShellType(varVal) && varVal != sstore.ShellTypePref_Detect {
+			return "", fmt.Errorf("invalid shellpref %q, must be %s", varVal, formatStrs([]string{packet.ShellType_bash, packet.ShellType_zsh, packet.ShellType_fish, sstore.ShellTypePref_Detect}, "or", false))
+		}
+	}
+	return varVal, nil
+}
+
+func setStoredVar(ctx context.Context, ids resolvedIds, scopeName string, varName string, varVal string) error {
+	scopeId, err := getSetVarScopeId(ids, scopeName)
+	if err != nil {
+		return err
+	}
+	storeVal, err := validateSetVarValue(varName, varVal)
+	if err != nil {
+		return err
+	}
+	if storeVal == "" {
+		return sstore.DeleteSetVar(ctx, scopeName, scopeId, varName)
+	}
+	return sstore.UpsertSetVar(ctx, &sstore.SetVarType{Scope: scopeName, ScopeId: scopeId, Name: varName, Value: storeVal})
+}
+
+// copies the model updates (but not the info messages) from a delegated command into update
+func addDelegatedUpdates(update *scbus.ModelUpdatePacketType, delegatedUpdate scbus.UpdatePacket) {
+	mu, ok := delegatedUpdate.(*scbus.ModelUpdatePacketType)
+	if !ok || mu == nil || mu.Data == nil {
+		return
+	}
+	for _, item := range *mu.Data {
+		if _, isInfo := item.(sstore.InfoMsgType); isInfo {
+			continue
+		}
+		update.AddUpdate(item)
+	}
+}
+
+// field vars are not stored in the setvar table, they are applied with the scope's regular command
+func setFieldVars(ctx context.Context, pk *scpacket.FeCommandPacketType, scopeName string, fieldVars map[string]string, update *scbus.ModelUpdatePacketType) error {
+	makeDelegatePk := func(metaCmd string, metaSubCmd string, kwargs map[string]string) *scpacket.FeCommandPacketType {
+		newPk := scpacket.MakeFeCommandPacket()
+		newPk.MetaCmd = metaCmd
+		newPk.MetaSubCmd = metaSubCmd
+		for key, val := range pk.Kwargs {
+			newPk.Kwargs[key] = val
+		}
+		for key, val := range kwargs {
+			newPk.Kwargs[key] = val
+		}
+		newPk.UIContext = pk.UIContext
+		newPk.Interactive = pk.Interactive
+		return newPk
+	}
+	var delegatedUpdate scbus.UpdatePacket
+	var err error
+	switch scopeName {
+	case "client":
+		if resolveBool(fieldVars["telemetry"], true) {
+			delegatedUpdate, err = TelemetryOnCommand(ctx, makeDelegatePk("telemetry", "on", nil))
+		} else {
+			delegatedUpdate, err = TelemetryOffCommand(ctx, makeDelegatePk("telemetry", "off", nil))
+		}
+	case "session":
+		delegatedUpdate, err = SessionSetCommand(ctx, makeDelegatePk("session", "set", fieldVars))
+	case "screen":
+		if indexVal, found := fieldVars["index"]; found {
+			delete(fieldVars, "index")
+			delegatedUpdate, err = ScreenReorderCommand(ctx, makeDelegatePk("screen", "reorder", map[string]string{"index": indexVal}))
+			if err != nil {
+				return err
+			}
+			addDelegatedUpdates(update, delegatedUpdate)
+			if len(fieldVars) == 0 {
+				return nil
+			}
+		}
+		delegatedUpdate, err = ScreenSetCommand(ctx, makeDelegatePk("screen", "set", fieldVars))
+	case "connection":
+		delegatedUpdate, err = RemoteSetCommand(ctx, makeDelegatePk("remote", "set", fieldVars))
+	default:
+		return fmt.Errorf("/set cannot set vars in scope %q", scopeName)
+	}
+	if err != nil {
+		return err
+	}
+	addDelegatedUpdates(update, delegatedUpdate)
+	return nil
+}
+
+func setVarDisplayValue(sv *sstore.SetVarType) string {
+	if sv.Name == sstore.SetVar_Remote {
+		rstate := remote.ResolveRemoteRef(sv.Value)
+		if rstate == nil {
+			return fmt.Sprintf("%s (not found)", sv.Value)
+		}
+		return rstate.GetBaseDisplayName()
+	}
+	return sv.Value
+}
+
+func writeSetVarsInfo(ctx context.Context, buf *bytes.Buffer, scopeName string, scopeId string) error {
+	setVars, err := sstore.GetSetVars(ctx, scopeName, scopeId)
+	if err != nil {
+		return fmt.Errorf("cannot retrieve %s vars: %v", scopeName, err)
+	}
+	for _, sv := range setVars {
+		buf.WriteString(fmt.Sprintf("  %-15s %s\n", scopeName+"."+sv.Name, setVarDisplayValue(sv)))
+	}
+	return nil
+}
+
+func makeSetVarsInfoUpdate(ctx context.Context, ids resolvedIds) (scbus.UpdatePacket, error) {
+	var buf bytes.Buffer
+	for _, varScope := range SetVarScopes {
+		if len(varScope.StoredVarNames) == 0 {
+			continue
+		}
+		scopeId, err := getSetVarScopeId(ids, varScope.ScopeName)
+		if err != nil {
+			continue
+		}
+		err = writeSetVarsInfo(ctx, &buf, varScope.ScopeName, scopeId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if buf.Len() == 0 {
+		buf.WriteString("  (no vars set)\n")
+	}
+	update := scbus.MakeUpdatePacket()
+	update.AddUpdate(sstore.InfoMsgType{
+		InfoTitle: "set vars",
+		InfoLines: splitLinesForInfo(buf.String()),
+	})
+	return update, nil
 }
 
 func makeStreamFilePk(ids resolvedIds, pk *scpacket.FeCommandPacketType) (*packet.StreamFilePacketType, error) {
 	cwd := ids.Remote.FeState["cwd"]
 	fileArg := pk.Args[0]
 	if fileArg == "" {
-		return nil, fmt.Errorf("/view:stat file argument must be set (cannot be empty)")
+		return nil, fmt.Errorf("%s file argument must be set (cannot be empty)", GetCmdStr(pk))
 	}
 	streamPk := packet.MakeStreamFilePacket()
 	streamPk.ReqId = uuid.New().String()
@@ -4561,105 +5492,319 @@ func ViewStatCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scb
 	if err != nil {
 		return nil, err
 	}
-	streamPk.StatOnly = true
-	msh := ids.Remote.MShell
+	streamPk.StatOnly = true
+	msh := ids.Remote.MShell
+	iter, err := msh.StreamFile(ctx, streamPk)
+	if err != nil {
+		return nil, fmt.Errorf("/view:stat error: %v", err)
+	}
+	defer iter.Close()
+	respIf, err := iter.Next(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("/view:stat error getting response: %v", err)
+	}
+	resp, ok := respIf.(*packet.StreamFileResponseType)
+	if !ok {
+		return nil, fmt.Errorf("/view:stat error, bad response packet type: %T", respIf)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("/view:stat error: %s", resp.Error)
+	}
+	if resp.Info == nil {
+		return nil, fmt.Errorf("/view:stat error, no file info")
+	}
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("  %-15s %s\n", "path", resp.Info.Name))
+	buf.WriteString(fmt.Sprintf("  %-15s %d\n", "size", resp.Info.Size))
+	modTs := time.UnixMilli(resp.Info.ModTs)
+	buf.WriteString(fmt.Sprintf("  %-15s %s\n", "modts", modTs.Format(TsFormatStr)))
+	buf.WriteString(fmt.Sprintf("  %-15s %v\n", "isdir", resp.Info.IsDir))
+	modeStr := fs.FileMode(resp.Info.Perm).String()
+	if len(modeStr) > 9 {
+		modeStr = modeStr[len(modeStr)-9:]
+	}
+	buf.WriteString(fmt.Sprintf("  %-15s %s\n", "perms", modeStr))
+	update := scbus.MakeUpdatePacket()
+	update.AddUpdate(sstore.InfoMsgType{
+		InfoTitle: fmt.Sprintf("view stat %q", streamPk.Path),
+		InfoLines: splitLinesForInfo(buf.String()),
+	})
+	return update, nil
+}
+
+func ViewTestCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
+	if len(pk.Args) == 0 {
+		return nil, fmt.Errorf("/view:test requires an argument (file name)")
+	}
+	ids, err := resolveUiIds(ctx, pk, R_Session|R_Screen|R_RemoteConnected)
+	if err != nil {
+		return nil, err
+	}
+	streamPk, err := makeStreamFilePk(ids, pk)
+	if err != nil {
+		return nil, err
+	}
+	msh := ids.Remote.MShell
+	iter, err := msh.StreamFile(ctx, streamPk)
+	if err != nil {
+		return nil, fmt.Errorf("/view:test error: %v", err)
+	}
+	defer iter.Close()
+	respIf, err := iter.Next(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("/view:test error getting response: %v", err)
+	}
+	resp, ok := respIf.(*packet.StreamFileResponseType)
+	if !ok {
+		return nil, fmt.Errorf("/view:test error, bad response packet type: %T", respIf)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("/view:test error: %s", resp.Error)
+	}
+	if resp.Info == nil {
+		return nil, fmt.Errorf("/view:test error, no file info")
+	}
+	var buf bytes.Buffer
+	var numPackets int
+	for {
+		dataPkIf, err := iter.Next(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("/view:test error while getting data: %w", err)
+		}
+		if dataPkIf == nil {
+			break
+		}
+		dataPk, ok := dataPkIf.(*packet.FileDataPacketType)
+		if !ok {
+			return nil, fmt.Errorf("/view:test invalid data packet type: %T", dataPkIf)
+		}
+		if dataPk.Error != "" {
+			return nil, fmt.Errorf("/view:test error returned while getting data: %s", dataPk.Error)
+		}
+		numPackets++
+		buf.Write(dataPk.Data)
+	}
+	buf.WriteString(fmt.Sprintf("\n\ntotal packets: %d\n", numPackets))
+	update := scbus.MakeUpdatePacket()
+	update.AddUpdate(sstore.InfoMsgType{
+		InfoTitle: fmt.Sprintf("view file %q", streamPk.Path),
+		InfoLines: splitLinesForInfo(buf.String()),
+	})
+	return update, nil
+}
+
+func formatDirEntry(entry *packet.FileInfo) string {
+	modeStr := fs.FileMode(entry.Mode).String()
+	if entry.NotFound {
+		modeStr = "?---------"
+	}
+	sizeStr := scbase.NumFormatB2(entry.Size)
+	if entry.IsDir && !entry.IsSymlink {
+		sizeStr = "-"
+	}
+	name := entry.Name
+	if entry.IsSymlink {
+		name = fmt.Sprintf("%s -> %s", entry.Name, entry.SymlinkTarget)
+	} else if entry.IsDir {
+		name = entry.Name + "/"
+	}
+	modTs := time.UnixMilli(entry.ModTs)
+	return fmt.Sprintf("  %-10s %8s  %s  %s\n", modeStr, sizeStr, modTs.Format(TsFormatStr), name)
+}
+
+func ViewLsCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
+	ids, err := resolveUiIds(ctx, pk, R_Session|R_Screen|R_RemoteConnected)
+	if err != nil {
+		return nil, err
+	}
+	msh := ids.Remote.MShell
+	if !msh.HasCapability(packet.Capability_ListDir) {
+		return nil, fmt.Errorf("/view:ls is not supported by this remote's waveshell version (try /remote:install)")
+	}
+	if len(pk.Args) == 0 {
+		pk.Args = []string{"."}
+	}
+	streamPk, err := makeStreamFilePk(ids, pk)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := resolveNonNegInt(pk.Kwargs["offset"], 0)
+	if err != nil {
+		return nil, fmt.Errorf("/view:ls invalid offset: %v", err)
+	}
+	limit, err := resolvePosInt(pk.Kwargs["limit"], 100)
+	if err != nil {
+		return nil, fmt.Errorf("/view:ls invalid limit: %v", err)
+	}
+	streamPk.ListDir = true
+	streamPk.DirOffset = offset
+	streamPk.DirLimit = limit
 	iter, err := msh.StreamFile(ctx, streamPk)
 	if err != nil {
-		return nil, fmt.Errorf("/view:stat error: %v", err)
+		return nil, fmt.Errorf("/view:ls error: %v", err)
 	}
 	defer iter.Close()
 	respIf, err := iter.Next(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("/view:stat error getting response: %v", err)
+		return nil, fmt.Errorf("/view:ls error getting response: %v", err)
 	}
 	resp, ok := respIf.(*packet.StreamFileResponseType)
 	if !ok {
-		return nil, fmt.Errorf("/view:stat error, bad response packet type: %T", respIf)
+		return nil, fmt.Errorf("/view:ls error, bad response packet type: %T", respIf)
 	}
 	if resp.Error != "" {
-		return nil, fmt.Errorf("/view:stat error: %s", resp.Error)
+		return nil, fmt.Errorf("/view:ls error: %s", resp.Error)
 	}
 	if resp.Info == nil {
-		return nil, fmt.Errorf("/view:stat error, no file info")
+		return nil, fmt.Errorf("/view:ls error, no file info")
 	}
 	var buf bytes.Buffer
-	buf.WriteString(fmt.Sprintf("  %-15s %s\n", "path", resp.Info.Name))
-	buf.WriteString(fmt.Sprintf("  %-15s %d\n", "size", resp.Info.Size))
-	modTs := time.UnixMilli(resp.Info.ModTs)
-	buf.WriteString(fmt.Sprintf("  %-15s %s\n", "modts", modTs.Format(TsFormatStr)))
-	buf.WriteString(fmt.Sprintf("  %-15s %v\n", "isdir", resp.Info.IsDir))
-	modeStr := fs.FileMode(resp.Info.Perm).String()
-	if len(modeStr) > 9 {
-		modeStr = modeStr[len(modeStr)-9:]
+	if !resp.Info.IsDir {
+		resp.Info.Mode = uint32(fs.FileMode(resp.Info.Perm))
+		buf.WriteString(formatDirEntry(resp.Info))
+	}
+	for _, entry := range resp.Entries {
+		buf.WriteString(formatDirEntry(entry))
+	}
+	if resp.Info.IsDir && len(resp.Entries) == 0 {
+		buf.WriteString("  (no entries)\n")
+	}
+	if resp.HasMore {
+		buf.WriteString(fmt.Sprintf("\n  showing %d-%d of %d entries (use offset=%d to see more)\n", offset+1, offset+len(resp.Entries), resp.TotalEntries, offset+len(resp.Entries)))
 	}
-	buf.WriteString(fmt.Sprintf("  %-15s %s\n", "perms", modeStr))
 	update := scbus.MakeUpdatePacket()
 	update.AddUpdate(sstore.InfoMsgType{
-		InfoTitle: fmt.Sprintf("view stat %q", streamPk.Path),
+		InfoTitle: fmt.Sprintf("view ls %q", streamPk.Path),
 		InfoLines: splitLinesForInfo(buf.String()),
 	})
 	return update, nil
 }
 
-func ViewTestCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
+// follows a remote file in a new line (like tail -f), the line runs until it is interrupted (^C)
+func ViewTailCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
 	if len(pk.Args) == 0 {
-		return nil, fmt.Errorf("/view:test requires an argument (file name)")
+		return nil, fmt.Errorf("/view:tail requires an argument (file name)")
 	}
 	ids, err := resolveUiIds(ctx, pk, R_Session|R_Screen|R_RemoteConnected)
 	if err != nil {
 		return nil, err
 	}
+	msh := ids.Remote.MShell
+	if !msh.HasCapability(packet.Capability_FollowFile) {
+		return nil, fmt.Errorf("/view:tail is not supported by this remote's waveshell version (try /remote:install)")
+	}
 	streamPk, err := makeStreamFilePk(ids, pk)
 	if err != nil {
 		return nil, err
 	}
-	msh := ids.Remote.MShell
+	tailBytes, err := resolveNonNegInt(pk.Kwargs["bytes"], DefaultTailBytes)
+	if err != nil {
+		return nil, fmt.Errorf("/view:tail invalid bytes: %v", err)
+	}
+	streamPk.ByteRange = []int64{-int64(tailBytes)}
+	streamPk.Follow = true
 	iter, err := msh.StreamFile(ctx, streamPk)
 	if err != nil {
-		return nil, fmt.Errorf("/view:test error: %v", err)
+		return nil, fmt.Errorf("/view:tail error: %v", err)
 	}
-	defer iter.Close()
 	respIf, err := iter.Next(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("/view:test error getting response: %v", err)
+		iter.Close()
+		return nil, fmt.Errorf("/view:tail error getting response: %v", err)
 	}
 	resp, ok := respIf.(*packet.StreamFileResponseType)
 	if !ok {
-		return nil, fmt.Errorf("/view:test error, bad response packet type: %T", respIf)
+		iter.Close()
+		return nil, fmt.Errorf("/view:tail error, bad response packet type: %T", respIf)
 	}
 	if resp.Error != "" {
-		return nil, fmt.Errorf("/view:test error: %s", resp.Error)
+		iter.Close()
+		return nil, fmt.Errorf("/view:tail error: %s", resp.Error)
 	}
-	if resp.Info == nil {
-		return nil, fmt.Errorf("/view:test error, no file info")
+	if resp.Info == nil || resp.Info.NotFound {
+		iter.Close()
+		return nil, fmt.Errorf("/view:tail error, file %q not found", streamPk.Path)
 	}
-	var buf bytes.Buffer
-	var numPackets int
+	termopts := sstore.TermOpts{Rows: shellutil.DefaultTermRows, Cols: shellutil.DefaultTermCols, FlexRows: true, MaxPtySize: remote.DefaultMaxPtySize}
+	cmd, err := makeDynCmd(ctx, "view tail", ids, pk.GetRawStr(), termopts)
+	if err != nil {
+		msh.UnfollowFile(streamPk.ReqId)
+		iter.Close()
+		return nil, err
+	}
+	update, err := addLineForCmd(ctx, "/view:tail", false, ids, cmd, "", nil)
+	if err != nil {
+		msh.UnfollowFile(streamPk.ReqId)
+		iter.Close()
+		return nil, err
+	}
+	update.AddUpdate(sstore.InteractiveUpdate(pk.Interactive))
+	scbus.MainUpdateBus.DoScreenUpdate(cmd.ScreenId, update)
+	go doViewTail(cmd, msh, streamPk.ReqId, iter)
+	return scbus.MakeUpdatePacket(), nil
+}
+
+func doViewTail(cmd *sstore.CmdType, msh *remote.MShellProc, reqId string, iter *packet.RpcResponseIter) {
+	ctx := context.Background()
+	tailCtx, cancelFn := context.WithCancel(ctx)
+	defer cancelFn()
+	ck := base.MakeCommandKey(cmd.ScreenId, cmd.LineId)
+	remote.RegisterLocalCmd(ck, cancelFn)
+	defer remote.UnregisterLocalCmd(ck)
+	defer iter.Close()
+	var outputPos int64
+	var exitSuccess bool
+	startTime := time.Now()
+	defer func() {
+		deferWriteCmdStatus(ctx, cmd, startTime, exitSuccess, outputPos)
+	}()
 	for {
-		dataPkIf, err := iter.Next(ctx)
+		dataPkIf, err := iter.Next(tailCtx)
+		if tailCtx.Err() != nil {
+			// interrupted, stop following (waveshell sends a final Eof)
+			exitSuccess = true
+			if msh.UnfollowFile(reqId) != nil {
+				return
+			}
+			drainCtx, drainCancelFn := context.WithTimeout(ctx, ViewTailDrainTimeout)
+			defer drainCancelFn()
+			for {
+				dataPkIf, err = iter.Next(drainCtx)
+				if err != nil || dataPkIf == nil || dataPkIf.GetResponseDone() {
+					return
+				}
+			}
+		}
 		if err != nil {
-			return nil, fmt.Errorf("/view:test error while getting data: %w", err)
+			writeStringToPty(ctx, cmd, fmt.Sprintf("\r\nerror: %v\r\n", err), &outputPos)
+			return
 		}
 		if dataPkIf == nil {
-			break
+			return
 		}
 		dataPk, ok := dataPkIf.(*packet.FileDataPacketType)
 		if !ok {
-			return nil, fmt.Errorf("/view:test invalid data packet type: %T", dataPkIf)
+			writeStringToPty(ctx, cmd, fmt.Sprintf("\r\nerror: invalid data packet type: %T\r\n", dataPkIf), &outputPos)
+			return
+		}
+		if dataPk.Truncated {
+			writeStringToPty(ctx, cmd, "\r\n[file truncated]\r\n", &outputPos)
+		}
+		if dataPk.Rotated {
+			writeStringToPty(ctx, cmd, "\r\n[file rotated]\r\n", &outputPos)
+		}
+		if len(dataPk.Data) > 0 {
+			writeStringToPty(ctx, cmd, strings.ReplaceAll(string(dataPk.Data), "\n", "\r\n"), &outputPos)
 		}
 		if dataPk.Error != "" {
-			return nil, fmt.Errorf("/view:test error returned while getting data: %s", dataPk.Error)
+			writeStringToPty(ctx, cmd, fmt.Sprintf("\r\nerror: %s\r\n", dataPk.Error), &outputPos)
+			return
+		}
+		if dataPk.Eof {
+			exitSuccess = true
+			return
 		}
-		numPackets++
-		buf.Write(dataPk.Data)
 	}
-	buf.WriteString(fmt.Sprintf("\n\ntotal packets: %d\n", numPackets))
-	update := scbus.MakeUpdatePacket()
-	update.AddUpdate(sstore.InfoMsgType{
-		InfoTitle: fmt.Sprintf("view file %q", streamPk.Path),
-		InfoLines: splitLinesForInfo(buf.String()),
-	})
-	return update, nil
 }
 
 func CodeEditCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
@@ -4812,7 +5957,7 @@ func EditTestCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scb
 	}
 	fileArg := pk.Args[0]
 	if fileArg == "" {
-		return nil, fmt.Errorf("/view:stat file argument must be set (cannot be empty)")
+		return nil, fmt.Errorf("%s file argument must be set (cannot be empty)", GetCmdStr(pk))
 	}
 	writePk := packet.MakeWriteFilePacket()
 	writePk.ReqId = uuid.New().String()
@@ -4891,7 +6036,7 @@ func SignalCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus
 	if cmd == nil {
 		return nil, fmt.Errorf("line %q does not have a command", lineArg)
 	}
-	if cmd.Status != sstore.CmdStatusRunning {
+	if !cmd.IsRunning() {
 		return nil, fmt.Errorf("line %q command is not running, cannot send signal", lineArg)
 	}
 	sigArg := pk.Args[1]
@@ -4910,6 +6055,12 @@ func SignalCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus
 	if !sigNameRe.MatchString(sigArg) {
 		return nil, fmt.Errorf("invalid signal name/number: %q", sigArg)
 	}
+	if remote.CancelLocalCmd(base.MakeCommandKey(cmd.ScreenId, cmd.LineId)) {
+		// wavesrv-side commands (e.g. /copyfile) are canceled by any signal
+		update := scbus.MakeUpdatePacket()
+		update.AddUpdate(sstore.InfoMsgUpdate("sent line %s signal %s", lineArg, sigArg))
+		return update, nil
+	}
 	msh := remote.GetRemoteById(cmd.Remote.RemoteId)
 	if msh == nil {
 		return nil, fmt.Errorf("cannot send signal, no remote found for command")
@@ -5306,8 +6457,25 @@ func ClientSetCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (sc
 			return nil, fmt.Errorf("error updating client openai base url: %v", err)
 		}
 	}
+	if readWindowStr, found := pk.Kwargs["readwindow"]; found {
+		readWindow, err := resolveByteSize(readWindowStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid readwindow: %v", err)
+		}
+		if readWindow != 0 && (readWindow < mpio.MinReadWindow || readWindow > mpio.MaxReadWindow) {
+			return nil, fmt.Errorf("invalid readwindow, must be 0 (default) or between %s and %s", scbase.NumFormatB2(mpio.MinReadWindow), scbase.NumFormatB2(mpio.MaxReadWindow))
+		}
+		clientOpts := clientData.ClientOpts
+		clientOpts.ReadWindow = readWindow
+		err = sstore.SetClientOpts(ctx, clientOpts)
+		if err != nil {
+			return nil, fmt.Errorf("error updating client readwindow: %v", err)
+		}
+		remote.SetReadWindow(readWindow)
+		varsUpdated = append(varsUpdated, "readwindow")
+	}
 	if len(varsUpdated) == 0 {
-		return nil, fmt.Errorf("/client:set requires a value to set: %s", formatStrs([]string{"termfontsize", "termfontfamily", "openaiapitoken", "openaimodel", "openaibaseurl", "openaimaxtokens", "openaimaxchoices"}, "or", false))
+		return nil, fmt.Errorf("/client:set requires a value to set: %s", formatStrs([]string{"termfontsize", "termfontfamily", "openaiapitoken", "openaimodel", "openaibaseurl", "openaimaxtokens", "openaimaxchoices", "readwindow"}, "or", false))
 	}
 	clientData, err = sstore.EnsureClientData(ctx)
 	if err != nil {
@@ -5340,10 +6508,15 @@ func ClientShowCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (s
 	buf.WriteString(fmt.Sprintf("  %-15s %s\n", "clientid", clientData.ClientId))
 	buf.WriteString(fmt.Sprintf("  %-15s %s\n", "telemetry", boolToStr(clientData.ClientOpts.NoTelemetry, "off", "on")))
 	buf.WriteString(fmt.Sprintf("  %-15s %s\n", "release-check", boolToStr(clientData.ClientOpts.NoReleaseCheck, "off", "on")))
+	buf.WriteString(fmt.Sprintf("  %-15s %s\n", "read-window", formatReadWindow(clientData.ClientOpts.ReadWindow)))
 	buf.WriteString(fmt.Sprintf("  %-15s %d\n", "db-version", dbVersion))
 	buf.WriteString(fmt.Sprintf("  %-15s %s\n", "client-version", clientVersion))
 	buf.WriteString(fmt.Sprintf("  %-15s %s %s\n", "server-version", scbase.WaveVersion, scbase.BuildTime))
 	buf.WriteString(fmt.Sprintf("  %-15s %s (%s)\n", "arch", scbase.ClientArch(), scbase.UnameKernelRelease()))
+	err = writeSetVarsInfo(ctx, &buf, sstore.SetVarScope_Client, "")
+	if err != nil {
+		return nil, err
+	}
 	update := scbus.MakeUpdatePacket()
 	update.AddUpdate(sstore.InfoMsgType{
 		InfoTitle: fmt.Sprintf("client info"),
@@ -5459,6 +6632,334 @@ func TelemetrySendCommand(ctx context.Context, pk *scpacket.FeCommandPacketType)
 	return sstore.InfoMsgUpdate("telemetry sent"), nil
 }
 
+const StorageShowMaxSessions = 10
+const StorageGcMaxActionLines = 20
+
+func StorageCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
+	return nil, fmt.Errorf("/storage requires a subcommand: %s", formatStrs([]string{"show", "set", "gc"}, "or", false))
+}
+
+func formatReadWindow(readWindow int64) string {
+	if readWindow == 0 {
+		return fmt.Sprintf("default (%s)", scbase.NumFormatB2(mpio.DefaultReadWindow))
+	}
+	return scbase.NumFormatB2(readWindow)
+}
+
+func formatRetentionAge(ageMs int64) string {
+	dayMs := int64(24 * time.Hour / time.Millisecond)
+	if ageMs%dayMs == 0 {
+		return fmt.Sprintf("%dd", ageMs/dayMs)
+	}
+	return (time.Duration(ageMs) * time.Millisecond).String()
+}
+
+func formatRetentionLimit(val int64, formatFn func(int64) string) string {
+	if val <= 0 {
+		return "none"
+	}
+	return formatFn(val)
+}
+
+func writeRetentionRules(buf *bytes.Buffer, opts sstore.RetentionOptsType) {
+	buf.WriteString(fmt.Sprintf("  %-15s %s\n", "maxdisk", formatRetentionLimit(opts.MaxDiskSize, scbase.NumFormatB2)))
+	buf.WriteString(fmt.Sprintf("  %-15s %s\n", "archivedmaxage", formatRetentionLimit(opts.ArchivedMaxAgeMs, formatRetentionAge)))
+	buf.WriteString(fmt.Sprintf("  %-15s %s\n", "screenptymax", formatRetentionLimit(opts.MaxScreenPtySize, scbase.NumFormatB2)))
+}
+
+func getRetentionOpts(clientData *sstore.ClientData) sstore.RetentionOptsType {
+	if clientData.ClientOpts.Retention == nil {
+		return sstore.RetentionOptsType{}
+	}
+	return *clientData.ClientOpts.Retention
+}
+
+// sets the rules from the maxdisk, archivedmaxage and screenptymax kwargs (a value of 0 removes the limit).
+// returns the names of the rules that were set
+func resolveRetentionArgs(pk *scpacket.FeCommandPacketType, opts *sstore.RetentionOptsType) ([]string, error) {
+	var varsUpdated []string
+	if arg, found := pk.Kwargs["maxdisk"]; found {
+		size, err := resolveByteSize(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid maxdisk: %v", err)
+		}
+		opts.MaxDiskSize = size
+		varsUpdated = append(varsUpdated, "maxdisk")
+	}
+	if arg, found := pk.Kwargs["archivedmaxage"]; found {
+		ageMs, err := resolveAgeMs(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid archivedmaxage: %v", err)
+		}
+		opts.ArchivedMaxAgeMs = ageMs
+		varsUpdated = append(varsUpdated, "archivedmaxage")
+	}
+	if arg, found := pk.Kwargs["screenptymax"]; found {
+		size, err := resolveByteSize(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid screenptymax: %v", err)
+		}
+		opts.MaxScreenPtySize = size
+		varsUpdated = append(varsUpdated, "screenptymax")
+	}
+	return varsUpdated, nil
+}
+
+func StorageShowCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
+	clientData, err := sstore.EnsureClientData(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot retrieve client data: %v", err)
+	}
+	usage, err := sstore.GetStorageUsage(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("/storage:show error getting disk usage: %v", err)
+	}
+	var buf bytes.Buffer
+	total := usage.Total
+	buf.WriteString(fmt.Sprintf("  %-15s %s (%d files)\n", "disksize", scbase.NumFormatB2(total.TotalSize), total.NumFiles))
+	if total.NumCompressedFiles > 0 {
+		buf.WriteString(fmt.Sprintf("  %-15s %d files, %s (%s raw)\n", "compressed", total.NumCompressedFiles, scbase.NumFormatB2(total.CompressedSize), scbase.NumFormatB2(total.CompressedRawSize)))
+	}
+	if total.ErrorCount > 0 {
+		buf.WriteString(fmt.Sprintf("  %-15s %d\n", "errors", total.ErrorCount))
+	}
+	buf.WriteString(fmt.Sprintf("  %-15s %s\n", "location", total.Location))
+	writeRetentionRules(&buf, getRetentionOpts(clientData))
+	buf.WriteString("\n")
+	for idx, session := range usage.Sessions {
+		if idx >= StorageShowMaxSessions {
+			buf.WriteString(fmt.Sprintf("  ... %d more sessions\n", len(usage.Sessions)-StorageShowMaxSessions))
+			break
+		}
+		name := session.Name
+		if session.Archived {
+			name += " (archived)"
+		}
+		buf.WriteString(fmt.Sprintf("  %-30s %10s\n", name, scbase.NumFormatB2(session.DiskSize.TotalSize)))
+	}
+	if usage.NumOrphanDirs > 0 {
+		buf.WriteString(fmt.Sprintf("  %-30s %10s (%d dirs)\n", "(deleted screens)", scbase.NumFormatB2(usage.OrphanDirsSize), usage.NumOrphanDirs))
+	}
+	update := scbus.MakeUpdatePacket()
+	update.AddUpdate(sstore.InfoMsgType{
+		InfoTitle: "storage info",
+		InfoLines: splitLinesForInfo(buf.String()),
+	})
+	return update, nil
+}
+
+func StorageSetCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
+	clientData, err := sstore.EnsureClientData(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot retrieve client data: %v", err)
+	}
+	opts := getRetentionOpts(clientData)
+	varsUpdated, err := resolveRetentionArgs(pk, &opts)
+	if err != nil {
+		return nil, fmt.Errorf("/storage:set %v", err)
+	}
+	if len(varsUpdated) == 0 {
+		return nil, fmt.Errorf("/storage:set requires a value to set: %s", formatStrs([]string{"maxdisk", "archivedmaxage", "screenptymax"}, "or", false))
+	}
+	clientOpts := clientData.ClientOpts
+	clientOpts.Retention = &opts
+	if opts.IsEmpty() {
+		clientOpts.Retention = nil
+	}
+	err = sstore.SetClientOpts(ctx, clientOpts)
+	if err != nil {
+		return nil, fmt.Errorf("error updating retention rules: %v", err)
+	}
+	clientData, err = sstore.EnsureClientData(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot retrieve updated client data: %v", err)
+	}
+	update := scbus.MakeUpdatePacket()
+	update.AddUpdate(*clientData)
+	update.AddUpdate(sstore.InfoMsgType{
+		InfoMsg:   fmt.Sprintf("storage updated %s", formatStrs(varsUpdated, "and", false)),
+		TimeoutMs: 2000,
+	})
+	return update, nil
+}
+
+// applies the retention rules now.  the saved rules can be overridden with the /storage:set kwargs,
+// dryrun=1 shows what would be deleted
+func StorageGcCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
+	clientData, err := sstore.EnsureClientData(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot retrieve client data: %v", err)
+	}
+	opts := getRetentionOpts(clientData)
+	_, err = resolveRetentionArgs(pk, &opts)
+	if err != nil {
+		return nil, fmt.Errorf("/storage:gc %v", err)
+	}
+	if opts.IsEmpty() {
+		return nil, fmt.Errorf("/storage:gc no retention rules are set (use /storage:set or pass maxdisk, archivedmaxage or screenptymax)")
+	}
+	dryRun := resolveBool(pk.Kwargs["dryrun"], false)
+	if !setStorageGcRunning(true) {
+		return nil, fmt.Errorf("/storage:gc a gc is already running")
+	}
+	// walking (and deleting from) a large screens dir can take longer than the http write timeout, the result is sent as an info message
+	go doStorageGc(opts, dryRun)
+	if dryRun {
+		return sstore.InfoMsgUpdate("checking storage retention rules (dry run)"), nil
+	}
+	return sstore.InfoMsgUpdate("applying storage retention rules"), nil
+}
+
+const StorageGcTimeout = 30 * time.Minute
+
+var storageGcLock = &sync.Mutex{}
+var storageGcRunning bool
+
+// returns false if running is already set to that value
+func setStorageGcRunning(running bool) bool {
+	storageGcLock.Lock()
+	defer storageGcLock.Unlock()
+	if storageGcRunning == running {
+		return false
+	}
+	storageGcRunning = running
+	return true
+}
+
+func doStorageGc(opts sstore.RetentionOptsType, dryRun bool) {
+	defer setStorageGcRunning(false)
+	ctx, cancelFn := context.WithTimeout(context.Background(), StorageGcTimeout)
+	defer cancelFn()
+	title := "storage gc"
+	if dryRun {
+		title = "storage gc (dry run)"
+	}
+	update := scbus.MakeUpdatePacket()
+	defer func() {
+		r := recover()
+		if r != nil {
+			log.Printf("panic in doStorageGc: %v\n", r)
+			update = scbus.MakeUpdatePacket()
+			update.AddUpdate(sstore.InfoMsgType{InfoTitle: title, InfoError: fmt.Sprintf("/storage:gc panic: %v", r)})
+		}
+		scbus.MainUpdateBus.DoUpdate(update)
+	}()
+	result, err := sstore.RunRetention(ctx, opts, dryRun)
+	if result == nil {
+		update.AddUpdate(sstore.InfoMsgType{InfoTitle: title, InfoError: fmt.Sprintf("/storage:gc error: %v", err)})
+		return
+	}
+	if len(result.Actions) == 0 {
+		update.AddUpdate(sstore.InfoMsgType{InfoMsg: fmt.Sprintf("%s: nothing to delete", title)})
+		return
+	}
+	var buf bytes.Buffer
+	counts := make(map[string]int)
+	var countKeys []string
+	for _, action := range result.Actions {
+		key := action.Action + " (" + action.Reason + ")"
+		if counts[key] == 0 {
+			countKeys = append(countKeys, key)
+		}
+		counts[key]++
+	}
+	for _, key := range countKeys {
+		buf.WriteString(fmt.Sprintf("  %-30s %d\n", key, counts[key]))
+	}
+	if dryRun {
+		buf.WriteString(fmt.Sprintf("  %-30s %s\n", "would free", scbase.NumFormatB2(result.FreedSize)))
+		for idx, action := range result.Actions {
+			if idx >= StorageGcMaxActionLines {
+				buf.WriteString(fmt.Sprintf("  ... %d more\n", len(result.Actions)-StorageGcMaxActionLines))
+				break
+			}
+			buf.WriteString(fmt.Sprintf("  %-15s %s %s %s\n", action.Action, action.ScreenId, action.LineId, scbase.NumFormatB2(action.Size)))
+		}
+	} else {
+		buf.WriteString(fmt.Sprintf("  %-30s %d/%d\n", "applied", result.NumApplied, len(result.Actions)))
+		if result.NumSkipped > 0 {
+			buf.WriteString(fmt.Sprintf("  %-30s %d\n", "skipped (in use)", result.NumSkipped))
+		}
+		buf.WriteString(fmt.Sprintf("  %-30s %s\n", "freed", scbase.NumFormatB2(result.FreedSize)))
+	}
+	if err != nil {
+		buf.WriteString(fmt.Sprintf("  %-30s %v\n", "error", err))
+	}
+	update.AddUpdate(sstore.InfoMsgType{
+		InfoTitle: title,
+		InfoLines: splitLinesForInfo(buf.String()),
+	})
+}
+
+// /db:backup [file], file defaults to a timestamped file in the wave home backups directory (restore with wavesrv --restore [file])
+func DbBackupCommand(ctx context.Context, pk *scpacket.FeCommandPacketType) (scbus.UpdatePacket, error) {
+	fileName := sstore.GetDefaultBackupName()
+	if len(pk.Args) > 0 {
+		fileName = base.ExpandHomeDir(pk.Args[0])
+		if !filepath.IsAbs(fileName) {
+			return nil, fmt.Errorf("/db:backup file must be absolute, cannot be a relative path")
+		}
+		finfo, err := os.Stat(fileName)
+		if err == nil && finfo.IsDir() {
+			fileName = filepath.Join(fileName, filepath.Base(sstore.GetDefaultBackupName()))
+		}
+	}
+	if !setDbBackupRunning(true) {
+		return nil, fmt.Errorf("/db:backup a backup is already running")
+	}
+	// a real-sized backup takes longer than the http write timeout, the result is sent as an info message
+	go doDbBackup(fileName)
+	return sstore.InfoMsgUpdate("backing up database to %q", fileName), nil
+}
+
+const DbBackupTimeout = 30 * time.Minute
+
+var dbBackupLock = &sync.Mutex{}
+var dbBackupRunning bool
+
+// returns false if running is already set to that value
+func setDbBackupRunning(running bool) bool {
+	dbBackupLock.Lock()
+	defer dbBackupLock.Unlock()
+	if dbBackupRunning == running {
+		return false
+	}
+	dbBackupRunning = running
+	return true
+}
+
+func doDbBackup(fileName string) {
+	defer setDbBackupRunning(false)
+	ctx, cancelFn := context.WithTimeout(context.Background(), DbBackupTimeout)
+	defer cancelFn()
+	update := scbus.MakeUpdatePacket()
+	defer func() {
+		r := recover()
+		if r != nil {
+			log.Printf("panic in doDbBackup: %v\n", r)
+			update = scbus.MakeUpdatePacket()
+			update.AddUpdate(sstore.InfoMsgType{InfoTitle: "database backup", InfoError: fmt.Sprintf("/db:backup panic: %v", r)})
+		}
+		scbus.MainUpdateBus.DoUpdate(update)
+	}()
+	result, err := sstore.BackupDB(ctx, fileName)
+	if err != nil {
+		log.Printf("[db] backup error: %v\n", err)
+		update.AddUpdate(sstore.InfoMsgType{InfoTitle: "database backup", InfoError: fmt.Sprintf("/db:backup error: %v", err)})
+		return
+	}
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("  %-15s %s\n", "file", result.FileName))
+	buf.WriteString(fmt.Sprintf("  %-15s %s\n", "size", scbase.NumFormatB2(result.Size)))
+	buf.WriteString(fmt.Sprintf("  %-15s %d\n", "dbversion", result.DBVersion))
+	buf.WriteString(fmt.Sprintf("  %-15s %d\n", "ptyfiles", result.NumFiles))
+	buf.WriteString(fmt.Sprintf("  %-15s %s\n", "restore", fmt.Sprintf("wavesrv --restore %s", shellescape.Quote(result.FileName))))
+	update.AddUpdate(sstore.InfoMsgType{
+		InfoTitle: "database backup",
+		InfoLines: splitLinesForInfo(buf.String()),
+	})
+}
+
 func runReleaseCheck(ctx context.Context, force bool) error {
 	rslt, err := releasechecker.CheckNewRelease(ctx, force)
 
@@ -0,0 +1,837 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmdrunner
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/base"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/server"
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/remote"
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/scbase"
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/scbus"
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/scpacket"
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/sstore"
+)
+
+const DefaultCopyWindow = 512 * 1024
+const CopyProgressInterval = 1 * time.Second
+
+type copyFileOpts struct {
+	Recursive bool
+	Include   []string // globs, matched against the path relative to the source dir and the base name
+	Exclude   []string // same as Include, excluded directories are not descended into
+	Preserve  bool     // preserve permissions and mtime
+	Verify    bool     // compare sha256 of the source and the written file
+	DryRun    bool     // only list what would be copied
+	Window    int64    // flow control window (bytes) for remote reads/writes, 0 to disable
+}
+
+// one side of a copy.  Msh is nil for local files (read/written directly by wavesrv)
+type copyEndpoint struct {
+	Msh  *remote.MShellProc
+	Path string
+}
+
+func (ep copyEndpoint) isLocal() bool {
+	return ep.Msh == nil
+}
+
+type copyFileEntry struct {
+	RelPath string // relative to the source root ("" when copying a single file)
+	Info    *packet.FileInfo
+}
+
+func splitCopyGlobs(arg string) ([]string, error) {
+	var rtn []string
+	for glob := range resolveCommaSepListToMap(arg) {
+		if glob == "" {
+			continue
+		}
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %v", glob, err)
+		}
+		rtn = append(rtn, glob)
+	}
+	return rtn, nil
+}
+
+func parseCopyFileOpts(pk *scpacket.FeCommandPacketType) (*copyFileOpts, error) {
+	include, err := splitCopyGlobs(pk.Kwargs["include"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid include: %v", err)
+	}
+	exclude, err := splitCopyGlobs(pk.Kwargs["exclude"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid exclude: %v", err)
+	}
+	window, err := resolveNonNegInt(pk.Kwargs["window"], DefaultCopyWindow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid window: %v", err)
+	}
+	if window > server.MaxFileDataWindow {
+		return nil, fmt.Errorf("invalid window, max is %s", scbase.NumFormatB2(server.MaxFileDataWindow))
+	}
+	return &copyFileOpts{
+		Recursive: resolveBool(pk.Kwargs["recursive"], false),
+		Include:   include,
+		Exclude:   exclude,
+		Preserve:  resolveBool(pk.Kwargs["preserve"], true),
+		Verify:    resolveBool(pk.Kwargs["verify"], true),
+		DryRun:    resolveBool(pk.Kwargs["dryrun"], false),
+		Window:    int64(window),
+	}, nil
+}
+
+func matchesAnyGlob(globs []string, relPath string) bool {
+	baseName := filepath.Base(relPath)
+	for _, glob := range globs {
+		if ok, _ := filepath.Match(glob, relPath); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(glob, baseName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// include globs only apply to files (so directories are always descended into)
+func (opts *copyFileOpts) isIncluded(relPath string, isDir bool) bool {
+	if matchesAnyGlob(opts.Exclude, relPath) {
+		return false
+	}
+	if isDir || len(opts.Include) == 0 {
+		return true
+	}
+	return matchesAnyGlob(opts.Include, relPath)
+}
+
+func makeLocalFileInfo(name string, finfo os.FileInfo) *packet.FileInfo {
+	return &packet.FileInfo{
+		Name:      name,
+		Size:      finfo.Size(),
+		ModTs:     finfo.ModTime().UnixMilli(),
+		IsDir:     finfo.IsDir(),
+		Perm:      int(finfo.Mode().Perm()),
+		Mode:      uint32(finfo.Mode()),
+		IsSymlink: finfo.Mode()&os.ModeSymlink != 0,
+	}
+}
+
+func getStreamFileResponse(ctx context.Context, iter *packet.RpcResponseIter) (*packet.StreamFileResponseType, error) {
+	respIf, err := iter.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, ok := respIf.(*packet.StreamFileResponseType)
+	if !ok {
+		return nil, fmt.Errorf("bad response packet type: %T", respIf)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("%s", resp.Error)
+	}
+	if resp.Info == nil {
+		return nil, fmt.Errorf("no file info returned")
+	}
+	if resp.Info.NotFound {
+		return nil, fmt.Errorf("file not found")
+	}
+	return resp, nil
+}
+
+func statCopyPath(ctx context.Context, ep copyEndpoint, fullPath string) (*packet.FileInfo, error) {
+	if ep.isLocal() {
+		finfo, err := os.Stat(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		return makeLocalFileInfo(fullPath, finfo), nil
+	}
+	streamPk := packet.MakeStreamFilePacket()
+	streamPk.ReqId = uuid.New().String()
+	streamPk.Path = fullPath
+	streamPk.StatOnly = true
+	iter, err := ep.Msh.StreamFile(ctx, streamPk)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	resp, err := getStreamFileResponse(ctx, iter)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Info, nil
+}
+
+func listCopyDir(ctx context.Context, ep copyEndpoint, dirPath string) ([]*packet.FileInfo, error) {
+	if ep.isLocal() {
+		dirEntries, err := os.ReadDir(dirPath)
+		if err != nil {
+			return nil, err
+		}
+		var rtn []*packet.FileInfo
+		for _, dirEntry := range dirEntries {
+			finfo, err := dirEntry.Info()
+			if err != nil {
+				continue
+			}
+			rtn = append(rtn, makeLocalFileInfo(dirEntry.Name(), finfo))
+		}
+		return rtn, nil
+	}
+	if !ep.Msh.HasCapability(packet.Capability_ListDir) {
+		return nil, fmt.Errorf("remote waveshell does not support directory listings (try /remote:install)")
+	}
+	var rtn []*packet.FileInfo
+	for {
+		streamPk := packet.MakeStreamFilePacket()
+		streamPk.ReqId = uuid.New().String()
+		streamPk.Path = dirPath
+		streamPk.ListDir = true
+		streamPk.DirOffset = len(rtn)
+		streamPk.DirLimit = server.MaxDirEntries
+		iter, err := ep.Msh.StreamFile(ctx, streamPk)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := getStreamFileResponse(ctx, iter)
+		iter.Close()
+		if err != nil {
+			return nil, err
+		}
+		rtn = append(rtn, resp.Entries...)
+		if !resp.HasMore || len(resp.Entries) == 0 {
+			return rtn, nil
+		}
+	}
+}
+
+// returns the files to copy (sorted, directories are walked depth-first)
+func walkCopySource(ctx context.Context, src copyEndpoint, opts *copyFileOpts) ([]*copyFileEntry, error) {
+	rootInfo, err := statCopyPath(ctx, src, src.Path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot stat source %q: %v", src.Path, err)
+	}
+	if !rootInfo.IsDir {
+		return []*copyFileEntry{{RelPath: "", Info: rootInfo}}, nil
+	}
+	if !opts.Recursive {
+		return nil, fmt.Errorf("source %q is a directory (use recursive=1)", src.Path)
+	}
+	var rtn []*copyFileEntry
+	var walkFn func(relDir string) error
+	walkFn = func(relDir string) error {
+		entries, err := listCopyDir(ctx, src, filepath.Join(src.Path, relDir))
+		if err != nil {
+			return fmt.Errorf("cannot list directory %q: %v", filepath.Join(src.Path, relDir), err)
+		}
+		for _, entry := range entries {
+			relPath := filepath.Join(relDir, entry.Name)
+			if !opts.isIncluded(relPath, entry.IsDir && !entry.IsSymlink) {
+				continue
+			}
+			if entry.IsDir && !entry.IsSymlink {
+				err = walkFn(relPath)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			rtn = append(rtn, &copyFileEntry{RelPath: relPath, Info: entry})
+		}
+		return nil
+	}
+	err = walkFn("")
+	if err != nil {
+		return nil, err
+	}
+	return rtn, nil
+}
+
+// reads a remote file from a streamfile rpc.  with a Window, the consumed bytes are acked so
+// waveshell never has more than Window bytes in flight (keeps the rpc channel from filling up
+// and blocking all of the remote's other packets)
+type remoteFileReader struct {
+	Ctx    context.Context
+	Msh    *remote.MShellProc
+	ReqId  string
+	Iter   *packet.RpcResponseIter
+	Window int64
+	Buf    []byte
+	Done   bool
+	Pos    int64
+	AckPos int64
+	Hash   string // from the Eof packet (hashed by waveshell as it read the file)
+}
+
+func (r *remoteFileReader) Read(p []byte) (int, error) {
+	for len(r.Buf) == 0 {
+		if r.Done {
+			return 0, io.EOF
+		}
+		dataPkIf, err := r.Iter.Next(r.Ctx)
+		if err != nil {
+			return 0, err
+		}
+		if dataPkIf == nil {
+			r.Done = true
+			continue
+		}
+		dataPk, ok := dataPkIf.(*packet.FileDataPacketType)
+		if !ok {
+			return 0, fmt.Errorf("invalid data packet type: %T", dataPkIf)
+		}
+		if dataPk.Error != "" {
+			return 0, fmt.Errorf("read error: %s", dataPk.Error)
+		}
+		r.Buf = dataPk.Data
+		r.Done = dataPk.Eof
+		if dataPk.Eof {
+			r.Hash = dataPk.Sha256
+		}
+		r.Pos += int64(len(dataPk.Data))
+		if r.Window > 0 && !r.Done && r.Pos-r.AckPos >= r.Window/4 {
+			err = r.Msh.SendFileDataAck(packet.MakeFileDataAckPacket(r.ReqId, r.Pos))
+			if err != nil {
+				return 0, err
+			}
+			r.AckPos = r.Pos
+		}
+	}
+	n := copy(p, r.Buf)
+	r.Buf = r.Buf[n:]
+	return n, nil
+}
+
+func (r *remoteFileReader) Sha256() string {
+	return r.Hash
+}
+
+func (r *remoteFileReader) Close() error {
+	if r.Window > 0 && !r.Done {
+		// stop the server from waiting for acks
+		cancelPk := packet.MakeFileDataAckPacket(r.ReqId, r.Pos)
+		cancelPk.Cancel = true
+		r.Msh.SendFileDataAck(cancelPk)
+	}
+	r.Iter.Close()
+	return nil
+}
+
+type copyFileReader interface {
+	io.ReadCloser
+	// hex sha256 of the data read from the source file (valid after EOF, "" if it cannot be computed)
+	Sha256() string
+}
+
+// hashes the bytes as they are read from disk
+type localFileReader struct {
+	Fd     *os.File
+	Hasher hash.Hash
+}
+
+func (r *localFileReader) Read(p []byte) (int, error) {
+	n, err := r.Fd.Read(p)
+	r.Hasher.Write(p[0:n])
+	return n, err
+}
+
+func (r *localFileReader) Sha256() string {
+	return hex.EncodeToString(r.Hasher.Sum(nil))
+}
+
+func (r *localFileReader) Close() error {
+	return r.Fd.Close()
+}
+
+func openCopySource(ctx context.Context, ep copyEndpoint, fullPath string, opts *copyFileOpts) (copyFileReader, error) {
+	if ep.isLocal() {
+		fd, err := os.Open(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		return &localFileReader{Fd: fd, Hasher: sha256.New()}, nil
+	}
+	streamPk := packet.MakeStreamFilePacket()
+	streamPk.ReqId = uuid.New().String()
+	streamPk.Path = fullPath
+	if ep.Msh.HasCapability(packet.Capability_FileDataAck) {
+		streamPk.Window = opts.Window
+	}
+	// older waveshells cannot hash the source, the copy is then not verified
+	streamPk.Sha256 = opts.Verify && ep.Msh.HasCapability(packet.Capability_FileSha256)
+	iter, err := ep.Msh.StreamFile(ctx, streamPk)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := getStreamFileResponse(ctx, iter)
+	if err != nil {
+		iter.Close()
+		return nil, err
+	}
+	rtn := &remoteFileReader{Ctx: ctx, Msh: ep.Msh, ReqId: streamPk.ReqId, Iter: iter, Window: streamPk.Window, Done: resp.Done}
+	if resp.Done && streamPk.Sha256 {
+		// empty files return Done with no data packets
+		emptyHash := sha256.Sum256(nil)
+		rtn.Hash = hex.EncodeToString(emptyHash[:])
+	}
+	return rtn, nil
+}
+
+type copyFileWriter interface {
+	io.Writer
+	// completes the write, returns the hex sha256 of the written file ("" if it cannot be computed)
+	Finish() (string, error)
+	Abort()
+}
+
+type localFileWriter struct {
+	Fd       *os.File
+	Info     *packet.FileInfo
+	Preserve bool
+	Verify   bool
+}
+
+func (w *localFileWriter) Write(p []byte) (int, error) {
+	return w.Fd.Write(p)
+}
+
+func (w *localFileWriter) Finish() (string, error) {
+	err := w.Fd.Close()
+	if err != nil {
+		return "", err
+	}
+	var fileHash string
+	if w.Verify {
+		// re-read what was written (before the chmod, the preserved perms might not allow reading)
+		fileHash, err = hashLocalFile(w.Fd.Name())
+		if err != nil {
+			return "", err
+		}
+	}
+	if w.Preserve {
+		err = os.Chmod(w.Fd.Name(), os.FileMode(w.Info.Perm).Perm())
+		if err != nil {
+			return "", fmt.Errorf("cannot set file permissions: %v", err)
+		}
+		modTime := time.UnixMilli(w.Info.ModTs)
+		err = os.Chtimes(w.Fd.Name(), modTime, modTime)
+		if err != nil {
+			return "", fmt.Errorf("cannot set file modification time: %v", err)
+		}
+	}
+	return fileHash, nil
+}
+
+func hashLocalFile(fileName string) (string, error) {
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, fd)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func (w *localFileWriter) Abort() {
+	w.Fd.Close()
+}
+
+// writes a remote file with a writefile rpc.  with a Window, waits for the server's acks so
+// at most Window bytes are queued (in wavesrv's sender and the server's write-file context)
+type remoteFileWriter struct {
+	Ctx     context.Context
+	Msh     *remote.MShellProc
+	ReqId   string
+	Iter    *packet.RpcResponseIter
+	Window  int64
+	SentPos int64
+	AckPos  int64
+}
+
+// reads the next ack (or an early done packet, which is always an error)
+func (w *remoteFileWriter) waitForAck() error {
+	respIf, err := w.Iter.Next(w.Ctx)
+	if err != nil {
+		return err
+	}
+	switch resp := respIf.(type) {
+	case *packet.FileDataAckPacketType:
+		if resp.Pos > w.AckPos {
+			w.AckPos = resp.Pos
+		}
+		return nil
+	case *packet.WriteFileDonePacketType:
+		if resp.Error != "" {
+			return fmt.Errorf("write error: %s", resp.Error)
+		}
+		return fmt.Errorf("write finished early")
+	default:
+		return fmt.Errorf("bad write response packet received: %T", respIf)
+	}
+}
+
+func (w *remoteFileWriter) Write(p []byte) (int, error) {
+	for pos := 0; pos < len(p); pos += server.MaxFileDataPacketSize {
+		endPos := pos + server.MaxFileDataPacketSize
+		if endPos > len(p) {
+			endPos = len(p)
+		}
+		for w.Window > 0 && w.SentPos-w.AckPos >= w.Window {
+			err := w.waitForAck()
+			if err != nil {
+				return pos, err
+			}
+		}
+		dataPk := packet.MakeFileDataPacket(w.ReqId)
+		dataPk.Data = make([]byte, endPos-pos)
+		copy(dataPk.Data, p[pos:endPos])
+		err := w.Msh.SendFileData(dataPk)
+		if err != nil {
+			return pos, err
+		}
+		w.SentPos += int64(len(dataPk.Data))
+	}
+	return len(p), nil
+}
+
+func (w *remoteFileWriter) Finish() (string, error) {
+	defer w.Iter.Close()
+	dataPk := packet.MakeFileDataPacket(w.ReqId)
+	dataPk.Eof = true
+	err := w.Msh.SendFileData(dataPk)
+	if err != nil {
+		return "", err
+	}
+	donePk, err := checkForWriteFinished(w.Ctx, w.Iter)
+	if err != nil {
+		return "", err
+	}
+	return donePk.Sha256, nil
+}
+
+func (w *remoteFileWriter) Abort() {
+	dataPk := packet.MakeFileDataPacket(w.ReqId)
+	dataPk.Error = "copy aborted"
+	w.Msh.SendFileData(dataPk)
+	w.Iter.Close()
+}
+
+func openCopyDest(ctx context.Context, ep copyEndpoint, fullPath string, info *packet.FileInfo, opts *copyFileOpts) (copyFileWriter, error) {
+	if ep.isLocal() {
+		err := os.MkdirAll(filepath.Dir(fullPath), 0777)
+		if err != nil {
+			return nil, err
+		}
+		fd, err := os.Create(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		return &localFileWriter{Fd: fd, Info: info, Preserve: opts.Preserve, Verify: opts.Verify}, nil
+	}
+	writePk := packet.MakeWriteFilePacket()
+	writePk.ReqId = uuid.New().String()
+	writePk.Path = fullPath
+	writePk.MkDirs = true
+	if opts.Preserve {
+		perm := info.Perm
+		writePk.Perm = &perm
+		writePk.ModTs = info.ModTs
+	}
+	writePk.Sha256 = opts.Verify
+	if ep.Msh.HasCapability(packet.Capability_FileDataAck) {
+		writePk.Window = opts.Window
+	}
+	iter, err := ep.Msh.WriteFile(ctx, writePk)
+	if err != nil {
+		return nil, err
+	}
+	_, err = checkForWriteReady(ctx, iter)
+	if err != nil {
+		iter.Close()
+		return nil, err
+	}
+	return &remoteFileWriter{Ctx: ctx, Msh: ep.Msh, ReqId: writePk.ReqId, Iter: iter, Window: writePk.Window}, nil
+}
+
+func checkForWriteReady(ctx context.Context, iter *packet.RpcResponseIter) (string, error) {
+	readyIf, err := iter.Next(ctx)
+	if err != nil {
+		return "", fmt.Errorf("error getting write ready response: %v", err)
+	}
+	readyPk, ok := readyIf.(*packet.WriteFileReadyPacketType)
+	if !ok {
+		return "", fmt.Errorf("bad write ready packet received %v", readyIf)
+	}
+	if readyPk.Error != "" {
+		return "", fmt.Errorf("ready error: %v", readyPk.Error)
+	}
+	return readyPk.RespId, nil
+}
+
+// skips any remaining filedataack packets
+func checkForWriteFinished(ctx context.Context, iter *packet.RpcResponseIter) (*packet.WriteFileDonePacketType, error) {
+	for {
+		doneIf, err := iter.Next(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error while getting done response: %v", err)
+		}
+		if _, ok := doneIf.(*packet.FileDataAckPacketType); ok {
+			continue
+		}
+		writeDonePk, ok := doneIf.(*packet.WriteFileDonePacketType)
+		if !ok {
+			return nil, fmt.Errorf("bad done packet received: %T", doneIf)
+		}
+		if writeDonePk.Error != "" {
+			return nil, fmt.Errorf("done error: %v", writeDonePk.Error)
+		}
+		return writeDonePk, nil
+	}
+}
+
+func getStatusBarString(filePercentageInt int) string {
+	statusBarString := "\x1b[2K\r["
+	for count := 0; count < 20; count++ {
+		if (filePercentageInt - count*5) > 0 {
+			statusBarString += "-"
+		} else {
+			statusBarString += " "
+		}
+	}
+	if filePercentageInt < 100 {
+		statusBarString += fmt.Sprintf("] %v%%", filePercentageInt)
+	} else {
+		statusBarString += "]"
+	}
+	return statusBarString
+}
+
+// progress of a running copy.  written into the line's pty output as a status bar (every 5% of
+// a file) and into the line's state (LineState_CopyProgress, at most once per CopyProgressInterval)
+type copyProgress struct {
+	Ctx        context.Context // for pty/db writes (not canceled with the copy)
+	Cmd        *sstore.CmdType
+	OutputPos  *int64
+	StartTime  time.Time
+	TotalSize  int64
+	BytesDone  int64
+	FileSize   int64
+	FileBytes  int64
+	LastPct    int
+	LastUpdate time.Time
+}
+
+func (cp *copyProgress) startFile(size int64) {
+	cp.FileSize = size
+	cp.FileBytes = 0
+	cp.LastPct = 0
+}
+
+// bytes/s and the estimated time remaining (for the whole copy)
+func (cp *copyProgress) getRateAndEta() (int64, time.Duration) {
+	elapsed := time.Since(cp.StartTime)
+	if elapsed <= 0 || cp.BytesDone == 0 {
+		return 0, 0
+	}
+	rate := int64(float64(cp.BytesDone) / elapsed.Seconds())
+	if rate <= 0 {
+		return 0, 0
+	}
+	eta := time.Duration(float64(cp.TotalSize-cp.BytesDone)/float64(rate)) * time.Second
+	return rate, eta
+}
+
+func (cp *copyProgress) Write(p []byte) (int, error) {
+	cp.FileBytes += int64(len(p))
+	cp.BytesDone += int64(len(p))
+	if cp.FileSize > 0 {
+		pct := int(cp.FileBytes * 100 / cp.FileSize)
+		if pct-cp.LastPct >= 5 {
+			rate, eta := cp.getRateAndEta()
+			statusStr := getStatusBarString(pct)
+			if rate > 0 {
+				statusStr += fmt.Sprintf(" %s/s, ETA %v", scbase.NumFormatB2(rate), eta.Round(time.Second))
+			}
+			writeStringToPty(cp.Ctx, cp.Cmd, statusStr, cp.OutputPos)
+			cp.LastPct = pct
+		}
+	}
+	if time.Since(cp.LastUpdate) >= CopyProgressInterval {
+		cp.updateLineState(false)
+	}
+	return len(p), nil
+}
+
+func (cp *copyProgress) updateLineState(done bool) {
+	cp.LastUpdate = time.Now()
+	line, err := sstore.GetLineById(cp.Ctx, cp.Cmd.ScreenId, cp.Cmd.LineId)
+	if err != nil || line == nil {
+		return
+	}
+	rate, eta := cp.getRateAndEta()
+	progress := map[string]any{
+		"bytes":  cp.BytesDone,
+		"total":  cp.TotalSize,
+		"rate":   rate,
+		"etasec": int64(eta.Seconds()),
+		"done":   done,
+	}
+	lineState := make(map[string]any)
+	for key, val := range line.LineState {
+		lineState[key] = val
+	}
+	lineState[sstore.LineState_CopyProgress] = progress
+	err = sstore.UpdateLineState(cp.Ctx, cp.Cmd.ScreenId, cp.Cmd.LineId, lineState)
+	if err != nil {
+		log.Printf("error updating copy progress linestate: %v\n", err)
+		return
+	}
+	line.LineState = lineState
+	update := scbus.MakeUpdatePacket()
+	sstore.AddLineUpdate(update, line, nil)
+	scbus.MainUpdateBus.DoScreenUpdate(cp.Cmd.ScreenId, update)
+}
+
+// copies one file, returns a short verification status.  ctx cancels the copy
+func copyOneFile(ctx context.Context, progress *copyProgress, src copyEndpoint, srcPath string, dest copyEndpoint, destPath string, info *packet.FileInfo, opts *copyFileOpts) (string, error) {
+	reader, err := openCopySource(ctx, src, srcPath, opts)
+	if err != nil {
+		return "", fmt.Errorf("cannot open source: %v", err)
+	}
+	defer reader.Close()
+	writer, err := openCopyDest(ctx, dest, destPath, info, opts)
+	if err != nil {
+		return "", fmt.Errorf("cannot open destination: %v", err)
+	}
+	progress.startFile(info.Size)
+	_, err = io.Copy(io.MultiWriter(writer, progress), reader)
+	if err != nil {
+		writer.Abort()
+		return "", err
+	}
+	destHash, err := writer.Finish()
+	if err != nil {
+		return "", err
+	}
+	if !opts.Verify {
+		return "", nil
+	}
+	// both hashes come from the files on disk (not the bytes relayed through wavesrv)
+	srcHash := reader.Sha256()
+	if srcHash == "" || destHash == "" {
+		return "not verified", nil
+	}
+	if srcHash != destHash {
+		return "", fmt.Errorf("sha256 mismatch, source=%s dest=%s", srcHash, destHash)
+	}
+	return fmt.Sprintf("sha256 %s ok", srcHash[0:12]), nil
+}
+
+func (ep copyEndpoint) fullPath(relPath string) string {
+	if relPath == "" {
+		return ep.Path
+	}
+	return filepath.Join(ep.Path, relPath)
+}
+
+// runs as a local cmd (see remote.RegisterLocalCmd), so ^C or /signal cancels the copy
+func doCopyFiles(ctx context.Context, cmd *sstore.CmdType, src copyEndpoint, dest copyEndpoint, opts *copyFileOpts, outputPos int64) {
+	var exitSuccess bool
+	startTime := time.Now()
+	defer func() {
+		deferWriteCmdStatus(ctx, cmd, startTime, exitSuccess, outputPos)
+	}()
+	copyCtx, cancelFn := context.WithCancel(ctx)
+	defer cancelFn()
+	ck := base.MakeCommandKey(cmd.ScreenId, cmd.LineId)
+	remote.RegisterLocalCmd(ck, cancelFn)
+	defer remote.UnregisterLocalCmd(ck)
+	entries, err := walkCopySource(copyCtx, src, opts)
+	if err != nil {
+		writeStringToPty(ctx, cmd, fmt.Sprintf("Error: %v\r\n", err), &outputPos)
+		return
+	}
+	var totalSize int64
+	for _, entry := range entries {
+		totalSize += entry.Info.Size
+	}
+	if opts.DryRun {
+		writeStringToPty(ctx, cmd, fmt.Sprintf("Dry run, would copy %d file(s), %s:\r\n", len(entries), prettyPrintByteSize(totalSize)), &outputPos)
+		for _, entry := range entries {
+			if entry.Info.IsSymlink {
+				writeStringToPty(ctx, cmd, fmt.Sprintf("  %s (symlink, skipped)\r\n", src.fullPath(entry.RelPath)), &outputPos)
+				continue
+			}
+			writeStringToPty(ctx, cmd, fmt.Sprintf("  %s -> %s (%s)\r\n", src.fullPath(entry.RelPath), dest.fullPath(entry.RelPath), prettyPrintByteSize(entry.Info.Size)), &outputPos)
+		}
+		exitSuccess = true
+		return
+	}
+	if !dest.isLocal() && (opts.Preserve || opts.Verify) && !dest.Msh.HasCapability(packet.Capability_WriteFileOpts) {
+		writeStringToPty(ctx, cmd, "Warning: destination waveshell cannot preserve file attributes or verify copies (try /remote:install)\r\n", &outputPos)
+	}
+	if len(entries) == 1 && entries[0].RelPath == "" {
+		writeStringToPty(ctx, cmd, fmt.Sprintf("Source File Size: %s\r\n", prettyPrintByteSize(totalSize)), &outputPos)
+	} else {
+		writeStringToPty(ctx, cmd, fmt.Sprintf("Copying %d file(s), %s\r\n", len(entries), prettyPrintByteSize(totalSize)), &outputPos)
+	}
+	progress := &copyProgress{Ctx: ctx, Cmd: cmd, OutputPos: &outputPos, StartTime: time.Now(), TotalSize: totalSize}
+	var numCopied, numErrors int
+	var bytesCopied int64
+	for _, entry := range entries {
+		if copyCtx.Err() != nil {
+			numErrors++
+			writeStringToPty(ctx, cmd, "\x1b[2K\rCopy canceled\r\n", &outputPos)
+			break
+		}
+		displayName := entry.RelPath
+		if displayName == "" {
+			displayName = filepath.Base(src.Path)
+		}
+		if entry.Info.IsSymlink {
+			writeStringToPty(ctx, cmd, fmt.Sprintf("%s: skipped (symlink)\r\n", displayName), &outputPos)
+			continue
+		}
+		status, err := copyOneFile(copyCtx, progress, src, src.fullPath(entry.RelPath), dest, dest.fullPath(entry.RelPath), entry.Info, opts)
+		if err != nil {
+			numErrors++
+			writeStringToPty(ctx, cmd, fmt.Sprintf("\x1b[2K\r%s: error: %v\r\n", displayName, err), &outputPos)
+			continue
+		}
+		numCopied++
+		bytesCopied += entry.Info.Size
+		statusStr := prettyPrintByteSize(entry.Info.Size)
+		if status != "" {
+			statusStr += ", " + status
+		}
+		writeStringToPty(ctx, cmd, fmt.Sprintf("\x1b[2K\r%s (%s)\r\n", displayName, statusStr), &outputPos)
+	}
+	progress.updateLineState(true)
+	summary := fmt.Sprintf("Finished transferring. Transferred %d file(s), %v bytes", numCopied, bytesCopied)
+	if rate, _ := progress.getRateAndEta(); rate > 0 {
+		summary += fmt.Sprintf(" (%s/s)", scbase.NumFormatB2(rate))
+	}
+	if numErrors > 0 {
+		summary += fmt.Sprintf(", %d error(s)", numErrors)
+	}
+	writeStringToPty(ctx, cmd, summary+"\r\n", &outputPos)
+	exitSuccess = numErrors == 0
+}
@@ -0,0 +1,163 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmdrunner
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCopyFileFilters(t *testing.T) {
+	opts := &copyFileOpts{Include: []string{"*.go", "docs/*.md"}, Exclude: []string{"node_modules", "*_test.go"}}
+	tests := []struct {
+		RelPath  string
+		IsDir    bool
+		Expected bool
+	}{
+		{"main.go", false, true},
+		{"pkg/util/util.go", false, true},
+		{"pkg/util/util_test.go", false, false},
+		{"README.md", false, false},
+		{"docs/README.md", false, true},
+		{"pkg", true, true},
+		{"node_modules", true, false},
+		{"web/node_modules", true, false},
+	}
+	for _, test := range tests {
+		if opts.isIncluded(test.RelPath, test.IsDir) != test.Expected {
+			t.Errorf("isIncluded(%q, %v) should be %v", test.RelPath, test.IsDir, test.Expected)
+		}
+	}
+	if _, err := splitCopyGlobs("*.go,[a-"); err == nil {
+		t.Errorf("expected error for invalid glob")
+	}
+}
+
+func TestWalkCopySource(t *testing.T) {
+	srcDir := t.TempDir()
+	os.MkdirAll(filepath.Join(srcDir, "a", "b"), 0755)
+	os.MkdirAll(filepath.Join(srcDir, "skip"), 0755)
+	os.WriteFile(filepath.Join(srcDir, "top.txt"), []byte("top"), 0644)
+	os.WriteFile(filepath.Join(srcDir, "a", "b", "deep.txt"), []byte("deep"), 0600)
+	os.WriteFile(filepath.Join(srcDir, "a", "b", "deep.log"), []byte("log"), 0644)
+	os.WriteFile(filepath.Join(srcDir, "skip", "x.txt"), []byte("x"), 0644)
+	src := copyEndpoint{Path: srcDir}
+	_, err := walkCopySource(context.Background(), src, &copyFileOpts{})
+	if err == nil {
+		t.Fatalf("expected error copying a directory without recursive")
+	}
+	entries, err := walkCopySource(context.Background(), src, &copyFileOpts{Recursive: true, Include: []string{"*.txt"}, Exclude: []string{"skip"}})
+	if err != nil {
+		t.Fatalf("error walking source: %v", err)
+	}
+	var relPaths []string
+	for _, entry := range entries {
+		relPaths = append(relPaths, entry.RelPath)
+	}
+	if len(relPaths) != 2 || relPaths[0] != "a/b/deep.txt" || relPaths[1] != "top.txt" {
+		t.Fatalf("bad entries: %v", relPaths)
+	}
+	if entries[0].Info.Perm != 0600 || entries[0].Info.Size != 4 {
+		t.Errorf("bad entry info: %#v", entries[0].Info)
+	}
+	entries, err = walkCopySource(context.Background(), copyEndpoint{Path: filepath.Join(srcDir, "top.txt")}, &copyFileOpts{})
+	if err != nil || len(entries) != 1 || entries[0].RelPath != "" {
+		t.Fatalf("bad single file walk: %v %v", entries, err)
+	}
+}
+
+func TestLocalFileWriter(t *testing.T) {
+	srcDir := t.TempDir()
+	srcPath := filepath.Join(srcDir, "src.txt")
+	os.WriteFile(srcPath, []byte("hello world\n"), 0640)
+	entries, err := walkCopySource(context.Background(), copyEndpoint{Path: srcPath}, &copyFileOpts{})
+	if err != nil {
+		t.Fatalf("error walking source: %v", err)
+	}
+	info := entries[0].Info
+	destPath := filepath.Join(t.TempDir(), "new", "dir", "dest.txt")
+	opts := &copyFileOpts{Preserve: true, Verify: true}
+	writer, err := openCopyDest(context.Background(), copyEndpoint{Path: destPath}, destPath, info, opts)
+	if err != nil {
+		t.Fatalf("error opening dest: %v", err)
+	}
+	writer.Write([]byte("hello world\n"))
+	destHash, err := writer.Finish()
+	if err != nil {
+		t.Fatalf("error finishing write: %v", err)
+	}
+	srcHash := sha256.Sum256([]byte("hello world\n"))
+	if destHash != hex.EncodeToString(srcHash[:]) {
+		t.Errorf("bad dest hash: %s", destHash)
+	}
+	destInfo, err := os.Stat(destPath)
+	if err != nil {
+		t.Fatalf("cannot stat dest: %v", err)
+	}
+	if destInfo.Mode().Perm() != 0640 || destInfo.ModTime().UnixMilli() != info.ModTs {
+		t.Errorf("attributes not preserved: mode=%v modts=%d (expected %d)", destInfo.Mode(), destInfo.ModTime().UnixMilli(), info.ModTs)
+	}
+}
+
+func TestCopyProgressRate(t *testing.T) {
+	cp := &copyProgress{StartTime: time.Now().Add(-2 * time.Second), TotalSize: 4000}
+	if rate, eta := cp.getRateAndEta(); rate != 0 || eta != 0 {
+		t.Errorf("expected no rate before any bytes, got %d %v", rate, eta)
+	}
+	cp.BytesDone = 1000
+	rate, eta := cp.getRateAndEta()
+	if rate < 450 || rate > 500 {
+		t.Errorf("bad rate: %d", rate)
+	}
+	if eta < 5*time.Second || eta > 7*time.Second {
+		t.Errorf("bad eta: %v", eta)
+	}
+}
+
+func TestLocalCopyHashPerm0(t *testing.T) {
+	srcPath := filepath.Join(t.TempDir(), "src.txt")
+	os.WriteFile(srcPath, []byte("hello world\n"), 0640)
+	entries, err := walkCopySource(context.Background(), copyEndpoint{Path: srcPath}, &copyFileOpts{})
+	if err != nil {
+		t.Fatalf("error walking source: %v", err)
+	}
+	info := entries[0].Info
+	info.Perm = 0
+	opts := &copyFileOpts{Preserve: true, Verify: true}
+	reader, err := openCopySource(context.Background(), copyEndpoint{Path: srcPath}, srcPath, opts)
+	if err != nil {
+		t.Fatalf("error opening source: %v", err)
+	}
+	defer reader.Close()
+	destPath := filepath.Join(t.TempDir(), "dest.txt")
+	writer, err := openCopyDest(context.Background(), copyEndpoint{Path: destPath}, destPath, info, opts)
+	if err != nil {
+		t.Fatalf("error opening dest: %v", err)
+	}
+	_, err = io.Copy(writer, reader)
+	if err != nil {
+		t.Fatalf("error copying: %v", err)
+	}
+	destHash, err := writer.Finish()
+	if err != nil {
+		t.Fatalf("error finishing write: %v", err)
+	}
+	expectedHash := sha256.Sum256([]byte("hello world\n"))
+	if reader.Sha256() != hex.EncodeToString(expectedHash[:]) || destHash != reader.Sha256() {
+		t.Errorf("bad hashes: src=%s dest=%s", reader.Sha256(), destHash)
+	}
+	destInfo, err := os.Stat(destPath)
+	if err != nil {
+		t.Fatalf("cannot stat dest: %v", err)
+	}
+	if destInfo.Mode().Perm() != 0 {
+		t.Errorf("mode 0 not preserved: %v", destInfo.Mode())
+	}
+}
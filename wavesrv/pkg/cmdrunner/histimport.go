@@ -0,0 +1,276 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmdrunner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/remote"
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/sstore"
+)
+
+const (
+	HistoryFormat_JsonL = "jsonl"
+	HistoryFormat_Bash  = "bash"
+	HistoryFormat_Zsh   = "zsh"
+)
+
+const MaxHistoryImportFileSize = 50 * 1024 * 1024
+const MaxHistoryImportLineSize = 1024 * 1024
+
+var HistoryImportFormats = []string{HistoryFormat_JsonL, HistoryFormat_Bash, HistoryFormat_Zsh}
+
+var historyImportDefaultFiles = map[string]string{
+	HistoryFormat_Bash: "~/.bash_history",
+	HistoryFormat_Zsh:  "~/.zsh_history",
+}
+
+// namespace for deterministic historyids of imported shell history (so re-importing a file does not create duplicates)
+var historyImportNamespace = uuid.MustParse("6d0e5a4e-3c1b-4b7e-9a55-2f3b8c0f6a11")
+
+var bashHistTsRe = regexp.MustCompile(`^#(\d+)$`)
+var zshExtHistRe = regexp.MustCompile(`^: *(\d+):(\d+);`)
+
+// a command parsed out of a shell-native history file.  Ts is in milliseconds (0 if the file has no timestamp)
+type shellHistoryEntry struct {
+	Ts         int64
+	DurationMs *int64
+	CmdStr     string
+}
+
+// bash history, with optional HISTTIMEFORMAT timestamp comments ("#1700000000").
+// when timestamps are present all lines up to the next timestamp belong to one command (lithist).
+func parseBashHistory(data []byte) []shellHistoryEntry {
+	var rtn []shellHistoryEntry
+	var curTs int64
+	var curLines []string
+	hasTs := false
+	flush := func() {
+		if len(curLines) == 0 {
+			return
+		}
+		cmdStr := strings.TrimSpace(strings.Join(curLines, "\n"))
+		if cmdStr != "" {
+			rtn = append(rtn, shellHistoryEntry{Ts: curTs, CmdStr: cmdStr})
+		}
+		curLines = nil
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if m := bashHistTsRe.FindStringSubmatch(line); m != nil {
+			flush()
+			tsSec, _ := strconv.ParseInt(m[1], 10, 64)
+			curTs = tsSec * 1000
+			hasTs = true
+			continue
+		}
+		curLines = append(curLines, line)
+		if !hasTs {
+			flush()
+		}
+	}
+	flush()
+	return rtn
+}
+
+// zsh stores non-ascii bytes "metafied" (0x83 followed by the byte xor 32)
+func unmetafyZsh(data []byte) []byte {
+	if bytes.IndexByte(data, 0x83) == -1 {
+		return data
+	}
+	rtn := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		if data[i] == 0x83 && i+1 < len(data) {
+			i++
+			rtn = append(rtn, data[i]^32)
+			continue
+		}
+		rtn = append(rtn, data[i])
+	}
+	return rtn
+}
+
+// zsh history, either plain or extended (": <start>:<elapsed>;<cmd>").
+// lines ending in a backslash continue onto the next line (multi-line commands).
+func parseZshHistory(data []byte) []shellHistoryEntry {
+	var rtn []shellHistoryEntry
+	var cur *shellHistoryEntry
+	continuing := false
+	for _, line := range strings.Split(string(unmetafyZsh(data)), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if continuing && cur != nil {
+			cur.CmdStr += "\n" + line
+		} else {
+			if cur != nil {
+				rtn = append(rtn, *cur)
+			}
+			cur = &shellHistoryEntry{CmdStr: line}
+			if m := zshExtHistRe.FindStringSubmatch(line); m != nil {
+				tsSec, _ := strconv.ParseInt(m[1], 10, 64)
+				durSec, _ := strconv.ParseInt(m[2], 10, 64)
+				durMs := durSec * 1000
+				cur.Ts = tsSec * 1000
+				cur.DurationMs = &durMs
+				cur.CmdStr = line[len(m[0]):]
+			}
+		}
+		continuing = strings.HasSuffix(cur.CmdStr, "\\")
+		if continuing {
+			cur.CmdStr = strings.TrimSuffix(cur.CmdStr, "\\")
+		}
+	}
+	if cur != nil {
+		rtn = append(rtn, *cur)
+	}
+	var filtered []shellHistoryEntry
+	for _, entry := range rtn {
+		entry.CmdStr = strings.TrimSpace(entry.CmdStr)
+		if entry.CmdStr == "" {
+			continue
+		}
+		filtered = append(filtered, entry)
+	}
+	return filtered
+}
+
+// converts parsed shell history entries into history items for the given remote.
+// entries without timestamps are given increasing timestamps ending at fallbackTs (to preserve file order).
+func makeImportedHistoryItems(entries []shellHistoryEntry, format string, rptr sstore.RemotePtrType, fallbackTs int64) []*sstore.HistoryItemType {
+	rtn := make([]*sstore.HistoryItemType, 0, len(entries))
+	for idx, entry := range entries {
+		ts := entry.Ts
+		if ts == 0 {
+			ts = fallbackTs - int64(len(entries)-1-idx)
+		}
+		idKey := fmt.Sprintf("%s|%s|%s|%d|%s", format, rptr.OwnerId, rptr.RemoteId, ts, entry.CmdStr)
+		hitem := &sstore.HistoryItemType{
+			HistoryId:  uuid.NewSHA1(historyImportNamespace, []byte(idKey)).String(),
+			Ts:         ts,
+			UserId:     DefaultUserId,
+			CmdStr:     entry.CmdStr,
+			Remote:     rptr,
+			DurationMs: entry.DurationMs,
+			Tags:       map[string]bool{"import:" + format: true},
+			Status:     sstore.CmdStatusDone,
+		}
+		rtn = append(rtn, hitem)
+	}
+	return rtn
+}
+
+func writeHistoryJsonL(w io.Writer, hitems []*sstore.HistoryItemType) error {
+	bufWriter := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bufWriter)
+	for _, hitem := range hitems {
+		err := encoder.Encode(hitem)
+		if err != nil {
+			return err
+		}
+	}
+	return bufWriter.Flush()
+}
+
+func readHistoryJsonL(r io.Reader) ([]*sstore.HistoryItemType, error) {
+	var rtn []*sstore.HistoryItemType
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), MaxHistoryImportLineSize)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var hitem sstore.HistoryItemType
+		err := json.Unmarshal(line, &hitem)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid json: %v", lineNum, err)
+		}
+		if _, err := uuid.Parse(hitem.HistoryId); err != nil {
+			return nil, fmt.Errorf("line %d: invalid historyid %q", lineNum, hitem.HistoryId)
+		}
+		if hitem.CmdStr == "" {
+			return nil, fmt.Errorf("line %d: empty cmdstr", lineNum)
+		}
+		// the sessions/screens/lines the items were exported from do not exist here
+		hitem.SessionId = ""
+		hitem.ScreenId = ""
+		hitem.LineId = ""
+		hitem.LineNum = 0
+		hitem.HistoryNum = ""
+		hitem.Remove = false
+		if hitem.Status == "" {
+			hitem.Status = sstore.CmdStatusDone
+		}
+		rtn = append(rtn, &hitem)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rtn, nil
+}
+
+// reads an entire (small) file from a remote using streamfile, returns the data and the file's modts
+func readRemoteFile(ctx context.Context, msh *remote.MShellProc, path string, maxSize int64) ([]byte, int64, error) {
+	streamPk := packet.MakeStreamFilePacket()
+	streamPk.ReqId = uuid.New().String()
+	streamPk.Path = path
+	iter, err := msh.StreamFile(ctx, streamPk)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer iter.Close()
+	respIf, err := iter.Next(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error getting response: %v", err)
+	}
+	resp, ok := respIf.(*packet.StreamFileResponseType)
+	if !ok {
+		return nil, 0, fmt.Errorf("bad response packet type: %T", respIf)
+	}
+	if resp.Error != "" {
+		return nil, 0, fmt.Errorf("%s", resp.Error)
+	}
+	if resp.Info == nil {
+		return nil, 0, fmt.Errorf("no file info")
+	}
+	if resp.Info.NotFound {
+		return nil, 0, fmt.Errorf("file %q not found", path)
+	}
+	if resp.Info.IsDir {
+		return nil, 0, fmt.Errorf("%q is a directory", path)
+	}
+	if resp.Info.Size > maxSize {
+		return nil, 0, fmt.Errorf("file %q is too large (%d bytes, max %d)", path, resp.Info.Size, maxSize)
+	}
+	var buf bytes.Buffer
+	for {
+		dataPkIf, err := iter.Next(ctx)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error while getting data: %w", err)
+		}
+		if dataPkIf == nil {
+			break
+		}
+		dataPk, ok := dataPkIf.(*packet.FileDataPacketType)
+		if !ok {
+			return nil, 0, fmt.Errorf("invalid data packet type: %T", dataPkIf)
+		}
+		if dataPk.Error != "" {
+			return nil, 0, fmt.Errorf("error returned while getting data: %s", dataPk.Error)
+		}
+		buf.Write(dataPk.Data)
+	}
+	return buf.Bytes(), resp.Info.ModTs, nil
+}
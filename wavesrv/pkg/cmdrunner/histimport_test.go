@@ -0,0 +1,79 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmdrunner
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/sstore"
+)
+
+func TestParseBashHistory(t *testing.T) {
+	entries := parseBashHistory([]byte("ls -l\ncd /tmp\n\n"))
+	if len(entries) != 2 || entries[0].CmdStr != "ls -l" || entries[1].CmdStr != "cd /tmp" || entries[0].Ts != 0 {
+		t.Errorf("bad plain bash parse: %#v", entries)
+	}
+	entries = parseBashHistory([]byte("#1700000000\nls -l\n#1700000005\nfor x in 1 2; do\n  echo $x\ndone\n"))
+	if len(entries) != 2 {
+		t.Fatalf("bad timestamped bash parse: %#v", entries)
+	}
+	if entries[0].Ts != 1700000000000 || entries[1].Ts != 1700000005000 {
+		t.Errorf("bad bash timestamps: %#v", entries)
+	}
+	if entries[1].CmdStr != "for x in 1 2; do\n  echo $x\ndone" {
+		t.Errorf("bad bash multi-line cmd: %q", entries[1].CmdStr)
+	}
+}
+
+func TestParseZshHistory(t *testing.T) {
+	data := []byte(": 1700000000:3;make\n: 1700000010:0;echo foo \\\nbar\n: 1700000020:0;echo caf\xc3\x83\x89\n")
+	entries := parseZshHistory(data)
+	if len(entries) != 3 {
+		t.Fatalf("bad zsh parse: %#v", entries)
+	}
+	if entries[0].CmdStr != "make" || entries[0].Ts != 1700000000000 || entries[0].DurationMs == nil || *entries[0].DurationMs != 3000 {
+		t.Errorf("bad zsh entry: %#v", entries[0])
+	}
+	if entries[1].CmdStr != "echo foo \nbar" {
+		t.Errorf("bad zsh multi-line cmd: %q", entries[1].CmdStr)
+	}
+	if entries[2].CmdStr != "echo caf\xc3\xa9" {
+		t.Errorf("bad zsh unmetafy: %q", entries[2].CmdStr)
+	}
+	entries = parseZshHistory([]byte("ls\npwd\n"))
+	if len(entries) != 2 || entries[1].CmdStr != "pwd" || entries[1].DurationMs != nil {
+		t.Errorf("bad plain zsh parse: %#v", entries)
+	}
+}
+
+func TestHistoryJsonLRoundTrip(t *testing.T) {
+	rptr := sstore.RemotePtrType{RemoteId: "ab5b5c39-5d1a-4a35-8c9d-c0e2e4b3e5f1"}
+	hitems := makeImportedHistoryItems([]shellHistoryEntry{{CmdStr: "ls"}, {Ts: 5000, CmdStr: "pwd"}}, HistoryFormat_Bash, rptr, 10000)
+	if hitems[0].Ts != 9999 || hitems[1].Ts != 5000 {
+		t.Errorf("bad fallback timestamps: %d %d", hitems[0].Ts, hitems[1].Ts)
+	}
+	again := makeImportedHistoryItems([]shellHistoryEntry{{CmdStr: "ls"}, {Ts: 5000, CmdStr: "pwd"}}, HistoryFormat_Bash, rptr, 10000)
+	if hitems[1].HistoryId != again[1].HistoryId {
+		t.Errorf("imported historyids should be deterministic")
+	}
+	hitems[1].SessionId = "d3b0bd3e-0c84-4f2e-9b3e-7a1c6f2d9e10"
+	hitems[1].ScreenId = "5f3c2a1b-8e7d-4c6b-a5f4-e3d2c1b0a987"
+	hitems[1].LineId = "0e1d2c3b-4a59-4687-b6a5-c4d3e2f1a0b9"
+	var buf bytes.Buffer
+	err := writeHistoryJsonL(&buf, hitems)
+	if err != nil {
+		t.Fatalf("error writing jsonl: %v", err)
+	}
+	readItems, err := readHistoryJsonL(&buf)
+	if err != nil {
+		t.Fatalf("error reading jsonl: %v", err)
+	}
+	if len(readItems) != 2 || readItems[1].CmdStr != "pwd" || readItems[1].Remote.RemoteId != rptr.RemoteId || !readItems[1].Tags["import:bash"] {
+		t.Errorf("bad jsonl round trip: %#v", readItems)
+	}
+	if readItems[1].SessionId != "" || readItems[1].ScreenId != "" || readItems[1].LineId != "" {
+		t.Errorf("imported items should not reference the exported sessions/screens/lines: %#v", readItems[1])
+	}
+}
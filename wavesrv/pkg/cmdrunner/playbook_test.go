@@ -0,0 +1,88 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmdrunner
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/sstore"
+)
+
+func makeTestPlaybookEntries(cmdStrs ...string) []*sstore.PlaybookEntry {
+	var rtn []*sstore.PlaybookEntry
+	for _, cmdStr := range cmdStrs {
+		rtn = append(rtn, &sstore.PlaybookEntry{CmdStr: cmdStr})
+	}
+	return rtn
+}
+
+func TestRunPlaybookEntries(t *testing.T) {
+	// "fail" entries exit non-zero, "error" entries cannot be started
+	tests := []struct {
+		Name            string
+		CmdStrs         []string
+		ContinueOnError bool
+		ExpectedRan     []string
+		NumRun          int
+		NumFailed       int
+		ExpectedErr     string
+	}{
+		{"all-ok", []string{"a", "b", "c"}, false, []string{"a", "b", "c"}, 3, 0, ""},
+		{"stop-on-fail", []string{"a", "fail", "c"}, false, []string{"a", "fail"}, 2, 1, "entry 2 failed"},
+		{"continue-on-fail", []string{"a", "fail", "c", "fail"}, true, []string{"a", "fail", "c", "fail"}, 4, 2, ""},
+		{"stop-on-error", []string{"a", "error", "c"}, false, []string{"a", "error"}, 1, 0, "entry 2 error: cannot start"},
+		{"continue-stops-on-error", []string{"fail", "error", "c"}, true, []string{"fail", "error"}, 1, 1, "entry 2 error: cannot start"},
+	}
+	for _, test := range tests {
+		var ran []string
+		runEntry := func(idx int, entry *sstore.PlaybookEntry) (bool, error) {
+			if idx != len(ran) {
+				t.Errorf("%s: entry %d run out of order", test.Name, idx)
+			}
+			ran = append(ran, entry.CmdStr)
+			if entry.CmdStr == "error" {
+				return false, fmt.Errorf("cannot start")
+			}
+			return entry.CmdStr != "fail", nil
+		}
+		numRun, numFailed, err := runPlaybookEntries(context.Background(), makeTestPlaybookEntries(test.CmdStrs...), test.ContinueOnError, runEntry)
+		var errStr string
+		if err != nil {
+			errStr = err.Error()
+		}
+		if !reflect.DeepEqual(ran, test.ExpectedRan) || numRun != test.NumRun || numFailed != test.NumFailed || errStr != test.ExpectedErr {
+			t.Errorf("%s: ran=%v numrun=%d numfailed=%d err=%q, expected ran=%v numrun=%d numfailed=%d err=%q", test.Name, ran, numRun, numFailed, errStr, test.ExpectedRan, test.NumRun, test.NumFailed, test.ExpectedErr)
+		}
+	}
+}
+
+func TestRunPlaybookEntriesCancel(t *testing.T) {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	var ran []string
+	// canceled while the second entry is running (the wait returns the context error)
+	runEntry := func(idx int, entry *sstore.PlaybookEntry) (bool, error) {
+		ran = append(ran, entry.CmdStr)
+		if idx == 1 {
+			cancelFn()
+			return false, ctx.Err()
+		}
+		return true, nil
+	}
+	numRun, numFailed, err := runPlaybookEntries(ctx, makeTestPlaybookEntries("a", "b", "c"), true, runEntry)
+	if err == nil || err.Error() != "interrupted at entry 2" {
+		t.Errorf("bad error: %v", err)
+	}
+	if !reflect.DeepEqual(ran, []string{"a", "b"}) || numRun != 1 || numFailed != 0 {
+		t.Errorf("bad run: ran=%v numrun=%d numfailed=%d", ran, numRun, numFailed)
+	}
+	ran = nil
+	numRun, _, err = runPlaybookEntries(ctx, makeTestPlaybookEntries("a"), true, runEntry)
+	if err == nil || err.Error() != "interrupted before entry 1" || len(ran) != 0 || numRun != 0 {
+		t.Errorf("canceled playbook should not run entries: ran=%v err=%v", ran, err)
+	}
+}
@@ -487,7 +487,7 @@ func ResolveRemoteFromPtr(ctx context.Context, rptr *sstore.RemotePtrType, sessi
 			// continue with state set to nil
 		} else {
 			if ri == nil {
-				rtn.ShellType = msh.GetShellPref()
+				rtn.ShellType = getDefaultShellType(ctx, msh, &rcopy, sessionId, screenId)
 				rtn.StatePtr = msh.GetDefaultStatePtr(rtn.ShellType)
 				rtn.FeState = msh.GetDefaultFeState(rtn.ShellType)
 			} else {
@@ -500,6 +500,23 @@ func ResolveRemoteFromPtr(ctx context.Context, rptr *sstore.RemotePtrType, sessi
 	return rtn, nil
 }
 
+// a remote's own shellpref wins unless it is set to "detect", in which case the
+// screen/session/connection/client "shellpref" setvars are consulted before falling back to detection
+func getDefaultShellType(ctx context.Context, msh *remote.MShellProc, rcopy *sstore.RemoteType, sessionId string, screenId string) string {
+	if rcopy.ShellPref != sstore.ShellTypePref_Detect {
+		return msh.GetShellPref()
+	}
+	sv, err := sstore.ResolveSetVar(ctx, sstore.SetVar_ShellPref, sstore.SetVarScopeIds{ScreenId: screenId, SessionId: sessionId, RemoteId: rcopy.RemoteId})
+	if err != nil {
+		log.Printf("ERROR resolving shellpref setvar: %v\n", err)
+		return msh.GetShellPref()
+	}
+	if sv == nil || sv.Value == sstore.ShellTypePref_Detect {
+		return msh.GetShellPref()
+	}
+	return sv.Value
+}
+
 // returns (remoteDisplayName, remoteptr, state, rstate, err)
 func resolveRemote(ctx context.Context, fullRemoteRef string, sessionId string, screenId string) (string, *sstore.RemotePtrType, *remote.RemoteRuntimeState, error) {
 	if fullRemoteRef == "" {
@@ -0,0 +1,117 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmdrunner
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/remote"
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/scbase"
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/scpacket"
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/sstore"
+)
+
+// creates a migrated db in a temp WAVETERM_HOME and loads its remotes (nothing is launched)
+func setupTestRemotes(t *testing.T) context.Context {
+	t.Setenv(scbase.WaveHomeVarName, t.TempDir())
+	sstore.CloseDB()
+	t.Cleanup(sstore.CloseDB)
+	err := sstore.TryMigrateUp()
+	if err != nil {
+		t.Fatalf("error migrating test db: %v", err)
+	}
+	ctx := context.Background()
+	_, err = sstore.EnsureClientData(ctx)
+	if err != nil {
+		t.Fatalf("error creating client data: %v", err)
+	}
+	err = sstore.EnsureLocalRemote(ctx)
+	if err != nil {
+		t.Fatalf("error creating local remote: %v", err)
+	}
+	localRemote, err := sstore.GetLocalRemote(ctx)
+	if err != nil || localRemote == nil {
+		t.Fatalf("error getting local remote: %v", err)
+	}
+	_, err = sstore.UpdateRemote(ctx, localRemote.RemoteId, map[string]interface{}{sstore.RemoteField_ConnectMode: sstore.ConnectModeManual})
+	if err != nil {
+		t.Fatalf("error updating local remote: %v", err)
+	}
+	err = remote.LoadRemotes(ctx)
+	if err != nil {
+		t.Fatalf("error loading remotes: %v", err)
+	}
+	return ctx
+}
+
+func makeTestSetPk(remoteId string, args ...string) *scpacket.FeCommandPacketType {
+	pk := scpacket.MakeFeCommandPacket()
+	pk.MetaCmd = "set"
+	pk.Args = args
+	pk.UIContext = &scpacket.UIContextType{Remote: &sstore.RemotePtrType{RemoteId: remoteId}}
+	return pk
+}
+
+func TestSetConnectionVars(t *testing.T) {
+	ctx := setupTestRemotes(t)
+	r := &sstore.RemoteType{
+		RemoteId:            uuid.New().String(),
+		RemoteType:          sstore.RemoteTypeSsh,
+		RemoteCanonicalName: "user@testhost",
+		RemoteUser:          "user",
+		RemoteHost:          "testhost",
+		ConnectMode:         sstore.ConnectModeManual,
+		SSHOpts:             &sstore.SSHOpts{SSHHost: "testhost", SSHUser: "user"},
+		ShellPref:           sstore.ShellTypePref_Detect,
+	}
+	err := remote.AddRemote(ctx, r, false)
+	if err != nil {
+		t.Fatalf("error adding remote: %v", err)
+	}
+	checkVars := func(expected map[string]string) {
+		t.Helper()
+		setVars, err := sstore.GetSetVars(ctx, sstore.SetVarScope_Connection, r.RemoteId)
+		if err != nil {
+			t.Fatalf("error getting setvars: %v", err)
+		}
+		if len(setVars) != len(expected) {
+			t.Errorf("got %d connection setvars, expected %d", len(setVars), len(expected))
+		}
+		for _, sv := range setVars {
+			if expected[sv.Name] != sv.Value {
+				t.Errorf("connection setvar %s=%q, expected %q", sv.Name, sv.Value, expected[sv.Name])
+			}
+		}
+	}
+	_, err = SetCommand(ctx, makeTestSetPk(r.RemoteId, "connection.pterm=30x100", "connection.shellpref=zsh"))
+	if err != nil {
+		t.Fatalf("/set error: %v", err)
+	}
+	checkVars(map[string]string{sstore.SetVar_PTerm: "30x100", sstore.SetVar_ShellPref: "zsh"})
+	rcopy := remote.GetRemoteCopyById(r.RemoteId)
+	if rcopy == nil || rcopy.ShellPref != sstore.ShellTypePref_Detect {
+		t.Errorf("connection shellpref setvar should not change the remote's shellpref: %+v", rcopy)
+	}
+	_, err = SetCommand(ctx, makeTestSetPk(r.RemoteId, "connection.pterm=bad"))
+	if err == nil {
+		t.Errorf("/set with an invalid pterm should fail")
+	}
+	_, err = SetCommand(ctx, makeTestSetPk(r.RemoteId, "connection.shellpref="))
+	if err != nil {
+		t.Fatalf("/set error: %v", err)
+	}
+	checkVars(map[string]string{sstore.SetVar_PTerm: "30x100"})
+	// the connection scope needs a current connection
+	_, err = SetCommand(ctx, makeTestSetPk("", "connection.pterm=30x100"))
+	if err == nil {
+		t.Errorf("/set connection var without a connection should fail")
+	}
+	err = remote.ArchiveRemote(ctx, r.RemoteId)
+	if err != nil {
+		t.Fatalf("error archiving remote: %v", err)
+	}
+	checkVars(nil)
+}
@@ -0,0 +1,87 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmdrunner
+
+import (
+	"testing"
+)
+
+func TestResolveByteSize(t *testing.T) {
+	tests := []struct {
+		Arg      string
+		Expected int64
+		Err      bool
+	}{
+		{"0", 0, false},
+		{"1000", 1000, false},
+		{"10k", 10 * 1024, false},
+		{"10KB", 10 * 1024, false},
+		{"5M", 5 * 1024 * 1024, false},
+		{"2gb", 2 * 1024 * 1024 * 1024, false},
+		{"9223372036854775807", 9223372036854775807, false},
+		{"8589934591G", 8589934591 * 1024 * 1024 * 1024, false},
+		{"8589934592G", 0, true},
+		{"9999999999G", 0, true},
+		{"99999999999999999999", 0, true},
+		{"", 0, true},
+		{"G", 0, true},
+		{"-5M", 0, true},
+		{"1.5G", 0, true},
+		{"10T", 0, true},
+	}
+	for _, test := range tests {
+		rtn, err := resolveByteSize(test.Arg)
+		if test.Err {
+			if err == nil {
+				t.Errorf("resolveByteSize(%q) expected error, got %d", test.Arg, rtn)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("resolveByteSize(%q) unexpected error: %v", test.Arg, err)
+			continue
+		}
+		if rtn != test.Expected {
+			t.Errorf("resolveByteSize(%q) got %d, expected %d", test.Arg, rtn, test.Expected)
+		}
+	}
+}
+
+func TestResolveAgeMs(t *testing.T) {
+	const dayMs = 24 * 60 * 60 * 1000
+	tests := []struct {
+		Arg      string
+		Expected int64
+		Err      bool
+	}{
+		{"0", 0, false},
+		{"30d", 30 * dayMs, false},
+		{"12h", 12 * 60 * 60 * 1000, false},
+		{"90m", 90 * 60 * 1000, false},
+		{"1h30m", 90 * 60 * 1000, false},
+		{"106751991167d", 106751991167 * dayMs, false},
+		{"106751991168d", 0, true},
+		{"-5h", 0, true},
+		{"d", 0, true},
+		{"30", 0, true},
+		{"", 0, true},
+		{"abc", 0, true},
+	}
+	for _, test := range tests {
+		rtn, err := resolveAgeMs(test.Arg)
+		if test.Err {
+			if err == nil {
+				t.Errorf("resolveAgeMs(%q) expected error, got %d", test.Arg, rtn)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("resolveAgeMs(%q) unexpected error: %v", test.Arg, err)
+			continue
+		}
+		if rtn != test.Expected {
+			t.Errorf("resolveAgeMs(%q) got %d, expected %d", test.Arg, rtn, test.Expected)
+		}
+	}
+}
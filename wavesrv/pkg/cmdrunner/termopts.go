@@ -4,7 +4,9 @@
 package cmdrunner
 
 import (
+	"context"
 	"fmt"
+	"log"
 	"strconv"
 	"strings"
 
@@ -83,6 +85,23 @@ func parseSingleTermStr(s string) (*PTermOptsType, error) {
 	return &PTermOptsType{Rows: rows, RowsFlex: rowsFlex, Cols: cols, ColsFlex: colsFlex}, nil
 }
 
+// resolves the "pterm" setvar (screen, session, connection, then client scope), defaults to DefaultPTERM
+func getDefaultPTerm(ctx context.Context, ids resolvedIds) string {
+	scopeIds := sstore.SetVarScopeIds{ScreenId: ids.ScreenId, SessionId: ids.SessionId}
+	if ids.Remote != nil {
+		scopeIds.RemoteId = ids.Remote.RemotePtr.RemoteId
+	}
+	sv, err := sstore.ResolveSetVar(ctx, sstore.SetVar_PTerm, scopeIds)
+	if err != nil {
+		log.Printf("error resolving pterm setvar: %v\n", err)
+		return DefaultPTERM
+	}
+	if sv == nil || sv.Value == "" {
+		return DefaultPTERM
+	}
+	return sv.Value
+}
+
 func GetUITermOpts(winSize *packet.WinSize, ptermStr string) (*packet.TermOpts, error) {
 	opts, err := parseSingleTermStr(ptermStr)
 	if err != nil {
@@ -71,6 +71,7 @@ type CompPoint struct {
 // directories will have a trailing "/"
 type CompEntry struct {
 	Word      string
+	Desc      string // optional, set by command providers (see RegisterCompProvider)
 	IsMetaCmd bool
 }
 
@@ -545,10 +546,20 @@ func DoCompGen(ctx context.Context, cmdStr utilfn.StrWithPos, compCtx CompContex
 			compPrefix = fixupVarPrefix(compPrefix)
 		}
 	}
-	scType := getCompType(compPos)
-	crtn, err := DoSimpleComp(ctx, scType, compPrefix, compCtx, nil)
-	if err != nil {
-		return nil, nil, err
+	var crtn *CompReturn
+	if pargs := getCompProviderArgs(compPos, compPrefix); pargs != nil {
+		var err error
+		crtn, err = doProviderComp(ctx, *pargs, compCtx)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if crtn == nil {
+		var err error
+		crtn, err = DoSimpleComp(ctx, getCompType(compPos), compPrefix, compCtx, nil)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 	if compCtx.ForDisplay {
 		return crtn, nil, nil
@@ -633,6 +644,20 @@ func (c *CompReturn) GetCompDisplayStrs() []string {
 	return rtn
 }
 
+// returns nil if no entry has a description
+func (c *CompReturn) GetCompDescs() []string {
+	var hasDesc bool
+	rtn := make([]string, len(c.Entries))
+	for idx, entry := range c.Entries {
+		rtn[idx] = entry.Desc
+		hasDesc = hasDesc || entry.Desc != ""
+	}
+	if !hasDesc {
+		return nil
+	}
+	return rtn
+}
+
 func (p CompPoint) getOrigPos() int {
 	pword := p.Words[p.CompWord]
 	return len(p.Prefix) + pword.Offset + len(pword.Prefix) + p.CompWordPos
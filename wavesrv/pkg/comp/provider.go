@@ -0,0 +1,322 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package comp
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/utilfn"
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/remote"
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/shparse"
+)
+
+// the command argument being completed
+type CompProviderArgs struct {
+	CmdName string   // base name of the command word (e.g. "git")
+	Args    []string // expanded args before the completion word (not including the command word)
+	Prefix  string
+}
+
+// returns positional args (skips flags and the values of valueFlags, stops at "--")
+func (pargs CompProviderArgs) Positional(valueFlags ...string) []string {
+	var rtn []string
+	for idx := 0; idx < len(pargs.Args); idx++ {
+		arg := pargs.Args[idx]
+		if arg == "--" {
+			return append(rtn, pargs.Args[idx+1:]...)
+		}
+		if strings.HasPrefix(arg, "-") {
+			if utilfn.ContainsStr(valueFlags, arg) {
+				idx++
+			}
+			continue
+		}
+		rtn = append(rtn, arg)
+	}
+	return rtn
+}
+
+// return a nil CompReturn to fall back to file completion
+type CompProviderFnType = func(ctx context.Context, pargs CompProviderArgs, compCtx CompContext) (*CompReturn, error)
+
+var compProviderMap = map[string]CompProviderFnType{
+	"git":     compProviderGit,
+	"kubectl": compProviderKubectl,
+	"docker":  compProviderDocker,
+	"ssh":     compProviderSsh,
+	"make":    compProviderMake,
+}
+
+func RegisterCompProvider(cmdName string, fn CompProviderFnType) {
+	globalLock.Lock()
+	defer globalLock.Unlock()
+	if _, ok := compProviderMap[cmdName]; ok {
+		panic(fmt.Sprintf("compProvider %q already registered", cmdName))
+	}
+	compProviderMap[cmdName] = fn
+}
+
+func getCompProvider(cmdName string) CompProviderFnType {
+	globalLock.Lock()
+	defer globalLock.Unlock()
+	return compProviderMap[cmdName]
+}
+
+// returns nil if compPos is not an argument of a command with a registered provider
+func getCompProviderArgs(compPos shparse.CompletionPos, compPrefix string) *CompProviderArgs {
+	if compPos.CompType != shparse.CompTypeArg || compPos.Cmd == nil || len(compPos.Cmd.Words) == 0 || compPos.CmdWordPos <= 0 {
+		return nil
+	}
+	cmdWord, info := shparse.SimpleExpand(shparse.ExpandContext{}, compPos.Cmd.Words[0])
+	if info.HasVar || info.HasGlob || cmdWord == "" {
+		return nil
+	}
+	rtn := &CompProviderArgs{CmdName: filepath.Base(cmdWord), Prefix: compPrefix}
+	for idx := 1; idx < compPos.CmdWordPos && idx < len(compPos.Cmd.Words); idx++ {
+		arg, _ := shparse.SimpleExpand(shparse.ExpandContext{}, compPos.Cmd.Words[idx])
+		rtn.Args = append(rtn.Args, arg)
+	}
+	return rtn
+}
+
+func doProviderComp(ctx context.Context, pargs CompProviderArgs, compCtx CompContext) (*CompReturn, error) {
+	providerFn := getCompProvider(pargs.CmdName)
+	if providerFn == nil {
+		return nil, nil
+	}
+	crtn, err := providerFn(ctx, pargs, compCtx)
+	if err != nil || crtn == nil {
+		return nil, err
+	}
+	crtn.CompType = pargs.CmdName
+	return crtn, nil
+}
+
+type compWordDesc struct {
+	Word string
+	Desc string
+}
+
+func compStaticWords(words []compWordDesc, prefix string) *CompReturn {
+	var rtn CompReturn
+	for _, w := range words {
+		if strings.HasPrefix(w.Word, prefix) {
+			rtn.Entries = append(rtn.Entries, CompEntry{Word: w.Word, Desc: w.Desc})
+		}
+	}
+	return &rtn
+}
+
+// runs a packet.CompGenType_* compgen on the remote.  returns nil (fall back to file completion)
+// if the remote does not support the provider types
+func doRemoteProviderCompGen(ctx context.Context, compType string, prefix string, compCtx CompContext) (*CompReturn, error) {
+	if compCtx.RemotePtr == nil {
+		return nil, nil
+	}
+	msh := remote.GetRemoteById(compCtx.RemotePtr.RemoteId)
+	if msh == nil || !msh.HasCapability(packet.Capability_CompProviders) {
+		return nil, nil
+	}
+	cgPacket := packet.MakeCompGenPacket()
+	cgPacket.ReqId = uuid.New().String()
+	cgPacket.CompType = compType
+	cgPacket.Prefix = prefix
+	cgPacket.Cwd = compCtx.Cwd
+	resp, err := msh.PacketRpc(ctx, cgPacket)
+	if err != nil {
+		return nil, err
+	}
+	if err = resp.Err(); err != nil {
+		return nil, err
+	}
+	comps := utilfn.GetStrArr(resp.Data, "comps")
+	descs := utilfn.GetStrArr(resp.Data, "descs")
+	crtn := compsToCompReturn(comps, utilfn.GetBool(resp.Data, "hasmore"))
+	for idx := range crtn.Entries {
+		if idx < len(descs) {
+			crtn.Entries[idx].Desc = descs[idx]
+		}
+	}
+	return crtn, nil
+}
+
+var gitSubCmds = []compWordDesc{
+	{"add", "add file contents to the index"},
+	{"bisect", "find the commit that introduced a bug"},
+	{"branch", "list, create, or delete branches"},
+	{"checkout", "switch branches or restore files"},
+	{"cherry-pick", "apply the changes of existing commits"},
+	{"clone", "clone a repository"},
+	{"commit", "record changes to the repository"},
+	{"diff", "show changes"},
+	{"fetch", "download objects and refs"},
+	{"grep", "print lines matching a pattern"},
+	{"init", "create an empty repository"},
+	{"log", "show commit logs"},
+	{"merge", "join development histories"},
+	{"mv", "move or rename a file"},
+	{"pull", "fetch and integrate"},
+	{"push", "update remote refs"},
+	{"rebase", "reapply commits on top of another base"},
+	{"remote", "manage tracked repositories"},
+	{"reset", "reset HEAD to a specified state"},
+	{"restore", "restore working tree files"},
+	{"revert", "revert existing commits"},
+	{"rm", "remove files from the index"},
+	{"show", "show objects"},
+	{"stash", "stash changes"},
+	{"status", "show the working tree status"},
+	{"switch", "switch branches"},
+	{"tag", "create, list, or delete tags"},
+}
+
+var gitRefSubCmds = map[string]bool{
+	"branch": true, "checkout": true, "cherry-pick": true, "diff": true, "log": true, "merge": true,
+	"rebase": true, "reset": true, "revert": true, "show": true, "switch": true,
+}
+
+func compProviderGit(ctx context.Context, pargs CompProviderArgs, compCtx CompContext) (*CompReturn, error) {
+	if strings.HasPrefix(pargs.Prefix, "-") {
+		return nil, nil
+	}
+	positional := pargs.Positional("-c", "-C")
+	if len(positional) == 0 {
+		return compStaticWords(gitSubCmds, pargs.Prefix), nil
+	}
+	if gitRefSubCmds[positional[0]] {
+		return doRemoteProviderCompGen(ctx, packet.CompGenType_GitBranch, pargs.Prefix, compCtx)
+	}
+	return nil, nil
+}
+
+var kubectlSubCmds = []compWordDesc{
+	{"apply", "apply a configuration to a resource"},
+	{"config", "modify kubeconfig files"},
+	{"create", "create a resource"},
+	{"delete", "delete resources"},
+	{"describe", "show details of resources"},
+	{"edit", "edit a resource"},
+	{"exec", "execute a command in a container"},
+	{"explain", "documentation of resources"},
+	{"get", "display resources"},
+	{"logs", "print the logs for a container"},
+	{"port-forward", "forward local ports to a pod"},
+	{"rollout", "manage the rollout of a resource"},
+	{"scale", "set a new size for a resource"},
+	{"top", "display resource usage"},
+}
+
+var kubectlResourceTypes = []compWordDesc{
+	{"configmaps", ""},
+	{"cronjobs", ""},
+	{"daemonsets", ""},
+	{"deployments", ""},
+	{"ingresses", ""},
+	{"jobs", ""},
+	{"namespaces", ""},
+	{"nodes", ""},
+	{"persistentvolumeclaims", ""},
+	{"pods", ""},
+	{"replicasets", ""},
+	{"secrets", ""},
+	{"services", ""},
+	{"statefulsets", ""},
+}
+
+var kubectlResourceSubCmds = map[string]bool{
+	"delete": true, "describe": true, "edit": true, "explain": true, "get": true, "scale": true,
+}
+
+func compProviderKubectl(ctx context.Context, pargs CompProviderArgs, compCtx CompContext) (*CompReturn, error) {
+	if strings.HasPrefix(pargs.Prefix, "-") {
+		return nil, nil
+	}
+	positional := pargs.Positional("-n", "--namespace", "--context")
+	if len(positional) == 0 {
+		return compStaticWords(kubectlSubCmds, pargs.Prefix), nil
+	}
+	if len(positional) == 1 && kubectlResourceSubCmds[positional[0]] {
+		return compStaticWords(kubectlResourceTypes, pargs.Prefix), nil
+	}
+	return nil, nil
+}
+
+var dockerSubCmds = []compWordDesc{
+	{"attach", "attach to a running container"},
+	{"build", "build an image"},
+	{"compose", "docker compose"},
+	{"exec", "execute a command in a running container"},
+	{"images", "list images"},
+	{"inspect", "low-level information on docker objects"},
+	{"kill", "kill running containers"},
+	{"logs", "fetch the logs of a container"},
+	{"network", "manage networks"},
+	{"ps", "list containers"},
+	{"pull", "download an image"},
+	{"push", "upload an image"},
+	{"restart", "restart containers"},
+	{"rm", "remove containers"},
+	{"rmi", "remove images"},
+	{"run", "create and run a new container"},
+	{"start", "start stopped containers"},
+	{"stop", "stop running containers"},
+	{"volume", "manage volumes"},
+}
+
+var dockerContainerSubCmds = map[string]bool{
+	"attach": true, "exec": true, "inspect": true, "kill": true, "logs": true, "restart": true,
+	"rm": true, "start": true, "stop": true,
+}
+
+var dockerImageSubCmds = map[string]bool{"rmi": true, "run": true, "push": true}
+
+func compProviderDocker(ctx context.Context, pargs CompProviderArgs, compCtx CompContext) (*CompReturn, error) {
+	if strings.HasPrefix(pargs.Prefix, "-") {
+		return nil, nil
+	}
+	positional := pargs.Positional()
+	if len(positional) == 0 {
+		return compStaticWords(dockerSubCmds, pargs.Prefix), nil
+	}
+	if dockerContainerSubCmds[positional[0]] {
+		return doRemoteProviderCompGen(ctx, packet.CompGenType_DockerContainer, pargs.Prefix, compCtx)
+	}
+	if len(positional) == 1 && dockerImageSubCmds[positional[0]] {
+		return doRemoteProviderCompGen(ctx, packet.CompGenType_DockerImage, pargs.Prefix, compCtx)
+	}
+	return nil, nil
+}
+
+// completes the host (after an optional "user@") of the first positional arg
+func compProviderSsh(ctx context.Context, pargs CompProviderArgs, compCtx CompContext) (*CompReturn, error) {
+	if strings.HasPrefix(pargs.Prefix, "-") || len(pargs.Positional("-i", "-l", "-p", "-F", "-J", "-o")) > 0 {
+		return nil, nil
+	}
+	var userPrefix string
+	hostPrefix := pargs.Prefix
+	if atIdx := strings.LastIndex(pargs.Prefix, "@"); atIdx >= 0 {
+		userPrefix = pargs.Prefix[0 : atIdx+1]
+		hostPrefix = pargs.Prefix[atIdx+1:]
+	}
+	crtn, err := doRemoteProviderCompGen(ctx, packet.CompGenType_SshHost, hostPrefix, compCtx)
+	if err != nil || crtn == nil {
+		return crtn, err
+	}
+	for idx := range crtn.Entries {
+		crtn.Entries[idx].Word = userPrefix + crtn.Entries[idx].Word
+	}
+	return crtn, nil
+}
+
+func compProviderMake(ctx context.Context, pargs CompProviderArgs, compCtx CompContext) (*CompReturn, error) {
+	if strings.HasPrefix(pargs.Prefix, "-") || strings.Contains(pargs.Prefix, "=") {
+		return nil, nil
+	}
+	return doRemoteProviderCompGen(ctx, packet.CompGenType_MakeTarget, pargs.Prefix, compCtx)
+}
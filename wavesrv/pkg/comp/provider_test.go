@@ -0,0 +1,67 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package comp
+
+import (
+	"context"
+	"testing"
+
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/shparse"
+)
+
+func parseProviderArgs(cmdStr string) *CompProviderArgs {
+	sp := parseToSP(cmdStr)
+	cmds := shparse.ParseCommands(shparse.Tokenize(sp.Str))
+	compPos := shparse.FindCompletionPos(cmds, sp.Pos)
+	var compPrefix string
+	if compPos.CompWord != nil {
+		compPrefix, _ = shparse.SimpleExpandPrefix(shparse.ExpandContext{}, compPos.CompWord, compPos.CompWordOffset)
+	}
+	return getCompProviderArgs(compPos, compPrefix)
+}
+
+func TestCompProviderArgs(t *testing.T) {
+	pargs := parseProviderArgs("ls; /usr/bin/git -c x=1 checkout ma[*]")
+	if pargs == nil || pargs.CmdName != "git" || pargs.Prefix != "ma" {
+		t.Fatalf("bad provider args: %#v", pargs)
+	}
+	if positional := pargs.Positional(); len(positional) != 2 || positional[0] != "x=1" {
+		t.Errorf("bad positional args: %v", positional)
+	}
+	if positional := pargs.Positional("-c"); len(positional) != 1 || positional[0] != "checkout" {
+		t.Errorf("bad positional args (skipping -c values): %v", positional)
+	}
+	pargs = parseProviderArgs("git [*]")
+	if pargs == nil || len(pargs.Args) != 0 || pargs.Prefix != "" {
+		t.Fatalf("bad provider args for new word: %#v", pargs)
+	}
+	if pargs = parseProviderArgs("gi[*]"); pargs != nil {
+		t.Errorf("command word should not use providers: %#v", pargs)
+	}
+}
+
+func TestCompProviderStatic(t *testing.T) {
+	crtn, err := doProviderComp(context.Background(), CompProviderArgs{CmdName: "git", Prefix: "che"}, CompContext{})
+	if err != nil || crtn == nil {
+		t.Fatalf("expected git completions: %v", err)
+	}
+	if crtn.CompType != "git" || len(crtn.Entries) != 2 || crtn.Entries[0].Word != "checkout" || crtn.Entries[1].Word != "cherry-pick" {
+		t.Fatalf("bad git completions: %#v", crtn)
+	}
+	if descs := crtn.GetCompDescs(); len(descs) != 2 || descs[0] == "" {
+		t.Errorf("expected descriptions: %v", descs)
+	}
+	crtn, _ = doProviderComp(context.Background(), CompProviderArgs{CmdName: "kubectl", Args: []string{"get"}, Prefix: "dep"}, CompContext{})
+	if crtn == nil || len(crtn.Entries) != 1 || crtn.Entries[0].Word != "deployments" {
+		t.Errorf("bad kubectl completions: %#v", crtn)
+	}
+	// remote completions fall back to file completion without a remote
+	crtn, _ = doProviderComp(context.Background(), CompProviderArgs{CmdName: "git", Args: []string{"checkout"}}, CompContext{})
+	if crtn != nil {
+		t.Errorf("expected fallback for git checkout without a remote: %#v", crtn)
+	}
+	if crtn, _ = doProviderComp(context.Background(), CompProviderArgs{CmdName: "ls"}, CompContext{}); crtn != nil {
+		t.Errorf("expected no provider for ls")
+	}
+}
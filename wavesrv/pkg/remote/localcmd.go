@@ -0,0 +1,46 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package remote
+
+import (
+	"context"
+	"sync"
+
+	"github.com/wavetermdev/waveterm/waveshell/pkg/base"
+)
+
+// long running lines that are driven by wavesrv (e.g. /view:tail) instead of a waveshell command.
+// input for these lines never goes to the remote, an interrupt (^C or a signal) cancels them.
+var localCmdLock = &sync.Mutex{}
+var localCmdMap = make(map[base.CommandKey]context.CancelFunc)
+
+func RegisterLocalCmd(ck base.CommandKey, cancelFn context.CancelFunc) {
+	localCmdLock.Lock()
+	defer localCmdLock.Unlock()
+	localCmdMap[ck] = cancelFn
+}
+
+func UnregisterLocalCmd(ck base.CommandKey) {
+	localCmdLock.Lock()
+	defer localCmdLock.Unlock()
+	delete(localCmdMap, ck)
+}
+
+func IsLocalCmd(ck base.CommandKey) bool {
+	localCmdLock.Lock()
+	defer localCmdLock.Unlock()
+	return localCmdMap[ck] != nil
+}
+
+// returns true if ck was a local command
+func CancelLocalCmd(ck base.CommandKey) bool {
+	localCmdLock.Lock()
+	cancelFn := localCmdMap[ck]
+	localCmdLock.Unlock()
+	if cancelFn == nil {
+		return false
+	}
+	cancelFn()
+	return true
+}
@@ -0,0 +1,467 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package remote
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/sstore"
+	"golang.org/x/crypto/ssh"
+)
+
+const DefaultPortForwardBindHost = "localhost"
+
+// a running port forward (the listener is local for local/dynamic forwards, and on the remote for remote forwards)
+type portForwardProc struct {
+	Lock     *sync.Mutex
+	Fwd      sstore.PortForwardType
+	Listener net.Listener
+	Conns    map[net.Conn]bool
+	Err      error
+	Closed   bool
+}
+
+func (proc *portForwardProc) addConn(conn net.Conn) bool {
+	proc.Lock.Lock()
+	defer proc.Lock.Unlock()
+	if proc.Closed {
+		return false
+	}
+	proc.Conns[conn] = true
+	return true
+}
+
+func (proc *portForwardProc) removeConn(conn net.Conn) {
+	proc.Lock.Lock()
+	defer proc.Lock.Unlock()
+	delete(proc.Conns, conn)
+}
+
+func (proc *portForwardProc) close() {
+	proc.Lock.Lock()
+	defer proc.Lock.Unlock()
+	if proc.Closed {
+		return
+	}
+	proc.Closed = true
+	if proc.Listener != nil {
+		proc.Listener.Close()
+	}
+	for conn := range proc.Conns {
+		conn.Close()
+	}
+	proc.Conns = make(map[net.Conn]bool)
+}
+
+func (proc *portForwardProc) getState() *sstore.PortForwardStateType {
+	proc.Lock.Lock()
+	defer proc.Lock.Unlock()
+	state := &sstore.PortForwardStateType{PortForwardType: proc.Fwd, NumConns: len(proc.Conns)}
+	if proc.Err != nil {
+		state.Status = sstore.PortForwardStatusError
+		state.ErrorStr = proc.Err.Error()
+	} else if proc.Closed {
+		state.Status = sstore.PortForwardStatusInactive
+	} else {
+		state.Status = sstore.PortForwardStatusActive
+	}
+	return state
+}
+
+// splits a colon separated forward spec, allowing bracketed ipv6 addresses (e.g. "[::1]:8080:localhost:80")
+func splitPortForwardSpec(spec string) ([]string, error) {
+	var rtn []string
+	var cur strings.Builder
+	inBracket := false
+	for _, ch := range spec {
+		switch {
+		case ch == '[' && !inBracket:
+			inBracket = true
+		case ch == ']' && inBracket:
+			inBracket = false
+		case ch == ':' && !inBracket:
+			rtn = append(rtn, cur.String())
+			cur.Reset()
+		default:
+			cur.WriteRune(ch)
+		}
+	}
+	if inBracket {
+		return nil, fmt.Errorf("unterminated '[' in %q", spec)
+	}
+	rtn = append(rtn, cur.String())
+	return rtn, nil
+}
+
+// an empty bind host means localhost, "*" means all interfaces (same as ssh)
+func makeForwardAddr(host string, portStr string, isBind bool) (string, error) {
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 || (port == 0 && !isBind) {
+		return "", fmt.Errorf("invalid port %q", portStr)
+	}
+	if isBind && host == "" {
+		host = DefaultPortForwardBindHost
+	} else if isBind && host == "*" {
+		host = ""
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// parses a forward spec using the ssh command line formats:
+//
+//	local/remote: [bind_address:]port:host:hostport
+//	dynamic:      [bind_address:]port
+func ParsePortForwardSpec(fwdType string, spec string) (*sstore.PortForwardType, error) {
+	parts, err := splitPortForwardSpec(strings.TrimSpace(spec))
+	if err != nil {
+		return nil, err
+	}
+	fwd := &sstore.PortForwardType{ForwardId: uuid.New().String(), ForwardType: fwdType}
+	switch fwdType {
+	case sstore.PortForwardTypeLocal, sstore.PortForwardTypeRemote:
+		if len(parts) == 3 {
+			parts = append([]string{""}, parts...)
+		}
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("invalid forward %q, format is [bind_address:]port:host:hostport", spec)
+		}
+		fwd.BindAddr, err = makeForwardAddr(parts[0], parts[1], true)
+		if err != nil {
+			return nil, err
+		}
+		if parts[2] == "" {
+			return nil, fmt.Errorf("invalid forward %q, no target host", spec)
+		}
+		fwd.TargetAddr, err = makeForwardAddr(parts[2], parts[3], false)
+		if err != nil {
+			return nil, err
+		}
+	case sstore.PortForwardTypeDynamic:
+		if len(parts) == 1 {
+			parts = append([]string{""}, parts...)
+		}
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid forward %q, format is [bind_address:]port", spec)
+		}
+		fwd.BindAddr, err = makeForwardAddr(parts[0], parts[1], true)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid forward type %q", fwdType)
+	}
+	return fwd, nil
+}
+
+func proxyConns(conn1 net.Conn, conn2 net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(conn1, conn2)
+		conn1.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(conn2, conn1)
+		conn2.Close()
+	}()
+	wg.Wait()
+}
+
+// minimal SOCKS5 server handshake (no auth, CONNECT only).  returns the requested "host:port".
+// on error the client has been sent a failure reply (when possible).
+func readSocks5Request(conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != 5 {
+		return "", fmt.Errorf("unsupported socks version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	hasNoAuth := false
+	for _, method := range methods {
+		if method == 0 {
+			hasNoAuth = true
+		}
+	}
+	if !hasNoAuth {
+		conn.Write([]byte{5, 0xff})
+		return "", fmt.Errorf("socks client does not support no-auth")
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return "", err
+	}
+	reqHeader := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reqHeader); err != nil {
+		return "", err
+	}
+	if reqHeader[1] != 1 {
+		writeSocks5Reply(conn, 7) // command not supported
+		return "", fmt.Errorf("unsupported socks command %d", reqHeader[1])
+	}
+	var host string
+	switch reqHeader[3] {
+	case 1:
+		addr := make([]byte, 4)
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return "", err
+		}
+		host = net.IP(addr).String()
+	case 3:
+		addrLen := make([]byte, 1)
+		if _, err := io.ReadFull(conn, addrLen); err != nil {
+			return "", err
+		}
+		addr := make([]byte, addrLen[0])
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return "", err
+		}
+		host = string(addr)
+	case 4:
+		addr := make([]byte, 16)
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return "", err
+		}
+		host = net.IP(addr).String()
+	default:
+		writeSocks5Reply(conn, 8) // address type not supported
+		return "", fmt.Errorf("unsupported socks address type %d", reqHeader[3])
+	}
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(conn, portBytes); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(portBytes)))), nil
+}
+
+func writeSocks5Reply(conn net.Conn, replyCode byte) error {
+	// bound address is not meaningful for a tunneled connection, always 0.0.0.0:0
+	_, err := conn.Write([]byte{5, replyCode, 0, 1, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// dialFn connects to the far side of the forward (through ssh for local/dynamic, locally for remote forwards)
+func (proc *portForwardProc) acceptLoop(dialFn func(addr string) (net.Conn, error)) {
+	for {
+		conn, err := proc.Listener.Accept()
+		if err != nil {
+			proc.Lock.Lock()
+			if !proc.Closed {
+				proc.Err = fmt.Errorf("listener closed: %w", err)
+			}
+			proc.Lock.Unlock()
+			return
+		}
+		if !proc.addConn(conn) {
+			conn.Close()
+			return
+		}
+		go func() {
+			defer proc.removeConn(conn)
+			defer conn.Close()
+			targetAddr := proc.Fwd.TargetAddr
+			if proc.Fwd.ForwardType == sstore.PortForwardTypeDynamic {
+				var socksErr error
+				targetAddr, socksErr = readSocks5Request(conn)
+				if socksErr != nil {
+					return
+				}
+			}
+			targetConn, err := dialFn(targetAddr)
+			if proc.Fwd.ForwardType == sstore.PortForwardTypeDynamic {
+				if err != nil {
+					writeSocks5Reply(conn, 5) // connection refused
+					return
+				}
+				writeSocks5Reply(conn, 0)
+			}
+			if err != nil {
+				log.Printf("[portforward] %s cannot connect to %s: %v\n", proc.Fwd.String(), targetAddr, err)
+				return
+			}
+			proxyConns(conn, targetConn)
+		}()
+	}
+}
+
+// opens the forward's listener, this can block (client.Listen is a round trip to the remote) so it
+// must not be called while holding msh.Lock.  client can be nil (the returned proc has an error).
+func startPortForward(client *ssh.Client, fwd sstore.PortForwardType) *portForwardProc {
+	proc := &portForwardProc{Lock: &sync.Mutex{}, Fwd: fwd, Conns: make(map[net.Conn]bool)}
+	if client == nil {
+		proc.Err = fmt.Errorf("not connected")
+		if !UseSshLibrary {
+			proc.Err = fmt.Errorf("port forwarding requires the native ssh client")
+		}
+		proc.Closed = true
+		return proc
+	}
+	var dialFn func(addr string) (net.Conn, error)
+	var err error
+	switch fwd.ForwardType {
+	case sstore.PortForwardTypeLocal, sstore.PortForwardTypeDynamic:
+		proc.Listener, err = net.Listen("tcp", fwd.BindAddr)
+		dialFn = func(addr string) (net.Conn, error) {
+			return client.Dial("tcp", addr)
+		}
+	case sstore.PortForwardTypeRemote:
+		proc.Listener, err = client.Listen("tcp", fwd.BindAddr)
+		dialFn = func(addr string) (net.Conn, error) {
+			return net.Dial("tcp", addr)
+		}
+	default:
+		err = fmt.Errorf("invalid forward type %q", fwd.ForwardType)
+	}
+	if err != nil {
+		proc.Err = err
+		proc.Closed = true
+		return proc
+	}
+	go proc.acceptLoop(dialFn)
+	return proc
+}
+
+// starts the remote's port forwards that are not already running (called on connect)
+func (msh *MShellProc) startPortForwards() {
+	msh.PortForwardUpdateLock.Lock()
+	defer msh.PortForwardUpdateLock.Unlock()
+	var client *ssh.Client
+	var fwds []sstore.PortForwardType
+	msh.WithLock(func() {
+		client = msh.Client
+		for _, fwd := range msh.Remote.PortForwards {
+			if proc := msh.PortForwardProcs[fwd.ForwardId]; proc != nil && proc.getState().Status == sstore.PortForwardStatusActive {
+				continue
+			}
+			fwds = append(fwds, *fwd)
+		}
+	})
+	for _, fwd := range fwds {
+		msh.setPortForwardProc(client, startPortForward(client, fwd))
+	}
+}
+
+// records a started forward.  the listener was opened without msh.Lock, so if the connection was
+// lost (or the forward was removed) in the meantime, the forward is closed instead.
+func (msh *MShellProc) setPortForwardProc(client *ssh.Client, proc *portForwardProc) {
+	msh.Lock.Lock()
+	defer msh.Lock.Unlock()
+	fwdId := proc.Fwd.ForwardId
+	isDefined := false
+	for _, fwd := range msh.Remote.PortForwards {
+		if fwd.ForwardId == fwdId {
+			isDefined = true
+		}
+	}
+	if msh.Client != client || !isDefined {
+		proc.close()
+		return
+	}
+	if oldProc := msh.PortForwardProcs[fwdId]; oldProc != nil && oldProc != proc {
+		oldProc.close()
+	}
+	msh.PortForwardProcs[fwdId] = proc
+}
+
+// stops all running port forwards (called on disconnect), definitions are kept so they restart on reconnect
+func (msh *MShellProc) stopPortForwards_nolock() {
+	for _, proc := range msh.PortForwardProcs {
+		proc.close()
+	}
+	msh.PortForwardProcs = make(map[string]*portForwardProc)
+}
+
+func (msh *MShellProc) getPortForwards() (bool, []*sstore.PortForwardType) {
+	msh.Lock.Lock()
+	defer msh.Lock.Unlock()
+	return msh.Remote.Local, msh.Remote.PortForwards
+}
+
+func (msh *MShellProc) AddPortForward(ctx context.Context, fwd *sstore.PortForwardType) error {
+	msh.PortForwardUpdateLock.Lock()
+	defer msh.PortForwardUpdateLock.Unlock()
+	isLocal, curFwds := msh.getPortForwards()
+	if isLocal {
+		return fmt.Errorf("cannot forward ports on a local connection")
+	}
+	for _, existingFwd := range curFwds {
+		if existingFwd.ForwardType == fwd.ForwardType && existingFwd.BindAddr == fwd.BindAddr {
+			return fmt.Errorf("forward already exists for %s", existingFwd.String())
+		}
+	}
+	newFwds := append(append([]*sstore.PortForwardType{}, curFwds...), fwd)
+	updatedRemote, err := sstore.UpdateRemotePortForwards(ctx, msh.RemoteId, newFwds)
+	if err != nil {
+		return err
+	}
+	var client *ssh.Client
+	isConnected := false
+	msh.WithLock(func() {
+		msh.Remote = updatedRemote
+		client = msh.Client
+		isConnected = (msh.Status == StatusConnected)
+	})
+	if isConnected {
+		msh.setPortForwardProc(client, startPortForward(client, *fwd))
+	}
+	go msh.NotifyRemoteUpdate()
+	return nil
+}
+
+func (msh *MShellProc) RemovePortForward(ctx context.Context, forwardId string) error {
+	msh.PortForwardUpdateLock.Lock()
+	defer msh.PortForwardUpdateLock.Unlock()
+	_, curFwds := msh.getPortForwards()
+	var newFwds []*sstore.PortForwardType
+	for _, fwd := range curFwds {
+		if fwd.ForwardId != forwardId {
+			newFwds = append(newFwds, fwd)
+		}
+	}
+	if len(newFwds) == len(curFwds) {
+		return fmt.Errorf("port forward not found")
+	}
+	updatedRemote, err := sstore.UpdateRemotePortForwards(ctx, msh.RemoteId, newFwds)
+	if err != nil {
+		return err
+	}
+	msh.Lock.Lock()
+	msh.Remote = updatedRemote
+	proc := msh.PortForwardProcs[forwardId]
+	delete(msh.PortForwardProcs, forwardId)
+	msh.Lock.Unlock()
+	if proc != nil {
+		proc.close()
+	}
+	go msh.NotifyRemoteUpdate()
+	return nil
+}
+
+// returns the state of each defined port forward (in definition order)
+func (msh *MShellProc) getPortForwardStates_nolock() []*sstore.PortForwardStateType {
+	var rtn []*sstore.PortForwardStateType
+	for _, fwd := range msh.Remote.PortForwards {
+		proc := msh.PortForwardProcs[fwd.ForwardId]
+		if proc == nil {
+			rtn = append(rtn, &sstore.PortForwardStateType{PortForwardType: *fwd, Status: sstore.PortForwardStatusInactive})
+			continue
+		}
+		rtn = append(rtn, proc.getState())
+	}
+	return rtn
+}
@@ -0,0 +1,162 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package remote
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/sstore"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestParsePortForwardSpec(t *testing.T) {
+	fwd, err := ParsePortForwardSpec(sstore.PortForwardTypeLocal, "8080:db.internal:5432")
+	if err != nil || fwd.BindAddr != "localhost:8080" || fwd.TargetAddr != "db.internal:5432" {
+		t.Errorf("bad local forward: %#v %v", fwd, err)
+	}
+	fwd, err = ParsePortForwardSpec(sstore.PortForwardTypeRemote, "*:9000:[::1]:80")
+	if err != nil || fwd.BindAddr != ":9000" || fwd.TargetAddr != "[::1]:80" {
+		t.Errorf("bad remote forward: %#v %v", fwd, err)
+	}
+	fwd, err = ParsePortForwardSpec(sstore.PortForwardTypeDynamic, "127.0.0.1:1080")
+	if err != nil || fwd.BindAddr != "127.0.0.1:1080" || fwd.TargetAddr != "" {
+		t.Errorf("bad dynamic forward: %#v %v", fwd, err)
+	}
+	for _, badSpec := range []string{"8080", "8080:host", "8080:host:0", "70000:host:80", "8080::80", "[::1:8080:h:80"} {
+		if _, err := ParsePortForwardSpec(sstore.PortForwardTypeLocal, badSpec); err == nil {
+			t.Errorf("expected bad local forward %q to fail", badSpec)
+		}
+	}
+	if _, err := ParsePortForwardSpec(sstore.PortForwardTypeDynamic, "a:b:1080"); err == nil {
+		t.Errorf("expected bad dynamic forward to fail")
+	}
+}
+
+// echo server that replies with each line it receives
+func startTestEchoServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func checkEcho(t *testing.T, conn net.Conn, msg string) {
+	_, err := conn.Write([]byte(msg + "\n"))
+	if err != nil {
+		t.Fatalf("error writing: %v", err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != msg+"\n" {
+		t.Errorf("bad echo %q: %v", line, err)
+	}
+}
+
+func TestPortForwards(t *testing.T) {
+	privKey, pubKey := makeTestKey(t)
+	keyring := agent.NewKeyring()
+	keyring.Add(agent.AddedKey{PrivateKey: privKey})
+	signers, _ := keyring.Signers()
+	sshAddr := startTestSshServerWithChannels(t, pubKey, handleDirectTcpip)
+	echoAddr := startTestEchoServer(t)
+	client, err := ssh.Dial("tcp", sshAddr, &ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+	defer client.Close()
+
+	// local forward
+	localProc := startPortForward(client, sstore.PortForwardType{ForwardId: "local", ForwardType: sstore.PortForwardTypeLocal, BindAddr: "127.0.0.1:0", TargetAddr: echoAddr})
+	defer localProc.close()
+	if state := localProc.getState(); state.Status != sstore.PortForwardStatusActive {
+		t.Fatalf("local forward not active: %#v", state)
+	}
+	conn, err := net.Dial("tcp", localProc.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("error connecting to local forward: %v", err)
+	}
+	checkEcho(t, conn, "hello")
+	conn.Close()
+
+	// dynamic (socks5) forward
+	dynProc := startPortForward(client, sstore.PortForwardType{ForwardId: "dynamic", ForwardType: sstore.PortForwardTypeDynamic, BindAddr: "127.0.0.1:0"})
+	defer dynProc.close()
+	conn, err = net.Dial("tcp", dynProc.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("error connecting to socks forward: %v", err)
+	}
+	defer conn.Close()
+	echoHost, echoPortStr, _ := net.SplitHostPort(echoAddr)
+	echoPort, _ := strconv.Atoi(echoPortStr)
+	req := []byte{5, 1, 0, 5, 1, 0, 3, byte(len(echoHost))}
+	req = append(req, []byte(echoHost)...)
+	req = binary.BigEndian.AppendUint16(req, uint16(echoPort))
+	conn.Write(req)
+	resp := make([]byte, 12)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatalf("error reading socks response: %v", err)
+	}
+	if resp[0] != 5 || resp[1] != 0 || resp[3] != 0 {
+		t.Fatalf("bad socks response: %v", resp)
+	}
+	checkEcho(t, conn, "via socks")
+
+	// closing stops the listener
+	localProc.close()
+	if state := localProc.getState(); state.Status != sstore.PortForwardStatusInactive {
+		t.Errorf("expected closed forward to be inactive: %#v", state)
+	}
+	if _, err := net.Dial("tcp", localProc.Listener.Addr().String()); err == nil {
+		t.Errorf("expected closed forward to refuse connections")
+	}
+}
+
+func TestSetPortForwardProc(t *testing.T) {
+	msh := MakeMShell(&sstore.RemoteType{RemoteId: "test-remote", PortForwards: []*sstore.PortForwardType{{ForwardId: "fwd1"}}})
+	makeProc := func(fwdId string) *portForwardProc {
+		return &portForwardProc{Lock: &sync.Mutex{}, Fwd: sstore.PortForwardType{ForwardId: fwdId}, Conns: make(map[net.Conn]bool)}
+	}
+	proc1 := makeProc("fwd1")
+	msh.setPortForwardProc(nil, proc1)
+	if msh.PortForwardProcs["fwd1"] != proc1 || proc1.Closed {
+		t.Fatalf("forward should be recorded")
+	}
+	// removed while its listener was starting
+	proc2 := makeProc("fwd2")
+	msh.setPortForwardProc(nil, proc2)
+	if msh.PortForwardProcs["fwd2"] != nil || !proc2.Closed {
+		t.Errorf("removed forward should be closed, not recorded")
+	}
+	// reconnected (new client) while its listener was starting
+	msh.Client = &ssh.Client{}
+	proc3 := makeProc("fwd1")
+	msh.setPortForwardProc(nil, proc3)
+	if msh.PortForwardProcs["fwd1"] != proc1 || !proc3.Closed {
+		t.Errorf("forward started on an old client should be closed, not recorded")
+	}
+}
@@ -0,0 +1,330 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package remote
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/base"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/shexec"
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/scbus"
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/sstore"
+)
+
+const ReconnectBaseDelay = 1 * time.Second
+const ReconnectMaxDelay = 60 * time.Second
+const MaxReconnectAttempts = 10
+
+// exponential backoff: 1s, 2s, 4s, ... capped at ReconnectMaxDelay (attempt is 1-based)
+func getReconnectDelay(attempt int) time.Duration {
+	delay := ReconnectBaseDelay
+	for i := 1; i < attempt && delay < ReconnectMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > ReconnectMaxDelay {
+		delay = ReconnectMaxDelay
+	}
+	return delay
+}
+
+// true if tryAutoReconnect will run once the current connection is lost
+func (msh *MShellProc) willAutoReconnect_nolock() bool {
+	return !msh.DisconnectRequested && !msh.Remote.Archived && msh.Remote.ConnectMode != sstore.ConnectModeManual
+}
+
+func (msh *MShellProc) cancelReconnect() {
+	msh.Lock.Lock()
+	defer msh.Lock.Unlock()
+	msh.cancelReconnect_nolock()
+}
+
+func (msh *MShellProc) cancelReconnect_nolock() {
+	if msh.ReconnectCancelFn != nil {
+		msh.ReconnectCancelFn()
+		msh.ReconnectCancelFn = nil
+	}
+	msh.ReconnectAttempt = 0
+	msh.ReconnectTime = nil
+}
+
+// called when the connection is lost without the user disconnecting.  retries the connection with
+// exponential backoff until it succeeds, MaxReconnectAttempts is reached, or the user connects/disconnects.
+func (msh *MShellProc) tryAutoReconnect() {
+	var ctx context.Context
+	var cancelFn context.CancelFunc
+	shouldRun := false
+	msh.WithLock(func() {
+		if msh.ReconnectCancelFn != nil || !msh.willAutoReconnect_nolock() {
+			return
+		}
+		ctx, cancelFn = context.WithCancel(context.Background())
+		msh.ReconnectCancelFn = cancelFn
+		shouldRun = true
+	})
+	if !shouldRun {
+		return
+	}
+	defer func() {
+		msh.WithLock(func() {
+			// if canceled, cancelReconnect_nolock has already cleared the state (and a new reconnect may be running)
+			if ctx.Err() == nil {
+				msh.ReconnectCancelFn = nil
+				msh.ReconnectAttempt = 0
+				msh.ReconnectTime = nil
+			}
+		})
+		cancelFn()
+		go msh.NotifyRemoteUpdate()
+	}()
+	for attempt := 1; attempt <= MaxReconnectAttempts; attempt++ {
+		delay := getReconnectDelay(attempt)
+		reconnectTime := time.Now().Add(delay)
+		msh.WithLock(func() {
+			msh.ReconnectAttempt = attempt
+			msh.ReconnectTime = &reconnectTime
+		})
+		go msh.NotifyRemoteUpdate()
+		msh.WriteToPtyBuffer("*connection lost, reconnecting in %v (attempt %d/%d)\n", delay, attempt, MaxReconnectAttempts)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		status := msh.GetStatus()
+		if status == StatusConnected || status == StatusConnecting {
+			return
+		}
+		msh.WithLock(func() {
+			msh.ReconnectTime = nil
+		})
+		msh.launcher.Launch(msh, false)
+		if ctx.Err() != nil {
+			return
+		}
+		if msh.GetStatus() == StatusConnected {
+			msh.WriteToPtyBuffer("*reconnected to %s\n", msh.GetRemoteName())
+			return
+		}
+	}
+	msh.WriteToPtyBuffer("*could not reconnect after %d attempts, use /remote:connect to try again\n", MaxReconnectAttempts)
+	msh.hangupDetachedCmds()
+}
+
+// detached cmds are kept (not hung up) while an auto-reconnect is pending, called once it gives up
+func (msh *MShellProc) hangupDetachedCmds() {
+	screens, err := sstore.HangupDetachedCmdsByRemoteId(context.Background(), msh.RemoteId)
+	if err != nil {
+		msh.WriteToPtyBuffer("*error calling HUP on detached cmds %v\n", err)
+	}
+	msh.WithLock(func() {
+		msh.notifyHangups_nolock(false)
+	})
+	if len(screens) > 0 {
+		go sendScreenUpdates(screens)
+	}
+}
+
+// reattaches to detached commands that kept running on the remote while the connection was down,
+// output is read from the remote's command files starting at the end of our local copy
+func (msh *MShellProc) reattachDetachedCmds() {
+	if !msh.HasCapability(packet.Capability_CmdTail) {
+		// older waveshell, detached commands stay detached (as before)
+		return
+	}
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	cmdPtrs, err := sstore.GetDetachedCmdsByRemoteId(ctx, msh.RemoteId)
+	if err != nil {
+		msh.WriteToPtyBuffer("*error getting detached commands: %v\n", err)
+		return
+	}
+	for _, cmdPtr := range cmdPtrs {
+		ck := base.MakeCommandKey(cmdPtr.ScreenId, cmdPtr.LineId)
+		if msh.GetRunningCmd(ck) == nil {
+			// not kept from the lost connection (e.g. wavesrv was restarted), input and cmddone need a RunningCmds entry
+			err = msh.addDetachedRunningCmd(ctx, ck)
+			if err != nil {
+				msh.WriteToPtyBuffer("*error reattaching to %s: %v\n", ck, err)
+				continue
+			}
+		}
+		var ptyPos int64
+		stat, err := sstore.StatCmdPtyFile(ctx, cmdPtr.ScreenId, cmdPtr.LineId)
+		if err == nil {
+			ptyPos = stat.FileOffset + stat.DataSize
+		}
+		msh.WriteToPtyBuffer("reattaching to detached command %s (pos=%d)\n", ck, ptyPos)
+		go msh.tailDetachedCmd(ck, ptyPos)
+	}
+}
+
+func (msh *MShellProc) addDetachedRunningCmd(ctx context.Context, ck base.CommandKey) error {
+	cmd, err := sstore.GetCmdByScreenId(ctx, ck.GetGroupId(), ck.GetCmdId())
+	if err != nil {
+		return err
+	}
+	if cmd == nil {
+		return fmt.Errorf("cmd not found")
+	}
+	screen, err := sstore.GetScreenById(ctx, ck.GetGroupId())
+	if err != nil {
+		return err
+	}
+	if screen == nil {
+		return fmt.Errorf("screen not found")
+	}
+	runPacket := packet.MakeRunPacket()
+	runPacket.CK = ck
+	runPacket.Command = cmd.CmdStr
+	runPacket.UsePty = true
+	runPacket.Detached = true
+	runPacket.ReturnState = cmd.RtnState
+	msh.AddRunningCmd(RunCmdType{
+		SessionId: screen.SessionId,
+		ScreenId:  ck.GetGroupId(),
+		RemotePtr: cmd.Remote,
+		RunPacket: runPacket,
+	})
+	return nil
+}
+
+type detachedTail struct {
+	ServerProc *shexec.ClientProc
+	CancelFn   context.CancelFunc
+}
+
+// returns false if ck is already being tailed on the current connection
+func (msh *MShellProc) startDetachedTail(ck base.CommandKey, cancelFn context.CancelFunc) (*shexec.ClientProc, bool) {
+	msh.Lock.Lock()
+	defer msh.Lock.Unlock()
+	if msh.ServerProc == nil || msh.DetachedTails[ck].ServerProc == msh.ServerProc {
+		return nil, false
+	}
+	msh.DetachedTails[ck] = detachedTail{ServerProc: msh.ServerProc, CancelFn: cancelFn}
+	return msh.ServerProc, true
+}
+
+func (msh *MShellProc) endDetachedTail(ck base.CommandKey, serverProc *shexec.ClientProc) {
+	msh.Lock.Lock()
+	defer msh.Lock.Unlock()
+	if msh.DetachedTails[ck].ServerProc == serverProc {
+		delete(msh.DetachedTails, ck)
+	}
+}
+
+// rpc iterators do not return when the connection is lost, so tails on a lost server proc are canceled
+func (msh *MShellProc) cancelDetachedTails_nolock(serverProc *shexec.ClientProc) {
+	for ck, tail := range msh.DetachedTails {
+		if tail.ServerProc == serverProc {
+			tail.CancelFn()
+			delete(msh.DetachedTails, ck)
+		}
+	}
+}
+
+// runs until the command is done (a cmddone packet is found in its runout file) or the connection is lost
+func (msh *MShellProc) tailDetachedCmd(ck base.CommandKey, ptyPos int64) {
+	connCtx, connCancelFn := context.WithCancel(context.Background())
+	defer connCancelFn()
+	tailProc, ok := msh.startDetachedTail(ck, connCancelFn)
+	if !ok {
+		return
+	}
+	defer msh.endDetachedTail(ck, tailProc)
+	getPk := packet.MakeGetCmdPacket()
+	getPk.ReqId = uuid.New().String()
+	getPk.CK = ck
+	getPk.PtyPos = ptyPos
+	getPk.Tail = true
+	tailProc.Output.RegisterRpcSz(getPk.ReqId, RpcIterChannelSize)
+	iter := tailProc.Output.GetResponseIter(getPk.ReqId)
+	defer iter.Close()
+	err := tailProc.Input.SendPacketCtx(connCtx, getPk)
+	if err != nil {
+		msh.WriteToPtyBuffer("*error tailing %s: %v\n", ck, err)
+		return
+	}
+	// the runout file is a packet stream (written by the detached waveshell), parse it for the cmddone packet
+	tailCtx, tailCancelFn := context.WithCancel(connCtx)
+	defer tailCancelFn()
+	runOutReader, runOutWriter := io.Pipe()
+	defer runOutWriter.Close()
+	runOutParser := packet.MakePacketParser(runOutReader, nil)
+	doneCh := make(chan *packet.CmdDonePacketType, 1)
+	go func() {
+		for pk := range runOutParser.MainCh {
+			if donePk, ok := pk.(*packet.CmdDonePacketType); ok && len(doneCh) == 0 {
+				doneCh <- donePk
+				tailCancelFn()
+			}
+		}
+	}()
+	var donePk *packet.CmdDonePacketType
+	for donePk == nil {
+		respIf, err := iter.Next(tailCtx)
+		if connCtx.Err() != nil {
+			// connection lost, the command stays detached
+			return
+		}
+		if tailCtx.Err() != nil {
+			donePk = <-doneCh
+			break
+		}
+		if err != nil || respIf == nil {
+			return
+		}
+		if resp, ok := respIf.(*packet.ResponsePacketType); ok {
+			if resp.Error != "" {
+				msh.WriteToPtyBuffer("*error tailing %s: %s\n", ck, resp.Error)
+			}
+			return
+		}
+		dataPk, ok := respIf.(*packet.CmdDataPacketType)
+		if !ok {
+			log.Printf("invalid packet type tailing %s: %T\n", ck, respIf)
+			continue
+		}
+		err = msh.writeDetachedCmdData(ck, dataPk)
+		if err != nil {
+			msh.WriteToPtyBuffer("*error writing output for %s: %v\n", ck, err)
+		}
+		if dataPk.PtyDataLen > 0 {
+			go pushStatusIndicatorUpdate(&ck, sstore.StatusIndicatorLevel_Output)
+		}
+		if dataPk.RunDataLen > 0 {
+			runData, _ := base64.StdEncoding.DecodeString(dataPk.RunData64)
+			runOutWriter.Write(runData)
+		}
+	}
+	untailPk := packet.MakeUntailCmdPacket()
+	untailPk.ReqId = getPk.ReqId
+	untailPk.CK = ck
+	tailProc.Input.SendPacket(untailPk)
+	msh.handleCmdDonePacket(donePk)
+}
+
+func (msh *MShellProc) writeDetachedCmdData(ck base.CommandKey, dataPk *packet.CmdDataPacketType) error {
+	if dataPk.PtyDataLen == 0 {
+		return nil
+	}
+	ptyData, err := base64.StdEncoding.DecodeString(dataPk.PtyData64)
+	if err != nil {
+		return fmt.Errorf("invalid pty data: %w", err)
+	}
+	update, err := sstore.AppendToCmdPtyBlob(context.Background(), ck.GetGroupId(), ck.GetCmdId(), ptyData, dataPk.PtyPos)
+	if err != nil {
+		return err
+	}
+	if update != nil {
+		scbus.MainUpdateBus.DoScreenUpdate(ck.GetGroupId(), update)
+	}
+	return nil
+}
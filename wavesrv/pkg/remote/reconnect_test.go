@@ -0,0 +1,328 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/base"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/shexec"
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/scbase"
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/sstore"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestReconnectDelay(t *testing.T) {
+	expected := []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second, 60 * time.Second, 60 * time.Second}
+	for idx, delay := range expected {
+		if rtn := getReconnectDelay(idx + 1); rtn != delay {
+			t.Errorf("reconnect delay attempt %d => %v, expected %v", idx+1, rtn, delay)
+		}
+	}
+}
+
+// tcp proxy to addr that silently drops server->client data once frozen is set (simulates a dead link)
+func startTestFreezeProxy(t *testing.T, addr string, frozen *atomic.Bool) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			serverConn, err := net.Dial("tcp", addr)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			go func() {
+				buf := make([]byte, 4096)
+				for {
+					n, err := serverConn.Read(buf)
+					if err != nil {
+						conn.Close()
+						return
+					}
+					if !frozen.Load() {
+						conn.Write(buf[:n])
+					}
+				}
+			}()
+			go func() {
+				buf := make([]byte, 4096)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						serverConn.Close()
+						return
+					}
+					serverConn.Write(buf[:n])
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestSshKeepalive(t *testing.T) {
+	privKey, pubKey := makeTestKey(t)
+	keyring := agent.NewKeyring()
+	keyring.Add(agent.AddedKey{PrivateKey: privKey})
+	signers, _ := keyring.Signers()
+	var frozen atomic.Bool
+	proxyAddr := startTestFreezeProxy(t, startTestSshServer(t, pubKey), &frozen)
+	client, err := ssh.Dial("tcp", proxyAddr, &ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+	defer client.Close()
+	interval := 50 * time.Millisecond
+	go runSshKeepalive(client, interval, 3, "test")
+	closedCh := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(closedCh)
+	}()
+
+	// a live link stays open
+	select {
+	case <-closedCh:
+		t.Fatalf("keepalive closed a live connection")
+	case <-time.After(10 * interval):
+	}
+
+	// a dead link is closed after countMax missed replies
+	frozen.Store(true)
+	select {
+	case <-closedCh:
+	case <-time.After(20 * interval):
+		t.Fatalf("keepalive did not close a dead connection")
+	}
+}
+
+func setupTestDB(t *testing.T) context.Context {
+	t.Setenv(scbase.WaveHomeVarName, t.TempDir())
+	sstore.CloseDB()
+	t.Cleanup(sstore.CloseDB)
+	err := sstore.TryMigrateUp()
+	if err != nil {
+		t.Fatalf("error migrating test db: %v", err)
+	}
+	ctx := context.Background()
+	_, err = sstore.EnsureClientData(ctx)
+	if err != nil {
+		t.Fatalf("error creating client data: %v", err)
+	}
+	err = sstore.EnsureLocalRemote(ctx)
+	if err != nil {
+		t.Fatalf("error creating local remote: %v", err)
+	}
+	return ctx
+}
+
+// the waveshell server side of a fake connection (ServerProc is what wavesrv sees)
+type testServerConn struct {
+	ServerProc *shexec.ClientProc
+	FromClient *packet.PacketParser
+	ToClient   *packet.PacketSender
+	toClientW  *io.PipeWriter
+}
+
+func makeTestServerConn(capabilities ...string) *testServerConn {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	initPk := packet.MakeInitPacket()
+	initPk.Capabilities = capabilities
+	serverProc := &shexec.ClientProc{
+		InitPk:  initPk,
+		StartTs: time.Now(),
+		Input:   packet.MakePacketSender(inW, nil),
+		Output:  packet.MakePacketParser(outR, &packet.PacketParserOpts{RpcHandler: true}),
+	}
+	return &testServerConn{
+		ServerProc: serverProc,
+		FromClient: packet.MakePacketParser(inR, nil),
+		ToClient:   packet.MakePacketSender(outW, nil),
+		toClientW:  outW,
+	}
+}
+
+// simulates the transport dying
+func (conn *testServerConn) Drop() {
+	conn.ToClient.Close()
+	conn.ToClient.WaitForDone()
+	conn.toClientW.Close()
+}
+
+func (conn *testServerConn) nextPacket(t *testing.T) packet.PacketType {
+	select {
+	case pk := <-conn.FromClient.MainCh:
+		return pk
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for packet from wavesrv")
+		return nil
+	}
+}
+
+// connects msh to conn, returns a channel that is closed when ProcessPackets returns
+func connectTestServer(msh *MShellProc, conn *testServerConn) chan bool {
+	msh.WithLock(func() {
+		msh.ServerProc = conn.ServerProc
+		msh.Status = StatusConnected
+	})
+	doneCh := make(chan bool)
+	go func() {
+		defer close(doneCh)
+		msh.ProcessPackets()
+	}()
+	return doneCh
+}
+
+func makeTestCmdDataPacket(getPk *packet.GetCmdPacketType, ptyPos int64, ptyData string, runData []byte) *packet.CmdDataPacketType {
+	dataPk := packet.MakeCmdDataPacket(getPk.ReqId)
+	dataPk.CK = getPk.CK
+	dataPk.PtyPos = ptyPos
+	dataPk.PtyData64 = base64.StdEncoding.EncodeToString([]byte(ptyData))
+	dataPk.PtyDataLen = len(ptyData)
+	dataPk.RunData64 = base64.StdEncoding.EncodeToString(runData)
+	dataPk.RunDataLen = len(runData)
+	return dataPk
+}
+
+func waitForCondition(t *testing.T, desc string, fn func() bool) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if fn() {
+			return
+		}
+	}
+	t.Fatalf("timeout waiting for %s", desc)
+}
+
+func TestDetachedCmdReattach(t *testing.T) {
+	ctx := setupTestDB(t)
+	localRemote, err := sstore.GetLocalRemote(ctx)
+	if err != nil || localRemote == nil {
+		t.Fatalf("error getting local remote: %v", err)
+	}
+	localRemote.ConnectMode = sstore.ConnectModeAuto
+	msh := MakeMShell(localRemote)
+	_, err = sstore.InsertSessionWithName(ctx, "detached", true)
+	if err != nil {
+		t.Fatalf("error creating session: %v", err)
+	}
+	sessions, _ := sstore.GetAllSessions(ctx)
+	screens, err := sstore.GetSessionScreens(ctx, sessions[0].SessionId)
+	if err != nil || len(screens) == 0 {
+		t.Fatalf("error getting screens: %v", err)
+	}
+	screenId := screens[0].ScreenId
+	clientData, _ := sstore.EnsureClientData(ctx)
+	remotePtr := sstore.RemotePtrType{RemoteId: localRemote.RemoteId}
+	cmd := &sstore.CmdType{
+		ScreenId: screenId,
+		LineId:   uuid.New().String(),
+		CmdStr:   "sleep 10",
+		Remote:   remotePtr,
+		TermOpts: sstore.TermOpts{Rows: 25, Cols: 80, MaxPtySize: DefaultMaxPtySize},
+		Status:   sstore.CmdStatusDetached,
+	}
+	_, err = sstore.AddCmdLine(ctx, screenId, clientData.UserId, cmd, "", nil)
+	if err != nil {
+		t.Fatalf("error adding cmd line: %v", err)
+	}
+	err = sstore.CreateCmdPtyFile(ctx, screenId, cmd.LineId, DefaultMaxPtySize)
+	if err != nil {
+		t.Fatalf("error creating pty file: %v", err)
+	}
+	ck := base.MakeCommandKey(screenId, cmd.LineId)
+	runPk := packet.MakeRunPacket()
+	runPk.CK = ck
+	runPk.Detached = true
+	msh.AddRunningCmd(RunCmdType{SessionId: sessions[0].SessionId, ScreenId: screenId, RemotePtr: remotePtr, RunPacket: runPk})
+	checkPtyOut := func(expected string) func() bool {
+		return func() bool {
+			_, data, _ := sstore.ReadFullPtyOutFile(ctx, screenId, cmd.LineId)
+			return string(data) == expected
+		}
+	}
+
+	// tailed from the start (as in the RunCommand callback)
+	conn1 := makeTestServerConn(packet.Capability_CmdTail)
+	processDoneCh := connectTestServer(msh, conn1)
+	go msh.tailDetachedCmd(ck, 0)
+	getPk, ok := conn1.nextPacket(t).(*packet.GetCmdPacketType)
+	if !ok || getPk.CK != ck || !getPk.Tail || getPk.PtyPos != 0 {
+		t.Fatalf("bad getcmd packet: %#v", getPk)
+	}
+	conn1.ToClient.SendPacket(makeTestCmdDataPacket(getPk, 0, "hello\n", nil))
+	waitForCondition(t, "first output", checkPtyOut("hello\n"))
+
+	// transport lost, an auto-reconnect is pending so the cmd stays detached
+	conn1.Drop()
+	select {
+	case <-processDoneCh:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ProcessPackets did not return after the transport was dropped")
+	}
+	waitForCondition(t, "tail to stop", func() bool {
+		var numTails int
+		msh.WithLock(func() { numTails = len(msh.DetachedTails) })
+		return numTails == 0
+	})
+	dbCmd, err := sstore.GetCmdByScreenId(ctx, screenId, cmd.LineId)
+	if err != nil || dbCmd.Status != sstore.CmdStatusDetached {
+		t.Fatalf("cmd should still be detached after the transport was lost: %v %v", dbCmd, err)
+	}
+	if msh.GetRunningCmd(ck) == nil {
+		t.Fatalf("detached cmd should be kept in RunningCmds")
+	}
+
+	// reconnected, tailed again from the end of our local output
+	conn2 := makeTestServerConn(packet.Capability_CmdTail)
+	connectTestServer(msh, conn2)
+	defer conn2.Drop()
+	go msh.reattachDetachedCmds()
+	getPk, ok = conn2.nextPacket(t).(*packet.GetCmdPacketType)
+	if !ok || getPk.CK != ck || !getPk.Tail || getPk.PtyPos != int64(len("hello\n")) {
+		t.Fatalf("bad getcmd packet after reconnect: %#v", getPk)
+	}
+	var runOut bytes.Buffer
+	runOutSender := packet.MakePacketSender(&runOut, nil)
+	donePk := packet.MakeCmdDonePacket(ck)
+	donePk.ExitCode = 3
+	runOutSender.SendPacket(donePk)
+	runOutSender.Close()
+	runOutSender.WaitForDone()
+	conn2.ToClient.SendPacket(makeTestCmdDataPacket(getPk, getPk.PtyPos, "world\n", runOut.Bytes()))
+	untailPk, ok := conn2.nextPacket(t).(*packet.UntailCmdPacketType)
+	if !ok || untailPk.CK != ck || untailPk.ReqId != getPk.ReqId {
+		t.Fatalf("expected untail after cmddone, got %#v", untailPk)
+	}
+	waitForCondition(t, "cmd done", func() bool {
+		dbCmd, _ := sstore.GetCmdByScreenId(ctx, screenId, cmd.LineId)
+		return dbCmd != nil && dbCmd.Status == sstore.CmdStatusDone && dbCmd.ExitCode == 3
+	})
+	waitForCondition(t, "all output", checkPtyOut("hello\nworld\n"))
+	waitForCondition(t, "cmd removed from RunningCmds", func() bool {
+		return msh.GetRunningCmd(ck) == nil
+	})
+}
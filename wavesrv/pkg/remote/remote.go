@@ -117,6 +117,11 @@ func init() {
 
 var GlobalStore *Store
 
+// the client's cmd output read window (ClientOpts.ReadWindow), cached so RunCommand does not
+// read the client data for every command.  set at startup and by /client:set
+var readWindowLock = &sync.Mutex{}
+var readWindow int64
+
 type Store struct {
 	Lock       *sync.Mutex
 	Map        map[string]*MShellProc // key=remoteid
@@ -161,9 +166,21 @@ type MShellProc struct {
 	InstallErr         error
 
 	RunningCmds      map[base.CommandKey]RunCmdType
+	CmdDoneChs       map[base.CommandKey]chan bool       // closed when the cmd is removed from RunningCmds (see WaitForCmdDone)
+	DetachedTails    map[base.CommandKey]detachedTail    // detached cmds being tailed (see tailDetachedCmd)
 	PendingStateCmds map[pendingStateKey]base.CommandKey // key=[remoteinstance name]
 	launcher         Launcher                            // for conditional launch method based on ssh library in use. remove once ssh library is stabilized
 	Client           *ssh.Client
+	PortForwardProcs map[string]*portForwardProc // key=forwardid
+
+	// serializes port forward definition changes (held across the db write, Lock is not)
+	PortForwardUpdateLock *sync.Mutex
+
+	// auto-reconnect (set when the connection is lost without a user disconnect)
+	DisconnectRequested bool
+	ReconnectCancelFn   context.CancelFunc
+	ReconnectAttempt    int
+	ReconnectTime       *time.Time
 }
 
 type RunCmdType struct {
@@ -187,6 +204,10 @@ func CanComplete(remoteType string) bool {
 // for conditional launch method based on ssh library in use
 // remove once ssh library is stabilized
 func (msh *MShellProc) Launch(interactive bool) {
+	msh.WithLock(func() {
+		msh.cancelReconnect_nolock()
+		msh.DisconnectRequested = false
+	})
 	msh.launcher.Launch(msh, interactive)
 }
 
@@ -240,6 +261,18 @@ func (msh *MShellProc) GetInstallStatus() string {
 	return msh.InstallStatus
 }
 
+func SetReadWindow(window int64) {
+	readWindowLock.Lock()
+	defer readWindowLock.Unlock()
+	readWindow = window
+}
+
+func GetReadWindow() int64 {
+	readWindowLock.Lock()
+	defer readWindowLock.Unlock()
+	return readWindow
+}
+
 func LoadRemotes(ctx context.Context) error {
 	GlobalStore = &Store{
 		Lock:       &sync.Mutex{},
@@ -578,6 +611,17 @@ func (msh *MShellProc) GetRemoteRuntimeState() RemoteRuntimeState {
 	if msh.Remote.SSHOpts != nil {
 		state.AuthType = msh.Remote.SSHOpts.GetAuthType()
 	}
+	state.PortForwards = msh.getPortForwardStates_nolock()
+	if msh.ReconnectCancelFn != nil {
+		state.Reconnecting = true
+		state.ReconnectAttempt = msh.ReconnectAttempt
+		if msh.ReconnectTime != nil {
+			state.ReconnectTimeout = int(time.Until(*msh.ReconnectTime) / time.Second)
+			if state.ReconnectTimeout < 0 {
+				state.ReconnectTimeout = 0
+			}
+		}
+	}
 	if msh.Remote.RemoteOpts != nil {
 		optsCopy := *msh.Remote.RemoteOpts
 		state.RemoteOpts = &optsCopy
@@ -635,6 +679,7 @@ func (msh *MShellProc) GetRemoteRuntimeState() RemoteRuntimeState {
 		} else {
 			state.MShellVersion = fmt.Sprintf("%s+%s", initPk.Version, initPk.BuildTime)
 		}
+		state.MShellCapabilities = initPk.Capabilities
 		vars["home"] = initPk.HomeDir
 		vars["remoteuser"] = initPk.User
 		vars["bestuser"] = vars["remoteuser"]
@@ -698,17 +743,21 @@ func MakeMShell(r *sstore.RemoteType) *MShellProc {
 		panic(err) // this should never happen (NewBuffer only returns an error if CirBufSize <= 0)
 	}
 	rtn := &MShellProc{
-		Lock:             &sync.Mutex{},
-		Remote:           r,
-		RemoteId:         r.RemoteId,
-		Status:           StatusDisconnected,
-		PtyBuffer:        buf,
-		InstallStatus:    StatusDisconnected,
-		RunningCmds:      make(map[base.CommandKey]RunCmdType),
-		PendingStateCmds: make(map[pendingStateKey]base.CommandKey),
-		StateMap:         server.MakeShellStateMap(),
-		launcher:         LegacyLauncher{}, // for conditional launch method based on ssh library in use. remove once ssh library is stabilized
-		DataPosMap:       utilfn.MakeSyncMap[base.CommandKey, int64](),
+		Lock:                  &sync.Mutex{},
+		Remote:                r,
+		RemoteId:              r.RemoteId,
+		Status:                StatusDisconnected,
+		PtyBuffer:             buf,
+		InstallStatus:         StatusDisconnected,
+		RunningCmds:           make(map[base.CommandKey]RunCmdType),
+		CmdDoneChs:            make(map[base.CommandKey]chan bool),
+		DetachedTails:         make(map[base.CommandKey]detachedTail),
+		PendingStateCmds:      make(map[pendingStateKey]base.CommandKey),
+		PortForwardProcs:      make(map[string]*portForwardProc),
+		PortForwardUpdateLock: &sync.Mutex{},
+		StateMap:              server.MakeShellStateMap(),
+		launcher:              LegacyLauncher{}, // for conditional launch method based on ssh library in use. remove once ssh library is stabilized
+		DataPosMap:            utilfn.MakeSyncMap[base.CommandKey, int64](),
 	}
 	// for conditional launch method based on ssh library in use
 	// remove once ssh library is stabilized
@@ -788,11 +837,12 @@ func convertSSHOpts(opts *sstore.SSHOpts) shexec.SSHOpts {
 		opts = &sstore.SSHOpts{}
 	}
 	return shexec.SSHOpts{
-		SSHHost:     opts.SSHHost,
-		SSHOptsStr:  opts.SSHOptsStr,
-		SSHIdentity: opts.SSHIdentity,
-		SSHUser:     opts.SSHUser,
-		SSHPort:     opts.SSHPort,
+		SSHHost:      opts.SSHHost,
+		SSHOptsStr:   opts.SSHOptsStr,
+		SSHIdentity:  opts.SSHIdentity,
+		SSHUser:      opts.SSHUser,
+		SSHPort:      opts.SSHPort,
+		SSHProxyJump: opts.SSHProxyJump,
 	}
 }
 
@@ -879,6 +929,9 @@ func (msh *MShellProc) Disconnect(force bool) {
 	}
 	msh.Lock.Lock()
 	defer msh.Lock.Unlock()
+	msh.DisconnectRequested = true
+	msh.cancelReconnect_nolock()
+	msh.stopPortForwards_nolock()
 	if msh.ServerProc != nil {
 		msh.ServerProc.Close()
 		msh.Client = nil
@@ -1376,9 +1429,12 @@ func (msh *MShellProc) ReInit(ctx context.Context, shellType string) (*packet.Sh
 	if !msh.IsConnected() {
 		return nil, fmt.Errorf("cannot reinit, remote is not connected")
 	}
-	if shellType != packet.ShellType_bash && shellType != packet.ShellType_zsh {
+	if !packet.IsValidShellType(shellType) {
 		return nil, fmt.Errorf("invalid shell type %q", shellType)
 	}
+	if shellType == packet.ShellType_fish && !msh.HasCapability(packet.Capability_Fish) {
+		return nil, fmt.Errorf("remote waveshell does not support the fish shell (upgrade waveshell)")
+	}
 	reinitPk := packet.MakeReInitPacket()
 	reinitPk.ReqId = uuid.New().String()
 	reinitPk.ShellType = shellType
@@ -1421,6 +1477,15 @@ func (msh *MShellProc) StreamFile(ctx context.Context, streamPk *packet.StreamFi
 	return msh.PacketRpcIter(ctx, streamPk)
 }
 
+// stops a Follow streamfile request, the iterator will receive a final Eof packet
+func (msh *MShellProc) UnfollowFile(reqId string) error {
+	serverProc := msh.getConnectedServerProc()
+	if serverProc == nil {
+		return fmt.Errorf("remote is not connected")
+	}
+	return serverProc.Input.SendPacket(packet.MakeUnfollowFilePacket(reqId))
+}
+
 func addScVarsToState(state *packet.ShellState) *packet.ShellState {
 	if state == nil {
 		return nil
@@ -1489,7 +1554,12 @@ func (msh *MShellProc) createWaveshellSession(remoteCopy sstore.RemoteType) (she
 		msh.MakeClientDeadline = nil
 		go msh.NotifyRemoteUpdate()
 	})
-	sapi, err := shellapi.MakeShellApi(msh.GetShellType())
+	// the waveshell launch command is posix sh, so fish remotes are launched through bash
+	launchShellType := msh.GetShellType()
+	if launchShellType == packet.ShellType_fish {
+		launchShellType = packet.ShellType_bash
+	}
+	sapi, err := shellapi.MakeShellApi(launchShellType)
 	if err != nil {
 		return nil, err
 	}
@@ -1634,16 +1704,31 @@ func (NewLauncher) Launch(msh *MShellProc, interactive bool) {
 	go func() {
 		exitErr := cproc.Cmd.Wait()
 		exitCode := shexec.GetExitCode(exitErr)
+		shouldReconnect := false
 		msh.WithLock(func() {
+			msh.stopPortForwards_nolock()
 			if msh.Status == StatusConnected || msh.Status == StatusConnecting {
 				msh.Status = StatusDisconnected
 				go msh.NotifyRemoteUpdate()
 			}
+			if msh.ServerProc == cproc && !msh.DisconnectRequested {
+				// transport died (e.g. keepalive timeout), drop the client so we dial a new one
+				shouldReconnect = true
+				if msh.Client != nil {
+					msh.Client.Close()
+					msh.Client = nil
+				}
+			}
 		})
 		msh.WriteToPtyBuffer("*disconnected exitcode=%d\n", exitCode)
+		if shouldReconnect {
+			go msh.tryAutoReconnect()
+		}
 	}()
 	go msh.ProcessPackets()
 	msh.initActiveShells()
+	msh.startPortForwards()
+	go msh.reattachDetachedCmds()
 	go msh.NotifyRemoteUpdate()
 }
 
@@ -1810,6 +1895,27 @@ func (msh *MShellProc) IsConnected() bool {
 	return msh.Status == StatusConnected
 }
 
+// returns nil if not connected.  ServerProc is replaced on reconnect, so read it under the lock
+func (msh *MShellProc) getConnectedServerProc() *shexec.ClientProc {
+	msh.Lock.Lock()
+	defer msh.Lock.Unlock()
+	if msh.Status != StatusConnected {
+		return nil
+	}
+	return msh.ServerProc
+}
+
+// checks the capabilities advertised by the connected waveshell (older versions advertise none).
+// use before sending newer packet types, so older waveshells degrade gracefully.
+func (msh *MShellProc) HasCapability(capability string) bool {
+	msh.Lock.Lock()
+	defer msh.Lock.Unlock()
+	if msh.ServerProc == nil || msh.ServerProc.InitPk == nil {
+		return false
+	}
+	return msh.ServerProc.InitPk.HasCapability(capability)
+}
+
 func (msh *MShellProc) GetShellType() string {
 	msh.Lock.Lock()
 	defer msh.Lock.Unlock()
@@ -1846,6 +1952,14 @@ func (msh *MShellProc) SendInput(dataPk *packet.DataPacketType) error {
 	return msh.ServerProc.Input.SendPacket(dataPk)
 }
 
+func (msh *MShellProc) SendFileDataAck(ackPk *packet.FileDataAckPacketType) error {
+	serverProc := msh.getConnectedServerProc()
+	if serverProc == nil {
+		return fmt.Errorf("remote is not connected, cannot send ack")
+	}
+	return serverProc.Input.SendPacket(ackPk)
+}
+
 func (msh *MShellProc) KillRunningCommandAndWait(ctx context.Context, ck base.CommandKey) error {
 	if !msh.IsCmdRunning(ck) {
 		return nil
@@ -1870,6 +1984,44 @@ func (msh *MShellProc) KillRunningCommandAndWait(ctx context.Context, ck base.Co
 	}
 }
 
+// returns nil if ck is not running
+func (msh *MShellProc) getCmdDoneCh(ck base.CommandKey) chan bool {
+	msh.Lock.Lock()
+	defer msh.Lock.Unlock()
+	if _, ok := msh.RunningCmds[ck]; !ok {
+		return nil
+	}
+	doneCh := msh.CmdDoneChs[ck]
+	if doneCh == nil {
+		doneCh = make(chan bool)
+		msh.CmdDoneChs[ck] = doneCh
+	}
+	return doneCh
+}
+
+func (msh *MShellProc) notifyCmdDone_nolock(ck base.CommandKey) {
+	doneCh := msh.CmdDoneChs[ck]
+	if doneCh == nil {
+		return
+	}
+	close(doneCh)
+	delete(msh.CmdDoneChs, ck)
+}
+
+// waits until ck is no longer running (cmddone/cmdfinal processed, or the remote disconnected)
+func (msh *MShellProc) WaitForCmdDone(ctx context.Context, ck base.CommandKey) error {
+	doneCh := msh.getCmdDoneCh(ck)
+	if doneCh == nil {
+		return nil
+	}
+	select {
+	case <-doneCh:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (msh *MShellProc) SendSpecialInput(siPk *packet.SpecialInputPacketType) error {
 	if !msh.IsConnected() {
 		return fmt.Errorf("remote is not connected, cannot send input")
@@ -1931,6 +2083,9 @@ type RunCommandOpts struct {
 
 	// set to true to skip creating the pty file (for restarted commands)
 	NoCreateCmdPtyFile bool
+
+	// optional, shell type to use when there is no remote-instance state (defaults to GetShellPref())
+	ShellType string
 }
 
 // returns (CmdType, allow-updates-callback, err)
@@ -1957,6 +2112,10 @@ func RunCommand(ctx context.Context, rcOpts RunCommandOpts, runPacket *packet.Ru
 	if rcOpts.StatePtr != nil && runPacket.ReturnState {
 		return nil, nil, fmt.Errorf("RunCommand: cannot use ReturnState with StatePtr")
 	}
+	if runPacket.ReadWindow == 0 {
+		// older waveshells ignore the window (and use their fixed buffer size)
+		runPacket.ReadWindow = int(GetReadWindow())
+	}
 
 	// pending state command logic
 	// if we are currently running a command that can change the state, we need to wait for it to finish
@@ -1999,11 +2158,15 @@ func RunCommand(ctx context.Context, rcOpts RunCommandOpts, runPacket *packet.Ru
 		}
 	}
 	if statePtr == nil { // can be null if there is no remote-instance (screen has unchanged state from default)
-		err := msh.EnsureShellType(ctx, msh.GetShellPref()) // make sure shellType is initialized
+		shellType := rcOpts.ShellType
+		if shellType == "" {
+			shellType = msh.GetShellPref()
+		}
+		err := msh.EnsureShellType(ctx, shellType) // make sure shellType is initialized
 		if err != nil {
 			return nil, nil, err
 		}
-		statePtr = msh.GetDefaultStatePtr(msh.GetShellPref())
+		statePtr = msh.GetDefaultStatePtr(shellType)
 		if statePtr == nil {
 			return nil, nil, fmt.Errorf("cannot run command, no valid connection stateptr")
 		}
@@ -2015,6 +2178,10 @@ func RunCommand(ctx context.Context, rcOpts RunCommandOpts, runPacket *packet.Ru
 	runPacket.State = addScVarsToState(currentState)
 	runPacket.StateComplete = true
 	runPacket.ShellType = currentState.GetShellType()
+	if runPacket.UsePty && len(runPacket.Fds) == 0 && msh.HasCapability(packet.Capability_CmdTail) {
+		// detached commands keep running when the connection is lost, their output is tailed (see reconnect.go)
+		runPacket.Detached = true
+	}
 	err = msh.EnsureShellType(ctx, runPacket.ShellType) // make sure shellType is initialized
 	if err != nil {
 		return nil, nil, err
@@ -2090,7 +2257,13 @@ func RunCommand(ctx context.Context, rcOpts RunCommandOpts, runPacket *packet.Ru
 		RunPacket: runPacket,
 	})
 
-	return cmd, func() { removeCmdWait(runPacket.CK) }, nil
+	callback := func() {
+		removeCmdWait(runPacket.CK)
+		if runPacket.Detached {
+			go msh.tailDetachedCmd(runPacket.CK, 0)
+		}
+	}
+	return cmd, callback, nil
 }
 
 func (msh *MShellProc) AddRunningCmd(rct RunCmdType) {
@@ -2113,6 +2286,7 @@ func (msh *MShellProc) RemoveRunningCmd(ck base.CommandKey) {
 	msh.Lock.Lock()
 	defer msh.Lock.Unlock()
 	delete(msh.RunningCmds, ck)
+	msh.notifyCmdDone_nolock(ck)
 	for key, pendingCk := range msh.PendingStateCmds {
 		if pendingCk == ck {
 			delete(msh.PendingStateCmds, key)
@@ -2185,8 +2359,19 @@ func makeDataAckPacket(ck base.CommandKey, fdNum int, ackLen int, err error) *pa
 	return ack
 }
 
-func (msh *MShellProc) notifyHangups_nolock() {
-	for ck := range msh.RunningCmds {
+// keepDetached keeps the detached cmds in RunningCmds (their state is needed when they are reattached)
+func (msh *MShellProc) notifyHangups_nolock(keepDetached bool) {
+	for ck, rct := range msh.RunningCmds {
+		if keepDetached && rct.RunPacket.Detached {
+			continue
+		}
+		delete(msh.RunningCmds, ck)
+		for key, pendingCk := range msh.PendingStateCmds {
+			if pendingCk == ck {
+				delete(msh.PendingStateCmds, key)
+			}
+		}
+		msh.notifyCmdDone_nolock(ck)
 		cmd, err := sstore.GetCmdByScreenId(context.Background(), ck.GetGroupId(), ck.GetCmdId())
 		if err != nil {
 			continue
@@ -2196,8 +2381,9 @@ func (msh *MShellProc) notifyHangups_nolock() {
 		scbus.MainUpdateBus.DoScreenUpdate(ck.GetGroupId(), update)
 		go pushNumRunningCmdsUpdate(&ck, -1)
 	}
-	msh.RunningCmds = make(map[base.CommandKey]RunCmdType)
-	msh.PendingStateCmds = make(map[pendingStateKey]base.CommandKey)
+	if !keepDetached {
+		msh.PendingStateCmds = make(map[pendingStateKey]base.CommandKey)
+	}
 }
 
 func (msh *MShellProc) handleCmdDonePacket(donePk *packet.CmdDonePacketType) {
@@ -2373,15 +2559,29 @@ func sendScreenUpdates(screens []*sstore.ScreenType) {
 }
 
 func (msh *MShellProc) ProcessPackets() {
+	var serverProc *shexec.ClientProc
+	msh.WithLock(func() {
+		serverProc = msh.ServerProc
+	})
 	defer msh.WithLock(func() {
 		if msh.Status == StatusConnected {
 			msh.Status = StatusDisconnected
 		}
+		msh.cancelDetachedTails_nolock(serverProc)
 		screens, err := sstore.HangupRunningCmdsByRemoteId(context.Background(), msh.Remote.RemoteId)
 		if err != nil {
 			msh.writeToPtyBuffer_nolock("error calling HUP on cmds %v\n", err)
 		}
-		msh.notifyHangups_nolock()
+		// detached cmds keep running on the remote, they are tailed again once auto-reconnect succeeds
+		keepDetached := msh.willAutoReconnect_nolock()
+		if !keepDetached {
+			detachedScreens, err := sstore.HangupDetachedCmdsByRemoteId(context.Background(), msh.Remote.RemoteId)
+			if err != nil {
+				msh.writeToPtyBuffer_nolock("error calling HUP on detached cmds %v\n", err)
+			}
+			screens = append(screens, detachedScreens...)
+		}
+		msh.notifyHangups_nolock(keepDetached)
 		go msh.NotifyRemoteUpdate()
 		if len(screens) > 0 {
 			go sendScreenUpdates(screens)
@@ -0,0 +1,67 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package remote
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/wavetermdev/waveterm/waveshell/pkg/base"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/packet"
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/sstore"
+)
+
+func addTestRunningCmd(msh *MShellProc, ck base.CommandKey) {
+	runPk := packet.MakeRunPacket()
+	runPk.CK = ck
+	msh.AddRunningCmd(RunCmdType{RunPacket: runPk})
+}
+
+func TestWaitForCmdDone(t *testing.T) {
+	msh := MakeMShell(&sstore.RemoteType{RemoteId: "test-remote"})
+	ck := base.MakeCommandKey("screen", "line1")
+	err := msh.WaitForCmdDone(context.Background(), ck)
+	if err != nil {
+		t.Fatalf("waiting for a cmd that is not running: %v", err)
+	}
+	addTestRunningCmd(msh, ck)
+	waitCh := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			waitCh <- msh.WaitForCmdDone(context.Background(), ck)
+		}()
+	}
+	select {
+	case err := <-waitCh:
+		t.Fatalf("wait returned while the cmd was running: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	msh.RemoveRunningCmd(ck)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-waitCh:
+			if err != nil {
+				t.Errorf("wait error: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("wait did not return after the cmd was removed")
+		}
+	}
+	if len(msh.CmdDoneChs) != 0 {
+		t.Errorf("done channel not cleaned up: %v", msh.CmdDoneChs)
+	}
+}
+
+func TestWaitForCmdDoneCancel(t *testing.T) {
+	msh := MakeMShell(&sstore.RemoteType{RemoteId: "test-remote"})
+	ck := base.MakeCommandKey("screen", "line1")
+	addTestRunningCmd(msh, ck)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancelFn()
+	err := msh.WaitForCmdDone(ctx, ck)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+}
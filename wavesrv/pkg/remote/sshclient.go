@@ -10,12 +10,15 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"net"
 	"os"
 	"os/user"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -27,6 +30,7 @@ import (
 	"github.com/wavetermdev/waveterm/wavesrv/pkg/sstore"
 	"github.com/wavetermdev/waveterm/wavesrv/pkg/userinput"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/crypto/ssh/knownhosts"
 )
 
@@ -54,6 +58,57 @@ func createDummySigner() ([]ssh.Signer, error) {
 
 }
 
+// returns the public keys for the identity files (used to match agent keys).
+// the public key comes from the unencrypted private key or from the identity file's .pub file
+func getIdentityPublicKeys(identityFiles []string, existingKeys map[string][]byte) map[string]string {
+	rtn := make(map[string]string)
+	for _, identityFile := range identityFiles {
+		var pubKey ssh.PublicKey
+		signer, err := ssh.ParsePrivateKey(existingKeys[identityFile])
+		if err == nil {
+			pubKey = signer.PublicKey()
+		} else {
+			pubKeyBytes, err := os.ReadFile(base.ExpandHomeDir(identityFile) + ".pub")
+			if err != nil {
+				continue
+			}
+			pubKey, _, _, _, err = ssh.ParseAuthorizedKey(pubKeyBytes)
+			if err != nil {
+				continue
+			}
+		}
+		rtn[identityFile] = string(pubKey.Marshal())
+	}
+	return rtn
+}
+
+// returns the agent's signers to try, in agent order.  with IdentitiesOnly, only agent keys that
+// match one of the configured identity files are used (like openssh).
+func getAgentSigners(sshKeywords *SshKeywords, agentClient agent.Agent, identityPubKeys map[string]string) []ssh.Signer {
+	if agentClient == nil {
+		return nil
+	}
+	signers, err := agentClient.Signers()
+	if err != nil {
+		log.Printf("error getting signers from ssh-agent: %v\n", err)
+		return nil
+	}
+	if !sshKeywords.IdentitiesOnly {
+		return signers
+	}
+	identityKeySet := make(map[string]bool)
+	for _, pubKey := range identityPubKeys {
+		identityKeySet[pubKey] = true
+	}
+	var rtn []ssh.Signer
+	for _, signer := range signers {
+		if identityKeySet[string(signer.PublicKey().Marshal())] {
+			rtn = append(rtn, signer)
+		}
+	}
+	return rtn
+}
+
 // This is a workaround to only process one identity file at a time,
 // even if they have passphrases. It must be combined with retryable
 // authentication to work properly
@@ -65,7 +120,13 @@ func createDummySigner() ([]ssh.Signer, error) {
 // they were successes. An error in this function prevents any other
 // keys from being attempted. But if there's an error because of a dummy
 // file, the library can still try again with a new key.
-func createPublicKeyCallback(sshKeywords *SshKeywords, passphrase string) func() ([]ssh.Signer, error) {
+//
+// Keys from the ssh-agent (if agentClient is set) are tried first. Identity
+// files whose key is held by the agent are skipped so the user is not
+// prompted for a passphrase the agent has already unlocked.
+//
+// Returns the callback and the number of keys it will offer.
+func createPublicKeyCallback(sshKeywords *SshKeywords, passphrase string, agentClient agent.Agent) (func() ([]ssh.Signer, error), int) {
 	var identityFiles []string
 	existingKeys := make(map[string][]byte)
 
@@ -80,10 +141,33 @@ func createPublicKeyCallback(sshKeywords *SshKeywords, passphrase string) func()
 		existingKeys[identityFile] = privateKey
 		identityFiles = append(identityFiles, identityFile)
 	}
+	identityPubKeys := getIdentityPublicKeys(identityFiles, existingKeys)
+	agentSigners := getAgentSigners(sshKeywords, agentClient, identityPubKeys)
+	if len(agentSigners) > 0 {
+		agentKeySet := make(map[string]bool)
+		for _, signer := range agentSigners {
+			agentKeySet[string(signer.PublicKey().Marshal())] = true
+		}
+		var remainingFiles []string
+		for _, identityFile := range identityFiles {
+			if pubKey, ok := identityPubKeys[identityFile]; ok && agentKeySet[pubKey] {
+				continue
+			}
+			remainingFiles = append(remainingFiles, identityFile)
+		}
+		identityFiles = remainingFiles
+	}
+	numKeys := len(agentSigners) + len(identityFiles)
 	// require pointer to modify list in closure
 	identityFilesPtr := &identityFiles
+	agentSignersPtr := &agentSigners
 
 	return func() ([]ssh.Signer, error) {
+		if len(*agentSignersPtr) > 0 {
+			signer := (*agentSignersPtr)[0]
+			*agentSignersPtr = (*agentSignersPtr)[1:]
+			return []ssh.Signer{signer}, nil
+		}
 		if len(*identityFilesPtr) == 0 {
 			return nil, fmt.Errorf("no identity files remaining")
 		}
@@ -138,7 +222,7 @@ func createPublicKeyCallback(sshKeywords *SshKeywords, passphrase string) func()
 			return createDummySigner()
 		}
 		return []ssh.Signer{signer}, err
-	}
+	}, numKeys
 }
 
 func createDefaultPasswordCallbackPrompt(password string) func() (secret string, err error) {
@@ -505,18 +589,62 @@ func createHostKeyCallback(opts *sstore.SSHOpts) (ssh.HostKeyCallback, error) {
 	return waveHostKeyCallback, nil
 }
 
+const KeepaliveRequestName = "keepalive@openssh.com"
+const DefaultServerAliveInterval = 30
+const DefaultServerAliveCountMax = 3
+
+// max number of jump hosts in a ProxyJump chain (guards against ProxyJump loops in ssh config)
+const MaxProxyJumpHops = 10
+
 func ConnectToClient(opts *sstore.SSHOpts, remoteDisplayName string) (*ssh.Client, error) {
+	return connectToClientInternal(opts, remoteDisplayName, nil, 0)
+}
+
+// connects to the host in opts.  if the host has jump hosts (from ssh config or opts.SSHProxyJump), each
+// hop is connected to in turn (each with its own ssh config, host key verification, and auth prompts) and
+// the connection is tunneled through the previous hop.  if jumpClient is set the connection is made
+// through it (and jumpClient is closed when the returned client closes, or on error).
+func connectToClientInternal(opts *sstore.SSHOpts, remoteDisplayName string, jumpClient *ssh.Client, jumpNum int) (*ssh.Client, error) {
 	sshConfigKeywords, err := findSshConfigKeywords(opts.SSHHost)
 	if err != nil {
+		closeJumpClient(jumpClient)
 		return nil, err
 	}
 
 	sshKeywords, err := combineSshKeywords(opts, sshConfigKeywords)
 	if err != nil {
+		closeJumpClient(jumpClient)
 		return nil, err
 	}
 
-	publicKeyCallback := ssh.PublicKeysCallback(createPublicKeyCallback(sshKeywords, opts.SSHPassword))
+	if jumpClient == nil && len(sshKeywords.ProxyJump) > 0 {
+		if jumpNum+len(sshKeywords.ProxyJump) > MaxProxyJumpHops {
+			return nil, fmt.Errorf("too many jump hosts connecting to %s (max %d), check ProxyJump for loops", opts.SSHHost, MaxProxyJumpHops)
+		}
+		// each hop is reached through the previous one (so only the first hop uses its own ProxyJump)
+		for idx, jumpSpec := range sshKeywords.ProxyJump {
+			jumpOpts, err := parseProxyJumpSpec(jumpSpec)
+			if err != nil {
+				closeJumpClient(jumpClient)
+				return nil, err
+			}
+			jumpDisplayName := fmt.Sprintf("%s (jump host for %s)", jumpSpec, remoteDisplayName)
+			jumpClient, err = connectToClientInternal(jumpOpts, jumpDisplayName, jumpClient, jumpNum+idx+1)
+			if err != nil {
+				return nil, fmt.Errorf("cannot connect to jump host %s: %w", jumpSpec, err)
+			}
+		}
+	} else if jumpClient == nil && sshKeywords.ProxyCommand != "" {
+		// not supported (only ProxyJump is), the host is dialed directly as it was before ProxyJump support
+		log.Printf("ssh config ProxyCommand for %s is not supported (use ProxyJump), ignoring it and connecting directly\n", opts.SSHHost)
+	}
+
+	agentClient, agentConn := connectToSshAgent(sshKeywords.IdentityAgent)
+	if agentConn != nil {
+		defer agentConn.Close()
+	}
+	rawPublicKeyCallback, numPublicKeys := createPublicKeyCallback(sshKeywords, opts.SSHPassword, agentClient)
+	publicKeyCallback := ssh.PublicKeysCallback(rawPublicKeyCallback)
 	keyboardInteractive := ssh.KeyboardInteractive(createCombinedKbdInteractiveChallenge(opts.SSHPassword, remoteDisplayName))
 	passwordCallback := ssh.PasswordCallback(createCombinedPasswordCallbackPrompt(opts.SSHPassword, remoteDisplayName))
 
@@ -531,13 +659,13 @@ func ConnectToClient(opts *sstore.SSHOpts, remoteDisplayName string) (*ssh.Clien
 
 	// exclude gssapi-with-mic and hostbased until implemented
 	authMethodMap := map[string]ssh.AuthMethod{
-		"publickey":            ssh.RetryableAuthMethod(publicKeyCallback, len(sshKeywords.IdentityFile)),
+		"publickey":            ssh.RetryableAuthMethod(publicKeyCallback, numPublicKeys),
 		"keyboard-interactive": ssh.RetryableAuthMethod(keyboardInteractive, attemptsAllowed),
 		"password":             ssh.RetryableAuthMethod(passwordCallback, attemptsAllowed),
 	}
 
 	authMethodActiveMap := map[string]bool{
-		"publickey":            sshKeywords.PubkeyAuthentication,
+		"publickey":            sshKeywords.PubkeyAuthentication && numPublicKeys > 0,
 		"keyboard-interactive": sshKeywords.KbdInteractiveAuthentication,
 		"password":             sshKeywords.PasswordAuthentication,
 	}
@@ -557,6 +685,7 @@ func ConnectToClient(opts *sstore.SSHOpts, remoteDisplayName string) (*ssh.Clien
 
 	hostKeyCallback, err := createHostKeyCallback(opts)
 	if err != nil {
+		closeJumpClient(jumpClient)
 		return nil, err
 	}
 
@@ -566,19 +695,187 @@ func ConnectToClient(opts *sstore.SSHOpts, remoteDisplayName string) (*ssh.Clien
 		HostKeyCallback: hostKeyCallback,
 	}
 	networkAddr := sshKeywords.HostName + ":" + sshKeywords.Port
-	return ssh.Dial("tcp", networkAddr, clientConfig)
+	client, err := dialSshClient(jumpClient, networkAddr, clientConfig)
+	if err != nil {
+		return nil, err
+	}
+	if sshKeywords.ServerAliveInterval > 0 {
+		keepaliveInterval := time.Duration(sshKeywords.ServerAliveInterval) * time.Second
+		go runSshKeepalive(client, keepaliveInterval, sshKeywords.ServerAliveCountMax, opts.SSHHost)
+	}
+	return client, nil
+}
+
+// sends keepalive requests every interval.  if countMax requests in a row get no reply the link is
+// considered dead and the client is closed (which closes all of its sessions, and triggers a reconnect)
+func runSshKeepalive(client *ssh.Client, interval time.Duration, countMax int, hostName string) {
+	doneCh := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(doneCh)
+	}()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	numMissed := 0
+	for {
+		select {
+		case <-doneCh:
+			return
+		case <-ticker.C:
+		}
+		replyCh := make(chan error, 1)
+		go func() {
+			// servers that do not know this request still reply (with failure), which is enough to show the link is alive
+			_, _, err := client.SendRequest(KeepaliveRequestName, true, nil)
+			replyCh <- err
+		}()
+		select {
+		case <-doneCh:
+			return
+		case err := <-replyCh:
+			if err != nil {
+				// connection is already closed
+				return
+			}
+			numMissed = 0
+			continue
+		case <-time.After(interval):
+			numMissed++
+		}
+		if numMissed >= countMax {
+			log.Printf("ssh keepalive: no response from %s after %d attempts, closing connection\n", hostName, numMissed)
+			client.Close()
+			return
+		}
+	}
+}
+
+// dials networkAddr directly, or tunneled through jumpClient if set.
+// jumpClient is owned by the returned client (closed when it closes), and is closed on error.
+func dialSshClient(jumpClient *ssh.Client, networkAddr string, clientConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	if jumpClient == nil {
+		return ssh.Dial("tcp", networkAddr, clientConfig)
+	}
+	conn, err := jumpClient.Dial("tcp", networkAddr)
+	if err != nil {
+		jumpClient.Close()
+		return nil, err
+	}
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, networkAddr, clientConfig)
+	if err != nil {
+		conn.Close()
+		jumpClient.Close()
+		return nil, err
+	}
+	client := ssh.NewClient(clientConn, chans, reqs)
+	go func() {
+		client.Wait()
+		jumpClient.Close()
+	}()
+	return client, nil
+}
+
+func closeJumpClient(jumpClient *ssh.Client) {
+	if jumpClient != nil {
+		jumpClient.Close()
+	}
+}
+
+var proxyJumpSpecRe = regexp.MustCompile(`^(?:ssh://)?(?:([^@\s]+)@)?([^@:\s\[\]]+|\[[0-9a-fA-F:.]+\])(?::(\d+))?$`)
+
+// parses a jump host in the ProxyJump format: [user@]host[:port] or ssh://[user@]host[:port]
+func parseProxyJumpSpec(jumpSpec string) (*sstore.SSHOpts, error) {
+	m := proxyJumpSpecRe.FindStringSubmatch(strings.TrimSpace(jumpSpec))
+	if m == nil {
+		return nil, fmt.Errorf("invalid jump host %q, must be [user@]host[:port]", jumpSpec)
+	}
+	opts := &sstore.SSHOpts{
+		SSHUser: m[1],
+		SSHHost: strings.Trim(m[2], "[]"),
+	}
+	if m[3] != "" {
+		port, err := strconv.Atoi(m[3])
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid port in jump host %q", jumpSpec)
+		}
+		opts.SSHPort = port
+	}
+	return opts, nil
+}
+
+func ValidateProxyJump(proxyJump string) error {
+	jumpSpecs := parseProxyJumpList(proxyJump)
+	if len(jumpSpecs) > MaxProxyJumpHops {
+		return fmt.Errorf("too many jump hosts (max %d)", MaxProxyJumpHops)
+	}
+	for _, jumpSpec := range jumpSpecs {
+		_, err := parseProxyJumpSpec(jumpSpec)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
+// splits a ProxyJump value into its hosts ("none" means no jump hosts)
+func parseProxyJumpList(proxyJump string) []string {
+	proxyJump = strings.TrimSpace(proxyJump)
+	if proxyJump == "" || strings.ToLower(proxyJump) == ProxyJumpNone {
+		return nil
+	}
+	var rtn []string
+	for _, jumpSpec := range strings.Split(proxyJump, ",") {
+		jumpSpec = strings.TrimSpace(jumpSpec)
+		if jumpSpec != "" {
+			rtn = append(rtn, jumpSpec)
+		}
+	}
+	return rtn
+}
+
+// connects to the ssh-agent given by the IdentityAgent keyword (defaults to SSH_AUTH_SOCK).
+// returns nils if there is no agent (or IdentityAgent is "none"), the caller must close the returned conn
+func connectToSshAgent(identityAgent string) (agent.Agent, net.Conn) {
+	var sockPath string
+	switch {
+	case identityAgent == "none":
+		return nil, nil
+	case identityAgent == "" || identityAgent == "SSH_AUTH_SOCK":
+		sockPath = os.Getenv("SSH_AUTH_SOCK")
+	case strings.HasPrefix(identityAgent, "$"):
+		sockPath = os.Getenv(strings.Trim(identityAgent[1:], "{}"))
+	default:
+		sockPath = base.ExpandHomeDir(identityAgent)
+	}
+	if sockPath == "" {
+		return nil, nil
+	}
+	conn, err := net.DialTimeout("unix", sockPath, 2*time.Second)
+	if err != nil {
+		log.Printf("cannot connect to ssh-agent at %q: %v\n", sockPath, err)
+		return nil, nil
+	}
+	return agent.NewClient(conn), conn
+}
+
+const ProxyJumpNone = "none"
+
 type SshKeywords struct {
 	User                         string
 	HostName                     string
 	Port                         string
 	IdentityFile                 []string
+	IdentitiesOnly               bool
+	IdentityAgent                string
 	BatchMode                    bool
 	PubkeyAuthentication         bool
 	PasswordAuthentication       bool
 	KbdInteractiveAuthentication bool
 	PreferredAuthentications     []string
+	ProxyJump                    []string
+	ProxyCommand                 string
+	ServerAliveInterval          int // seconds, 0 disables keepalives, -1 if not set
+	ServerAliveCountMax          int
 }
 
 func combineSshKeywords(opts *sstore.SSHOpts, configKeywords *SshKeywords) (*SshKeywords, error) {
@@ -617,15 +914,65 @@ func combineSshKeywords(opts *sstore.SSHOpts, configKeywords *SshKeywords) (*Ssh
 
 	// these are not officially supported in the waveterm frontend but can be configured
 	// in ssh config files
+	sshKeywords.IdentitiesOnly = configKeywords.IdentitiesOnly
+	sshKeywords.IdentityAgent = configKeywords.IdentityAgent
 	sshKeywords.BatchMode = configKeywords.BatchMode
 	sshKeywords.PubkeyAuthentication = configKeywords.PubkeyAuthentication
 	sshKeywords.PasswordAuthentication = configKeywords.PasswordAuthentication
 	sshKeywords.KbdInteractiveAuthentication = configKeywords.KbdInteractiveAuthentication
 	sshKeywords.PreferredAuthentications = configKeywords.PreferredAuthentications
 
+	if opts.SSHProxyJump != "" {
+		sshKeywords.ProxyJump = parseProxyJumpList(opts.SSHProxyJump)
+	} else {
+		sshKeywords.ProxyJump = configKeywords.ProxyJump
+	}
+	sshKeywords.ProxyCommand = configKeywords.ProxyCommand
+
+	// unlike openssh, keepalives are on by default so dead connections are detected (and reconnected).
+	// an explicit "ServerAliveInterval 0" still turns them off
+	sshKeywords.ServerAliveInterval = configKeywords.ServerAliveInterval
+	if sshKeywords.ServerAliveInterval < 0 {
+		sshKeywords.ServerAliveInterval = DefaultServerAliveInterval
+	}
+	sshKeywords.ServerAliveCountMax = configKeywords.ServerAliveCountMax
+	if sshKeywords.ServerAliveCountMax <= 0 {
+		sshKeywords.ServerAliveCountMax = DefaultServerAliveCountMax
+	}
+
 	return sshKeywords, nil
 }
 
+var sshUserConfigFile = "~/.ssh/config"
+var sshSystemConfigFile = "/etc/ssh/ssh_config"
+
+// ssh_config.GetStrict returns the default value for keywords that are not set (e.g. "0" for
+// ServerAliveInterval), so this checks the config files directly to tell "not set" from an explicit value
+func sshConfigHasKeyword(hostPattern string, keyword string) (bool, error) {
+	for _, fileName := range []string{sshUserConfigFile, sshSystemConfigFile} {
+		fd, err := os.Open(base.ExpandHomeDir(fileName))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		config, err := ssh_config.Decode(fd)
+		fd.Close()
+		if err != nil {
+			return false, err
+		}
+		val, err := config.Get(hostPattern, keyword)
+		if err != nil {
+			return false, err
+		}
+		if val != "" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // note that a `var == "yes"` will default to false
 // but `var != "no"` will default to true
 // when given unexpected strings
@@ -651,6 +998,17 @@ func findSshConfigKeywords(hostPattern string) (*SshKeywords, error) {
 
 	sshKeywords.IdentityFile = ssh_config.GetAll(hostPattern, "IdentityFile")
 
+	identitiesOnlyRaw, err := ssh_config.GetStrict(hostPattern, "IdentitiesOnly")
+	if err != nil {
+		return nil, err
+	}
+	sshKeywords.IdentitiesOnly = (strings.ToLower(identitiesOnlyRaw) == "yes")
+
+	sshKeywords.IdentityAgent, err = ssh_config.GetStrict(hostPattern, "IdentityAgent")
+	if err != nil {
+		return nil, err
+	}
+
 	batchModeRaw, err := ssh_config.GetStrict(hostPattern, "BatchMode")
 	if err != nil {
 		return nil, err
@@ -684,5 +1042,42 @@ func findSshConfigKeywords(hostPattern string) (*SshKeywords, error) {
 	}
 	sshKeywords.PreferredAuthentications = strings.Split(preferredAuthenticationsRaw, ",")
 
+	proxyJumpRaw, err := ssh_config.GetStrict(hostPattern, "ProxyJump")
+	if err != nil {
+		return nil, err
+	}
+	sshKeywords.ProxyJump = parseProxyJumpList(proxyJumpRaw)
+
+	proxyCommandRaw, err := ssh_config.GetStrict(hostPattern, "ProxyCommand")
+	if err != nil {
+		return nil, err
+	}
+	if strings.ToLower(proxyCommandRaw) != "none" {
+		sshKeywords.ProxyCommand = proxyCommandRaw
+	}
+
+	// invalid values fall back to the defaults
+	sshKeywords.ServerAliveInterval = -1
+	hasServerAliveInterval, err := sshConfigHasKeyword(hostPattern, "ServerAliveInterval")
+	if err != nil {
+		return nil, err
+	}
+	if hasServerAliveInterval {
+		serverAliveIntervalRaw, err := ssh_config.GetStrict(hostPattern, "ServerAliveInterval")
+		if err != nil {
+			return nil, err
+		}
+		serverAliveInterval, err := strconv.Atoi(serverAliveIntervalRaw)
+		if err == nil && serverAliveInterval >= 0 {
+			sshKeywords.ServerAliveInterval = serverAliveInterval
+		}
+	}
+
+	serverAliveCountMaxRaw, err := ssh_config.GetStrict(hostPattern, "ServerAliveCountMax")
+	if err != nil {
+		return nil, err
+	}
+	sshKeywords.ServerAliveCountMax, _ = strconv.Atoi(serverAliveCountMaxRaw)
+
 	return sshKeywords, nil
 }
@@ -0,0 +1,304 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package remote
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/sstore"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func makeTestKey(t *testing.T) (ed25519.PrivateKey, ssh.PublicKey) {
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	pubKey, err := ssh.NewPublicKey(privKey.Public())
+	if err != nil {
+		t.Fatalf("error making public key: %v", err)
+	}
+	return privKey, pubKey
+}
+
+// starts an ssh server on localhost that only accepts publickey auth with allowedKey
+func startTestSshServer(t *testing.T, allowedKey ssh.PublicKey) string {
+	return startTestSshServerWithChannels(t, allowedKey, func(newChan ssh.NewChannel) {
+		newChan.Reject(ssh.Prohibited, "no channels")
+	})
+}
+
+// forwards direct-tcpip channels (what ssh.Client.Dial opens), so the server can be used as a jump host
+func handleDirectTcpip(newChan ssh.NewChannel) {
+	if newChan.ChannelType() != "direct-tcpip" {
+		newChan.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		return
+	}
+	extra := newChan.ExtraData()
+	if len(extra) < 4 {
+		newChan.Reject(ssh.ConnectionFailed, "bad direct-tcpip data")
+		return
+	}
+	hostLen := binary.BigEndian.Uint32(extra)
+	if len(extra) < int(4+hostLen+4) {
+		newChan.Reject(ssh.ConnectionFailed, "bad direct-tcpip data")
+		return
+	}
+	host := string(extra[4 : 4+hostLen])
+	port := binary.BigEndian.Uint32(extra[4+hostLen:])
+	targetConn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, reqs, err := newChan.Accept()
+	if err != nil {
+		targetConn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		io.Copy(channel, targetConn)
+		channel.CloseWrite()
+	}()
+	go func() {
+		io.Copy(targetConn, channel)
+		targetConn.Close()
+	}()
+}
+
+func startTestSshServerWithChannels(t *testing.T, allowedKey ssh.PublicKey, handleChannel func(ssh.NewChannel)) string {
+	_, hostPrivKey, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, err := ssh.NewSignerFromKey(hostPrivKey)
+	if err != nil {
+		t.Fatalf("error making host key: %v", err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), allowedKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	}
+	config.AddHostKey(hostSigner)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for newChan := range chans {
+					go handleChannel(newChan)
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func dialWithPublicKeys(addr string, sshKeywords *SshKeywords, agentClient agent.Agent) error {
+	callback, numKeys := createPublicKeyCallback(sshKeywords, "", agentClient)
+	if numKeys == 0 {
+		return ssh.ErrNoAuth
+	}
+	clientConfig := &ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.RetryableAuthMethod(ssh.PublicKeysCallback(callback), numKeys)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	client, err := ssh.Dial("tcp", addr, clientConfig)
+	if err != nil {
+		return err
+	}
+	return client.Close()
+}
+
+func TestSshAgentAuth(t *testing.T) {
+	agentPrivKey, agentPubKey := makeTestKey(t)
+	otherPrivKey, _ := makeTestKey(t)
+	keyring := agent.NewKeyring()
+	err := keyring.Add(agent.AddedKey{PrivateKey: agentPrivKey})
+	if err != nil {
+		t.Fatalf("error adding key to agent: %v", err)
+	}
+	addr := startTestSshServer(t, agentPubKey)
+
+	// write the agent's key as a passphrase-protected identity file (with .pub), and an unrelated key
+	tempDir := t.TempDir()
+	encBlock, err := ssh.MarshalPrivateKeyWithPassphrase(agentPrivKey, "", []byte("secret"))
+	if err != nil {
+		t.Fatalf("error marshaling key: %v", err)
+	}
+	agentKeyFile := filepath.Join(tempDir, "id_agent")
+	os.WriteFile(agentKeyFile, pem.EncodeToMemory(encBlock), 0600)
+	os.WriteFile(agentKeyFile+".pub", ssh.MarshalAuthorizedKey(agentPubKey), 0600)
+	otherBlock, err := ssh.MarshalPrivateKey(otherPrivKey, "")
+	if err != nil {
+		t.Fatalf("error marshaling key: %v", err)
+	}
+	otherKeyFile := filepath.Join(tempDir, "id_other")
+	os.WriteFile(otherKeyFile, pem.EncodeToMemory(otherBlock), 0600)
+
+	// agent keys are used
+	err = dialWithPublicKeys(addr, &SshKeywords{IdentityFile: []string{otherKeyFile}, BatchMode: true}, keyring)
+	if err != nil {
+		t.Errorf("expected agent auth to succeed: %v", err)
+	}
+	// without the agent, only the unrelated identity file is available
+	err = dialWithPublicKeys(addr, &SshKeywords{IdentityFile: []string{otherKeyFile}, BatchMode: true}, nil)
+	if err == nil {
+		t.Errorf("expected auth without agent to fail")
+	}
+	// IdentitiesOnly filters out agent keys that are not configured identities
+	err = dialWithPublicKeys(addr, &SshKeywords{IdentityFile: []string{otherKeyFile}, IdentitiesOnly: true, BatchMode: true}, keyring)
+	if err == nil {
+		t.Errorf("expected IdentitiesOnly auth with unrelated identity to fail")
+	}
+	// IdentitiesOnly with the matching (encrypted) identity file uses the agent, the file is skipped (no passphrase prompt)
+	sshKeywords := &SshKeywords{IdentityFile: []string{agentKeyFile}, IdentitiesOnly: true}
+	_, numKeys := createPublicKeyCallback(sshKeywords, "", keyring)
+	if numKeys != 1 {
+		t.Errorf("expected identity file held by agent to be skipped, got %d keys", numKeys)
+	}
+	err = dialWithPublicKeys(addr, sshKeywords, keyring)
+	if err != nil {
+		t.Errorf("expected IdentitiesOnly agent auth to succeed: %v", err)
+	}
+}
+
+func TestParseProxyJump(t *testing.T) {
+	jumpSpecs := parseProxyJumpList(" bastion1, admin@bastion2:2222 ,")
+	if len(jumpSpecs) != 2 || jumpSpecs[0] != "bastion1" || jumpSpecs[1] != "admin@bastion2:2222" {
+		t.Errorf("bad proxyjump list: %v", jumpSpecs)
+	}
+	if parseProxyJumpList("none") != nil || parseProxyJumpList("") != nil {
+		t.Errorf("expected no jump hosts for none/empty")
+	}
+	opts, err := parseProxyJumpSpec("ssh://admin@bastion2:2222")
+	if err != nil || opts.SSHUser != "admin" || opts.SSHHost != "bastion2" || opts.SSHPort != 2222 {
+		t.Errorf("bad jump spec parse: %#v %v", opts, err)
+	}
+	opts, err = parseProxyJumpSpec("[::1]:22")
+	if err != nil || opts.SSHHost != "::1" || opts.SSHPort != 22 || opts.SSHUser != "" {
+		t.Errorf("bad ipv6 jump spec parse: %#v %v", opts, err)
+	}
+	if _, err := parseProxyJumpSpec("user@host:99999"); err == nil {
+		t.Errorf("expected bad port to fail")
+	}
+	if ValidateProxyJump("a,b@c d") == nil {
+		t.Errorf("expected invalid jump host to fail validation")
+	}
+}
+
+func TestSshJumpHostDial(t *testing.T) {
+	agentPrivKey, agentPubKey := makeTestKey(t)
+	keyring := agent.NewKeyring()
+	err := keyring.Add(agent.AddedKey{PrivateKey: agentPrivKey})
+	if err != nil {
+		t.Fatalf("error adding key to agent: %v", err)
+	}
+	targetAddr := startTestSshServer(t, agentPubKey)
+	jumpAddr1 := startTestSshServerWithChannels(t, agentPubKey, handleDirectTcpip)
+	jumpAddr2 := startTestSshServerWithChannels(t, agentPubKey, handleDirectTcpip)
+	signers, err := keyring.Signers()
+	if err != nil {
+		t.Fatalf("error getting signers: %v", err)
+	}
+	clientConfig := &ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	var client *ssh.Client
+	for _, addr := range []string{jumpAddr1, jumpAddr2, targetAddr} {
+		client, err = dialSshClient(client, addr, clientConfig)
+		if err != nil {
+			t.Fatalf("error dialing %s through jump hosts: %v", addr, err)
+		}
+	}
+	if string(client.ServerVersion()) == "" {
+		t.Errorf("expected server version from target")
+	}
+	client.Close()
+	// a failed hop closes the jump client
+	jumpClient, err := dialSshClient(nil, jumpAddr1, clientConfig)
+	if err != nil {
+		t.Fatalf("error dialing jump host: %v", err)
+	}
+	_, err = dialSshClient(jumpClient, "127.0.0.1:1", clientConfig)
+	if err == nil {
+		t.Fatalf("expected dial to closed port to fail")
+	}
+	_, _, err = jumpClient.SendRequest("keepalive@openssh.com", true, nil)
+	if err == nil {
+		t.Errorf("expected jump client to be closed after failed hop")
+	}
+}
+
+func TestServerAliveInterval(t *testing.T) {
+	dir := t.TempDir()
+	userConfig := filepath.Join(dir, "config")
+	systemConfig := filepath.Join(dir, "ssh_config")
+	os.WriteFile(userConfig, []byte("Host off\n  ServerAliveInterval 0\n\nHost fast\n  ServerAliveInterval 5\n"), 0600)
+	os.WriteFile(systemConfig, []byte("Host system\n  ServerAliveInterval 10\n"), 0600)
+	origUser, origSystem := sshUserConfigFile, sshSystemConfigFile
+	sshUserConfigFile, sshSystemConfigFile = userConfig, systemConfig
+	defer func() {
+		sshUserConfigFile, sshSystemConfigFile = origUser, origSystem
+	}()
+	tests := []struct {
+		Host       string
+		Has        bool
+		ConfigVal  int
+		Expected   int
+		CountMax   int
+		ExpectedCM int
+	}{
+		{"off", true, 0, 0, 0, DefaultServerAliveCountMax},
+		{"fast", true, 5, 5, 2, 2},
+		{"system", true, 10, 10, 0, DefaultServerAliveCountMax},
+		{"other", false, -1, DefaultServerAliveInterval, 0, DefaultServerAliveCountMax},
+	}
+	for _, test := range tests {
+		has, err := sshConfigHasKeyword(test.Host, "ServerAliveInterval")
+		if err != nil {
+			t.Fatalf("%s: error reading config: %v", test.Host, err)
+		}
+		if has != test.Has {
+			t.Errorf("%s: has keyword got %v, expected %v", test.Host, has, test.Has)
+		}
+		configKeywords := &SshKeywords{ServerAliveInterval: test.ConfigVal, ServerAliveCountMax: test.CountMax}
+		sshKeywords, err := combineSshKeywords(&sstore.SSHOpts{SSHHost: test.Host, SSHUser: "test"}, configKeywords)
+		if err != nil {
+			t.Fatalf("%s: error combining keywords: %v", test.Host, err)
+		}
+		if sshKeywords.ServerAliveInterval != test.Expected || sshKeywords.ServerAliveCountMax != test.ExpectedCM {
+			t.Errorf("%s: got interval %d countmax %d, expected %d %d", test.Host, sshKeywords.ServerAliveInterval, sshKeywords.ServerAliveCountMax, test.Expected, test.ExpectedCM)
+		}
+	}
+}
@@ -213,7 +213,8 @@ func DisplayStateUpdateDiff(buf *bytes.Buffer, oldState packet.ShellState, newSt
 			}
 		}
 	}
-	if newState.GetShellType() == packet.ShellType_zsh {
+	// fish abbreviations and functions use the same map encoding as zsh
+	if newState.GetShellType() == packet.ShellType_zsh || newState.GetShellType() == packet.ShellType_fish {
 		makeZshAlisesDiff(buf, oldState.Aliases, newState.Aliases)
 		makeZshFuncsDiff(buf, oldState.Funcs, newState.Funcs)
 	} else {
@@ -31,6 +31,7 @@ const WaveHomeVarName = "WAVETERM_HOME"
 const WaveDevVarName = "WAVETERM_DEV"
 const SessionsDirBaseName = "sessions"
 const ScreensDirBaseName = "screens"
+const PtyOutFileSuffix = ".ptyout.cf"
 const WaveLockFile = "waveterm.lock"
 const WaveDirName = ".waveterm"        // must match emain.ts
 const WaveDevDirName = ".waveterm-dev" // must match emain.ts
@@ -272,7 +273,7 @@ func PtyOutFile(screenId string, lineId string) (string, error) {
 	if lineId == "" {
 		return "", fmt.Errorf("cannot get ptyout file for blank lineid")
 	}
-	return fmt.Sprintf("%s/%s.ptyout.cf", sdir, lineId), nil
+	return fmt.Sprintf("%s/%s%s", sdir, lineId, PtyOutFileSuffix), nil
 }
 
 func GenWaveUUID() string {
@@ -146,6 +146,21 @@ func (bus *UpdateBus) DoScreenUpdate(screenId string, update UpdatePacket) {
 	}
 }
 
+// Returns true if any client is subscribed to the given screenId
+func (bus *UpdateBus) IsScreenWatched(screenId string) bool {
+	if screenId == "" {
+		return false
+	}
+	bus.Lock.Lock()
+	defer bus.Lock.Unlock()
+	for _, uch := range bus.Channels {
+		if uch.Match(screenId) {
+			return true
+		}
+	}
+	return false
+}
+
 // An interface for rpc requests
 // This is separate from the RpcPacketType defined in the waveshell/pkg/packet package, as that one is intended for use communicating between wavesrv and waveshell. It is has a different set of required methods.
 type RpcPacket interface {
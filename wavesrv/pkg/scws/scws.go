@@ -4,7 +4,9 @@
 package scws
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"fmt"
 	"log"
 	"runtime/debug"
@@ -307,6 +309,18 @@ func (ws *WSState) RunWSRead() {
 	}
 }
 
+// ^C or ^D
+func isInterruptInput(inputData64 string) bool {
+	if inputData64 == "" {
+		return false
+	}
+	inputData, err := base64.StdEncoding.DecodeString(inputData64)
+	if err != nil {
+		return false
+	}
+	return bytes.IndexByte(inputData, 3) != -1 || bytes.IndexByte(inputData, 4) != -1
+}
+
 func sendCmdInput(pk *scpacket.FeInputPacketType) error {
 	err := pk.CK.Validate("input packet")
 	if err != nil {
@@ -315,6 +329,12 @@ func sendCmdInput(pk *scpacket.FeInputPacketType) error {
 	if pk.Remote.RemoteId == "" {
 		return fmt.Errorf("input must set remoteid")
 	}
+	if remote.IsLocalCmd(pk.CK) {
+		if pk.SigName != "" || isInterruptInput(pk.InputData64) {
+			remote.CancelLocalCmd(pk.CK)
+		}
+		return nil
+	}
 	msh := remote.GetRemoteById(pk.Remote.RemoteId)
 	if msh == nil {
 		return fmt.Errorf("remote %s not found", pk.Remote.RemoteId)
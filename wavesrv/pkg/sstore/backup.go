@@ -0,0 +1,477 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package sstore
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/cirfile"
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/scbase"
+)
+
+// a backup is a .tar.gz with a manifest, a copy of the database (made with the sqlite online backup api so it is
+// consistent while wavesrv is running), and the pty files in the sessions and screens directories:
+//
+//	backup.json
+//	waveterm.db
+//	sessions/...
+//	screens/...
+const BackupManifestName = "backup.json"
+const BackupManifestVersion = 1
+const BackupDirBaseName = "backups"
+const BackupFileSuffix = ".tar.gz"
+const BackupStepPages = 1000
+const BackupStepWait = 10 * time.Millisecond // lets writers in between backup steps
+const DBSHMFileName = "waveterm.db-shm"
+const PreRestorePrefix = "prerestore." // the replaced files are kept with this prefix
+
+type BackupManifestType struct {
+	Version     int    `json:"version"`
+	DBVersion   uint   `json:"dbversion"`
+	WaveVersion string `json:"waveversion"`
+	CreatedTs   int64  `json:"createdts"`
+}
+
+type BackupResultType struct {
+	FileName  string
+	DBVersion uint
+	NumFiles  int   // pty files (not including the database)
+	Size      int64 // size of the backup file
+}
+
+func GetDefaultBackupName() string {
+	fileName := fmt.Sprintf("waveterm-backup-%s%s", time.Now().Format("20060102-150405"), BackupFileSuffix)
+	return path.Join(scbase.GetWaveHomeDir(), BackupDirBaseName, fileName)
+}
+
+// copies the (running) database to destDBName using the sqlite online backup api
+func backupDBToFile(ctx context.Context, destDBName string) error {
+	db, err := GetDB(ctx)
+	if err != nil {
+		return err
+	}
+	srcConn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot get db connection: %w", err)
+	}
+	defer srcConn.Close()
+	destDB, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=rwc", destDBName))
+	if err != nil {
+		return fmt.Errorf("cannot open backup db: %w", err)
+	}
+	defer destDB.Close()
+	destConn, err := destDB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot open backup db: %w", err)
+	}
+	defer destConn.Close()
+	return destConn.Raw(func(destDriverConn interface{}) error {
+		return srcConn.Raw(func(srcDriverConn interface{}) error {
+			destSqlConn, ok := destDriverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("invalid backup db connection type %T", destDriverConn)
+			}
+			srcSqlConn, ok := srcDriverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("invalid db connection type %T", srcDriverConn)
+			}
+			backup, err := destSqlConn.Backup("main", srcSqlConn, "main")
+			if err != nil {
+				return fmt.Errorf("cannot start db backup: %w", err)
+			}
+			for {
+				done, err := backup.Step(BackupStepPages)
+				if err != nil {
+					backup.Finish()
+					return fmt.Errorf("db backup step: %w", err)
+				}
+				if done {
+					break
+				}
+				if ctx.Err() != nil {
+					backup.Finish()
+					return ctx.Err()
+				}
+				time.Sleep(BackupStepWait)
+			}
+			return backup.Finish()
+		})
+	})
+}
+
+// returns the schema version of dbName (not the running database), checked with the same migrations as MakeMigrate
+func getDBFileVersion(dbName string) (uint, error) {
+	m, err := makeMigrateForDB(dbName)
+	if err != nil {
+		return 0, err
+	}
+	defer m.Close()
+	version, dirty, err := MigrateVersion(m)
+	if err != nil {
+		return 0, fmt.Errorf("cannot get db version: %w", err)
+	}
+	if dirty {
+		return 0, fmt.Errorf("db is dirty (version %d)", version)
+	}
+	return version, nil
+}
+
+// os.Open (replaced in tests)
+var backupOpen = os.Open
+
+func writeTarFile(tw *tar.Writer, name string, fileName string) error {
+	fd, err := backupOpen(fileName)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	finfo, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: finfo.Size(), ModTime: finfo.ModTime(), Typeflag: tar.TypeReg})
+	if err != nil {
+		return err
+	}
+	// pty files can still be appended to, only the size at stat time is copied
+	_, err = io.CopyN(tw, fd, finfo.Size())
+	return err
+}
+
+// adds the files in waveHome/dirBaseName (skipping temp files), returns the number of files written.
+// a pty file that is compressed while the backup is running is backed up from its compressed file
+func writeTarDir(ctx context.Context, tw *tar.Writer, dirBaseName string) (int, error) {
+	waveHome := scbase.GetWaveHomeDir()
+	written := make(map[string]bool)
+	err := filepath.WalkDir(path.Join(waveHome, dirBaseName), func(fileName string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		relName, err := filepath.Rel(waveHome, fileName)
+		if err != nil {
+			return err
+		}
+		relName = filepath.ToSlash(relName)
+		if entry.IsDir() {
+			return tw.WriteHeader(&tar.Header{Name: relName + "/", Mode: 0700, Typeflag: tar.TypeDir})
+		}
+		if !entry.Type().IsRegular() || strings.HasSuffix(relName, ".tmp") || written[relName] {
+			return nil
+		}
+		err = writeTarFile(tw, relName, fileName)
+		if errors.Is(err, fs.ErrNotExist) && strings.HasSuffix(relName, scbase.PtyOutFileSuffix) {
+			relName = cirfile.CompressedFileName(relName)
+			if written[relName] {
+				return nil
+			}
+			err = writeTarFile(tw, relName, cirfile.CompressedFileName(fileName))
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			// deleted while the backup was running
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("writing %s: %w", relName, err)
+		}
+		written[relName] = true
+		return nil
+	})
+	return len(written), err
+}
+
+// writes a backup of the running database and the pty files to fileName.  the backup is written
+// to a temp file and renamed into place, so fileName is never a partial backup.
+func BackupDB(ctx context.Context, fileName string) (*BackupResultType, error) {
+	err := os.MkdirAll(path.Dir(fileName), 0700)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create backup directory: %w", err)
+	}
+	tmpDir, err := os.MkdirTemp(scbase.GetWaveHomeDir(), "backup-*")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create temp directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tmpDBName := path.Join(tmpDir, DBFileName)
+	err = backupDBToFile(ctx, tmpDBName)
+	if err != nil {
+		return nil, err
+	}
+	dbVersion, err := getDBFileVersion(tmpDBName)
+	if err != nil {
+		return nil, err
+	}
+	tmpFileName := fileName + ".tmp"
+	fd, err := os.OpenFile(tmpFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create backup file: %w", err)
+	}
+	rtn := &BackupResultType{FileName: fileName, DBVersion: dbVersion}
+	writeErr := writeBackupTar(ctx, fd, tmpDBName, dbVersion, rtn)
+	closeErr := fd.Close()
+	if writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr != nil {
+		os.Remove(tmpFileName)
+		return nil, fmt.Errorf("cannot write backup: %w", writeErr)
+	}
+	err = os.Rename(tmpFileName, fileName)
+	if err != nil {
+		os.Remove(tmpFileName)
+		return nil, fmt.Errorf("cannot rename backup file: %w", err)
+	}
+	finfo, err := os.Stat(fileName)
+	if err == nil {
+		rtn.Size = finfo.Size()
+	}
+	return rtn, nil
+}
+
+func writeBackupTar(ctx context.Context, w io.Writer, dbName string, dbVersion uint, result *BackupResultType) error {
+	gzw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gzw)
+	manifest := BackupManifestType{
+		Version:     BackupManifestVersion,
+		DBVersion:   dbVersion,
+		WaveVersion: scbase.WaveVersion,
+		CreatedTs:   time.Now().UnixMilli(),
+	}
+	barr, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{Name: BackupManifestName, Mode: 0600, Size: int64(len(barr)), ModTime: time.Now(), Typeflag: tar.TypeReg})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(barr)
+	if err != nil {
+		return err
+	}
+	err = writeTarFile(tw, DBFileName, dbName)
+	if err != nil {
+		return fmt.Errorf("writing db: %w", err)
+	}
+	for _, dirBaseName := range []string{scbase.SessionsDirBaseName, scbase.ScreensDirBaseName} {
+		numFiles, err := writeTarDir(ctx, tw, dirBaseName)
+		if err != nil {
+			return err
+		}
+		result.NumFiles += numFiles
+	}
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	return gzw.Close()
+}
+
+// only the manifest, the database, and files in the sessions and screens directories are extracted
+func isValidBackupEntryName(name string) bool {
+	if name == BackupManifestName || name == DBFileName {
+		return true
+	}
+	cleanName := path.Clean(name)
+	if cleanName != strings.TrimSuffix(name, "/") || path.IsAbs(cleanName) {
+		return false
+	}
+	dirBaseName, _, _ := strings.Cut(cleanName, "/")
+	return dirBaseName == scbase.SessionsDirBaseName || dirBaseName == scbase.ScreensDirBaseName
+}
+
+func extractBackup(backupFile string, destDir string) (*BackupManifestType, error) {
+	fd, err := os.Open(backupFile)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	gzr, err := gzip.NewReader(fd)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup file: %w", err)
+	}
+	defer gzr.Close()
+	tr := tar.NewReader(gzr)
+	var manifest *BackupManifestType
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid backup file: %w", err)
+		}
+		if !isValidBackupEntryName(hdr.Name) {
+			return nil, fmt.Errorf("invalid backup file entry %q", hdr.Name)
+		}
+		destName := path.Join(destDir, hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(destName, 0700)
+
+		case tar.TypeReg:
+			if hdr.Name == BackupManifestName {
+				manifest = &BackupManifestType{}
+				err = json.NewDecoder(tr).Decode(manifest)
+				break
+			}
+			err = os.MkdirAll(path.Dir(destName), 0700)
+			if err == nil {
+				err = extractFile(tr, destName)
+			}
+
+		default:
+			return nil, fmt.Errorf("invalid backup file entry %q (type %c)", hdr.Name, hdr.Typeflag)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("extracting %s: %w", hdr.Name, err)
+		}
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("invalid backup file, no %s", BackupManifestName)
+	}
+	return manifest, nil
+}
+
+func extractFile(r io.Reader, destName string) error {
+	fd, err := os.OpenFile(destName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fd, r)
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+// runs an integrity check and checks the schema version (a backup from a newer version of wave cannot be restored)
+func validateBackupDB(dbName string) (uint, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro", dbName))
+	if err != nil {
+		return 0, err
+	}
+	var checkResult string
+	err = db.QueryRow(`PRAGMA quick_check`).Scan(&checkResult)
+	db.Close()
+	if err != nil {
+		return 0, fmt.Errorf("cannot check backup db: %w", err)
+	}
+	if checkResult != "ok" {
+		return 0, fmt.Errorf("backup db failed integrity check: %s", checkResult)
+	}
+	version, err := getDBFileVersion(dbName)
+	if err != nil {
+		return 0, err
+	}
+	if version == 0 {
+		return 0, fmt.Errorf("backup db has no schema version")
+	}
+	if version > MaxMigration {
+		return 0, fmt.Errorf("backup db version %d is newer than the supported version %d", version, MaxMigration)
+	}
+	return version, nil
+}
+
+// replaces the database and the sessions/screens directories with the contents of backupFile.
+// must be called before the database is opened (and with the wave lock held).  the replaced files are
+// renamed with PreRestorePrefix (replacing the files from any previous restore).  older backups are
+// migrated up by the normal startup migration.
+func RestoreBackup(backupFile string) (*BackupManifestType, error) {
+	waveHome := scbase.GetWaveHomeDir()
+	tmpDir, err := os.MkdirTemp(waveHome, "restore-*")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create temp directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	manifest, err := extractBackup(backupFile, tmpDir)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Version > BackupManifestVersion {
+		return nil, fmt.Errorf("unsupported backup version %d", manifest.Version)
+	}
+	version, err := validateBackupDB(path.Join(tmpDir, DBFileName))
+	if err != nil {
+		return nil, err
+	}
+	manifest.DBVersion = version
+	err = swapRestoreFiles(waveHome, tmpDir)
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// os.Rename (replaced in tests)
+var restoreRename = os.Rename
+
+// moves the current db files and pty dirs aside and renames the restored ones (from tmpDir) into place.
+// on error everything is put back the way it was
+func swapRestoreFiles(waveHome string, tmpDir string) error {
+	// the wal and shm files of the current db are moved aside (the backup db is a single file)
+	swapNames := []string{DBFileName, DBWALFileName, DBSHMFileName, scbase.SessionsDirBaseName, scbase.ScreensDirBaseName}
+	var movedNames []string    // moved aside to PreRestorePrefix + name
+	var restoredNames []string // renamed in from tmpDir
+	rollback := func() {
+		// only remove what was restored, anything that was not moved aside is still the user's live data
+		for _, name := range restoredNames {
+			os.RemoveAll(path.Join(waveHome, name))
+		}
+		for _, name := range movedNames {
+			err := os.Rename(path.Join(waveHome, PreRestorePrefix+name), path.Join(waveHome, name))
+			if err != nil {
+				log.Printf("[db] error restoring %s: %v\n", name, err)
+			}
+		}
+	}
+	for _, name := range swapNames {
+		curName := path.Join(waveHome, name)
+		if _, err := os.Stat(curName); err != nil {
+			continue
+		}
+		preRestoreName := path.Join(waveHome, PreRestorePrefix+name)
+		os.RemoveAll(preRestoreName)
+		err := restoreRename(curName, preRestoreName)
+		if err != nil {
+			rollback()
+			return fmt.Errorf("cannot move %s: %w", name, err)
+		}
+		movedNames = append(movedNames, name)
+	}
+	for _, name := range []string{DBFileName, scbase.SessionsDirBaseName, scbase.ScreensDirBaseName} {
+		tmpName := path.Join(tmpDir, name)
+		if _, err := os.Stat(tmpName); err != nil {
+			continue
+		}
+		err := restoreRename(tmpName, path.Join(waveHome, name))
+		if err != nil {
+			rollback()
+			return fmt.Errorf("cannot restore %s: %w", name, err)
+		}
+		restoredNames = append(restoredNames, name)
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package sstore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/cirfile"
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/scbase"
+)
+
+const testScreenId = "11111111-1111-1111-1111-111111111111"
+const testLineId = "22222222-2222-2222-2222-222222222222"
+
+func TestBackupRestore(t *testing.T) {
+	ctx := setupTestDB(t)
+	waveHome := scbase.GetWaveHomeDir()
+	err := CreateCmdPtyFile(ctx, testScreenId, testLineId, 1000)
+	if err != nil {
+		t.Fatalf("error creating pty file: %v", err)
+	}
+	AppendToCmdPtyBlob(ctx, testScreenId, testLineId, []byte("hello world"), 0)
+	clientData, err := EnsureClientData(ctx)
+	if err != nil {
+		t.Fatalf("error getting client data: %v", err)
+	}
+	backupFile := GetDefaultBackupName()
+	result, err := BackupDB(ctx, backupFile)
+	if err != nil {
+		t.Fatalf("error creating backup: %v", err)
+	}
+	if result.DBVersion != MaxMigration || result.NumFiles == 0 || result.Size == 0 {
+		t.Errorf("bad backup result: %#v", result)
+	}
+	// changes after the backup are undone by the restore
+	AppendToCmdPtyBlob(ctx, testScreenId, testLineId, []byte("!!!"), 11)
+	WithTx(ctx, func(tx *TxWrap) error {
+		tx.Exec(`UPDATE client SET userid = 'changed'`)
+		return nil
+	})
+	CloseDB()
+	manifest, err := RestoreBackup(backupFile)
+	if err != nil {
+		t.Fatalf("error restoring backup: %v", err)
+	}
+	if manifest.DBVersion != MaxMigration {
+		t.Errorf("bad manifest: %#v", manifest)
+	}
+	_, data, err := ReadFullPtyOutFile(ctx, testScreenId, testLineId)
+	if err != nil || string(data) != "hello world" {
+		t.Errorf("bad restored pty data %q: %v", data, err)
+	}
+	var userId string
+	WithTx(ctx, func(tx *TxWrap) error {
+		userId = tx.GetString(`SELECT userid FROM client`)
+		return nil
+	})
+	if userId != clientData.UserId {
+		t.Errorf("bad restored userid %q (expected %q)", userId, clientData.UserId)
+	}
+	// the replaced data is kept
+	_, err = os.Stat(path.Join(waveHome, PreRestorePrefix+scbase.ScreensDirBaseName, testScreenId))
+	if err != nil {
+		t.Errorf("replaced screens dir not kept: %v", err)
+	}
+	_, err = os.Stat(path.Join(waveHome, PreRestorePrefix+DBFileName))
+	if err != nil {
+		t.Errorf("replaced db not kept: %v", err)
+	}
+	badFile := path.Join(waveHome, "bad.tar.gz")
+	os.WriteFile(badFile, []byte("not a backup"), 0600)
+	_, err = RestoreBackup(badFile)
+	if err == nil {
+		t.Errorf("expected error restoring an invalid backup")
+	}
+}
+
+func TestBackupCompressedDuringBackup(t *testing.T) {
+	ctx := setupTestDB(t)
+	// a new screen id (screen dirs are cached by id)
+	screenId := uuid.New().String()
+	err := CreateCmdPtyFile(ctx, screenId, testLineId, 1000)
+	if err != nil {
+		t.Fatalf("error creating pty file: %v", err)
+	}
+	AppendToCmdPtyBlob(ctx, screenId, testLineId, []byte("hello world"), 0)
+	ptyOutFileName, _ := scbase.PtyOutFile(screenId, testLineId)
+	// the pty file is compressed after the screen dir was listed, but before it is opened
+	defer func() { backupOpen = os.Open }()
+	backupOpen = func(fileName string) (*os.File, error) {
+		if fileName == ptyOutFileName {
+			_, err := cirfile.CompressCirFile(context.Background(), fileName)
+			if err != nil {
+				t.Errorf("error compressing pty file: %v", err)
+			}
+		}
+		return os.Open(fileName)
+	}
+	backupFile := GetDefaultBackupName()
+	_, err = BackupDB(ctx, backupFile)
+	if err != nil {
+		t.Fatalf("error creating backup: %v", err)
+	}
+	backupOpen = os.Open
+	CloseDB()
+	_, err = RestoreBackup(backupFile)
+	if err != nil {
+		t.Fatalf("error restoring backup: %v", err)
+	}
+	_, data, err := ReadFullPtyOutFile(ctx, screenId, testLineId)
+	if err != nil || string(data) != "hello world" {
+		t.Errorf("bad restored pty data %q: %v", data, err)
+	}
+}
+
+func TestBackupEntryNames(t *testing.T) {
+	tests := []struct {
+		Name  string
+		Valid bool
+	}{
+		{BackupManifestName, true},
+		{DBFileName, true},
+		{"sessions/", true},
+		{"screens/" + testScreenId + "/" + testLineId + ".ptyout.cf", true},
+		{"../waveterm.db", false},
+		{"screens/../../etc/passwd", false},
+		{"screens/../waveterm.db", false},
+		{"/etc/passwd", false},
+		{"/screens/x", false},
+		{"other/x", false},
+		{"screens//x", false},
+	}
+	for _, test := range tests {
+		if isValidBackupEntryName(test.Name) != test.Valid {
+			t.Errorf("isValidBackupEntryName(%q) should be %v", test.Name, test.Valid)
+		}
+	}
+}
+
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		fullName := path.Join(dir, name)
+		os.MkdirAll(path.Dir(fullName), 0700)
+		err := os.WriteFile(fullName, []byte(content), 0600)
+		if err != nil {
+			t.Fatalf("error writing %s: %v", name, err)
+		}
+	}
+}
+
+func TestRestoreRollback(t *testing.T) {
+	liveFiles := map[string]string{
+		DBFileName:        "live-db",
+		DBWALFileName:     "live-wal",
+		"sessions/s1/x":   "live-session",
+		"screens/s1/x.cf": "live-screen",
+	}
+	restoreFiles := map[string]string{
+		DBFileName:        "restored-db",
+		"sessions/s2/x":   "restored-session",
+		"screens/s2/x.cf": "restored-screen",
+	}
+	defer func() { restoreRename = os.Rename }()
+	// fail moving aside (after the db was moved), and fail renaming in (after the db was restored)
+	failTargets := []string{PreRestorePrefix + scbase.SessionsDirBaseName, scbase.ScreensDirBaseName}
+	for _, failTarget := range failTargets {
+		waveHome := t.TempDir()
+		tmpDir := t.TempDir()
+		writeTestFiles(t, waveHome, liveFiles)
+		writeTestFiles(t, tmpDir, restoreFiles)
+		restoreRename = func(oldName string, newName string) error {
+			if newName == path.Join(waveHome, failTarget) {
+				return fmt.Errorf("test rename error")
+			}
+			return os.Rename(oldName, newName)
+		}
+		err := swapRestoreFiles(waveHome, tmpDir)
+		if err == nil || !strings.Contains(err.Error(), "test rename error") {
+			t.Fatalf("expected rename error (%s), got %v", failTarget, err)
+		}
+		for name, content := range liveFiles {
+			barr, err := os.ReadFile(path.Join(waveHome, name))
+			if err != nil || string(barr) != content {
+				t.Errorf("live file %s not preserved after failed restore (%s): %q %v", name, failTarget, barr, err)
+			}
+		}
+		entries, _ := os.ReadDir(waveHome)
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), PreRestorePrefix) {
+				t.Errorf("%s left after rollback (%s)", entry.Name(), failTarget)
+			}
+		}
+	}
+}
@@ -219,9 +219,13 @@ func UpsertRemote(ctx context.Context, r *RemoteType) error {
 		maxRemoteIdx := tx.GetInt(query)
 		r.RemoteIdx = int64(maxRemoteIdx + 1)
 		query = `INSERT INTO remote
-            ( remoteid, remotetype, remotealias, remotecanonicalname, remoteuser, remotehost, connectmode, autoinstall, sshopts, remoteopts, lastconnectts, archived, remoteidx, local, statevars, sshconfigsrc, openaiopts, shellpref) VALUES
-            (:remoteid,:remotetype,:remotealias,:remotecanonicalname,:remoteuser,:remotehost,:connectmode,:autoinstall,:sshopts,:remoteopts,:lastconnectts,:archived,:remoteidx,:local,:statevars,:sshconfigsrc,:openaiopts,:shellpref)`
+            ( remoteid, remotetype, remotealias, remotecanonicalname, remoteuser, remotehost, connectmode, autoinstall, sshopts, remoteopts, lastconnectts, archived, remoteidx, local, statevars, sshconfigsrc, openaiopts, shellpref, portforwards) VALUES
+            (:remoteid,:remotetype,:remotealias,:remotecanonicalname,:remoteuser,:remotehost,:connectmode,:autoinstall,:sshopts,:remoteopts,:lastconnectts,:archived,:remoteidx,:local,:statevars,:sshconfigsrc,:openaiopts,:shellpref,:portforwards)`
 		tx.NamedExec(query, r.ToMap())
+		if r.Archived {
+			query = `DELETE FROM setvar WHERE scope = ? AND scopeid = ?`
+			tx.Exec(query, SetVarScope_Connection, r.RemoteId)
+		}
 		return nil
 	})
 	return txErr
@@ -251,6 +255,106 @@ func InsertHistoryItem(ctx context.Context, hitem *HistoryItemType) error {
 
 const HistoryQueryChunkSize = 1000
 
+// history_fts is an external-content FTS5 index over history.cmdstr (keyed by the history.historyrowid
+// INTEGER PRIMARY KEY, which unlike an implicit rowid is stable across VACUUM), kept in sync by triggers.
+// FTS5 is only compiled into sqlite when wavesrv is built with the "sqlite_fts5" tag, so the index
+// is set up at startup (EnsureHistoryFts) rather than in a migration.  when FTS5 is not available
+// token/prefix queries fall back to LIKE matching.
+var historyFtsLock = &sync.Mutex{}
+var historyFtsEnabled bool
+
+const historyFtsTableSql = `CREATE VIRTUAL TABLE history_fts USING fts5(cmdstr, content='history', content_rowid='historyrowid')`
+
+var historyFtsTriggers = map[string]string{
+	"history_fts_ai": `CREATE TRIGGER IF NOT EXISTS history_fts_ai AFTER INSERT ON history BEGIN
+  INSERT INTO history_fts (rowid, cmdstr) VALUES (new.historyrowid, new.cmdstr);
+END`,
+	"history_fts_ad": `CREATE TRIGGER IF NOT EXISTS history_fts_ad AFTER DELETE ON history BEGIN
+  INSERT INTO history_fts (history_fts, rowid, cmdstr) VALUES ('delete', old.historyrowid, old.cmdstr);
+END`,
+	"history_fts_au": `CREATE TRIGGER IF NOT EXISTS history_fts_au AFTER UPDATE OF cmdstr ON history BEGIN
+  INSERT INTO history_fts (history_fts, rowid, cmdstr) VALUES ('delete', old.historyrowid, old.cmdstr);
+  INSERT INTO history_fts (rowid, cmdstr) VALUES (new.historyrowid, new.cmdstr);
+END`,
+}
+
+func IsHistoryFtsEnabled() bool {
+	historyFtsLock.Lock()
+	defer historyFtsLock.Unlock()
+	return historyFtsEnabled
+}
+
+func EnsureHistoryFts(ctx context.Context) error {
+	var enabled bool
+	var rebuilt bool
+	txErr := WithTx(ctx, func(tx *TxWrap) error {
+		if !tx.GetBool(`SELECT sqlite_compileoption_used('ENABLE_FTS5')`) {
+			// triggers left over from an FTS5 enabled build would cause history inserts to fail
+			for triggerName := range historyFtsTriggers {
+				tx.Exec(fmt.Sprintf(`DROP TRIGGER IF EXISTS %s`, triggerName))
+			}
+			return nil
+		}
+		query := `SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'history_fts'`
+		tableSql := tx.GetString(query)
+		tableExists := tableSql != ""
+		if tableExists && tableSql != historyFtsTableSql {
+			// index from before the history table had an explicit rowid column (keyed off the implicit rowid)
+			for triggerName := range historyFtsTriggers {
+				tx.Exec(fmt.Sprintf(`DROP TRIGGER IF EXISTS %s`, triggerName))
+			}
+			tx.Exec(`DROP TABLE history_fts`)
+			tableExists = false
+		}
+		query = `SELECT count(*) FROM sqlite_master WHERE type = 'trigger' AND name IN (SELECT value FROM json_each(?))`
+		numTriggers := tx.GetInt(query, quickJsonArr(utilfn.GetMapKeys(historyFtsTriggers)))
+		if !tableExists {
+			tx.Exec(historyFtsTableSql)
+		}
+		if !tableExists || numTriggers != len(historyFtsTriggers) {
+			for _, triggerSql := range historyFtsTriggers {
+				tx.Exec(triggerSql)
+			}
+			tx.Exec(`INSERT INTO history_fts (history_fts) VALUES ('rebuild')`)
+			rebuilt = true
+		}
+		enabled = true
+		return nil
+	})
+	if txErr != nil {
+		return txErr
+	}
+	historyFtsLock.Lock()
+	historyFtsEnabled = enabled
+	historyFtsLock.Unlock()
+	log.Printf("[db] history fts enabled=%v rebuilt=%v\n", enabled, rebuilt)
+	return nil
+}
+
+// quotes each whitespace separated term as an FTS5 string (terms are implicitly AND-ed)
+func makeHistoryFtsQuery(searchText string, prefix bool) string {
+	var terms []string
+	for _, term := range strings.Fields(searchText) {
+		ftsTerm := "\"" + strings.ReplaceAll(term, "\"", "\"\"") + "\""
+		if prefix {
+			ftsTerm += "*"
+		}
+		terms = append(terms, ftsTerm)
+	}
+	return strings.Join(terms, " ")
+}
+
+func escapeLikeArg(arg string) string {
+	arg = strings.ReplaceAll(arg, "\\", "\\\\")
+	arg = strings.ReplaceAll(arg, "%", "\\%")
+	arg = strings.ReplaceAll(arg, "_", "\\_")
+	return arg
+}
+
+func makeHistoryLikeArg(searchText string) string {
+	return "%" + escapeLikeArg(searchText) + "%"
+}
+
 func _getNextHistoryItem(items []*HistoryItemType, index int, filterFn func(*HistoryItemType) bool) (*HistoryItemType, int) {
 	for ; index < len(items); index++ {
 		item := items[index]
@@ -349,12 +453,26 @@ func runHistoryQuery(tx *TxWrap, opts HistoryQueryOpts, realOffset int, itemLimi
 	} else {
 		hNumStr = "g"
 	}
+	fromClause := "history h"
+	var fromArgs []interface{}
+	orderBy := "h.ts DESC, h.historyid DESC"
 	if opts.SearchText != "" {
-		whereClause += " AND h.cmdstr LIKE ? ESCAPE '\\'"
-		likeArg := opts.SearchText
-		likeArg = strings.ReplaceAll(likeArg, "%", "\\%")
-		likeArg = strings.ReplaceAll(likeArg, "_", "\\_")
-		queryArgs = append(queryArgs, "%"+likeArg+"%")
+		isFtsMode := opts.QueryMode == HistoryQueryMode_Token || opts.QueryMode == HistoryQueryMode_Prefix
+		if isFtsMode && IsHistoryFtsEnabled() {
+			ftsQuery := makeHistoryFtsQuery(opts.SearchText, opts.QueryMode == HistoryQueryMode_Prefix)
+			fromClause = "history h JOIN (SELECT rowid, rank FROM history_fts WHERE history_fts MATCH ?) f ON f.rowid = h.historyrowid"
+			orderBy = "f.rank, " + orderBy
+			fromArgs = append(fromArgs, ftsQuery)
+		} else if isFtsMode {
+			// no FTS5, every term must be a substring
+			for _, term := range strings.Fields(opts.SearchText) {
+				whereClause += " AND h.cmdstr LIKE ? ESCAPE '\\'"
+				queryArgs = append(queryArgs, makeHistoryLikeArg(term))
+			}
+		} else {
+			whereClause += " AND h.cmdstr LIKE ? ESCAPE '\\'"
+			queryArgs = append(queryArgs, makeHistoryLikeArg(opts.SearchText))
+		}
 	}
 	if opts.FromTs > 0 {
 		whereClause += fmt.Sprintf(" AND h.ts <= %d", opts.FromTs)
@@ -365,8 +483,36 @@ func runHistoryQuery(tx *TxWrap, opts HistoryQueryOpts, realOffset int, itemLimi
 	if opts.NoMeta {
 		whereClause += " AND NOT h.ismetacmd"
 	}
-	query := fmt.Sprintf("SELECT %s, ('%s' || CAST((row_number() OVER win) as text)) historynum FROM history h %s WINDOW win AS (ORDER BY h.ts, h.historyid) ORDER BY h.ts DESC, h.historyid DESC LIMIT %d OFFSET %d", HistoryCols, hNumStr, whereClause, itemLimit, realOffset)
-	marr := tx.SelectMaps(query, queryArgs...)
+	if opts.FailedOnly {
+		whereClause += " AND (h.haderror OR (h.exitcode IS NOT NULL AND h.exitcode <> 0))"
+	}
+	if opts.ExitCode != nil {
+		whereClause += fmt.Sprintf(" AND h.exitcode = %d", *opts.ExitCode)
+	}
+	if opts.MinDurationMs > 0 {
+		whereClause += fmt.Sprintf(" AND h.durationms >= %d", opts.MinDurationMs)
+	}
+	if opts.MaxDurationMs > 0 {
+		whereClause += fmt.Sprintf(" AND h.durationms <= %d", opts.MaxDurationMs)
+	}
+	if opts.CwdPrefix != "" {
+		// matches the directory itself and anything below it (not /home/username for /home/user)
+		cwdPrefix := strings.TrimRight(opts.CwdPrefix, "/")
+		whereClause += " AND (json_extract(h.festate, '$.cwd') = ? OR json_extract(h.festate, '$.cwd') LIKE ? || '/%' ESCAPE '\\')"
+		queryArgs = append(queryArgs, cwdPrefix, escapeLikeArg(cwdPrefix))
+	}
+	if opts.BeforeTs > 0 {
+		whereClause += fmt.Sprintf(" AND h.ts < %d", opts.BeforeTs)
+	}
+	if opts.AfterTs > 0 {
+		whereClause += fmt.Sprintf(" AND h.ts > %d", opts.AfterTs)
+	}
+	for _, tag := range opts.Tags {
+		whereClause += " AND EXISTS (SELECT 1 FROM json_each(h.tags) WHERE key = ? AND value)"
+		queryArgs = append(queryArgs, tag)
+	}
+	query := fmt.Sprintf("SELECT %s, ('%s' || CAST((row_number() OVER win) as text)) historynum FROM %s %s WINDOW win AS (ORDER BY h.ts, h.historyid) ORDER BY %s LIMIT %d OFFSET %d", HistoryCols, hNumStr, fromClause, whereClause, orderBy, itemLimit, realOffset)
+	marr := tx.SelectMaps(query, append(fromArgs, queryArgs...)...)
 	rtn := make([]*HistoryItemType, len(marr))
 	for idx, m := range marr {
 		hitem := dbutil.FromMap[*HistoryItemType](m)
@@ -391,6 +537,49 @@ func GetHistoryItems(ctx context.Context, opts HistoryQueryOpts) (*HistoryQueryR
 	return rtn, nil
 }
 
+// returns all history items matching opts (MaxItems, Offset and FilterFn are ignored), oldest first
+func GetAllHistoryItems(ctx context.Context, opts HistoryQueryOpts) ([]*HistoryItemType, error) {
+	return WithTxRtn(ctx, func(tx *TxWrap) ([]*HistoryItemType, error) {
+		var rtn []*HistoryItemType
+		for rawOffset := 0; ; rawOffset += HistoryQueryChunkSize {
+			resultItems, err := runHistoryQuery(tx, opts, rawOffset, HistoryQueryChunkSize)
+			if err != nil {
+				return nil, err
+			}
+			rtn = append(rtn, resultItems...)
+			if len(resultItems) < HistoryQueryChunkSize {
+				break
+			}
+		}
+		for i, j := 0, len(rtn)-1; i < j; i, j = i+1, j-1 {
+			rtn[i], rtn[j] = rtn[j], rtn[i]
+		}
+		return rtn, nil
+	})
+}
+
+// inserts history items, skipping any items whose historyid already exists.  returns the number of items inserted.
+func ImportHistoryItems(ctx context.Context, hitems []*HistoryItemType) (int, error) {
+	return WithTxRtn(ctx, func(tx *TxWrap) (int, error) {
+		var numInserted int
+		for _, hitem := range hitems {
+			if hitem == nil {
+				continue
+			}
+			query := `SELECT historyid FROM history WHERE historyid = ?`
+			if tx.Exists(query, hitem.HistoryId) {
+				continue
+			}
+			query = `INSERT INTO history 
+                  ( historyid, ts, userid, sessionid, screenid, lineid, haderror, cmdstr, remoteownerid, remoteid, remotename, ismetacmd, linenum, exitcode, durationms, festate, tags, status) VALUES
+                  (:historyid,:ts,:userid,:sessionid,:screenid,:lineid,:haderror,:cmdstr,:remoteownerid,:remoteid,:remotename,:ismetacmd,:linenum,:exitcode,:durationms,:festate,:tags,:status)`
+			tx.NamedExec(query, hitem.ToMap())
+			numInserted++
+		}
+		return numInserted, nil
+	})
+}
+
 func GetHistoryItemByLineNum(ctx context.Context, screenId string, lineNum int) (*HistoryItemType, error) {
 	return WithTxRtn(ctx, func(tx *TxWrap) (*HistoryItemType, error) {
 		query := `SELECT * FROM history WHERE screenid = ? AND linenum = ?`
@@ -699,6 +888,12 @@ func InsertScreen(ctx context.Context, sessionId string, origScreenName string,
 		if localRemoteId == "" {
 			return fmt.Errorf("cannot create screen, no local remote found")
 		}
+		curRemoteId := localRemoteId
+		// the connection scope does not apply here (this var picks the connection)
+		defRemoteVar := resolveSetVar(tx, SetVar_Remote, SetVarScopeIds{SessionId: sessionId})
+		if defRemoteVar != nil && tx.Exists(`SELECT remoteid FROM remote WHERE remoteid = ? AND NOT archived`, defRemoteVar.Value) {
+			curRemoteId = defRemoteVar.Value
+		}
 		maxScreenIdx := tx.GetInt(`SELECT COALESCE(max(screenidx), 0) FROM screen WHERE sessionid = ? AND NOT archived`, sessionId)
 		var screenName string
 		if origScreenName == "" {
@@ -730,7 +925,7 @@ func InsertScreen(ctx context.Context, sessionId string, origScreenName string,
 			ScreenOpts:   ScreenOptsType{},
 			OwnerId:      "",
 			ShareMode:    ShareModeLocal,
-			CurRemote:    RemotePtrType{RemoteId: localRemoteId},
+			CurRemote:    RemotePtrType{RemoteId: curRemoteId},
 			NextLineNum:  1,
 			SelectedLine: 0,
 			Anchor:       ScreenAnchorType{},
@@ -902,16 +1097,16 @@ func UpdateWithUpdateOpenAICmdInfoPacket(ctx context.Context, screenId string, m
 	return UpdateWithCurrentOpenAICmdInfoChat(screenId, nil), nil
 }
 
-func UpdateCmdForRestart(ctx context.Context, ck base.CommandKey, ts int64, cmdPid int, remotePid int, termOpts *TermOpts) error {
+func UpdateCmdForRestart(ctx context.Context, ck base.CommandKey, ts int64, status string, cmdPid int, remotePid int, termOpts *TermOpts) error {
 	return WithTx(ctx, func(tx *TxWrap) error {
 		query := `UPDATE cmd
 		          SET restartts = ?, status = ?, exitcode = ?, cmdpid = ?, remotepid = ?, durationms = ?, termopts = ?, origtermopts = ?
 				  WHERE screenid = ? AND lineid = ?`
-		tx.Exec(query, ts, CmdStatusRunning, 0, cmdPid, remotePid, 0, quickJson(termOpts), quickJson(termOpts), ck.GetGroupId(), lineIdFromCK(ck))
+		tx.Exec(query, ts, status, 0, cmdPid, remotePid, 0, quickJson(termOpts), quickJson(termOpts), ck.GetGroupId(), lineIdFromCK(ck))
 		query = `UPDATE history
 		         SET ts = ?, status = ?, exitcode = ?, durationms = ?
 			     WHERE screenid = ? AND lineid = ?`
-		tx.Exec(query, ts, CmdStatusRunning, 0, 0, ck.GetGroupId(), lineIdFromCK(ck))
+		tx.Exec(query, ts, status, 0, 0, ck.GetGroupId(), lineIdFromCK(ck))
 		return nil
 	})
 }
@@ -927,8 +1122,8 @@ func UpdateCmdDoneInfo(ctx context.Context, ck base.CommandKey, donePk *packet.C
 	var rtnCmd *CmdType
 	txErr := WithTx(ctx, func(tx *TxWrap) error {
 		lineId := lineIdFromCK(ck)
-		query := `UPDATE cmd SET status = ?, donets = ?, exitcode = ?, durationms = ? WHERE screenid = ? AND lineid = ?`
-		tx.Exec(query, status, donePk.Ts, donePk.ExitCode, donePk.DurationMs, screenId, lineId)
+		query := `UPDATE cmd SET status = ?, donets = ?, exitcode = ?, durationms = ?, rusage = ? WHERE screenid = ? AND lineid = ?`
+		tx.Exec(query, status, donePk.Ts, donePk.ExitCode, donePk.DurationMs, quickNullableJson(donePk.RUsage), screenId, lineId)
 		query = `UPDATE history SET status = ?, exitcode = ?, durationms = ? WHERE screenid = ? AND lineid = ?`
 		tx.Exec(query, status, donePk.ExitCode, donePk.DurationMs, screenId, lineId)
 		var err error
@@ -1029,14 +1224,41 @@ func HangupAllRunningCmds(ctx context.Context) error {
 	})
 }
 
+// lineids of the screen's cmds that are no longer running (they will not write more output)
+func GetFinishedCmdLineIds(ctx context.Context, screenId string) ([]string, error) {
+	return WithTxRtn(ctx, func(tx *TxWrap) ([]string, error) {
+		query := `SELECT lineid FROM cmd WHERE screenid = ? AND status NOT IN (?, ?)`
+		return tx.SelectStrings(query, screenId, CmdStatusRunning, CmdStatusDetached), nil
+	})
+}
+
+// detached commands keep running on the remote when the connection is lost (they can be reattached)
+func GetDetachedCmdsByRemoteId(ctx context.Context, remoteId string) ([]CmdPtr, error) {
+	return WithTxRtn(ctx, func(tx *TxWrap) ([]CmdPtr, error) {
+		var cmdPtrs []CmdPtr
+		query := `SELECT screenid, lineid FROM cmd WHERE status = ? AND remoteid = ?`
+		tx.Select(&cmdPtrs, query, CmdStatusDetached, remoteId)
+		return cmdPtrs, nil
+	})
+}
+
 // TODO send update
 func HangupRunningCmdsByRemoteId(ctx context.Context, remoteId string) ([]*ScreenType, error) {
+	return hangupCmdsByRemoteId(ctx, remoteId, CmdStatusRunning)
+}
+
+// TODO send update
+func HangupDetachedCmdsByRemoteId(ctx context.Context, remoteId string) ([]*ScreenType, error) {
+	return hangupCmdsByRemoteId(ctx, remoteId, CmdStatusDetached)
+}
+
+func hangupCmdsByRemoteId(ctx context.Context, remoteId string, status string) ([]*ScreenType, error) {
 	return WithTxRtn(ctx, func(tx *TxWrap) ([]*ScreenType, error) {
 		var cmdPtrs []CmdPtr
 		query := `SELECT screenid, lineid FROM cmd WHERE status = ? AND remoteid = ?`
-		tx.Select(&cmdPtrs, query, CmdStatusRunning, remoteId)
+		tx.Select(&cmdPtrs, query, status, remoteId)
 		query = `UPDATE cmd SET status = ? WHERE status = ? AND remoteid = ?`
-		tx.Exec(query, CmdStatusHangup, CmdStatusRunning, remoteId)
+		tx.Exec(query, CmdStatusHangup, status, remoteId)
 		var rtn []*ScreenType
 		for _, cmdPtr := range cmdPtrs {
 			if isWebShare(tx, cmdPtr.ScreenId) {
@@ -1239,7 +1461,7 @@ func DeleteScreen(ctx context.Context, screenId string, sessionDel bool, update
 			}
 			query = `SELECT count(*) FROM screen WHERE sessionid = ? AND NOT archived`
 			numScreens := tx.GetInt(query, sessionId)
-			if numScreens <= 1 {
+			if numScreens <= 1 && !screen.Archived {
 				return fmt.Errorf("cannot delete the last screen in a session")
 			}
 			isActive = tx.Exists(`SELECT sessionid FROM session WHERE sessionid = ? AND activescreenid = ?`, sessionId, screenId)
@@ -1267,6 +1489,8 @@ func DeleteScreen(ctx context.Context, screenId string, sessionDel bool, update
 		tx.Exec(query, screenId)
 		query = `UPDATE history SET lineid = '', linenum = 0 WHERE screenid = ?`
 		tx.Exec(query, screenId)
+		query = `DELETE FROM setvar WHERE scope = ? AND scopeid = ?`
+		tx.Exec(query, SetVarScope_Screen, screenId)
 		if webSharing {
 			insertScreenDelUpdate(tx, screenId)
 		}
@@ -1525,10 +1749,10 @@ func ArchiveScreenLines(ctx context.Context, screenId string) (*scbus.ModelUpdat
 		if !tx.Exists(query, screenId) {
 			return fmt.Errorf("screen does not exist")
 		}
-		query = `UPDATE line SET archived = 1
+		query = `UPDATE line SET archived = 1, archivedts = ?
 		         WHERE line.archived = 0 AND line.screenid = ? AND NOT EXISTS (SELECT * FROM cmd c
 				 WHERE line.screenid = c.screenid AND line.lineid = c.lineid AND c.status IN ('running', 'detached'))`
-		tx.Exec(query, screenId)
+		tx.Exec(query, time.Now().UnixMilli(), screenId)
 		return nil
 	})
 	if txErr != nil {
@@ -1591,8 +1815,8 @@ func DeleteScreenLines(ctx context.Context, screenId string) (*scbus.ModelUpdate
 func GetRunningScreenCmds(ctx context.Context, screenId string) ([]*CmdType, error) {
 	var rtn []*CmdType
 	txErr := WithTx(ctx, func(tx *TxWrap) error {
-		query := `SELECT * FROM cmd WHERE screenid = ? AND status = ?`
-		rtn = dbutil.SelectMapsGen[*CmdType](tx, query, screenId, CmdStatusRunning)
+		query := `SELECT * FROM cmd WHERE screenid = ? AND status IN (?, ?)`
+		rtn = dbutil.SelectMapsGen[*CmdType](tx, query, screenId, CmdStatusRunning, CmdStatusDetached)
 		return nil
 	})
 	if txErr != nil {
@@ -1655,6 +1879,8 @@ func DeleteSession(ctx context.Context, sessionId string) (scbus.UpdatePacket, e
 		}
 		query = `DELETE FROM session WHERE sessionid = ?`
 		tx.Exec(query, sessionId)
+		query = `DELETE FROM setvar WHERE scope = ? AND scopeid = ?`
+		tx.Exec(query, SetVarScope_Session, sessionId)
 		newActiveSessionId, _ = fixActiveSessionId(tx.Context())
 		sessionTombstone = &SessionTombstoneType{
 			SessionId: sessionId,
@@ -1775,6 +2001,7 @@ func UnArchiveSession(ctx context.Context, sessionId string, activate bool) (*sc
 
 func GetSessionStats(ctx context.Context, sessionId string) (*SessionStatsType, error) {
 	rtn := &SessionStatsType{SessionId: sessionId}
+	var screenIds []string
 	txErr := WithTx(ctx, func(tx *TxWrap) error {
 		query := `SELECT sessionid FROM session WHERE sessionid = ?`
 		if !tx.Exists(query, sessionId) {
@@ -1788,6 +2015,8 @@ func GetSessionStats(ctx context.Context, sessionId string) (*SessionStatsType,
 		rtn.NumLines = tx.GetInt(query, sessionId)
 		query = `SELECT count(*) FROM cmd WHERE screenid IN (SELECT screenid FROM screen WHERE sessionid = ?)`
 		rtn.NumCmds = tx.GetInt(query, sessionId)
+		query = `SELECT screenid FROM screen WHERE sessionid = ?`
+		screenIds = tx.SelectStrings(query, sessionId)
 		return nil
 	})
 	if txErr != nil {
@@ -1797,6 +2026,7 @@ func GetSessionStats(ctx context.Context, sessionId string) (*SessionStatsType,
 	if err != nil {
 		return nil, err
 	}
+	diskSize.add(screensDiskSize(screenIds))
 	rtn.DiskStats = diskSize
 	return rtn, nil
 }
@@ -1808,6 +2038,7 @@ const (
 	RemoteField_SSHPassword = "sshpassword" // string
 	RemoteField_Color       = "color"       // string
 	RemoteField_ShellPref   = "shellpref"   // string
+	RemoteField_ProxyJump   = "proxyjump"   // string
 )
 
 // editMap: alias, connectmode, autoinstall, sshkey, color, sshpassword (from constants)
@@ -1839,6 +2070,10 @@ func UpdateRemote(ctx context.Context, remoteId string, editMap map[string]inter
 			query = `UPDATE remote SET sshopts = json_set(sshopts, '$.sshpassword', ?) WHERE remoteid = ?`
 			tx.Exec(query, sshPassword, remoteId)
 		}
+		if proxyJump, found := editMap[RemoteField_ProxyJump]; found {
+			query = `UPDATE remote SET sshopts = json_set(sshopts, '$.sshproxyjump', ?) WHERE remoteid = ?`
+			tx.Exec(query, proxyJump, remoteId)
+		}
 		if shellPref, found := editMap[RemoteField_ShellPref]; found {
 			query = `UPDATE remote SET shellpref = ? WHERE remoteid = ?`
 			tx.Exec(query, shellPref, remoteId)
@@ -1860,6 +2095,18 @@ func UpdateRemote(ctx context.Context, remoteId string, editMap map[string]inter
 	return rtn, nil
 }
 
+func UpdateRemotePortForwards(ctx context.Context, remoteId string, fwds []*PortForwardType) (*RemoteType, error) {
+	return WithTxRtn(ctx, func(tx *TxWrap) (*RemoteType, error) {
+		query := `SELECT remoteid FROM remote WHERE remoteid = ?`
+		if !tx.Exists(query, remoteId) {
+			return nil, fmt.Errorf("remote not found")
+		}
+		query = `UPDATE remote SET portforwards = ? WHERE remoteid = ?`
+		tx.Exec(query, quickJsonArr(fwds), remoteId)
+		return GetRemoteById(tx.Context(), remoteId)
+	})
+}
+
 const (
 	ScreenField_AnchorLine   = "anchorline"   // int
 	ScreenField_AnchorOffset = "anchoroffset" // int
@@ -2137,8 +2384,12 @@ func GetLineById(ctx context.Context, screenId string, lineId string) (*LineType
 
 func SetLineArchivedById(ctx context.Context, screenId string, lineId string, archived bool) error {
 	txErr := WithTx(ctx, func(tx *TxWrap) error {
-		query := `UPDATE line SET archived = ? WHERE screenid = ? AND lineid = ?`
-		tx.Exec(query, archived, screenId, lineId)
+		var archivedTs int64
+		if archived {
+			archivedTs = time.Now().UnixMilli()
+		}
+		query := `UPDATE line SET archived = ?, archivedts = ? WHERE screenid = ? AND lineid = ?`
+		tx.Exec(query, archived, archivedTs, screenId, lineId)
 		if isWebShare(tx, screenId) {
 			if archived {
 				insertScreenLineUpdate(tx, screenId, lineId, UpdateType_LineDel)
@@ -2193,7 +2444,7 @@ func DeleteLinesByIds(ctx context.Context, screenId string, lineIds []string) er
 		for _, lineId := range lineIds {
 			query := `SELECT status FROM cmd WHERE screenid = ? AND lineid = ?`
 			cmdStatus := tx.GetString(query, screenId, lineId)
-			if cmdStatus == CmdStatusRunning {
+			if cmdStatus == CmdStatusRunning || cmdStatus == CmdStatusDetached {
 				return fmt.Errorf("cannot delete line[%s], cmd is running", lineId)
 			}
 			query = `DELETE FROM line WHERE screenid = ? AND lineid = ?`
@@ -2428,9 +2679,17 @@ func GetBookmarkById(ctx context.Context, bookmarkId string, tag string) (*Bookm
 	return rtn, nil
 }
 
+// resolves a bookmark by alias, id, or 8-character id prefix
 func GetBookmarkIdByArg(ctx context.Context, bookmarkArg string) (string, error) {
 	var rtnId string
 	txErr := WithTx(ctx, func(tx *TxWrap) error {
+		if bookmarkArg != "" {
+			query := `SELECT bookmarkid FROM bookmark WHERE alias = ?`
+			rtnId = tx.GetString(query, bookmarkArg)
+			if rtnId != "" {
+				return nil
+			}
+		}
 		if len(bookmarkArg) == 8 {
 			query := `SELECT bookmarkid FROM bookmark WHERE bookmarkid LIKE (? || '%')`
 			rtnId = tx.GetString(query, bookmarkArg)
@@ -2481,6 +2740,7 @@ func InsertBookmark(ctx context.Context, bm *BookmarkType) error {
 const (
 	BookmarkField_Desc   = "desc"
 	BookmarkField_CmdStr = "cmdstr"
+	BookmarkField_Alias  = "alias"
 )
 
 func EditBookmark(ctx context.Context, bookmarkId string, editMap map[string]interface{}) error {
@@ -2497,6 +2757,14 @@ func EditBookmark(ctx context.Context, bookmarkId string, editMap map[string]int
 			query = `UPDATE bookmark SET cmdstr = ? WHERE bookmarkid = ?`
 			tx.Exec(query, cmdStr, bookmarkId)
 		}
+		if alias, found := editMap[BookmarkField_Alias]; found {
+			query = `SELECT bookmarkid FROM bookmark WHERE alias = ? AND alias <> '' AND bookmarkid <> ?`
+			if tx.Exists(query, alias, bookmarkId) {
+				return fmt.Errorf("bookmark alias %q already in use", alias)
+			}
+			query = `UPDATE bookmark SET alias = ? WHERE bookmarkid = ?`
+			tx.Exec(query, alias, bookmarkId)
+		}
 		return nil
 	})
 	return txErr
@@ -2531,18 +2799,19 @@ func DeleteBookmark(ctx context.Context, bookmarkId string) error {
 	return txErr
 }
 
-func CreatePlaybook(ctx context.Context, name string) (*PlaybookType, error) {
+func CreatePlaybook(ctx context.Context, name string, description string) (*PlaybookType, error) {
 	return WithTxRtn(ctx, func(tx *TxWrap) (*PlaybookType, error) {
-		query := `SELECT playbookid FROM playbook WHERE name = ?`
+		query := `SELECT playbookid FROM playbook WHERE playbookname = ?`
 		if tx.Exists(query, name) {
 			return nil, fmt.Errorf("playbook %q already exists", name)
 		}
 		rtn := &PlaybookType{}
 		rtn.PlaybookId = uuid.New().String()
 		rtn.PlaybookName = name
+		rtn.Description = description
 		query = `INSERT INTO playbook ( playbookid, playbookname, description, entryids)
                                VALUES (:playbookid,:playbookname,:description,:entryids)`
-		tx.Exec(query, rtn.ToMap())
+		tx.NamedExec(query, rtn.ToMap())
 		return rtn, nil
 	})
 }
@@ -2553,6 +2822,29 @@ func selectPlaybook(tx *TxWrap, playbookId string) *PlaybookType {
 	return playbook
 }
 
+func selectPlaybookEntries(tx *TxWrap, playbook *PlaybookType) {
+	query := `SELECT * FROM playbook_entry WHERE playbookid = ?`
+	playbook.Entries = dbutil.SelectMappable[*PlaybookEntry](tx, query, playbook.PlaybookId)
+	playbook.OrderEntries()
+}
+
+// resolves a playbook by name, id, or 8-character id prefix
+func GetPlaybookIdByArg(ctx context.Context, playbookArg string) (string, error) {
+	return WithTxRtn(ctx, func(tx *TxWrap) (string, error) {
+		query := `SELECT playbookid FROM playbook WHERE playbookname = ?`
+		rtnId := tx.GetString(query, playbookArg)
+		if rtnId != "" {
+			return rtnId, nil
+		}
+		if len(playbookArg) == 8 {
+			query = `SELECT playbookid FROM playbook WHERE playbookid LIKE (? || '%')`
+			return tx.GetString(query, playbookArg), nil
+		}
+		query = `SELECT playbookid FROM playbook WHERE playbookid = ?`
+		return tx.GetString(query, playbookArg), nil
+	})
+}
+
 func AddPlaybookEntry(ctx context.Context, entry *PlaybookEntry) error {
 	if entry.EntryId == "" {
 		return fmt.Errorf("invalid entryid")
@@ -2568,7 +2860,7 @@ func AddPlaybookEntry(ctx context.Context, entry *PlaybookEntry) error {
 		}
 		query = `INSERT INTO playbook_entry ( entryid, playbookid, description, alias, cmdstr, createdts, updatedts)
                                      VALUES (:entryid,:playbookid,:description,:alias,:cmdstr,:createdts,:updatedts)`
-		tx.Exec(query, entry)
+		tx.NamedExec(query, dbutil.ToDBMap(entry, false))
 		playbook.EntryIds = append(playbook.EntryIds, entry.EntryId)
 		query = `UPDATE playbook SET entryids = ? WHERE playbookid = ?`
 		tx.Exec(query, quickJsonArr(playbook.EntryIds), entry.PlaybookId)
@@ -2595,19 +2887,116 @@ func RemovePlaybookEntry(ctx context.Context, playbookId string, entryId string)
 	})
 }
 
+// moves entryId to newIdx (0-based, clamped to the end of the list)
+func SetPlaybookEntryIdx(ctx context.Context, playbookId string, entryId string, newIdx int) error {
+	return WithTx(ctx, func(tx *TxWrap) error {
+		playbook := selectPlaybook(tx, playbookId)
+		if playbook == nil {
+			return fmt.Errorf("cannot reorder playbook entry, playbook does not exist")
+		}
+		if !utilfn.ContainsStr(playbook.EntryIds, entryId) {
+			return fmt.Errorf("cannot reorder playbook entry, entry does not exist")
+		}
+		playbook.RemoveEntry(entryId)
+		if newIdx < 0 {
+			newIdx = 0
+		}
+		if newIdx > len(playbook.EntryIds) {
+			newIdx = len(playbook.EntryIds)
+		}
+		newEntryIds := make([]string, 0, len(playbook.EntryIds)+1)
+		newEntryIds = append(newEntryIds, playbook.EntryIds[:newIdx]...)
+		newEntryIds = append(newEntryIds, entryId)
+		newEntryIds = append(newEntryIds, playbook.EntryIds[newIdx:]...)
+		query := `UPDATE playbook SET entryids = ? WHERE playbookid = ?`
+		tx.Exec(query, quickJsonArr(newEntryIds), playbookId)
+		return nil
+	})
+}
+
+func DeletePlaybook(ctx context.Context, playbookId string) error {
+	return WithTx(ctx, func(tx *TxWrap) error {
+		query := `SELECT playbookid FROM playbook WHERE playbookid = ?`
+		if !tx.Exists(query, playbookId) {
+			return fmt.Errorf("playbook not found")
+		}
+		query = `DELETE FROM playbook_entry WHERE playbookid = ?`
+		tx.Exec(query, playbookId)
+		query = `DELETE FROM playbook WHERE playbookid = ?`
+		tx.Exec(query, playbookId)
+		return nil
+	})
+}
+
 func GetPlaybookById(ctx context.Context, playbookId string) (*PlaybookType, error) {
 	return WithTxRtn(ctx, func(tx *TxWrap) (*PlaybookType, error) {
 		rtn := selectPlaybook(tx, playbookId)
 		if rtn == nil {
 			return nil, nil
 		}
-		query := `SELECT * FROM playbook_entry WHERE playbookid = ?`
-		tx.Select(&rtn.Entries, query, playbookId)
-		rtn.OrderEntries()
+		selectPlaybookEntries(tx, rtn)
 		return rtn, nil
 	})
 }
 
+func GetAllPlaybooks(ctx context.Context) ([]*PlaybookType, error) {
+	return WithTxRtn(ctx, func(tx *TxWrap) ([]*PlaybookType, error) {
+		query := `SELECT * FROM playbook ORDER BY playbookname`
+		rtn := dbutil.SelectMapsGen[*PlaybookType](tx, query)
+		for _, playbook := range rtn {
+			selectPlaybookEntries(tx, playbook)
+		}
+		return rtn, nil
+	})
+}
+
+func UpsertSetVar(ctx context.Context, sv *SetVarType) error {
+	if sv == nil || sv.Scope == "" || sv.Name == "" {
+		return fmt.Errorf("invalid setvar, scope and name must be set")
+	}
+	return WithTx(ctx, func(tx *TxWrap) error {
+		sv.UpdatedTs = time.Now().UnixMilli()
+		query := `INSERT INTO setvar ( scope, scopeid, name, value, updatedts)
+                              VALUES (:scope,:scopeid,:name,:value,:updatedts)
+                  ON CONFLICT (scope, scopeid, name) DO UPDATE SET value = excluded.value, updatedts = excluded.updatedts`
+		tx.NamedExec(query, dbutil.ToDBMap(sv, false))
+		return nil
+	})
+}
+
+func DeleteSetVar(ctx context.Context, scope string, scopeId string, name string) error {
+	return WithTx(ctx, func(tx *TxWrap) error {
+		query := `DELETE FROM setvar WHERE scope = ? AND scopeid = ? AND name = ?`
+		tx.Exec(query, scope, scopeId, name)
+		return nil
+	})
+}
+
+func GetSetVars(ctx context.Context, scope string, scopeId string) ([]*SetVarType, error) {
+	return WithTxRtn(ctx, func(tx *TxWrap) ([]*SetVarType, error) {
+		query := `SELECT * FROM setvar WHERE scope = ? AND scopeid = ? ORDER BY name`
+		return dbutil.SelectMappable[*SetVarType](tx, query, scope, scopeId), nil
+	})
+}
+
+func resolveSetVar(tx *TxWrap, name string, scopeIds SetVarScopeIds) *SetVarType {
+	for _, scopeRef := range scopeIds.scopeChain() {
+		query := `SELECT * FROM setvar WHERE scope = ? AND scopeid = ? AND name = ?`
+		sv := dbutil.GetMappable[*SetVarType](tx, query, scopeRef[0], scopeRef[1], name)
+		if sv != nil {
+			return sv
+		}
+	}
+	return nil
+}
+
+// returns nil if the var is not set in any of the scopes
+func ResolveSetVar(ctx context.Context, name string, scopeIds SetVarScopeIds) (*SetVarType, error) {
+	return WithTxRtn(ctx, func(tx *TxWrap) (*SetVarType, error) {
+		return resolveSetVar(tx, name, scopeIds), nil
+	})
+}
+
 func getLineIdsFromHistoryItems(historyItems []*HistoryItemType) []string {
 	var rtn []string
 	for _, hitem := range historyItems {
@@ -12,6 +12,7 @@ import (
 	"log"
 	"os"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -21,24 +22,65 @@ import (
 	"github.com/wavetermdev/waveterm/wavesrv/pkg/scbus"
 )
 
+const PtyCompressMinAge = 10 * time.Minute
+
 func CreateCmdPtyFile(ctx context.Context, screenId string, lineId string, maxSize int64) error {
 	ptyOutFileName, err := scbase.PtyOutFile(screenId, lineId)
 	if err != nil {
 		return err
 	}
-	f, err := cirfile.CreateCirFile(ptyOutFileName, maxSize)
+	f, err := cirfile.CreateCirFileWithIndex(ptyOutFileName, maxSize)
 	if err != nil {
 		return err
 	}
 	return f.Close()
 }
 
+// finished pty files may be compressed (see CompressDonePtyFiles), stat and reads fall back to the compressed file
 func StatCmdPtyFile(ctx context.Context, screenId string, lineId string) (*cirfile.Stat, error) {
 	ptyOutFileName, err := scbase.PtyOutFile(screenId, lineId)
 	if err != nil {
 		return nil, err
 	}
-	return cirfile.StatCirFile(ctx, ptyOutFileName)
+	stat, err := cirfile.StatCirFile(ctx, ptyOutFileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		if zStat, zErr := cirfile.StatCompressedFile(ptyOutFileName); zErr == nil {
+			return zStat, nil
+		}
+	}
+	return stat, err
+}
+
+// implemented by *cirfile.File and *cirfile.CompressedFile
+type ptyOutReader interface {
+	ReadAll(ctx context.Context) (int64, []byte, error)
+	ReadAtWithMax(ctx context.Context, offset int64, maxSize int64) (int64, []byte, error)
+	ReadTimeRange(ctx context.Context, startTs int64, endTs int64, maxSize int64) (int64, []byte, error)
+	ReadIndex(ctx context.Context) ([]cirfile.IndexEntry, error)
+	Close() error
+}
+
+func openPtyOutReader(screenId string, lineId string) (ptyOutReader, error) {
+	ptyOutFileName, err := scbase.PtyOutFile(screenId, lineId)
+	if err != nil {
+		return nil, err
+	}
+	f, err := cirfile.OpenCirFile(ptyOutFileName)
+	if err == nil {
+		return f, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	cf, zErr := cirfile.ReadCompressedFile(ptyOutFileName)
+	if errors.Is(zErr, fs.ErrNotExist) {
+		// decompressed (by an append) after the cirfile open failed
+		return cirfile.OpenCirFile(ptyOutFileName)
+	}
+	if zErr != nil {
+		return nil, zErr
+	}
+	return cf, nil
 }
 
 func ClearCmdPtyFile(ctx context.Context, screenId string, lineId string) error {
@@ -46,11 +88,11 @@ func ClearCmdPtyFile(ctx context.Context, screenId string, lineId string) error
 	if err != nil {
 		return err
 	}
-	stat, err := cirfile.StatCirFile(ctx, ptyOutFileName)
+	stat, err := StatCmdPtyFile(ctx, screenId, lineId)
 	if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		return err
 	}
-	os.Remove(ptyOutFileName) // ignore error
+	cirfile.RemoveCirFile(ptyOutFileName) // ignore error (also removes a compressed file)
 	var maxSize int64 = shexec.DefaultMaxPtySize
 	if stat != nil {
 		maxSize = stat.MaxSize
@@ -74,6 +116,13 @@ func AppendToCmdPtyBlob(ctx context.Context, screenId string, lineId string, dat
 		return nil, err
 	}
 	f, err := cirfile.OpenCirFile(ptyOutFileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		// output for a compressed (finished) command, restore the cirfile.
+		// ErrNotExist means another caller already restored it
+		if zErr := cirfile.DecompressCirFile(ptyOutFileName); zErr == nil || errors.Is(zErr, fs.ErrNotExist) {
+			f, err = cirfile.OpenCirFile(ptyOutFileName)
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -100,11 +149,7 @@ func AppendToCmdPtyBlob(ctx context.Context, screenId string, lineId string, dat
 
 // returns (real-offset, data, err)
 func ReadFullPtyOutFile(ctx context.Context, screenId string, lineId string) (int64, []byte, error) {
-	ptyOutFileName, err := scbase.PtyOutFile(screenId, lineId)
-	if err != nil {
-		return 0, nil, err
-	}
-	f, err := cirfile.OpenCirFile(ptyOutFileName)
+	f, err := openPtyOutReader(screenId, lineId)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -114,16 +159,32 @@ func ReadFullPtyOutFile(ctx context.Context, screenId string, lineId string) (in
 
 // returns (real-offset, data, err)
 func ReadPtyOutFile(ctx context.Context, screenId string, lineId string, offset int64, maxSize int64) (int64, []byte, error) {
-	ptyOutFileName, err := scbase.PtyOutFile(screenId, lineId)
+	f, err := openPtyOutReader(screenId, lineId)
 	if err != nil {
 		return 0, nil, err
 	}
-	f, err := cirfile.OpenCirFile(ptyOutFileName)
+	defer f.Close()
+	return f.ReadAtWithMax(ctx, offset, maxSize)
+}
+
+// returns (real-offset, data, err) for the output written in [startTs, endTs) (unix millis, endTs of 0 for no end).
+// returns cirfile.ErrNoIndex for pty files created without an index
+func ReadPtyOutFileTimeRange(ctx context.Context, screenId string, lineId string, startTs int64, endTs int64, maxSize int64) (int64, []byte, error) {
+	f, err := openPtyOutReader(screenId, lineId)
 	if err != nil {
 		return 0, nil, err
 	}
 	defer f.Close()
-	return f.ReadAtWithMax(ctx, offset, maxSize)
+	return f.ReadTimeRange(ctx, startTs, endTs, maxSize)
+}
+
+func ReadPtyOutIndex(ctx context.Context, screenId string, lineId string) ([]cirfile.IndexEntry, error) {
+	f, err := openPtyOutReader(screenId, lineId)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.ReadIndex(ctx)
 }
 
 type SessionDiskSizeType struct {
@@ -131,6 +192,19 @@ type SessionDiskSizeType struct {
 	TotalSize  int64
 	ErrorCount int
 	Location   string
+
+	NumCompressedFiles int
+	CompressedSize     int64 // size on disk of the compressed pty files (included in TotalSize)
+	CompressedRawSize  int64 // uncompressed data size of the compressed pty files
+}
+
+func (ds *SessionDiskSizeType) add(other SessionDiskSizeType) {
+	ds.NumFiles += other.NumFiles
+	ds.TotalSize += other.TotalSize
+	ds.ErrorCount += other.ErrorCount
+	ds.NumCompressedFiles += other.NumCompressedFiles
+	ds.CompressedSize += other.CompressedSize
+	ds.CompressedRawSize += other.CompressedRawSize
 }
 
 func directorySize(dirName string) (SessionDiskSizeType, error) {
@@ -152,10 +226,36 @@ func directorySize(dirName string) (SessionDiskSizeType, error) {
 		}
 		rtn.NumFiles++
 		rtn.TotalSize += finfo.Size()
+		if strings.HasSuffix(entry.Name(), cirfile.CompressedSuffix) {
+			stat, err := cirfile.StatCompressedFile(strings.TrimSuffix(path.Join(dirName, entry.Name()), cirfile.CompressedSuffix))
+			if err != nil {
+				rtn.ErrorCount++
+				continue
+			}
+			rtn.NumCompressedFiles++
+			rtn.CompressedSize += stat.CompressedSize
+			rtn.CompressedRawSize += stat.DataSize
+		}
 	}
 	return rtn, nil
 }
 
+// the pty files are stored in the screen dirs (the session dir only has files from older versions)
+func screensDiskSize(screenIds []string) SessionDiskSizeType {
+	var rtn SessionDiskSizeType
+	for _, screenId := range screenIds {
+		diskSize, err := directorySize(path.Join(scbase.GetScreensDir(), screenId))
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				rtn.ErrorCount++
+			}
+			continue
+		}
+		rtn.add(diskSize)
+	}
+	return rtn
+}
+
 func SessionDiskSize(sessionId string) (SessionDiskSizeType, error) {
 	sessionDir, err := scbase.EnsureSessionDir(sessionId)
 	if err != nil {
@@ -189,12 +289,101 @@ func FullSessionDiskSize() (map[string]SessionDiskSizeType, error) {
 	return rtn, nil
 }
 
+// compresses the pty files of finished cmds that have not been written to for PtyCompressMinAge.
+// screens that a client is watching are skipped (so lines that are being viewed are not compressed).
+// returns the number of files compressed
+func CompressDonePtyFiles(ctx context.Context) (int, error) {
+	sdir := scbase.GetScreensDir()
+	entries, err := os.ReadDir(sdir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	numCompressed := 0
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return numCompressed, ctx.Err()
+		}
+		screenId := entry.Name()
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := uuid.Parse(screenId); err != nil {
+			continue
+		}
+		if scbus.MainUpdateBus.IsScreenWatched(screenId) {
+			continue
+		}
+		num, err := compressScreenPtyFiles(ctx, screenId, path.Join(sdir, screenId))
+		numCompressed += num
+		if err != nil {
+			log.Printf("error compressing pty files for screen %s: %v\n", screenId, err)
+		}
+	}
+	return numCompressed, nil
+}
+
+func compressScreenPtyFiles(ctx context.Context, screenId string, screenDir string) (int, error) {
+	dirEntries, err := os.ReadDir(screenDir)
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-PtyCompressMinAge)
+	candidates := make(map[string]string) // lineid => file name
+	for _, entry := range dirEntries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), scbase.PtyOutFileSuffix) {
+			continue
+		}
+		finfo, err := entry.Info()
+		if err != nil || finfo.ModTime().After(cutoff) {
+			continue
+		}
+		candidates[strings.TrimSuffix(entry.Name(), scbase.PtyOutFileSuffix)] = path.Join(screenDir, entry.Name())
+	}
+	if len(candidates) == 0 {
+		return 0, nil
+	}
+	lineIds, err := GetFinishedCmdLineIds(ctx, screenId)
+	if err != nil {
+		return 0, err
+	}
+	numCompressed := 0
+	for _, lineId := range lineIds {
+		fileName, ok := candidates[lineId]
+		if !ok {
+			continue
+		}
+		_, err = cirfile.CompressCirFile(ctx, fileName)
+		if err != nil {
+			return numCompressed, fmt.Errorf("lineid %s: %w", lineId, err)
+		}
+		numCompressed++
+	}
+	return numCompressed, nil
+}
+
 func DeletePtyOutFile(ctx context.Context, screenId string, lineId string) error {
 	ptyOutFileName, err := scbase.PtyOutFile(screenId, lineId)
 	if err != nil {
 		return err
 	}
-	err = os.Remove(ptyOutFileName)
+	err = cirfile.RemoveCirFile(ptyOutFileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// keeps only the newest keepSize bytes of the pty output (the file is rewritten, see cirfile.TruncateCirFile).
+// only for finished cmds
+func TruncatePtyOutFile(ctx context.Context, screenId string, lineId string, keepSize int64) error {
+	ptyOutFileName, err := scbase.PtyOutFile(screenId, lineId)
+	if err != nil {
+		return err
+	}
+	_, err = cirfile.TruncateCirFile(ctx, ptyOutFileName, keepSize)
 	if errors.Is(err, fs.ErrNotExist) {
 		return nil
 	}
@@ -0,0 +1,275 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package sstore
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+const testRemoteId = "33333333-3333-3333-3333-333333333333"
+
+type testHistoryItem struct {
+	CmdStr     string
+	ExitCode   *int64
+	HadError   bool
+	IsMetaCmd  bool
+	DurationMs int64
+	Cwd        string
+	Tags       []string
+}
+
+func int64Ptr(val int64) *int64 {
+	return &val
+}
+
+// inserts the items with increasing timestamps (1000, 2000, ...)
+func insertTestHistory(t *testing.T, ctx context.Context, items []testHistoryItem) {
+	for idx, item := range items {
+		hitem := &HistoryItemType{
+			HistoryId: uuid.New().String(),
+			Ts:        int64(idx+1) * 1000,
+			SessionId: testScreenId,
+			ScreenId:  testScreenId,
+			CmdStr:    item.CmdStr,
+			HadError:  item.HadError,
+			IsMetaCmd: item.IsMetaCmd,
+			ExitCode:  item.ExitCode,
+			Remote:    RemotePtrType{RemoteId: testRemoteId},
+			FeState:   FeStateType{"cwd": item.Cwd},
+			Status:    CmdStatusDone,
+		}
+		if item.DurationMs > 0 {
+			hitem.DurationMs = int64Ptr(item.DurationMs)
+		}
+		if len(item.Tags) > 0 {
+			hitem.Tags = make(map[string]bool)
+			for _, tag := range item.Tags {
+				hitem.Tags[tag] = true
+			}
+		}
+		err := InsertHistoryItem(ctx, hitem)
+		if err != nil {
+			t.Fatalf("error inserting history item: %v", err)
+		}
+	}
+}
+
+// returns the cmdstrs of the matching items (newest first), joined with ","
+func queryTestHistory(t *testing.T, ctx context.Context, opts HistoryQueryOpts) string {
+	opts.MaxItems = 100
+	result, err := GetHistoryItems(ctx, opts)
+	if err != nil {
+		t.Fatalf("error querying history: %v", err)
+	}
+	var cmdStrs []string
+	for _, item := range result.Items {
+		cmdStrs = append(cmdStrs, item.CmdStr)
+	}
+	return strings.Join(cmdStrs, ",")
+}
+
+func TestHistoryQueryFilters(t *testing.T) {
+	ctx := setupTestDB(t)
+	insertTestHistory(t, ctx, []testHistoryItem{
+		{CmdStr: "ls -l", ExitCode: int64Ptr(0), DurationMs: 10, Cwd: "/home/user"},
+		{CmdStr: "make build", ExitCode: int64Ptr(2), DurationMs: 5000, Cwd: "/home/user/src", Tags: []string{"build"}},
+		{CmdStr: "git status", ExitCode: int64Ptr(1), DurationMs: 50, Cwd: "/tmp/100%_/done", Tags: []string{"git"}},
+		{CmdStr: "make test", ExitCode: int64Ptr(0), DurationMs: 20000, Cwd: "/home/user/src", Tags: []string{"build", "test"}},
+		{CmdStr: "/history", HadError: true, IsMetaCmd: true, Cwd: "/home/username"},
+	})
+	tests := []struct {
+		Name     string
+		Opts     HistoryQueryOpts
+		Expected string
+	}{
+		{"all", HistoryQueryOpts{}, "/history,make test,git status,make build,ls -l"},
+		{"nometa", HistoryQueryOpts{NoMeta: true}, "make test,git status,make build,ls -l"},
+		{"failed", HistoryQueryOpts{FailedOnly: true}, "/history,git status,make build"},
+		{"exitcode 0", HistoryQueryOpts{ExitCode: int64Ptr(0)}, "make test,ls -l"},
+		{"exitcode 2", HistoryQueryOpts{ExitCode: int64Ptr(2)}, "make build"},
+		{"exitcode none", HistoryQueryOpts{ExitCode: int64Ptr(127)}, ""},
+		{"minduration", HistoryQueryOpts{MinDurationMs: 50}, "make test,git status,make build"},
+		{"maxduration", HistoryQueryOpts{MaxDurationMs: 5000}, "git status,make build,ls -l"},
+		{"duration range", HistoryQueryOpts{MinDurationMs: 50, MaxDurationMs: 5000}, "git status,make build"},
+		{"cwd", HistoryQueryOpts{CwdPrefix: "/home/user/src"}, "make test,make build"},
+		{"cwd prefix", HistoryQueryOpts{CwdPrefix: "/home/user"}, "make test,make build,ls -l"},
+		{"cwd trailing slash", HistoryQueryOpts{CwdPrefix: "/home/user/"}, "make test,make build,ls -l"},
+		{"cwd partial name", HistoryQueryOpts{CwdPrefix: "/home/use"}, ""},
+		{"cwd root", HistoryQueryOpts{CwdPrefix: "/"}, "/history,make test,git status,make build,ls -l"},
+		{"cwd escaped", HistoryQueryOpts{CwdPrefix: "/tmp/100%_"}, "git status"},
+		{"cwd escaped no match", HistoryQueryOpts{CwdPrefix: "/tmp/1000"}, ""},
+		{"before", HistoryQueryOpts{BeforeTs: 3000}, "make build,ls -l"},
+		{"after", HistoryQueryOpts{AfterTs: 3000}, "/history,make test"},
+		{"fromts", HistoryQueryOpts{FromTs: 3000}, "git status,make build,ls -l"},
+		{"tag", HistoryQueryOpts{Tags: []string{"build"}}, "make test,make build"},
+		{"all tags", HistoryQueryOpts{Tags: []string{"build", "test"}}, "make test"},
+		{"missing tag", HistoryQueryOpts{Tags: []string{"build", "git"}}, ""},
+		{"remote", HistoryQueryOpts{RemoteId: testRemoteId, NoMeta: true}, "make test,git status,make build,ls -l"},
+		{"other remote", HistoryQueryOpts{RemoteId: testLineId}, ""},
+		{"search", HistoryQueryOpts{SearchText: "make"}, "make test,make build"},
+		// combinations are AND-ed
+		{"failed and cwd", HistoryQueryOpts{FailedOnly: true, CwdPrefix: "/home/user/src"}, "make build"},
+		{"failed and nometa", HistoryQueryOpts{FailedOnly: true, NoMeta: true}, "git status,make build"},
+		{"tag and duration", HistoryQueryOpts{Tags: []string{"build"}, MaxDurationMs: 10000}, "make build"},
+		{"search and exitcode", HistoryQueryOpts{SearchText: "make", ExitCode: int64Ptr(0)}, "make test"},
+		{"range and cwd", HistoryQueryOpts{AfterTs: 1000, BeforeTs: 5000, CwdPrefix: "/home"}, "make test,make build"},
+		{"all filters", HistoryQueryOpts{SearchText: "make", NoMeta: true, ExitCode: int64Ptr(0), MinDurationMs: 1000, CwdPrefix: "/home/user", AfterTs: 1000, BeforeTs: 5000, Tags: []string{"test"}}, "make test"},
+	}
+	for _, test := range tests {
+		rtn := queryTestHistory(t, ctx, test.Opts)
+		if rtn != test.Expected {
+			t.Errorf("%s: got [%s], expected [%s]", test.Name, rtn, test.Expected)
+		}
+	}
+}
+
+func TestMakeHistoryFtsQuery(t *testing.T) {
+	tests := []struct {
+		SearchText string
+		Prefix     bool
+		Expected   string
+	}{
+		{"git", false, `"git"`},
+		{"git", true, `"git"*`},
+		{"  git   commit ", false, `"git" "commit"`},
+		{"git commit", true, `"git"* "commit"*`},
+		{`say "hi"`, false, `"say" """hi"""`},
+		{"a-b OR c*", false, `"a-b" "OR" "c*"`},
+		{"NEAR(a b)", true, `"NEAR(a"* "b)"*`},
+		{"", false, ""},
+		{"   ", true, ""},
+	}
+	for _, test := range tests {
+		rtn := makeHistoryFtsQuery(test.SearchText, test.Prefix)
+		if rtn != test.Expected {
+			t.Errorf("makeHistoryFtsQuery(%q, %v) got %s, expected %s", test.SearchText, test.Prefix, rtn, test.Expected)
+		}
+	}
+}
+
+func TestHistoryQueryModes(t *testing.T) {
+	ctx := setupTestDB(t)
+	err := EnsureHistoryFts(ctx)
+	if err != nil {
+		t.Fatalf("error setting up history fts: %v", err)
+	}
+	insertTestHistory(t, ctx, []testHistoryItem{
+		{CmdStr: "git commit -m fix"},
+		{CmdStr: "git checkout main"},
+		{CmdStr: "make gitignore"},
+		{CmdStr: "echo digit"},
+		{CmdStr: `echo "say hi" > out.txt`},
+	})
+	// without FTS5 (wavesrv built without the sqlite_fts5 tag), token and prefix queries require every term as a substring
+	ftsEnabled := IsHistoryFtsEnabled()
+	tests := []struct {
+		Mode         string
+		SearchText   string
+		Expected     string
+		ExpectedLike string
+	}{
+		{"", "git c", "git checkout main,git commit -m fix", ""},
+		{HistoryQueryMode_Substring, "git", "echo digit,make gitignore,git checkout main,git commit -m fix", ""},
+		{HistoryQueryMode_Substring, "git c", "git checkout main,git commit -m fix", ""},
+		{HistoryQueryMode_Token, "git", "git checkout main,git commit -m fix", "echo digit,make gitignore,git checkout main,git commit -m fix"},
+		{HistoryQueryMode_Token, "gi", "", "echo digit,make gitignore,git checkout main,git commit -m fix"},
+		{HistoryQueryMode_Token, "main git", "git checkout main", ""},
+		{HistoryQueryMode_Token, `"say`, `echo "say hi" > out.txt`, ""},
+		{HistoryQueryMode_Token, "out.txt", `echo "say hi" > out.txt`, ""},
+		{HistoryQueryMode_Prefix, "git", "make gitignore,git checkout main,git commit -m fix", "echo digit,make gitignore,git checkout main,git commit -m fix"},
+		{HistoryQueryMode_Prefix, "gi ma", "make gitignore,git checkout main", ""},
+		{HistoryQueryMode_Prefix, "che", "git checkout main", ""},
+		{HistoryQueryMode_Prefix, "ignore", "", "make gitignore"},
+		{HistoryQueryMode_Prefix, "NEAR(git", "", ""},
+	}
+	for _, test := range tests {
+		expected := test.Expected
+		if !ftsEnabled && test.ExpectedLike != "" {
+			expected = test.ExpectedLike
+		}
+		// ranked results are compared as sets (ties are ordered by ts, so the order is not fixed)
+		rtn := queryTestHistory(t, ctx, HistoryQueryOpts{SearchText: test.SearchText, QueryMode: test.Mode})
+		if test.Mode != HistoryQueryMode_Substring && test.Mode != "" {
+			rtn = sortCmdStrs(rtn)
+			expected = sortCmdStrs(expected)
+		}
+		if rtn != expected {
+			t.Errorf("%s %q (fts=%v): got [%s], expected [%s]", test.Mode, test.SearchText, ftsEnabled, rtn, expected)
+		}
+	}
+}
+
+func sortCmdStrs(cmdStrs string) string {
+	if cmdStrs == "" {
+		return ""
+	}
+	parts := strings.Split(cmdStrs, ",")
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func TestHistoryFtsUpgrade(t *testing.T) {
+	ctx := setupTestDB(t)
+	err := EnsureHistoryFts(ctx)
+	if err != nil {
+		t.Fatalf("error setting up history fts: %v", err)
+	}
+	if !IsHistoryFtsEnabled() {
+		t.Skip("sqlite built without FTS5 (use -tags sqlite_fts5)")
+	}
+	insertTestHistory(t, ctx, []testHistoryItem{{CmdStr: "git status"}, {CmdStr: "ls"}})
+	// indexes keyed off the implicit rowid (as created before historyrowid existed) are recreated
+	staleTableSqls := []string{
+		`CREATE VIRTUAL TABLE history_fts USING fts5(cmdstr, content='history', content_rowid='rowid')`,
+		`CREATE VIRTUAL TABLE history_fts USING fts5(cmdstr, content='history')`,
+	}
+	for _, staleSql := range staleTableSqls {
+		WithTx(ctx, func(tx *TxWrap) error {
+			tx.Exec(`DROP TABLE history_fts`)
+			tx.Exec(staleSql)
+			return nil
+		})
+		err = EnsureHistoryFts(ctx)
+		if err != nil {
+			t.Fatalf("error upgrading history fts: %v", err)
+		}
+		tableSql, _ := WithTxRtn(ctx, func(tx *TxWrap) (string, error) {
+			return tx.GetString(`SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'history_fts'`), nil
+		})
+		if tableSql != historyFtsTableSql {
+			t.Errorf("history_fts was not recreated: %s", tableSql)
+		}
+		rtn := queryTestHistory(t, ctx, HistoryQueryOpts{SearchText: "git", QueryMode: HistoryQueryMode_Token})
+		if rtn != "git status" {
+			t.Errorf("token query after upgrade from %q got [%s]", staleSql, rtn)
+		}
+	}
+}
+
+func TestHistoryFtsMigrateDown(t *testing.T) {
+	ctx := setupTestDB(t)
+	err := EnsureHistoryFts(ctx)
+	if err != nil {
+		t.Fatalf("error setting up history fts: %v", err)
+	}
+	if !IsHistoryFtsEnabled() {
+		t.Skip("sqlite built without FTS5 (use -tags sqlite_fts5)")
+	}
+	insertTestHistory(t, ctx, []testHistoryItem{{CmdStr: "git status"}})
+	err = MigrateGoto(35)
+	if err != nil {
+		t.Fatalf("error migrating down: %v", err)
+	}
+	numFts, _ := WithTxRtn(ctx, func(tx *TxWrap) (int, error) {
+		return tx.GetInt(`SELECT count(*) FROM sqlite_master WHERE name LIKE 'history_fts%'`), nil
+	})
+	if numFts != 0 {
+		t.Errorf("history_fts table/triggers left after migrating down: %d", numFts)
+	}
+}
@@ -22,23 +22,27 @@ import (
 	"github.com/golang-migrate/migrate/v4"
 )
 
-const MaxMigration = 31
+const MaxMigration = 36
 const MigratePrimaryScreenVersion = 9
 const CmdScreenSpecialMigration = 13
 const CmdLineSpecialMigration = 20
 const RISpecialMigration = 30
 
 func MakeMigrate() (*migrate.Migrate, error) {
+	return makeMigrateForDB(GetDBName())
+}
+
+func makeMigrateForDB(dbName string) (*migrate.Migrate, error) {
 	fsVar, err := iofs.New(sh2db.MigrationFS, "migrations")
 	if err != nil {
 		return nil, fmt.Errorf("opening iofs: %w", err)
 	}
 	// migrationPathUrl := fmt.Sprintf("file://%s", path.Join(wd, "db", "migrations"))
-	dbUrl := fmt.Sprintf("sqlite3://%s", GetDBName())
+	dbUrl := fmt.Sprintf("sqlite3://%s", dbName)
 	m, err := migrate.NewWithSourceInstance("iofs", fsVar, dbUrl)
 	// m, err := migrate.New(migrationPathUrl, dbUrl)
 	if err != nil {
-		return nil, fmt.Errorf("making migration db[%s]: %w", GetDBName(), err)
+		return nil, fmt.Errorf("making migration db[%s]: %w", dbName, err)
 	}
 	return m, nil
 }
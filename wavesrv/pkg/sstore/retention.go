@@ -0,0 +1,482 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package sstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/wavetermdev/waveterm/waveshell/pkg/cirfile"
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/scbase"
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/scbus"
+)
+
+const (
+	RetentionAction_DeleteScreen    = "delete-screen"
+	RetentionAction_DeleteLine      = "delete-line"
+	RetentionAction_DeletePtyFile   = "delete-ptyfile"
+	RetentionAction_TruncatePtyFile = "truncate-ptyfile"
+)
+
+const (
+	RetentionReason_ArchivedAge = "archived-age"
+	RetentionReason_ScreenPty   = "screen-pty"
+	RetentionReason_MaxDisk     = "max-disk"
+)
+
+type RetentionActionType struct {
+	Action   string `json:"action"`
+	Reason   string `json:"reason"`
+	ScreenId string `json:"screenid"`
+	LineId   string `json:"lineid,omitempty"`
+	Size     int64  `json:"size"`               // bytes freed on disk (estimated for truncations)
+	KeepSize int64  `json:"keepsize,omitempty"` // bytes of pty data kept by RetentionAction_TruncatePtyFile
+}
+
+type RetentionResultType struct {
+	Actions    []*RetentionActionType `json:"actions"`
+	NumApplied int                    `json:"numapplied"`
+	NumSkipped int                    `json:"numskipped,omitempty"` // pty actions skipped (screen being viewed or cmd running again)
+	FreedSize  int64                  `json:"freedsize"`
+	DryRun     bool                   `json:"dryrun,omitempty"`
+}
+
+type SessionStorageUsageType struct {
+	SessionId string
+	Name      string
+	Archived  bool
+	DiskSize  SessionDiskSizeType
+}
+
+type StorageUsageType struct {
+	Total          SessionDiskSizeType       // screen dirs + session dirs
+	Sessions       []SessionStorageUsageType // sorted by size (largest first)
+	NumOrphanDirs  int                       // screen dirs without a screen
+	OrphanDirsSize int64
+}
+
+// pty files (cirfile, index, compressed) for one line
+type ptyFileUsage struct {
+	ScreenId string
+	LineId   string
+	Size     int64 // on disk
+	DataSize int64 // (uncompressed) pty data
+	ModTime  time.Time
+}
+
+type screenDirUsage struct {
+	ScreenId string
+	DiskSize SessionDiskSizeType
+	PtyFiles []*ptyFileUsage
+}
+
+func listScreenDir(screenId string) (*screenDirUsage, error) {
+	screenDir := path.Join(scbase.GetScreensDir(), screenId)
+	diskSize, err := directorySize(screenDir)
+	if err != nil {
+		return nil, err
+	}
+	rtn := &screenDirUsage{ScreenId: screenId, DiskSize: diskSize}
+	entries, err := os.ReadDir(screenDir)
+	if err != nil {
+		return nil, err
+	}
+	byLineId := make(map[string]*ptyFileUsage)
+	for _, entry := range entries {
+		lineId, fileSuffix, found := strings.Cut(entry.Name(), scbase.PtyOutFileSuffix)
+		if !found || entry.IsDir() || strings.HasSuffix(fileSuffix, ".tmp") {
+			continue
+		}
+		finfo, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		pf := byLineId[lineId]
+		if pf == nil {
+			pf = &ptyFileUsage{ScreenId: screenId, LineId: lineId}
+			byLineId[lineId] = pf
+			rtn.PtyFiles = append(rtn.PtyFiles, pf)
+		}
+		pf.Size += finfo.Size()
+		if fileSuffix == "" && finfo.Size() > cirfile.HeaderLen {
+			pf.DataSize += finfo.Size() - cirfile.HeaderLen
+		} else if fileSuffix == cirfile.CompressedSuffix {
+			zStat, err := cirfile.StatCompressedFile(path.Join(screenDir, lineId+scbase.PtyOutFileSuffix))
+			if err == nil {
+				pf.DataSize += zStat.DataSize
+			}
+		}
+		if finfo.ModTime().After(pf.ModTime) {
+			pf.ModTime = finfo.ModTime()
+		}
+	}
+	return rtn, nil
+}
+
+func listAllScreenDirs() ([]*screenDirUsage, error) {
+	entries, err := os.ReadDir(scbase.GetScreensDir())
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var rtn []*screenDirUsage
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := uuid.Parse(entry.Name()); err != nil {
+			continue
+		}
+		usage, err := listScreenDir(entry.Name())
+		if err != nil {
+			log.Printf("error listing screen dir %s: %v\n", entry.Name(), err)
+			continue
+		}
+		rtn = append(rtn, usage)
+	}
+	return rtn, nil
+}
+
+func sessionDirsDiskSize() SessionDiskSizeType {
+	var rtn SessionDiskSizeType
+	sizes, err := FullSessionDiskSize()
+	if err != nil {
+		return rtn
+	}
+	for _, diskSize := range sizes {
+		rtn.add(diskSize)
+	}
+	return rtn
+}
+
+func GetStorageUsage(ctx context.Context) (*StorageUsageType, error) {
+	screenDirs, err := listAllScreenDirs()
+	if err != nil {
+		return nil, err
+	}
+	var sessions []*SessionStorageUsageType
+	screenSessionIds := make(map[string]string)
+	txErr := WithTx(ctx, func(tx *TxWrap) error {
+		query := `SELECT sessionid, name, archived FROM session ORDER BY archived, sessionidx`
+		tx.Select(&sessions, query)
+		var screenPtrs []struct {
+			ScreenId  string
+			SessionId string
+		}
+		query = `SELECT screenid, sessionid FROM screen`
+		tx.Select(&screenPtrs, query)
+		for _, ptr := range screenPtrs {
+			screenSessionIds[ptr.ScreenId] = ptr.SessionId
+		}
+		return nil
+	})
+	if txErr != nil {
+		return nil, txErr
+	}
+	rtn := &StorageUsageType{}
+	sessionMap := make(map[string]*SessionStorageUsageType)
+	for _, session := range sessions {
+		diskSize, _ := directorySize(path.Join(scbase.GetSessionsDir(), session.SessionId))
+		session.DiskSize = diskSize
+		sessionMap[session.SessionId] = session
+	}
+	for _, usage := range screenDirs {
+		session := sessionMap[screenSessionIds[usage.ScreenId]]
+		if session == nil {
+			rtn.NumOrphanDirs++
+			rtn.OrphanDirsSize += usage.DiskSize.TotalSize
+		} else {
+			session.DiskSize.add(usage.DiskSize)
+		}
+		rtn.Total.add(usage.DiskSize)
+	}
+	rtn.Total.add(sessionDirsDiskSize())
+	rtn.Total.Location = scbase.GetScreensDir()
+	for _, session := range sessions {
+		rtn.Sessions = append(rtn.Sessions, *session)
+	}
+	sort.SliceStable(rtn.Sessions, func(i int, j int) bool {
+		return rtn.Sessions[i].DiskSize.TotalSize > rtn.Sessions[j].DiskSize.TotalSize
+	})
+	return rtn, nil
+}
+
+// the db and disk state the retention rules are applied to
+type retentionInput struct {
+	ScreenDirs        []*screenDirUsage
+	SessionDirsSize   int64
+	ActiveCmds        []CmdPtr // running or detached, pty files are never deleted or truncated
+	ArchivedScreenIds []string // archived before the ArchivedMaxAgeMs cutoff (oldest first)
+	ArchivedLines     []CmdPtr // archived before the ArchivedMaxAgeMs cutoff (oldest first), not in ArchivedScreenIds
+}
+
+// returns the actions needed to enforce the retention rules (nothing is deleted).  the rules are applied in order:
+// screens and lines archived longer than ArchivedMaxAgeMs ago are deleted, then the oldest pty data in a screen is
+// deleted (or truncated) until it is under MaxScreenPtySize, then the oldest pty data overall until the total is under
+// MaxDiskSize.  pty files of running (or detached) cmds are never deleted.
+func PlanRetention(ctx context.Context, opts RetentionOptsType) ([]*RetentionActionType, error) {
+	if opts.IsEmpty() {
+		return nil, nil
+	}
+	screenDirs, err := listAllScreenDirs()
+	if err != nil {
+		return nil, err
+	}
+	input := &retentionInput{ScreenDirs: screenDirs, SessionDirsSize: sessionDirsDiskSize().TotalSize}
+	txErr := WithTx(ctx, func(tx *TxWrap) error {
+		query := `SELECT screenid, lineid FROM cmd WHERE status IN (?, ?)`
+		tx.Select(&input.ActiveCmds, query, CmdStatusRunning, CmdStatusDetached)
+		if opts.ArchivedMaxAgeMs > 0 {
+			cutoffTs := time.Now().UnixMilli() - opts.ArchivedMaxAgeMs
+			query = `SELECT screenid FROM screen WHERE archived AND archivedts < ? ORDER BY archivedts`
+			input.ArchivedScreenIds = tx.SelectStrings(query, cutoffTs)
+			query = `SELECT screenid, lineid FROM line
+			         WHERE archived AND archivedts < ?
+			           AND screenid NOT IN (SELECT screenid FROM screen WHERE archived AND archivedts < ?)
+			           AND NOT EXISTS (SELECT 1 FROM cmd c WHERE c.screenid = line.screenid AND c.lineid = line.lineid AND c.status IN (?, ?))
+			         ORDER BY archivedts`
+			tx.Select(&input.ArchivedLines, query, cutoffTs, cutoffTs, CmdStatusRunning, CmdStatusDetached)
+		}
+		return nil
+	})
+	if txErr != nil {
+		return nil, txErr
+	}
+	return planRetentionActions(opts, input), nil
+}
+
+// deletes pf if that frees less than (or just about) excess bytes, otherwise truncates its oldest data
+func trimPtyFileAction(pf *ptyFileUsage, excess int64, reason string) *RetentionActionType {
+	action := &RetentionActionType{Reason: reason, ScreenId: pf.ScreenId, LineId: pf.LineId}
+	var keepSize int64
+	if excess < pf.Size {
+		// the data to keep is proportional to the size on disk (which is compressed or includes the header and index)
+		keepSize = int64(float64(pf.DataSize) * float64(pf.Size-excess) / float64(pf.Size))
+	}
+	if keepSize <= 0 {
+		action.Action = RetentionAction_DeletePtyFile
+		action.Size = pf.Size
+		return action
+	}
+	action.Action = RetentionAction_TruncatePtyFile
+	action.Size = excess
+	action.KeepSize = keepSize
+	return action
+}
+
+// updates pf for the (planned) action
+func (pf *ptyFileUsage) applyAction(action *RetentionActionType) {
+	if action.Action == RetentionAction_TruncatePtyFile {
+		pf.Size -= action.Size
+		pf.DataSize = action.KeepSize
+	} else {
+		pf.Size = 0
+		pf.DataSize = 0
+	}
+}
+
+func planRetentionActions(opts RetentionOptsType, input *retentionInput) []*RetentionActionType {
+	activeSet := make(map[CmdPtr]bool)
+	for _, ptr := range input.ActiveCmds {
+		activeSet[ptr] = true
+	}
+	dirMap := make(map[string]*screenDirUsage)
+	ptyFileMap := make(map[CmdPtr]*ptyFileUsage)
+	for _, usage := range input.ScreenDirs {
+		dirMap[usage.ScreenId] = usage
+		for _, pf := range usage.PtyFiles {
+			ptyFileMap[CmdPtr{ScreenId: pf.ScreenId, LineId: pf.LineId}] = pf
+		}
+	}
+	var rtn []*RetentionActionType
+	var freedSize int64
+	deletedScreens := make(map[string]bool)
+	deletedPtyFiles := make(map[CmdPtr]bool)
+	for _, screenId := range input.ArchivedScreenIds {
+		var size int64
+		if usage := dirMap[screenId]; usage != nil {
+			size = usage.DiskSize.TotalSize
+		}
+		rtn = append(rtn, &RetentionActionType{Action: RetentionAction_DeleteScreen, Reason: RetentionReason_ArchivedAge, ScreenId: screenId, Size: size})
+		freedSize += size
+		deletedScreens[screenId] = true
+	}
+	for _, ptr := range input.ArchivedLines {
+		if activeSet[ptr] {
+			continue
+		}
+		var size int64
+		if pf := ptyFileMap[ptr]; pf != nil {
+			size = pf.Size
+		}
+		rtn = append(rtn, &RetentionActionType{Action: RetentionAction_DeleteLine, Reason: RetentionReason_ArchivedAge, ScreenId: ptr.ScreenId, LineId: ptr.LineId, Size: size})
+		freedSize += size
+		deletedPtyFiles[ptr] = true
+	}
+	// remaining deletable pty files, oldest first
+	var candidates []*ptyFileUsage
+	for _, usage := range input.ScreenDirs {
+		if deletedScreens[usage.ScreenId] {
+			continue
+		}
+		var screenFiles []*ptyFileUsage
+		var screenPtySize int64
+		for _, pf := range usage.PtyFiles {
+			ptr := CmdPtr{ScreenId: pf.ScreenId, LineId: pf.LineId}
+			if deletedPtyFiles[ptr] {
+				continue
+			}
+			screenPtySize += pf.Size
+			if !activeSet[ptr] {
+				screenFiles = append(screenFiles, pf)
+			}
+		}
+		sortPtyFilesByAge(screenFiles)
+		for opts.MaxScreenPtySize > 0 && screenPtySize > opts.MaxScreenPtySize && len(screenFiles) > 0 {
+			pf := screenFiles[0]
+			action := trimPtyFileAction(pf, screenPtySize-opts.MaxScreenPtySize, RetentionReason_ScreenPty)
+			rtn = append(rtn, action)
+			freedSize += action.Size
+			screenPtySize -= action.Size
+			pf.applyAction(action)
+			if action.Action == RetentionAction_DeletePtyFile {
+				screenFiles = screenFiles[1:]
+			} else {
+				break
+			}
+		}
+		candidates = append(candidates, screenFiles...)
+	}
+	if opts.MaxDiskSize > 0 {
+		var totalSize int64
+		for _, usage := range input.ScreenDirs {
+			totalSize += usage.DiskSize.TotalSize
+		}
+		totalSize += input.SessionDirsSize
+		totalSize -= freedSize
+		sortPtyFilesByAge(candidates)
+		for totalSize > opts.MaxDiskSize && len(candidates) > 0 {
+			pf := candidates[0]
+			candidates = candidates[1:]
+			action := trimPtyFileAction(pf, totalSize-opts.MaxDiskSize, RetentionReason_MaxDisk)
+			rtn = append(rtn, action)
+			totalSize -= action.Size
+			pf.applyAction(action)
+		}
+	}
+	return rtn
+}
+
+func sortPtyFilesByAge(files []*ptyFileUsage) {
+	sort.SliceStable(files, func(i int, j int) bool {
+		return files[i].ModTime.Before(files[j].ModTime)
+	})
+}
+
+// deletes through the normal screen/line/ptyfile delete paths (and sends the model updates).
+// keeps going on errors, returns the first error
+func ApplyRetentionActions(ctx context.Context, actions []*RetentionActionType) (*RetentionResultType, error) {
+	rtn := &RetentionResultType{Actions: actions}
+	var firstErr error
+	for _, action := range actions {
+		if ctx.Err() != nil {
+			return rtn, ctx.Err()
+		}
+		applied, err := applyRetentionAction(ctx, action)
+		if err != nil {
+			log.Printf("[retention] error %s screen:%s line:%s: %v\n", action.Action, action.ScreenId, action.LineId, err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s %s: %w", action.Action, action.ScreenId, err)
+			}
+			continue
+		}
+		if !applied {
+			rtn.NumSkipped++
+			continue
+		}
+		rtn.NumApplied++
+		rtn.FreedSize += action.Size
+	}
+	return rtn, firstErr
+}
+
+// pty files in a screen that is being viewed are left alone (the frontend may be reading them), and the cmd
+// status is checked again because the cmd can have been restarted since the actions were planned
+func skipPtyRetentionAction(ctx context.Context, action *RetentionActionType) (bool, error) {
+	if scbus.MainUpdateBus.IsScreenWatched(action.ScreenId) {
+		return true, nil
+	}
+	return WithTxRtn(ctx, func(tx *TxWrap) (bool, error) {
+		query := `SELECT 1 FROM cmd WHERE screenid = ? AND lineid = ? AND status IN (?, ?)`
+		return tx.Exists(query, action.ScreenId, action.LineId, CmdStatusRunning, CmdStatusDetached), nil
+	})
+}
+
+// returns false if the action was skipped
+func applyRetentionAction(ctx context.Context, action *RetentionActionType) (bool, error) {
+	switch action.Action {
+	case RetentionAction_DeleteScreen:
+		update, err := DeleteScreen(ctx, action.ScreenId, false, nil)
+		if err != nil {
+			return false, err
+		}
+		scbus.MainUpdateBus.DoUpdate(update)
+		return true, nil
+
+	case RetentionAction_DeleteLine:
+		err := DeleteLinesByIds(ctx, action.ScreenId, []string{action.LineId})
+		if err != nil {
+			return false, err
+		}
+		err = DeletePtyOutFile(ctx, action.ScreenId, action.LineId)
+		if err != nil {
+			return false, err
+		}
+		update := scbus.MakeUpdatePacket()
+		AddLineUpdate(update, &LineType{ScreenId: action.ScreenId, LineId: action.LineId, Remove: true}, nil)
+		scbus.MainUpdateBus.DoScreenUpdate(action.ScreenId, update)
+		return true, nil
+
+	case RetentionAction_DeletePtyFile, RetentionAction_TruncatePtyFile:
+		skip, err := skipPtyRetentionAction(ctx, action)
+		if err != nil || skip {
+			return false, err
+		}
+		if action.Action == RetentionAction_DeletePtyFile {
+			err = DeletePtyOutFile(ctx, action.ScreenId, action.LineId)
+		} else {
+			err = TruncatePtyOutFile(ctx, action.ScreenId, action.LineId, action.KeepSize)
+		}
+		return err == nil, err
+
+	default:
+		return false, fmt.Errorf("invalid retention action %q", action.Action)
+	}
+}
+
+func RunRetention(ctx context.Context, opts RetentionOptsType, dryRun bool) (*RetentionResultType, error) {
+	actions, err := PlanRetention(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		rtn := &RetentionResultType{Actions: actions, DryRun: true}
+		for _, action := range actions {
+			rtn.FreedSize += action.Size
+		}
+		return rtn, nil
+	}
+	return ApplyRetentionActions(ctx, actions)
+}
@@ -0,0 +1,265 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package sstore
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/scbase"
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/scbus"
+)
+
+func makeTestScreenDir(screenId string, baseTime time.Time, sizes ...int64) *screenDirUsage {
+	rtn := &screenDirUsage{ScreenId: screenId}
+	for idx, size := range sizes {
+		pf := &ptyFileUsage{
+			ScreenId: screenId,
+			LineId:   fmt.Sprintf("%s-l%d", screenId, idx+1),
+			Size:     size,
+			DataSize: size,
+			ModTime:  baseTime.Add(time.Duration(idx) * time.Minute),
+		}
+		rtn.PtyFiles = append(rtn.PtyFiles, pf)
+		rtn.DiskSize.TotalSize += size
+	}
+	return rtn
+}
+
+func formatRetentionActions(actions []*RetentionActionType) string {
+	var parts []string
+	for _, action := range actions {
+		target := action.ScreenId
+		if action.LineId != "" {
+			target = action.LineId
+		}
+		str := fmt.Sprintf("%s:%s:%s:%d", action.Action, action.Reason, target, action.Size)
+		if action.Action == RetentionAction_TruncatePtyFile {
+			str += fmt.Sprintf(":keep=%d", action.KeepSize)
+		}
+		parts = append(parts, str)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestPlanRetentionActions(t *testing.T) {
+	baseTime := time.Now().Add(-time.Hour)
+	// screen s1 has the oldest files (s2 is 10 minutes newer)
+	makeInput := func() *retentionInput {
+		return &retentionInput{
+			ScreenDirs: []*screenDirUsage{
+				makeTestScreenDir("s1", baseTime, 100, 200, 300),
+				makeTestScreenDir("s2", baseTime.Add(10*time.Minute), 400, 500),
+				makeTestScreenDir("s3", baseTime, 1000),
+			},
+			SessionDirsSize: 50,
+		}
+	}
+	tests := []struct {
+		Name     string
+		Opts     RetentionOptsType
+		Modify   func(input *retentionInput)
+		Expected string
+	}{
+		{
+			Name:     "under limits",
+			Opts:     RetentionOptsType{MaxDiskSize: 10000, MaxScreenPtySize: 1000},
+			Expected: "",
+		},
+		{
+			Name: "archived screens and lines",
+			Opts: RetentionOptsType{ArchivedMaxAgeMs: 1000},
+			Modify: func(input *retentionInput) {
+				input.ArchivedScreenIds = []string{"s3"}
+				input.ArchivedLines = []CmdPtr{{ScreenId: "s1", LineId: "s1-l2"}, {ScreenId: "s2", LineId: "s2-l1"}}
+				input.ActiveCmds = []CmdPtr{{ScreenId: "s2", LineId: "s2-l1"}}
+			},
+			Expected: "delete-screen:archived-age:s3:1000 delete-line:archived-age:s1-l2:200",
+		},
+		{
+			// oldest first, the last file is truncated (not deleted) to get exactly to the limit
+			Name:     "screen pty ordering",
+			Opts:     RetentionOptsType{MaxScreenPtySize: 450},
+			Expected: "delete-ptyfile:screen-pty:s1-l1:100 truncate-ptyfile:screen-pty:s1-l2:50:keep=150 delete-ptyfile:screen-pty:s2-l1:400 truncate-ptyfile:screen-pty:s2-l2:50:keep=450 truncate-ptyfile:screen-pty:s3-l1:550:keep=450",
+		},
+		{
+			Name: "screen pty skips active cmds",
+			Opts: RetentionOptsType{MaxScreenPtySize: 450},
+			Modify: func(input *retentionInput) {
+				input.ActiveCmds = []CmdPtr{{ScreenId: "s1", LineId: "s1-l1"}, {ScreenId: "s2", LineId: "s2-l1"}, {ScreenId: "s3", LineId: "s3-l1"}}
+			},
+			// s1 is 600 (100 active), s2 is 900 (400 active, the 500 file can only be cut down to 50)
+			Expected: "truncate-ptyfile:screen-pty:s1-l2:150:keep=50 truncate-ptyfile:screen-pty:s2-l2:450:keep=50",
+		},
+		{
+			// total is 2550 (includes the session dirs), the oldest files across all screens go first
+			// (s1-l1 and s3-l1 are the same age, s1 comes first)
+			Name:     "max disk",
+			Opts:     RetentionOptsType{MaxDiskSize: 1400},
+			Expected: "delete-ptyfile:max-disk:s1-l1:100 delete-ptyfile:max-disk:s3-l1:1000 truncate-ptyfile:max-disk:s1-l2:50:keep=150",
+		},
+		{
+			// the archived deletes count towards the disk limit
+			Name: "max disk after archived",
+			Opts: RetentionOptsType{MaxDiskSize: 1400, ArchivedMaxAgeMs: 1000},
+			Modify: func(input *retentionInput) {
+				input.ArchivedScreenIds = []string{"s3"}
+			},
+			Expected: "delete-screen:archived-age:s3:1000 delete-ptyfile:max-disk:s1-l1:100 truncate-ptyfile:max-disk:s1-l2:50:keep=150",
+		},
+		{
+			Name: "max disk skips active cmds",
+			Opts: RetentionOptsType{MaxDiskSize: 50},
+			Modify: func(input *retentionInput) {
+				input.ActiveCmds = []CmdPtr{{ScreenId: "s2", LineId: "s2-l2"}, {ScreenId: "s3", LineId: "s3-l1"}}
+			},
+			Expected: "delete-ptyfile:max-disk:s1-l1:100 delete-ptyfile:max-disk:s1-l2:200 delete-ptyfile:max-disk:s1-l3:300 delete-ptyfile:max-disk:s2-l1:400",
+		},
+		{
+			// the screen pty truncation is counted once (the max disk phase sees the truncated file)
+			Name:     "screen pty then max disk",
+			Opts:     RetentionOptsType{MaxScreenPtySize: 900, MaxDiskSize: 1850},
+			Expected: "truncate-ptyfile:screen-pty:s3-l1:100:keep=900 delete-ptyfile:max-disk:s1-l1:100 truncate-ptyfile:max-disk:s3-l1:500:keep=400",
+		},
+	}
+	for _, test := range tests {
+		input := makeInput()
+		if test.Modify != nil {
+			test.Modify(input)
+		}
+		actions := planRetentionActions(test.Opts, input)
+		if rtn := formatRetentionActions(actions); rtn != test.Expected {
+			t.Errorf("%s:\n  got      %s\n  expected %s", test.Name, rtn, test.Expected)
+		}
+	}
+}
+
+func TestPlanRetentionArchivedTs(t *testing.T) {
+	ctx := setupTestDB(t)
+	err := EnsureLocalRemote(ctx)
+	if err != nil {
+		t.Fatalf("error creating local remote: %v", err)
+	}
+	_, err = InsertSessionWithName(ctx, "retention", false)
+	if err != nil {
+		t.Fatalf("error creating session: %v", err)
+	}
+	sessions, err := GetAllSessions(ctx)
+	if err != nil || len(sessions) == 0 {
+		t.Fatalf("error getting sessions: %v", err)
+	}
+	screens, err := GetSessionScreens(ctx, sessions[0].SessionId)
+	if err != nil || len(screens) == 0 {
+		t.Fatalf("error getting screens: %v", err)
+	}
+	screenId := screens[0].ScreenId
+	clientData, _ := EnsureClientData(ctx)
+	line, err := AddCommentLine(ctx, screenId, clientData.UserId, "old line")
+	if err != nil {
+		t.Fatalf("error adding line: %v", err)
+	}
+	// created 31 days ago, archived now
+	oldTs := time.Now().Add(-31 * 24 * time.Hour).UnixMilli()
+	WithTx(ctx, func(tx *TxWrap) error {
+		tx.Exec(`UPDATE line SET ts = ? WHERE lineid = ?`, oldTs, line.LineId)
+		return nil
+	})
+	err = SetLineArchivedById(ctx, screenId, line.LineId, true)
+	if err != nil {
+		t.Fatalf("error archiving line: %v", err)
+	}
+	opts := RetentionOptsType{ArchivedMaxAgeMs: (30 * 24 * time.Hour).Milliseconds()}
+	actions, err := PlanRetention(ctx, opts)
+	if err != nil {
+		t.Fatalf("error planning retention: %v", err)
+	}
+	if len(actions) != 0 {
+		t.Errorf("recently archived line should not be deleted: %s", formatRetentionActions(actions))
+	}
+	WithTx(ctx, func(tx *TxWrap) error {
+		tx.Exec(`UPDATE line SET archivedts = ? WHERE lineid = ?`, oldTs, line.LineId)
+		return nil
+	})
+	actions, err = PlanRetention(ctx, opts)
+	if err != nil {
+		t.Fatalf("error planning retention: %v", err)
+	}
+	if len(actions) != 1 || actions[0].Action != RetentionAction_DeleteLine || actions[0].LineId != line.LineId {
+		t.Errorf("line archived 31 days ago should be deleted: %s", formatRetentionActions(actions))
+	}
+}
+
+func TestApplyRetentionSkipsActivePtyFiles(t *testing.T) {
+	ctx := setupTestDB(t)
+	err := EnsureLocalRemote(ctx)
+	if err != nil {
+		t.Fatalf("error creating local remote: %v", err)
+	}
+	_, err = InsertSessionWithName(ctx, "retention", true)
+	if err != nil {
+		t.Fatalf("error creating session: %v", err)
+	}
+	sessions, _ := GetAllSessions(ctx)
+	screens, err := GetSessionScreens(ctx, sessions[0].SessionId)
+	if err != nil || len(screens) == 0 {
+		t.Fatalf("error getting screens: %v", err)
+	}
+	screenId := screens[0].ScreenId
+	clientData, _ := EnsureClientData(ctx)
+	localRemote, _ := GetLocalRemote(ctx)
+	var lineIds []string
+	for _, status := range []string{CmdStatusRunning, CmdStatusDone} {
+		cmd := &CmdType{
+			ScreenId: screenId,
+			LineId:   uuid.New().String(),
+			CmdStr:   "ls",
+			Remote:   RemotePtrType{RemoteId: localRemote.RemoteId},
+			TermOpts: TermOpts{Rows: 25, Cols: 80, MaxPtySize: 1000},
+			Status:   status,
+		}
+		_, err = AddCmdLine(ctx, screenId, clientData.UserId, cmd, "", nil)
+		if err != nil {
+			t.Fatalf("error adding cmd line: %v", err)
+		}
+		err = CreateCmdPtyFile(ctx, screenId, cmd.LineId, 1000)
+		if err != nil {
+			t.Fatalf("error creating pty file: %v", err)
+		}
+		lineIds = append(lineIds, cmd.LineId)
+	}
+	ptyFileExists := func(lineId string) bool {
+		fileName, _ := scbase.PtyOutFile(screenId, lineId)
+		_, err := os.Stat(fileName)
+		return err == nil
+	}
+	// planned while both cmds were done, the first one has been restarted since
+	actions := []*RetentionActionType{
+		{Action: RetentionAction_DeletePtyFile, ScreenId: screenId, LineId: lineIds[0]},
+		{Action: RetentionAction_DeletePtyFile, ScreenId: screenId, LineId: lineIds[1]},
+	}
+	// nothing is deleted while the screen is being viewed
+	scbus.MainUpdateBus.RegisterChannel("retention-test", &scbus.UpdateChannel{ScreenId: screenId})
+	result, err := ApplyRetentionActions(ctx, actions)
+	scbus.MainUpdateBus.UnregisterChannel("retention-test")
+	if err != nil || result.NumApplied != 0 || result.NumSkipped != 2 {
+		t.Errorf("watched screen: applied=%d skipped=%d err=%v", result.NumApplied, result.NumSkipped, err)
+	}
+	if !ptyFileExists(lineIds[0]) || !ptyFileExists(lineIds[1]) {
+		t.Errorf("pty files of a watched screen should not be deleted")
+	}
+	result, err = ApplyRetentionActions(ctx, actions)
+	if err != nil || result.NumApplied != 1 || result.NumSkipped != 1 {
+		t.Errorf("applied=%d skipped=%d err=%v", result.NumApplied, result.NumSkipped, err)
+	}
+	if !ptyFileExists(lineIds[0]) {
+		t.Errorf("pty file of a running cmd should not be deleted")
+	}
+	if ptyFileExists(lineIds[1]) {
+		t.Errorf("pty file of a done cmd should be deleted")
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package sstore
+
+import (
+	"testing"
+)
+
+func TestResolveSetVarPrecedence(t *testing.T) {
+	ctx := setupTestDB(t)
+	const screenId, sessionId, remoteId = "screen1", "session1", "remote1"
+	allIds := SetVarScopeIds{ScreenId: screenId, SessionId: sessionId, RemoteId: remoteId}
+	scopes := []SetVarType{
+		{Scope: SetVarScope_Client, ScopeId: "", Value: "client"},
+		{Scope: SetVarScope_Connection, ScopeId: remoteId, Value: "connection"},
+		{Scope: SetVarScope_Session, ScopeId: sessionId, Value: "session"},
+		{Scope: SetVarScope_Screen, ScopeId: screenId, Value: "screen"},
+	}
+	checkVar := func(ids SetVarScopeIds, expected string) {
+		t.Helper()
+		sv, err := ResolveSetVar(ctx, SetVar_PTerm, ids)
+		if err != nil {
+			t.Fatalf("error resolving setvar: %v", err)
+		}
+		var val string
+		if sv != nil {
+			val = sv.Value
+		}
+		if val != expected {
+			t.Errorf("resolve %+v got %q, expected %q", ids, val, expected)
+		}
+	}
+	checkVar(allIds, "")
+	// each more specific scope overrides the ones set before it
+	for _, scope := range scopes {
+		sv := scope
+		sv.Name = SetVar_PTerm
+		err := UpsertSetVar(ctx, &sv)
+		if err != nil {
+			t.Fatalf("error setting var: %v", err)
+		}
+		checkVar(allIds, scope.Value)
+	}
+	// empty ids skip their scope
+	checkVar(SetVarScopeIds{SessionId: sessionId, RemoteId: remoteId}, "session")
+	checkVar(SetVarScopeIds{ScreenId: screenId, RemoteId: remoteId}, "screen")
+	checkVar(SetVarScopeIds{RemoteId: remoteId}, "connection")
+	checkVar(SetVarScopeIds{}, "client")
+	// ids for other screens/sessions/connections fall through to the client scope
+	checkVar(SetVarScopeIds{ScreenId: "screen2", SessionId: "session2", RemoteId: "remote2"}, "client")
+	checkVar(SetVarScopeIds{ScreenId: "screen2", SessionId: "session2", RemoteId: remoteId}, "connection")
+	// unsetting the most specific scopes falls back to the next one
+	err := DeleteSetVar(ctx, SetVarScope_Screen, screenId, SetVar_PTerm)
+	if err != nil {
+		t.Fatalf("error deleting var: %v", err)
+	}
+	checkVar(allIds, "session")
+	DeleteSetVar(ctx, SetVarScope_Session, sessionId, SetVar_PTerm)
+	checkVar(allIds, "connection")
+	DeleteSetVar(ctx, SetVarScope_Connection, remoteId, SetVar_PTerm)
+	checkVar(allIds, "client")
+	// other vars are independent
+	sv, _ := ResolveSetVar(ctx, SetVar_ShellPref, allIds)
+	if sv != nil {
+		t.Errorf("unexpected shellpref setvar: %+v", sv)
+	}
+}
@@ -67,6 +67,8 @@ const (
 	LineState_Template = "template"
 	LineState_Mode     = "mode"
 	LineState_Lang     = "lang"
+
+	LineState_CopyProgress = "copy:progress"
 )
 
 const (
@@ -127,6 +129,19 @@ const (
 	ScreenFocusCmd   = "cmd"
 )
 
+const (
+	SetVarScope_Client     = "client"
+	SetVarScope_Session    = "session"
+	SetVarScope_Screen     = "screen"
+	SetVarScope_Connection = "connection"
+)
+
+const (
+	SetVar_PTerm     = "pterm"
+	SetVar_Remote    = "remote" // remoteid of the default remote for new screens
+	SetVar_ShellPref = "shellpref"
+)
+
 const (
 	CmdStoreTypeSession = "session"
 	CmdStoreTypeScreen  = "screen"
@@ -285,13 +300,26 @@ type SidebarValueType struct {
 }
 
 type ClientOptsType struct {
-	NoTelemetry           bool              `json:"notelemetry,omitempty"`
-	NoReleaseCheck        bool              `json:"noreleasecheck,omitempty"`
-	AcceptedTos           int64             `json:"acceptedtos,omitempty"`
-	ConfirmFlags          map[string]bool   `json:"confirmflags,omitempty"`
-	MainSidebar           *SidebarValueType `json:"mainsidebar,omitempty"`
-	GlobalShortcut        string            `json:"globalshortcut,omitempty"`
-	GlobalShortcutEnabled bool              `json:"globalshortcutenabled,omitempty"`
+	NoTelemetry           bool               `json:"notelemetry,omitempty"`
+	NoReleaseCheck        bool               `json:"noreleasecheck,omitempty"`
+	AcceptedTos           int64              `json:"acceptedtos,omitempty"`
+	ConfirmFlags          map[string]bool    `json:"confirmflags,omitempty"`
+	MainSidebar           *SidebarValueType  `json:"mainsidebar,omitempty"`
+	GlobalShortcut        string             `json:"globalshortcut,omitempty"`
+	GlobalShortcutEnabled bool               `json:"globalshortcutenabled,omitempty"`
+	Retention             *RetentionOptsType `json:"retention,omitempty"`
+	ReadWindow            int64              `json:"readwindow,omitempty"` // cmd output flow control window (bytes), 0 for the waveshell default
+}
+
+// storage retention rules (see retention.go), 0 means no limit
+type RetentionOptsType struct {
+	MaxDiskSize      int64 `json:"maxdisksize,omitempty"`      // total bytes of the screen and session dirs
+	ArchivedMaxAgeMs int64 `json:"archivedmaxagems,omitempty"` // screens and lines archived longer ago than this are deleted
+	MaxScreenPtySize int64 `json:"maxscreenptysize,omitempty"` // bytes of pty output kept per screen
+}
+
+func (opts *RetentionOptsType) IsEmpty() bool {
+	return opts == nil || (opts.MaxDiskSize <= 0 && opts.ArchivedMaxAgeMs <= 0 && opts.MaxScreenPtySize <= 0)
 }
 
 type FeOptsType struct {
@@ -639,17 +667,34 @@ type HistoryItemType struct {
 	HistoryNum string `json:"historynum" dbmap:"-"`
 }
 
+const (
+	HistoryQueryMode_Substring = "substring" // LIKE match on the full search text (default)
+	HistoryQueryMode_Token     = "token"     // all terms must match as tokens, ranked
+	HistoryQueryMode_Prefix    = "prefix"    // all terms must match as token prefixes, ranked
+)
+
 type HistoryQueryOpts struct {
 	Offset     int
 	MaxItems   int
 	FromTs     int64
 	SearchText string
+	QueryMode  string
 	SessionId  string
 	RemoteId   string
 	ScreenId   string
 	NoMeta     bool
 	RawOffset  int
 	FilterFn   func(*HistoryItemType) bool
+
+	// structured filters (pushed down into SQL, zero values are ignored)
+	FailedOnly    bool   // haderror or non-zero exit code
+	ExitCode      *int64 // exact exit code match
+	MinDurationMs int64
+	MaxDurationMs int64
+	CwdPrefix     string
+	BeforeTs      int64    // exclusive
+	AfterTs       int64    // exclusive
+	Tags          []string // item must have all tags
 }
 
 type HistoryQueryResult struct {
@@ -867,7 +912,7 @@ func (p *PlaybookType) FromMap(m map[string]interface{}) bool {
 	quickSetStr(&p.PlaybookId, m, "playbookid")
 	quickSetStr(&p.PlaybookName, m, "playbookname")
 	quickSetStr(&p.Description, m, "description")
-	quickSetJsonArr(&p.Entries, m, "entries")
+	quickSetJsonArr(&p.EntryIds, m, "entryids")
 	return true
 }
 
@@ -913,9 +958,11 @@ type PlaybookEntry struct {
 	UpdatedTs   int64  `json:"updatedts"`
 	CreatedTs   int64  `json:"createdts"`
 	Description string `json:"description"`
-	Remove      bool   `json:"remove,omitempty"`
+	Remove      bool   `json:"remove,omitempty" dbmap:"-"`
 }
 
+func (PlaybookEntry) UseDBMap() {}
+
 type BookmarkType struct {
 	BookmarkId  string   `json:"bookmarkid"`
 	CreatedTs   int64    `json:"createdts"`
@@ -952,6 +999,40 @@ func (bm *BookmarkType) FromMap(m map[string]interface{}) bool {
 	return true
 }
 
+// client scope has no scopeid (there is only one client)
+type SetVarType struct {
+	Scope     string `json:"scope"`
+	ScopeId   string `json:"scopeid"`
+	Name      string `json:"name"`
+	Value     string `json:"value"`
+	UpdatedTs int64  `json:"updatedts"`
+}
+
+func (SetVarType) UseDBMap() {}
+
+// ids used to resolve a setvar.  scopes are searched from most to least specific:
+// screen, session, connection, client.  empty ids are skipped.
+type SetVarScopeIds struct {
+	ScreenId  string
+	SessionId string
+	RemoteId  string
+}
+
+func (ids SetVarScopeIds) scopeChain() [][2]string {
+	var rtn [][2]string
+	if ids.ScreenId != "" {
+		rtn = append(rtn, [2]string{SetVarScope_Screen, ids.ScreenId})
+	}
+	if ids.SessionId != "" {
+		rtn = append(rtn, [2]string{SetVarScope_Session, ids.SessionId})
+	}
+	if ids.RemoteId != "" {
+		rtn = append(rtn, [2]string{SetVarScope_Connection, ids.RemoteId})
+	}
+	rtn = append(rtn, [2]string{SetVarScope_Client, ""})
+	return rtn
+}
+
 type ResolveItem struct {
 	Name   string
 	Num    int
@@ -968,6 +1049,8 @@ type SSHOpts struct {
 	SSHIdentity string `json:"sshidentity,omitempty"`
 	SSHPort     int    `json:"sshport,omitempty"`
 	SSHPassword string `json:"sshpassword,omitempty"`
+	// comma separated list of jump hosts ([user@]host[:port]), overrides ProxyJump from ssh config ("none" disables it)
+	SSHProxyJump string `json:"sshproxyjump,omitempty"`
 }
 
 func (opts SSHOpts) GetAuthType() string {
@@ -983,6 +1066,44 @@ func (opts SSHOpts) GetAuthType() string {
 	return RemoteAuthTypeNone
 }
 
+const (
+	PortForwardTypeLocal   = "local"   // ssh -L, listens locally and connects from the remote
+	PortForwardTypeRemote  = "remote"  // ssh -R, listens on the remote and connects from here
+	PortForwardTypeDynamic = "dynamic" // ssh -D, local SOCKS5 proxy that connects from the remote
+)
+
+const (
+	PortForwardStatusActive   = "active"
+	PortForwardStatusInactive = "inactive"
+	PortForwardStatusError    = "error"
+)
+
+type PortForwardType struct {
+	ForwardId   string `json:"forwardid"`
+	ForwardType string `json:"forwardtype"`
+	BindAddr    string `json:"bindaddr"`             // host:port to listen on
+	TargetAddr  string `json:"targetaddr,omitempty"` // host:port to connect to (not used for dynamic forwards)
+}
+
+func (fwd PortForwardType) String() string {
+	switch fwd.ForwardType {
+	case PortForwardTypeLocal:
+		return fmt.Sprintf("-L %s:%s", fwd.BindAddr, fwd.TargetAddr)
+	case PortForwardTypeRemote:
+		return fmt.Sprintf("-R %s:%s", fwd.BindAddr, fwd.TargetAddr)
+	case PortForwardTypeDynamic:
+		return fmt.Sprintf("-D %s", fwd.BindAddr)
+	}
+	return fmt.Sprintf("%s %s %s", fwd.ForwardType, fwd.BindAddr, fwd.TargetAddr)
+}
+
+type PortForwardStateType struct {
+	PortForwardType
+	Status   string `json:"status"`
+	ErrorStr string `json:"errorstr,omitempty"`
+	NumConns int    `json:"numconns"`
+}
+
 type RemoteOptsType struct {
 	Color string `json:"color"`
 }
@@ -1003,35 +1124,40 @@ const (
 )
 
 type RemoteRuntimeState struct {
-	RemoteType          string            `json:"remotetype"`
-	RemoteId            string            `json:"remoteid"`
-	RemoteAlias         string            `json:"remotealias,omitempty"`
-	RemoteCanonicalName string            `json:"remotecanonicalname"`
-	RemoteVars          map[string]string `json:"remotevars"`
-	DefaultFeState      map[string]string `json:"defaultfestate"`
-	Status              string            `json:"status"`
-	ConnectTimeout      int               `json:"connecttimeout,omitempty"`
-	CountdownActive     bool              `json:"countdownactive"`
-	ErrorStr            string            `json:"errorstr,omitempty"`
-	InstallStatus       string            `json:"installstatus"`
-	InstallErrorStr     string            `json:"installerrorstr,omitempty"`
-	NeedsMShellUpgrade  bool              `json:"needsmshellupgrade,omitempty"`
-	NoInitPk            bool              `json:"noinitpk,omitempty"`
-	AuthType            string            `json:"authtype,omitempty"`
-	ConnectMode         string            `json:"connectmode"`
-	AutoInstall         bool              `json:"autoinstall"`
-	Archived            bool              `json:"archived,omitempty"`
-	RemoteIdx           int64             `json:"remoteidx"`
-	SSHConfigSrc        string            `json:"sshconfigsrc"`
-	UName               string            `json:"uname"`
-	MShellVersion       string            `json:"mshellversion"`
-	WaitingForPassword  bool              `json:"waitingforpassword,omitempty"`
-	Local               bool              `json:"local,omitempty"`
-	RemoteOpts          *RemoteOptsType   `json:"remoteopts,omitempty"`
-	CanComplete         bool              `json:"cancomplete,omitempty"`
-	ActiveShells        []string          `json:"activeshells,omitempty"`
-	ShellPref           string            `json:"shellpref,omitempty"`
-	DefaultShellType    string            `json:"defaultshelltype,omitempty"`
+	RemoteType          string                  `json:"remotetype"`
+	RemoteId            string                  `json:"remoteid"`
+	RemoteAlias         string                  `json:"remotealias,omitempty"`
+	RemoteCanonicalName string                  `json:"remotecanonicalname"`
+	RemoteVars          map[string]string       `json:"remotevars"`
+	DefaultFeState      map[string]string       `json:"defaultfestate"`
+	Status              string                  `json:"status"`
+	ConnectTimeout      int                     `json:"connecttimeout,omitempty"`
+	CountdownActive     bool                    `json:"countdownactive"`
+	Reconnecting        bool                    `json:"reconnecting,omitempty"`
+	ReconnectAttempt    int                     `json:"reconnectattempt,omitempty"`
+	ReconnectTimeout    int                     `json:"reconnecttimeout,omitempty"`
+	ErrorStr            string                  `json:"errorstr,omitempty"`
+	InstallStatus       string                  `json:"installstatus"`
+	InstallErrorStr     string                  `json:"installerrorstr,omitempty"`
+	NeedsMShellUpgrade  bool                    `json:"needsmshellupgrade,omitempty"`
+	NoInitPk            bool                    `json:"noinitpk,omitempty"`
+	AuthType            string                  `json:"authtype,omitempty"`
+	ConnectMode         string                  `json:"connectmode"`
+	AutoInstall         bool                    `json:"autoinstall"`
+	Archived            bool                    `json:"archived,omitempty"`
+	RemoteIdx           int64                   `json:"remoteidx"`
+	SSHConfigSrc        string                  `json:"sshconfigsrc"`
+	UName               string                  `json:"uname"`
+	MShellVersion       string                  `json:"mshellversion"`
+	MShellCapabilities  []string                `json:"mshellcapabilities,omitempty"`
+	WaitingForPassword  bool                    `json:"waitingforpassword,omitempty"`
+	Local               bool                    `json:"local,omitempty"`
+	RemoteOpts          *RemoteOptsType         `json:"remoteopts,omitempty"`
+	CanComplete         bool                    `json:"cancomplete,omitempty"`
+	ActiveShells        []string                `json:"activeshells,omitempty"`
+	ShellPref           string                  `json:"shellpref,omitempty"`
+	DefaultShellType    string                  `json:"defaultshelltype,omitempty"`
+	PortForwards        []*PortForwardStateType `json:"portforwards,omitempty"`
 }
 
 func (state RemoteRuntimeState) IsConnected() bool {
@@ -1082,15 +1208,16 @@ type RemoteType struct {
 	Archived            bool            `json:"archived"`
 
 	// SSH fields
-	Local        bool              `json:"local"`
-	RemoteUser   string            `json:"remoteuser"`
-	RemoteHost   string            `json:"remotehost"`
-	ConnectMode  string            `json:"connectmode"`
-	AutoInstall  bool              `json:"autoinstall"`
-	SSHOpts      *SSHOpts          `json:"sshopts"`
-	StateVars    map[string]string `json:"statevars"`
-	SSHConfigSrc string            `json:"sshconfigsrc"`
-	ShellPref    string            `json:"shellpref"` // bash, zsh, or detect
+	Local        bool               `json:"local"`
+	RemoteUser   string             `json:"remoteuser"`
+	RemoteHost   string             `json:"remotehost"`
+	ConnectMode  string             `json:"connectmode"`
+	AutoInstall  bool               `json:"autoinstall"`
+	SSHOpts      *SSHOpts           `json:"sshopts"`
+	StateVars    map[string]string  `json:"statevars"`
+	SSHConfigSrc string             `json:"sshconfigsrc"`
+	ShellPref    string             `json:"shellpref"` // bash, zsh, or detect
+	PortForwards []*PortForwardType `json:"portforwards"`
 
 	// OpenAI fields (unused)
 	OpenAIOpts *OpenAIOptsType `json:"openaiopts,omitempty"`
@@ -1112,27 +1239,28 @@ func (r *RemoteType) GetName() string {
 }
 
 type CmdType struct {
-	ScreenId     string              `json:"screenid"`
-	LineId       string              `json:"lineid"`
-	Remote       RemotePtrType       `json:"remote"`
-	CmdStr       string              `json:"cmdstr"`
-	RawCmdStr    string              `json:"rawcmdstr"`
-	FeState      map[string]string   `json:"festate"`
-	StatePtr     ShellStatePtr       `json:"state"`
-	TermOpts     TermOpts            `json:"termopts"`
-	OrigTermOpts TermOpts            `json:"origtermopts"`
-	Status       string              `json:"status"`
-	CmdPid       int                 `json:"cmdpid"`
-	RemotePid    int                 `json:"remotepid"`
-	RestartTs    int64               `json:"restartts,omitempty"`
-	DoneTs       int64               `json:"donets"`
-	ExitCode     int                 `json:"exitcode"`
-	DurationMs   int                 `json:"durationms"`
-	RunOut       []packet.PacketType `json:"runout,omitempty"`
-	RtnState     bool                `json:"rtnstate,omitempty"`
-	RtnStatePtr  ShellStatePtr       `json:"rtnstateptr,omitempty"`
-	Remove       bool                `json:"remove,omitempty"`    // not persisted to DB
-	Restarted    bool                `json:"restarted,omitempty"` // not persisted to DB
+	ScreenId     string                `json:"screenid"`
+	LineId       string                `json:"lineid"`
+	Remote       RemotePtrType         `json:"remote"`
+	CmdStr       string                `json:"cmdstr"`
+	RawCmdStr    string                `json:"rawcmdstr"`
+	FeState      map[string]string     `json:"festate"`
+	StatePtr     ShellStatePtr         `json:"state"`
+	TermOpts     TermOpts              `json:"termopts"`
+	OrigTermOpts TermOpts              `json:"origtermopts"`
+	Status       string                `json:"status"`
+	CmdPid       int                   `json:"cmdpid"`
+	RemotePid    int                   `json:"remotepid"`
+	RestartTs    int64                 `json:"restartts,omitempty"`
+	DoneTs       int64                 `json:"donets"`
+	ExitCode     int                   `json:"exitcode"`
+	DurationMs   int                   `json:"durationms"`
+	RUsage       *packet.CmdRUsageType `json:"rusage,omitempty"`
+	RunOut       []packet.PacketType   `json:"runout,omitempty"`
+	RtnState     bool                  `json:"rtnstate,omitempty"`
+	RtnStatePtr  ShellStatePtr         `json:"rtnstateptr,omitempty"`
+	Remove       bool                  `json:"remove,omitempty"`    // not persisted to DB
+	Restarted    bool                  `json:"restarted,omitempty"` // not persisted to DB
 }
 
 func (CmdType) GetType() string {
@@ -1159,6 +1287,7 @@ func (r *RemoteType) ToMap() map[string]interface{} {
 	rtn["sshconfigsrc"] = r.SSHConfigSrc
 	rtn["openaiopts"] = quickJson(r.OpenAIOpts)
 	rtn["shellpref"] = r.ShellPref
+	rtn["portforwards"] = quickJsonArr(r.PortForwards)
 	return rtn
 }
 
@@ -1181,6 +1310,7 @@ func (r *RemoteType) FromMap(m map[string]interface{}) bool {
 	quickSetStr(&r.SSHConfigSrc, m, "sshconfigsrc")
 	quickSetJson(&r.OpenAIOpts, m, "openaiopts")
 	quickSetStr(&r.ShellPref, m, "shellpref")
+	quickSetJsonArr(&r.PortForwards, m, "portforwards")
 	return true
 }
 
@@ -1205,6 +1335,7 @@ func (cmd *CmdType) ToMap() map[string]interface{} {
 	rtn["donets"] = cmd.DoneTs
 	rtn["exitcode"] = cmd.ExitCode
 	rtn["durationms"] = cmd.DurationMs
+	rtn["rusage"] = quickNullableJson(cmd.RUsage)
 	rtn["runout"] = quickJson(cmd.RunOut)
 	rtn["rtnstate"] = cmd.RtnState
 	rtn["rtnbasehash"] = cmd.RtnStatePtr.BaseHash
@@ -1232,6 +1363,7 @@ func (cmd *CmdType) FromMap(m map[string]interface{}) bool {
 	quickSetInt64(&cmd.RestartTs, m, "restartts")
 	quickSetInt(&cmd.ExitCode, m, "exitcode")
 	quickSetInt(&cmd.DurationMs, m, "durationms")
+	quickSetNullableJson(&cmd.RUsage, m, "rusage")
 	quickSetJson(&cmd.RunOut, m, "runout")
 	quickSetBool(&cmd.RtnState, m, "rtnstate")
 	quickSetStr(&cmd.RtnStatePtr.BaseHash, m, "rtnbasehash")
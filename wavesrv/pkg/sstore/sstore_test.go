@@ -0,0 +1,28 @@
+// Copyright 2023-2024, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package sstore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/wavetermdev/waveterm/wavesrv/pkg/scbase"
+)
+
+// creates a migrated db (and client data) in a temp WAVETERM_HOME, closed when the test finishes
+func setupTestDB(t *testing.T) context.Context {
+	t.Setenv(scbase.WaveHomeVarName, t.TempDir())
+	CloseDB()
+	t.Cleanup(CloseDB)
+	err := TryMigrateUp()
+	if err != nil {
+		t.Fatalf("error migrating test db: %v", err)
+	}
+	ctx := context.Background()
+	_, err = EnsureClientData(ctx)
+	if err != nil {
+		t.Fatalf("error creating client data: %v", err)
+	}
+	return ctx
+}
@@ -52,6 +52,7 @@ type InfoMsgType struct {
 	InfoMsgHtml   bool     `json:"infomsghtml,omitempty"`
 	WebShareLink  bool     `json:"websharelink,omitempty"`
 	InfoComps     []string `json:"infocomps,omitempty"`
+	InfoCompDescs []string `json:"infocompdescs,omitempty"` // parallel to InfoComps
 	InfoCompsMore bool     `json:"infocompssmore,omitempty"`
 	InfoLines     []string `json:"infolines,omitempty"`
 	TimeoutMs     int64    `json:"timeoutms,omitempty"`